@@ -2,13 +2,25 @@ package main
 
 import (
 	"fmt"
+	"github.com/scottcagno/net-tools/pkg/config"
 	"github.com/scottcagno/net-tools/pkg/data"
 	"log"
 )
 
 func main() {
 
-	st, err := data.OpenStore("cmd/data/test/data.txt")
+	var cfg struct {
+		Path string `config:"path" default:"cmd/data/test/data.txt" usage:"data store to open"`
+	}
+	err := config.Load("DATA", &cfg)
+	if err != nil {
+		if err == config.ErrHelp {
+			return
+		}
+		log.Panic(err)
+	}
+
+	st, err := data.OpenStore(cfg.Path)
 	if err != nil {
 		log.Panic(err)
 	}
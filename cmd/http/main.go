@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"github.com/scottcagno/net-tools/pkg/config"
 	"github.com/scottcagno/net-tools/pkg/web"
 	"log"
 	"net/http"
@@ -9,6 +10,18 @@ import (
 
 func main() {
 
+	// load the server settings from flags, env (HTTP_*) or a config file
+	var cfg struct {
+		web.Config
+		Capture web.CaptureConfig `config:"capture"`
+	}
+	if err := config.Load("HTTP", &cfg); err != nil {
+		if err == config.ErrHelp {
+			return
+		}
+		log.Fatal(err)
+	}
+
 	mux := http.NewServeMux()
 	mux.Handle("/", http.NotFoundHandler())
 	mux.Handle("/index", getIndex())
@@ -18,8 +31,18 @@ func main() {
 	// add a logger
 	chain := web.Logger(mux)
 
+	// capture requests for cmd/replay, when -capture.path is given
+	rec, err := web.OpenCapture(cfg.Capture)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if rec != nil {
+		defer rec.Close()
+		chain = web.Capture(rec)(chain)
+	}
+
 	// server
-	err := web.ListenAndServe(":8080", chain)
+	err = web.NewServerWithConfig(cfg.Config, chain).ListenAndServe()
 	log.Fatal(err)
 }
 
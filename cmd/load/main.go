@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/config"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config holds the settings for a load test
+type Config struct {
+	URL          string        `config:"url" usage:"url to send requests to, unless targets is set"`
+	Targets      string        `config:"targets" usage:"file of targets, one per line as [METHOD] URL [BODY_FILE], used round robin"`
+	Requests     int           `config:"requests" default:"200" usage:"number of requests to send, unless duration is set"`
+	Duration     time.Duration `config:"duration" usage:"how long to send requests for, instead of a number of them"`
+	Concurrency  int           `config:"concurrency" default:"50" usage:"max requests in flight"`
+	Rate         float64       `config:"rate" usage:"requests per second to start, whether or not earlier ones are done (open loop), 0 to send as fast as concurrency allows"`
+	Method       string        `config:"method" default:"GET" usage:"request method"`
+	Header       []string      `config:"header" usage:"headers to send as Name:value"`
+	Body         string        `config:"body" usage:"request body"`
+	BodyFile     string        `config:"body-file" usage:"file to send as the request body"`
+	ContentType  string        `config:"content-type" usage:"content type of the body"`
+	Timeout      time.Duration `config:"timeout" default:"20s" usage:"max duration of a single request"`
+	NoKeepAlive  bool          `config:"no-keepalive" usage:"open a new connection for every request"`
+	Insecure     bool          `config:"insecure" usage:"don't verify tls certificates"`
+	Format       string        `config:"format" default:"text" usage:"report format: text or json"`
+	MaxP99       time.Duration `config:"max-p99" usage:"exit with status 1 if the 99th percentile latency is over this, 0 to not check"`
+	MaxErrorRate float64       `config:"max-error-rate" default:"1" usage:"exit with status 1 if the share of failed requests, errors and 5xx, is over this"`
+}
+
+// main sends http requests at a server and reports on the latency,
+// throughput, status codes and errors, like hey or wrk
+func main() {
+	var cfg Config
+	if err := config.Load("LOAD", &cfg); err != nil {
+		if err == config.ErrHelp {
+			return
+		}
+		log.Fatalln(err)
+	}
+	targets, err := loadTargets(cfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	header, err := parseHeaders(cfg.Header)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if cfg.ContentType != "" {
+		header.Set("Content-Type", cfg.ContentType)
+	}
+	if cfg.Concurrency < 1 {
+		log.Fatalln("concurrency must be at least 1")
+	}
+	if cfg.Duration <= 0 && cfg.Requests < 1 {
+		log.Fatalln("give a number of requests or a duration")
+	}
+	if cfg.Format != "text" && cfg.Format != "json" {
+		log.Fatalf("bad format %q, want text or json\n", cfg.Format)
+	}
+
+	tr := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost: cfg.Concurrency,
+		DisableKeepAlives:   cfg.NoKeepAlive,
+		DisableCompression:  true,
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: cfg.Insecure},
+	}
+	l := &loader{
+		cfg:     cfg,
+		targets: targets,
+		header:  header,
+		client: &http.Client{
+			Transport: tr,
+			Timeout:   cfg.Timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	res := l.run()
+	rep := newReport(cfg, len(targets), res)
+	if cfg.Format == "json" {
+		err = rep.writeJSON(os.Stdout)
+	} else {
+		err = rep.writeText(os.Stdout)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if failed := rep.check(cfg); failed != "" {
+		fmt.Fprintln(os.Stderr, failed)
+		os.Exit(1)
+	}
+}
+
+// target is a request to send
+type target struct {
+	method string
+	url    string
+	body   []byte
+}
+
+// loadTargets returns the targets from the targets file, or the one
+// given by the url and body settings
+func loadTargets(cfg Config) ([]target, error) {
+	body := []byte(cfg.Body)
+	if cfg.BodyFile != "" {
+		b, err := ioutil.ReadFile(cfg.BodyFile)
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+	if cfg.Targets == "" {
+		if err := checkURL(cfg.URL); err != nil {
+			return nil, err
+		}
+		return []target{{method: strings.ToUpper(cfg.Method), url: cfg.URL, body: body}}, nil
+	}
+	f, err := os.Open(cfg.Targets)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readTargets(f, strings.ToUpper(cfg.Method), body)
+}
+
+// readTargets reads lines of [METHOD] URL [BODY_FILE]. Blank lines and
+// lines starting with # are skipped. Targets without a method or body
+// file get the defaults.
+func readTargets(r io.Reader, method string, body []byte) ([]target, error) {
+	var targets []target
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		t := target{method: method, body: body}
+		if !strings.Contains(fields[0], "://") {
+			t.method, fields = strings.ToUpper(fields[0]), fields[1:]
+		}
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("targets line %d: want [METHOD] URL [BODY_FILE]", n)
+		}
+		t.url = fields[0]
+		if err := checkURL(t.url); err != nil {
+			return nil, fmt.Errorf("targets line %d: %v", n, err)
+		}
+		if len(fields) == 2 {
+			b, err := ioutil.ReadFile(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("targets line %d: %v", n, err)
+			}
+			t.body = b
+		}
+		targets = append(targets, t)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no targets")
+	}
+	return targets, nil
+}
+
+func checkURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("bad url %q, want one like http://localhost:8080/", s)
+	}
+	return nil
+}
+
+// parseHeaders parses Name:value pairs
+func parseHeaders(list []string) (http.Header, error) {
+	h := make(http.Header)
+	for _, s := range list {
+		i := strings.Index(s, ":")
+		if i < 1 {
+			return nil, fmt.Errorf("bad header %q, want Name:value", s)
+		}
+		h.Add(strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:]))
+	}
+	return h, nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Report summarizes a load test. Latencies are in milliseconds, and only
+// count requests that got a response.
+type Report struct {
+	Targets     int           `json:"targets"`
+	Mode        string        `json:"mode"`
+	Rate        float64       `json:"rate,omitempty"`
+	Concurrency int           `json:"concurrency"`
+	Duration    float64       `json:"duration_ms"`
+	Requests    int           `json:"requests"`
+	Responses   int           `json:"responses"`
+	Errors      int           `json:"errors"`
+	Throughput  float64       `json:"requests_per_sec"`
+	Bytes       int64         `json:"bytes"`
+	BytesPerSec float64       `json:"bytes_per_sec"`
+	MaxLag      float64       `json:"max_lag_ms,omitempty"`
+	Latency     Latency       `json:"latency"`
+	Histogram   []Bucket      `json:"histogram"`
+	Status      []StatusCount `json:"status"`
+	ErrorCounts []ErrorCount  `json:"error_counts,omitempty"`
+}
+
+// Latency is a summary of response times
+type Latency struct {
+	Min         float64      `json:"min"`
+	Avg         float64      `json:"avg"`
+	Stdev       float64      `json:"stdev"`
+	Max         float64      `json:"max"`
+	Percentiles []Percentile `json:"percentiles"`
+}
+
+// Percentile is the latency under which P percent of responses came
+type Percentile struct {
+	P  float64 `json:"p"`
+	Ms float64 `json:"ms"`
+}
+
+// Bucket counts the responses that took up to Ms, and longer than the
+// bucket before
+type Bucket struct {
+	Ms    float64 `json:"ms"`
+	Count int     `json:"count"`
+}
+
+// StatusCount counts the responses with a status code
+type StatusCount struct {
+	Status int `json:"status"`
+	Count  int `json:"count"`
+}
+
+// ErrorCount counts the requests that failed with an error
+type ErrorCount struct {
+	Error string `json:"error"`
+	Count int    `json:"count"`
+}
+
+// percentiles reported
+var percentiles = []float64{10, 25, 50, 75, 90, 95, 99, 99.9}
+
+// buckets is the number of histogram buckets
+const buckets = 10
+
+// newReport sums up the results of a run
+func newReport(cfg Config, targets int, res *results) *Report {
+	rep := &Report{
+		Targets:     targets,
+		Mode:        "closed loop",
+		Concurrency: cfg.Concurrency,
+		Duration:    ms(res.took),
+		Requests:    len(res.samples),
+	}
+	if cfg.Rate > 0 {
+		rep.Mode, rep.Rate, rep.MaxLag = "open loop", cfg.Rate, ms(res.maxLag)
+	}
+	var lat []float64
+	status := make(map[int]int)
+	errs := make(map[string]int)
+	for _, s := range res.samples {
+		rep.Bytes += s.bytes
+		if s.status == 0 {
+			rep.Errors++
+			errs[s.err.Error()]++
+			continue
+		}
+		// a response cut short still has a status and a latency
+		if s.err != nil {
+			rep.Errors++
+			errs[s.err.Error()]++
+		}
+		rep.Responses++
+		status[s.status]++
+		lat = append(lat, ms(s.latency))
+	}
+	if secs := res.took.Seconds(); secs > 0 {
+		rep.Throughput = float64(rep.Requests) / secs
+		rep.BytesPerSec = float64(rep.Bytes) / secs
+	}
+	rep.Latency, rep.Histogram = latency(lat)
+	for code, n := range status {
+		rep.Status = append(rep.Status, StatusCount{Status: code, Count: n})
+	}
+	sort.Slice(rep.Status, func(i, j int) bool { return rep.Status[i].Status < rep.Status[j].Status })
+	for err, n := range errs {
+		rep.ErrorCounts = append(rep.ErrorCounts, ErrorCount{Error: err, Count: n})
+	}
+	sort.Slice(rep.ErrorCounts, func(i, j int) bool {
+		a, b := rep.ErrorCounts[i], rep.ErrorCounts[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Error < b.Error
+	})
+	return rep
+}
+
+// latency summarizes the latencies, and spreads them over a histogram of
+// equal width buckets from the fastest to the slowest
+func latency(ms []float64) (Latency, []Bucket) {
+	if len(ms) == 0 {
+		return Latency{}, nil
+	}
+	sort.Float64s(ms)
+	sum := 0.0
+	for _, v := range ms {
+		sum += v
+	}
+	l := Latency{Min: ms[0], Avg: sum / float64(len(ms)), Max: ms[len(ms)-1]}
+	for _, v := range ms {
+		l.Stdev += (v - l.Avg) * (v - l.Avg)
+	}
+	l.Stdev = math.Sqrt(l.Stdev / float64(len(ms)))
+	for _, p := range percentiles {
+		// nearest rank
+		i := int(math.Ceil(p/100*float64(len(ms)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		l.Percentiles = append(l.Percentiles, Percentile{P: p, Ms: ms[i]})
+	}
+
+	width := (l.Max - l.Min) / buckets
+	hist := make([]Bucket, buckets+1)
+	for i := range hist {
+		hist[i].Ms = l.Min + width*float64(i)
+	}
+	i := 0
+	for _, v := range ms {
+		for i < buckets && v > hist[i].Ms {
+			i++
+		}
+		hist[i].Count++
+	}
+	if width == 0 {
+		hist = hist[:1]
+	}
+	return l, hist
+}
+
+// p returns the latency at percentile p, or 0 if it wasn't reported
+func (l Latency) p(p float64) float64 {
+	for _, pc := range l.Percentiles {
+		if pc.P == p {
+			return pc.Ms
+		}
+	}
+	return 0
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// check returns why the run failed the thresholds in cfg, or nothing if
+// it passed
+func (rep *Report) check(cfg Config) string {
+	var failed []string
+	if cfg.MaxP99 > 0 {
+		if p99 := rep.Latency.p(99); p99 > ms(cfg.MaxP99) {
+			failed = append(failed, fmt.Sprintf("p99 latency %.2fms is over %v", p99, cfg.MaxP99))
+		}
+	}
+	bad := rep.Errors
+	for _, s := range rep.Status {
+		if s.Status >= 500 {
+			bad += s.Count
+		}
+	}
+	if rep.Requests > 0 {
+		if rate := float64(bad) / float64(rep.Requests); rate > cfg.MaxErrorRate {
+			failed = append(failed, fmt.Sprintf("%d of %d requests failed, over the max error rate of %g", bad, rep.Requests, cfg.MaxErrorRate))
+		}
+	}
+	return strings.Join(failed, "\n")
+}
+
+func (rep *Report) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rep)
+}
+
+func (rep *Report) writeText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	mode := rep.Mode
+	if rep.Rate > 0 {
+		mode = fmt.Sprintf("%s at %g req/s", mode, rep.Rate)
+	}
+	fmt.Fprintf(tw, "summary:\n")
+	fmt.Fprintf(tw, "  mode\t%s, concurrency %d\n", mode, rep.Concurrency)
+	fmt.Fprintf(tw, "  duration\t%.2fs\n", rep.Duration/1000)
+	fmt.Fprintf(tw, "  requests\t%d\t(%d errors)\n", rep.Requests, rep.Errors)
+	fmt.Fprintf(tw, "  throughput\t%.1f req/s\t%s/s\n", rep.Throughput, size(rep.BytesPerSec))
+	fmt.Fprintf(tw, "  transferred\t%s\n", size(float64(rep.Bytes)))
+	if rep.Rate > 0 {
+		fmt.Fprintf(tw, "  max lag\t%.2fms\n", rep.MaxLag)
+	}
+	fmt.Fprintf(tw, "\nlatency ms:\n")
+	l := rep.Latency
+	fmt.Fprintf(tw, "  min\t%.2f\n  avg\t%.2f\n  stdev\t%.2f\n  max\t%.2f\n", l.Min, l.Avg, l.Stdev, l.Max)
+	fmt.Fprintf(tw, "\npercentiles ms:\n")
+	for _, p := range l.Percentiles {
+		fmt.Fprintf(tw, "  p%g\t%.2f\n", p.P, p.Ms)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(rep.Histogram) > 0 {
+		fmt.Fprintf(w, "\nhistogram ms:\n")
+	}
+	most := 0
+	for _, b := range rep.Histogram {
+		if b.Count > most {
+			most = b.Count
+		}
+	}
+	for _, b := range rep.Histogram {
+		bar := 0
+		if most > 0 {
+			bar = b.Count * 40 / most
+		}
+		fmt.Fprintf(w, "  %10.2f  %-8d |%s\n", b.Ms, b.Count, strings.Repeat("■", bar))
+	}
+
+	fmt.Fprintf(w, "\nstatus codes:\n")
+	for _, s := range rep.Status {
+		fmt.Fprintf(w, "  [%d] %d responses\n", s.Status, s.Count)
+	}
+	if len(rep.ErrorCounts) > 0 {
+		fmt.Fprintf(w, "\nerrors:\n")
+	}
+	for _, e := range rep.ErrorCounts {
+		fmt.Fprintf(w, "  [%d] %s\n", e.Count, e.Error)
+	}
+	return nil
+}
+
+// size formats a number of bytes
+func size(n float64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	div, exp := float64(unit), 0
+	for n/div >= unit && exp < 3 {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", n/div, "KMGT"[exp])
+}
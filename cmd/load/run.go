@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sample is the outcome of one request
+type sample struct {
+	latency time.Duration
+	status  int
+	bytes   int64
+	err     error
+}
+
+// results are the samples of a run
+type results struct {
+	samples []sample
+	took    time.Duration
+	// maxLag is how far behind schedule a request was sent, in open loop
+	// mode. If it grows the concurrency is too low for the rate.
+	maxLag time.Duration
+}
+
+type loader struct {
+	cfg     Config
+	targets []target
+	header  http.Header
+	client  *http.Client
+	next    uint64
+}
+
+// run sends the requests and collects their samples. Without a rate each
+// worker sends its next request as soon as the last one is done (closed
+// loop). With a rate requests are due at fixed intervals, and their
+// latency is timed from when they were due rather than when a worker got
+// to them, so a stalled server shows up in the latency instead of just
+// slowing down the test (coordinated omission).
+func (l *loader) run() *results {
+	due := make(chan time.Time)
+	start := time.Now()
+	var end time.Time
+	if l.cfg.Duration > 0 {
+		end = start.Add(l.cfg.Duration)
+	}
+	go l.schedule(due, start, end)
+
+	res := &results{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < l.cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var samples []sample
+			var maxLag time.Duration
+			for at := range due {
+				sent := time.Now()
+				if at.IsZero() {
+					at = sent
+				} else if lag := sent.Sub(at); lag > maxLag {
+					maxLag = lag
+				}
+				s := l.send()
+				s.latency = time.Since(at)
+				samples = append(samples, s)
+			}
+			mu.Lock()
+			res.samples = append(res.samples, samples...)
+			if maxLag > res.maxLag {
+				res.maxLag = maxLag
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	res.took = time.Since(start)
+	return res
+}
+
+// schedule hands out requests until the count or duration is used up. In
+// closed loop mode it sends zero times, as soon as a worker is free. In
+// open loop mode it sends the time each request is due, and a worker that
+// picks one up late still times it from then.
+func (l *loader) schedule(due chan<- time.Time, start, end time.Time) {
+	defer close(due)
+	for i := 0; !end.IsZero() || i < l.cfg.Requests; i++ {
+		if l.cfg.Rate <= 0 {
+			if !end.IsZero() && !time.Now().Before(end) {
+				return
+			}
+			due <- time.Time{}
+			continue
+		}
+		at := start.Add(time.Duration(float64(i) * float64(time.Second) / l.cfg.Rate))
+		if !end.IsZero() && !at.Before(end) {
+			return
+		}
+		time.Sleep(time.Until(at))
+		due <- at
+	}
+}
+
+// send sends the next target's request and reads the whole response
+func (l *loader) send() sample {
+	n := atomic.AddUint64(&l.next, 1) - 1
+	t := l.targets[n%uint64(len(l.targets))]
+	req, err := http.NewRequest(t.method, t.url, bytes.NewReader(t.body))
+	if err != nil {
+		return sample{err: err}
+	}
+	if len(t.body) == 0 {
+		req.Body = http.NoBody
+	}
+	for k, vv := range l.header {
+		req.Header[k] = vv
+	}
+	if host := l.header.Get("Host"); host != "" {
+		req.Host = host
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		// leave out the method and url, so errors group across targets
+		if ue, ok := err.(*url.Error); ok {
+			err = ue.Err
+		}
+		return sample{err: err}
+	}
+	defer resp.Body.Close()
+	nb, err := io.Copy(io.Discard, resp.Body)
+	return sample{status: resp.StatusCode, bytes: nb, err: err}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// dumper writes hex dumps of traffic, a line at a time so the dumps of
+// different connections don't run into each other
+type dumper struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newDumper(w io.Writer) *dumper {
+	return &dumper{w: w}
+}
+
+// conn returns a stream to dump one connection's traffic with, its lines
+// starting with label. A nil dumper returns a nil stream, which dumps
+// nothing.
+func (d *dumper) conn(label string) *stream {
+	if d == nil {
+		return nil
+	}
+	if label != "" {
+		label += " "
+	}
+	return &stream{d: d, label: label}
+}
+
+// stream dumps the traffic of one connection, counting the offsets of
+// each direction from the start of the connection
+type stream struct {
+	d     *dumper
+	label string
+
+	mu         sync.Mutex
+	sentOffset int64
+	recvOffset int64
+}
+
+// sent dumps bytes written to the peer
+func (s *stream) sent(b []byte) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	off := s.sentOffset
+	s.sentOffset += int64(len(b))
+	s.mu.Unlock()
+	s.d.write(s.label+">", off, b)
+}
+
+// recv dumps bytes read from the peer
+func (s *stream) recv(b []byte) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	off := s.recvOffset
+	s.recvOffset += int64(len(b))
+	s.mu.Unlock()
+	s.d.write(s.label+"<", off, b)
+}
+
+// wrap returns conn with its traffic dumped to s, or conn as it is if s
+// is nil
+func (s *stream) wrap(conn net.Conn) net.Conn {
+	if s == nil {
+		return conn
+	}
+	return &dumpConn{Conn: conn, s: s}
+}
+
+// write dumps b 16 bytes to a line, like hexdump -C does, with each line
+// starting with prefix and the offset of its first byte
+func (d *dumper) write(prefix string, off int64, b []byte) {
+	var sb strings.Builder
+	for len(b) > 0 {
+		n := 16
+		if len(b) < n {
+			n = len(b)
+		}
+		fmt.Fprintf(&sb, "%s %08x  ", prefix, off)
+		for i := 0; i < 16; i++ {
+			if i < n {
+				fmt.Fprintf(&sb, "%02x ", b[i])
+			} else {
+				sb.WriteString("   ")
+			}
+			if i == 7 {
+				sb.WriteByte(' ')
+			}
+		}
+		sb.WriteString(" |")
+		for _, c := range b[:n] {
+			if c < 32 || c > 126 {
+				c = '.'
+			}
+			sb.WriteByte(c)
+		}
+		sb.WriteString("|\n")
+		b, off = b[n:], off+int64(n)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	io.WriteString(d.w, sb.String())
+}
+
+// dumpConn dumps what is read from and written to the connection
+type dumpConn struct {
+	net.Conn
+	s *stream
+}
+
+func (c *dumpConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.s.recv(p[:n])
+	}
+	return n, err
+}
+
+func (c *dumpConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.s.sent(p[:n])
+	}
+	return n, err
+}
+
+// Unwrap returns the underlying connection
+func (c *dumpConn) Unwrap() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/config"
+	"github.com/scottcagno/net-tools/pkg/tcp/client"
+	"github.com/scottcagno/net-tools/pkg/tcp/server"
+	"github.com/scottcagno/net-tools/pkg/tcp/tlsutil"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config holds the settings for nc
+type Config struct {
+	Network     string        `config:"network" default:"tcp" usage:"tcp, udp, unix or unixgram, or tcp4, tcp6, udp4 and udp6"`
+	Addr        string        `config:"addr" usage:"address to connect to, or to listen on with -listen; the socket file for unix"`
+	Listen      bool          `config:"listen" usage:"listen for a connection instead of making one"`
+	Keep        bool          `config:"keep" usage:"with -listen, keep listening after the first connection closes"`
+	Forward     []string      `config:"L" usage:"relay connections from local to remote, given as [host:]port:host:port, comma separated for more than one"`
+	Hex         bool          `config:"hex" usage:"dump the traffic in hex to stderr, > for sent and < for received"`
+	DialTimeout time.Duration `config:"dial-timeout" default:"10s" usage:"max duration of a connect attempt"`
+	IdleTimeout time.Duration `config:"idle-timeout" default:"0s" usage:"close connections with no traffic for this long, 0 for no limit"`
+	TLS         bool          `config:"tls" usage:"connect with tls, and with -L, connect to the remote with tls"`
+	TLSCA       string        `config:"tls-ca" usage:"ca bundle to verify the server against, turns on tls; with -listen, to verify clients against"`
+	TLSCert     string        `config:"tls-cert" usage:"certificate file; with -listen or -L, turns on tls for the listener"`
+	TLSKey      string        `config:"tls-key" usage:"private key file for the certificate"`
+	TLSServer   string        `config:"tls-server-name" usage:"name to verify the server certificate against, defaults to the host in addr"`
+	Insecure    bool          `config:"insecure" usage:"skip verifying the server certificate"`
+	Verbose     bool          `config:"verbose" usage:"log connections as they open and close"`
+}
+
+// logger is where nc logs, keeping stdout for the traffic
+var logger = log.New(os.Stderr, "nc: ", 0)
+
+// verbose turns on the connection logs, see vlogf
+var verbose bool
+
+// main connects to an address, or listens on one, and pipes stdin to the
+// connection and the connection to stdout, like netcat. With -L it relays
+// connections to another address instead.
+func main() {
+	var cfg Config
+	if err := config.Load("NC", &cfg); err != nil {
+		if err == config.ErrHelp {
+			return
+		}
+		logger.Fatalln(err)
+	}
+	verbose = cfg.Verbose
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := run(ctx, cfg); err != nil {
+		logger.Fatalln(err)
+	}
+}
+
+// run picks the mode from the config and runs it until it is done or ctx
+// ends
+func run(ctx context.Context, cfg Config) error {
+	stream, err := isStream(cfg.Network)
+	if err != nil {
+		return err
+	}
+	clientTLS, err := cfg.clientTLS()
+	if err != nil {
+		return err
+	}
+	serverTLS, err := cfg.serverTLS()
+	if err != nil {
+		return err
+	}
+	if !stream && (clientTLS != nil || serverTLS != nil) {
+		return fmt.Errorf("tls needs a stream network, not %s", cfg.Network)
+	}
+	var dump *dumper
+	if cfg.Hex {
+		dump = newDumper(os.Stderr)
+	}
+	if len(cfg.Forward) > 0 {
+		if cfg.Listen || cfg.Addr != "" {
+			return errors.New("-L can't be used with -listen or -addr")
+		}
+		if strings.HasPrefix(cfg.Network, "unix") {
+			return errors.New("-L needs a tcp or udp network")
+		}
+		return relay(ctx, cfg, stream, dump, clientTLS, serverTLS)
+	}
+	if cfg.Addr == "" {
+		return errors.New("missing -addr")
+	}
+	in := newInput(os.Stdin)
+	switch {
+	case cfg.Listen && stream:
+		return listen(ctx, cfg, in, dump, serverTLS)
+	case cfg.Listen:
+		return listenPacket(ctx, cfg, in, dump)
+	}
+	conn, err := dial(ctx, cfg.Network, cfg.Addr, cfg.DialTimeout, clientTLS)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	vlogf("connected to %s", conn.RemoteAddr())
+	// interrupting closes the connection, which ends the pipe
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	err = pipe(withIdle(conn, cfg.IdleTimeout), in, os.Stdout, dump.conn(""))
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// isStream reports whether network is a stream network, and checks that
+// nc supports it
+func isStream(network string) (bool, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix":
+		return true, nil
+	case "udp", "udp4", "udp6", "unixgram":
+		return false, nil
+	}
+	return false, fmt.Errorf("unsupported network %q", network)
+}
+
+// clientTLS returns the tls settings for outgoing connections, or nil for
+// plain ones
+func (c Config) clientTLS() (*tls.Config, error) {
+	if !c.TLS && (c.Listen || c.TLSCA == "") {
+		return nil, nil
+	}
+	if c.Listen {
+		return nil, errors.New("-tls is for connecting, use -tls-cert and -tls-key with -listen")
+	}
+	cert, key := c.TLSCert, c.TLSKey
+	if len(c.Forward) > 0 {
+		// with -L the certificate is for the listener
+		cert, key = "", ""
+	}
+	cfg, err := tlsutil.ClientConfig(c.TLSCA, cert, key, c.TLSServer)
+	if err != nil {
+		return nil, err
+	}
+	cfg.InsecureSkipVerify = c.Insecure
+	return cfg, nil
+}
+
+// serverTLS returns the tls settings for the listener, or nil if it is
+// plain
+func (c Config) serverTLS() (*tls.Config, error) {
+	if c.TLSCert == "" || (!c.Listen && len(c.Forward) == 0) {
+		return nil, nil
+	}
+	ca := c.TLSCA
+	if !c.Listen {
+		// with -L the ca is for verifying the remote
+		ca = ""
+	}
+	return tlsutil.ServerConfig(c.TLSCert, c.TLSKey, ca)
+}
+
+// dial connects to addr, with tls if tlsConfig is set
+func dial(ctx context.Context, network, addr string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+	if network == "unixgram" {
+		return dialUnixgram(addr)
+	}
+	d := &client.Dialer{Network: network, Addr: addr, Timeout: timeout, TLSConfig: tlsConfig}
+	conn, err := d.Dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// the pipe does its own buffering
+	return conn.Conn, nil
+}
+
+// dialUnixgram connects to a unix datagram socket. Unlike udp, the server
+// can only reply if the client is bound to a socket file of its own, so
+// one is made in the temp dir and removed when the connection is closed.
+func dialUnixgram(path string) (net.Conn, error) {
+	dir, err := ioutil.TempDir("", "nc")
+	if err != nil {
+		return nil, err
+	}
+	laddr := &net.UnixAddr{Name: filepath.Join(dir, "nc.sock"), Net: "unixgram"}
+	conn, err := net.DialUnix("unixgram", laddr, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &unlinkConn{UnixConn: conn, dir: dir}, nil
+}
+
+// unlinkConn removes its socket file when it is closed
+type unlinkConn struct {
+	*net.UnixConn
+	dir string
+}
+
+func (c *unlinkConn) Close() error {
+	err := c.UnixConn.Close()
+	os.RemoveAll(c.dir)
+	return err
+}
+
+// Unwrap returns the underlying connection
+func (c *unlinkConn) Unwrap() net.Conn {
+	return c.UnixConn
+}
+
+// listen accepts a connection and pipes it, and then stops unless -keep
+// is set. With -keep, connections take turns, the next one waiting until
+// the one before it is done.
+func listen(ctx context.Context, cfg Config, in *input, dump *dumper, tlsConfig *tls.Config) error {
+	srv, err := server.NewServer(server.Config{
+		Network:     cfg.Network,
+		Addr:        cfg.Addr,
+		IdleTimeout: cfg.IdleTimeout,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	srv.ErrorLog = logger
+	srv.TLSConfig = tlsConfig
+	var turn sync.Mutex
+	served := false
+	srv.Handler = func(conn net.Conn) {
+		turn.Lock()
+		defer turn.Unlock()
+		if served && !cfg.Keep {
+			return
+		}
+		served = true
+		vlogf("connection from %s", conn.RemoteAddr())
+		if err := pipe(conn, in, os.Stdout, dump.conn("")); err != nil {
+			logger.Printf("%s: %v", conn.RemoteAddr(), err)
+		}
+		vlogf("closed %s", conn.RemoteAddr())
+		if !cfg.Keep {
+			go srv.Close()
+		}
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	vlogf("listening on %s", cfg.Addr)
+	if err = srv.ListenAndServe(); err != server.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// listenPacket reads datagrams to stdout, and sends what comes in on
+// stdin to the peer the last one came from. Without -keep it sticks to
+// the first peer and drops datagrams from anyone else.
+func listenPacket(ctx context.Context, cfg Config, in *input, dump *dumper) error {
+	var mu sync.Mutex
+	var peer net.Addr
+	var reply server.PacketWriter
+	ds := dump.conn("")
+	srv := server.NewPacketServer(server.PacketConfig{
+		Network:        cfg.Network,
+		Addr:           cfg.Addr,
+		Workers:        1, // keep the output in order
+		SessionTimeout: cfg.IdleTimeout,
+	}, nil)
+	srv.ErrorLog = logger
+	chain := server.NewPacketChain(server.RecoverPacket(logger))
+	srv.Handler = chain.Then(func(w server.PacketWriter, p *server.Packet) {
+		if p.Session == nil || p.Addr == nil {
+			// an unnamed unix socket, there is no way to reply
+			vlogf("dropped %d bytes from an unbound socket", len(p.Data))
+			return
+		}
+		mu.Lock()
+		if peer != nil && !cfg.Keep && p.Addr.String() != peer.String() {
+			mu.Unlock()
+			vlogf("dropped %d bytes from %s", len(p.Data), p.Addr)
+			return
+		}
+		if peer == nil || p.Addr.String() != peer.String() {
+			vlogf("datagrams from %s", p.Addr)
+		}
+		peer, reply = p.Addr, w
+		mu.Unlock()
+		ds.recv(p.Data)
+		os.Stdout.Write(p.Data)
+	})
+	go func() {
+		in.each(ctx.Done(), func(b []byte) error {
+			mu.Lock()
+			to, w := peer, reply
+			mu.Unlock()
+			if to == nil {
+				vlogf("dropped %d bytes of input, no peer yet", len(b))
+				return nil
+			}
+			ds.sent(b)
+			if _, err := w.WriteTo(b, to); err != nil {
+				logger.Printf("%s: %v", to, err)
+			}
+			return nil
+		})
+	}()
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	vlogf("listening on %s", cfg.Addr)
+	if err := srv.ListenAndServe(); err != server.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// vlogf logs when -verbose is set
+func vlogf(format string, v ...interface{}) {
+	if verbose {
+		logger.Printf(format, v...)
+	}
+}
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/tcp/tlsutil"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ncPath is the nc the tests run, this test binary started as nc by
+// TestMain
+var ncPath string
+
+// TestMain runs main instead of the tests when the binary is started by
+// startNC, so the tests can run nc without building it first
+func TestMain(m *testing.M) {
+	if os.Getenv("NC_TEST_AS_NC") == "1" {
+		main()
+		os.Exit(0)
+	}
+	var err error
+	if ncPath, err = os.Executable(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// nc is a running nc
+type nc struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout buffer
+	stderr buffer
+}
+
+// buffer is a bytes.Buffer that can be read while nc writes to it
+type buffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *buffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *buffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+// startNC runs nc with args, leaving its stdin open
+func startNC(args ...string) (*nc, error) {
+	n := &nc{cmd: exec.Command(ncPath, args...)}
+	n.cmd.Env = append(os.Environ(), "NC_TEST_AS_NC=1")
+	n.cmd.Stdout, n.cmd.Stderr = &n.stdout, &n.stderr
+	var err error
+	if n.stdin, err = n.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	return n, n.cmd.Start()
+}
+
+// runNC runs nc with args and input on its stdin, and waits for it to exit
+func runNC(input string, args ...string) (*nc, error) {
+	n, err := startNC(args...)
+	if err != nil {
+		return nil, err
+	}
+	io.WriteString(n.stdin, input)
+	n.stdin.Close()
+	return n, n.wait(5 * time.Second)
+}
+
+// wait waits for nc to exit, killing it after timeout
+func (n *nc) wait(timeout time.Duration) error {
+	t := time.AfterFunc(timeout, func() { n.cmd.Process.Kill() })
+	defer t.Stop()
+	if err := n.cmd.Wait(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(n.stderr.String()))
+	}
+	return nil
+}
+
+// stop interrupts nc, which should exit cleanly
+func (n *nc) stop() error {
+	n.cmd.Process.Signal(os.Interrupt)
+	return n.wait(5 * time.Second)
+}
+
+// freeAddr returns a loopback address that nothing is listening on
+func freeAddr(network string) (string, error) {
+	if network == "udp" {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return "", err
+		}
+		defer pc.Close()
+		return pc.LocalAddr().String(), nil
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer ln.Close()
+	return ln.Addr().String(), nil
+}
+
+// dialRetry connects to a listener nc is still starting
+func dialRetry(network, addr string) (net.Conn, error) {
+	var err error
+	for i := 0; i < 50; i++ {
+		var conn net.Conn
+		if conn, err = net.Dial(network, addr); err == nil {
+			return conn, nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return nil, err
+}
+
+// upperServer reads everything sent to it, until the client closes its
+// write side, and then replies with it in upper case and closes
+func upperServer() (net.Listener, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b, _ := ioutil.ReadAll(conn)
+				conn.Write(bytes.ToUpper(b))
+			}()
+		}
+	}()
+	return ln, nil
+}
+
+// echoPacket echoes datagrams back to where they came from
+func echoPacket(pc net.PacketConn) {
+	b := make([]byte, 64<<10)
+	for {
+		n, addr, err := pc.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		pc.WriteTo(b[:n], addr)
+	}
+}
+
+// exchange sends msg on conn, closes its write side, and returns what
+// comes back before the other side closes
+func exchange(conn net.Conn, msg string) (string, error) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, msg); err != nil {
+		return "", err
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	b, err := ioutil.ReadAll(conn)
+	return string(b), err
+}
+
+func TestConnect(t *testing.T) {
+	ln, err := upperServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// the reply only comes once nc passes on the end of its input
+	n, err := runNC("hello\n", "-addr", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := n.stdout.String(); got != "HELLO\n" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestListen(t *testing.T) {
+	addr, err := freeAddr("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := startNC("-listen", "-addr", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(n.stdin, "from nc\n")
+	n.stdin.Close()
+	conn, err := dialRetry("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := exchange(conn, "from peer\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.wait(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got != "from nc\n" || n.stdout.String() != "from peer\n" {
+		t.Fatalf("peer got %q, nc got %q", got, n.stdout.String())
+	}
+}
+
+func TestListenKeep(t *testing.T) {
+	addr, err := freeAddr("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := startNC("-listen", "-keep", "-addr", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.stdin.Close()
+	for _, msg := range []string{"one\n", "two\n"} {
+		conn, err := dialRetry("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := exchange(conn, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := n.stop(); err != nil {
+		t.Fatal(err)
+	}
+	if got := n.stdout.String(); got != "one\ntwo\n" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go echoPacket(pc)
+	n, err := runNC("ping\n", "-network", "udp", "-addr", pc.LocalAddr().String(), "-idle-timeout", "300ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := n.stdout.String(); got != "ping\n" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestUDPListen(t *testing.T) {
+	addr, err := freeAddr("udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := startNC("-network", "udp", "-listen", "-addr", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// resend until nc is up, it has no listener to connect to first
+	b := make([]byte, 100)
+	for i := 0; ; i++ {
+		if _, err := conn.Write([]byte("hi\n")); err != nil && i > 50 {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		if strings.Contains(n.stdout.String(), "hi\n") {
+			break
+		}
+		if i > 100 {
+			t.Fatal("nc got nothing")
+		}
+	}
+	io.WriteString(n.stdin, "back\n")
+	k, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.stop(); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b[:k]); got != "back\n" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestUnix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "nc.sock")
+	n, err := startNC("-network", "unix", "-listen", "-addr", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(n.stdin, "over unix\n")
+	n.stdin.Close()
+	conn, err := dialRetry("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := exchange(conn, "back\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.wait(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got != "over unix\n" || n.stdout.String() != "back\n" {
+		t.Fatalf("peer got %q, nc got %q", got, n.stdout.String())
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket file left behind: %v", err)
+	}
+}
+
+func TestUnixgram(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "echo.sock")
+	pc, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go echoPacket(pc)
+	n, err := runNC("dgram\n", "-network", "unixgram", "-addr", path, "-idle-timeout", "300ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := n.stdout.String(); got != "dgram\n" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestUnixgramListen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "nc.sock")
+	n, err := startNC("-network", "unixgram", "-listen", "-addr", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.stop()
+	raddr := &net.UnixAddr{Name: path, Net: "unixgram"}
+	// a sender with no socket file of its own can't be replied to, so nc
+	// drops what it sends
+	var anon *net.UnixConn
+	for i := 0; i < 50; i++ {
+		if anon, err = net.DialUnix("unixgram", nil, raddr); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer anon.Close()
+	if _, err := anon.Write([]byte("anon\n")); err != nil {
+		t.Fatal(err)
+	}
+	laddr := &net.UnixAddr{Name: filepath.Join(dir, "client.sock"), Net: "unixgram"}
+	conn, err := net.DialUnix("unixgram", laddr, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("named\n")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && !strings.Contains(n.stdout.String(), "named\n"); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err := n.stop(); err != nil {
+		t.Fatal(err)
+	}
+	if got := n.stdout.String(); got != "named\n" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestHex(t *testing.T) {
+	ln, err := upperServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	n, err := runNC("hello, hex dump!\n", "-addr", ln.Addr().String(), "-hex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"> 00000000  68 65 6c 6c 6f 2c 20 68  65 78 20 64 75 6d 70 21  |hello, hex dump!|\n",
+		"> 00000010  0a                                                |.|\n",
+		"< 00000000  48 45 4c 4c 4f 2c 20 48  45 58 20 44 55 4d 50 21  |HELLO, HEX DUMP!|\n",
+	} {
+		if !strings.Contains(n.stderr.String(), want) {
+			t.Fatalf("dump missing %q:\n%s", want, n.stderr.String())
+		}
+	}
+	if got := n.stdout.String(); got != "HELLO, HEX DUMP!\n" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := tlsutil.GenerateCA("nc test ca", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := ca.IssueServer("localhost", []string{"localhost", "127.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile, certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ca.WriteFiles(caFile, filepath.Join(dir, "ca-key.pem")); err != nil {
+		t.Fatal(err)
+	}
+	if err := pair.WriteFiles(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	addr, err := freeAddr("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := startNC("-listen", "-addr", addr, "-tls-cert", certFile, "-tls-key", keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(srv.stdin, "secret reply\n")
+	srv.stdin.Close()
+	// retry until the listener is up
+	var n *nc
+	for i := 0; ; i++ {
+		n, err = runNC("secret\n", "-addr", addr, "-tls-ca", caFile, "-tls-server-name", "localhost")
+		if err == nil || !strings.Contains(err.Error(), "refused") || i > 50 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		srv.cmd.Process.Kill()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := srv.wait(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if n.stdout.String() != "secret reply\n" || srv.stdout.String() != "secret\n" {
+		t.Fatalf("client got %q, server got %q", n.stdout.String(), srv.stdout.String())
+	}
+
+	// a server with a certificate from some other ca fails the handshake
+	other, err := tlsutil.GenerateCA("other ca", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pair, err = other.IssueServer("localhost", []string{"127.0.0.1"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := pair.TLSCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.Read(make([]byte, 1))
+				conn.Close()
+			}()
+		}
+	}()
+	if _, err := runNC("", "-addr", ln.Addr().String(), "-tls-ca", caFile); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("untrusted server gave %v", err)
+	}
+}
+
+func TestRelayTCP(t *testing.T) {
+	// the echo passes on the half close, so the reply can be read to the end
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	addr, err := freeAddr("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := startNC("-L", addr+":"+echo.Addr().String(), "-hex", "-verbose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"first\n", "second\n"} {
+		conn, err := dialRetry("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := exchange(conn, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != msg {
+			t.Fatalf("relayed %q, got %q back", msg, got)
+		}
+	}
+	if err := n.stop(); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"relaying to " + echo.Addr().String(), "> 00000000  66 69 72 73 74 0a", "< 00000000  73 65 63 6f 6e 64 0a"} {
+		if !strings.Contains(n.stderr.String(), want) {
+			t.Fatalf("log missing %q:\n%s", want, n.stderr.String())
+		}
+	}
+}
+
+func TestRelayUDP(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go echoPacket(echo)
+	addr, err := freeAddr("udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := startNC("-network", "udp", "-L", addr+":"+echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.stop()
+	b := make([]byte, 100)
+	for _, msg := range []string{"a\n", "b\n"} {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// resend until nc is up
+		var k int
+		for i := 0; i < 50; i++ {
+			conn.Write([]byte(msg))
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			if k, err = conn.Read(b); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b[:k]); got != msg {
+			t.Fatalf("relayed %q, got %q back", msg, got)
+		}
+	}
+	if err := n.stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBadFlags(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"-network", "sctp", "-addr", "127.0.0.1:1"},
+		{"-network", "udp", "-addr", "127.0.0.1:1", "-tls"},
+		{"-L", "8080:example.com"},
+		{"-L", "1:2:3", "-listen"},
+		{"-network", "unix", "-L", "1:a:2"},
+		{"-listen", "-addr", "127.0.0.1:1", "-tls"},
+	} {
+		n, err := runNC("", args...)
+		if err == nil {
+			t.Fatalf("%q ran: %s", args, n.stderr.String())
+		}
+		if !strings.HasPrefix(n.stderr.String(), "nc: ") {
+			t.Fatalf("%q gave %q", args, n.stderr.String())
+		}
+	}
+	// refused connections are reported too
+	addr, err := freeAddr("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runNC("", "-addr", addr); err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Fatalf("refused connect gave %v", err)
+	}
+}
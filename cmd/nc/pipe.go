@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"github.com/scottcagno/net-tools/pkg/tcp/netutil"
+	"io"
+	"net"
+	"time"
+)
+
+// errStopped is returned by input.each when it is told to stop before the
+// input runs out
+var errStopped = errors.New("stopped")
+
+// input reads stdin on a goroutine of its own, so a pipe that ends in the
+// middle of a read doesn't leave it behind to eat what was meant for the
+// next connection.
+type input struct {
+	ch  chan []byte
+	err error // set before ch is closed
+}
+
+// newInput starts reading r
+func newInput(r io.Reader) *input {
+	in := &input{ch: make(chan []byte)}
+	go func() {
+		defer close(in.ch)
+		for {
+			// datagram networks send each read as one datagram, so stay
+			// under the largest udp payload
+			b := make([]byte, 32<<10)
+			n, err := r.Read(b)
+			if n > 0 {
+				in.ch <- b[:n]
+			}
+			if err != nil {
+				if err != io.EOF {
+					in.err = err
+				}
+				return
+			}
+		}
+	}()
+	return in
+}
+
+// each calls fn with each chunk of input until the input runs out, when
+// it returns nil, fn fails, or done is closed.
+func (in *input) each(done <-chan struct{}, fn func(b []byte) error) error {
+	for {
+		select {
+		case b, ok := <-in.ch:
+			if !ok {
+				return in.err
+			}
+			if err := fn(b); err != nil {
+				return err
+			}
+		case <-done:
+			return errStopped
+		}
+	}
+}
+
+// pipe copies the input to conn and conn to out until both are done.
+// When the input runs out, conn's write side is closed so the peer sees
+// the end of it, and when the peer closes its side, pipe keeps sending
+// it the input until that runs out too. A read error ends it right away.
+func pipe(conn net.Conn, in *input, out io.Writer, ds *stream) error {
+	conn = ds.wrap(conn)
+	done := make(chan struct{})
+	defer close(done)
+	wrote := make(chan error, 1)
+	go func() {
+		err := in.each(done, func(b []byte) error {
+			_, err := conn.Write(b)
+			return err
+		})
+		if err == nil {
+			netutil.CloseWrite(conn)
+		}
+		wrote <- err
+	}()
+	_, err := io.Copy(out, conn)
+	if err == nil {
+		err = <-wrote
+	}
+	if errors.Is(err, net.ErrClosed) {
+		// closed on purpose, by an interrupt or an idle timeout
+		return nil
+	}
+	return err
+}
+
+// join copies between a and b in both directions, passing on each half
+// close, until both are done. An error either way closes both, so the
+// other direction doesn't wait on a peer that is gone.
+func join(a, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		copyHalf(b, a)
+		close(done)
+	}()
+	copyHalf(a, b)
+	<-done
+}
+
+// copyHalf copies src to dst, and then closes dst's write side, or both
+// connections if the copy failed
+func copyHalf(dst, src net.Conn) {
+	if _, err := io.Copy(dst, src); err != nil {
+		src.Close()
+		dst.Close()
+		return
+	}
+	netutil.CloseWrite(dst)
+}
+
+// withIdle closes conn once it has gone d without a read or a write, or
+// returns it as it is if d is zero
+func withIdle(conn net.Conn, d time.Duration) net.Conn {
+	if d <= 0 {
+		return conn
+	}
+	return &idleConn{
+		Conn: conn,
+		idle: d,
+		timer: time.AfterFunc(d, func() {
+			vlogf("%s: idle for %v, closing", conn.RemoteAddr(), d)
+			conn.Close()
+		}),
+	}
+}
+
+// idleConn is a connection that closes itself when it goes idle
+type idleConn struct {
+	net.Conn
+	idle  time.Duration
+	timer *time.Timer
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.timer.Reset(c.idle)
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.timer.Reset(c.idle)
+	}
+	return n, err
+}
+
+func (c *idleConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
+
+// Unwrap returns the underlying connection
+func (c *idleConn) Unwrap() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/tcp/server"
+	"net"
+	"strings"
+)
+
+// relay listens on the local address of each -L and relays every
+// connection made to it to the remote address, until ctx ends
+func relay(ctx context.Context, cfg Config, stream bool, dump *dumper, clientTLS, serverTLS *tls.Config) error {
+	errc := make(chan error, len(cfg.Forward))
+	var stops []func() error
+	for _, spec := range cfg.Forward {
+		local, remote, err := parseForward(spec)
+		if err != nil {
+			return err
+		}
+		var serve, stop func() error
+		if stream {
+			srv, err := relayServer(ctx, cfg, local, remote, dump, clientTLS)
+			if err != nil {
+				return err
+			}
+			srv.TLSConfig = serverTLS
+			serve, stop = srv.ListenAndServe, srv.Close
+		} else {
+			srv := relayPacketServer(ctx, cfg, local, remote, dump)
+			serve, stop = srv.ListenAndServe, srv.Close
+		}
+		stops = append(stops, stop)
+		vlogf("relaying %s to %s", local, remote)
+		go func() {
+			errc <- serve()
+		}()
+	}
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+	}
+	for _, stop := range stops {
+		stop()
+	}
+	if err == server.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// relayServer returns a server that connects each connection it accepts
+// to remote and copies between the two
+func relayServer(ctx context.Context, cfg Config, local, remote string, dump *dumper, clientTLS *tls.Config) (*server.Server, error) {
+	srv, err := server.NewServer(server.Config{
+		Network:     cfg.Network,
+		Addr:        local,
+		IdleTimeout: cfg.IdleTimeout,
+	}, func(conn net.Conn) {
+		up, err := dial(ctx, cfg.Network, remote, cfg.DialTimeout, clientTLS)
+		if err != nil {
+			logger.Printf("%s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		defer up.Close()
+		from := conn.RemoteAddr().String()
+		vlogf("%s: relaying to %s", from, remote)
+		// the dump is from the remote's side, > is what is sent to it
+		join(conn, dump.conn(from).wrap(up))
+		vlogf("%s: closed", from)
+	})
+	if err != nil {
+		return nil, err
+	}
+	srv.ErrorLog = logger
+	return srv, nil
+}
+
+// relayPacketServer returns a packet server that relays the datagrams of
+// each peer to remote from a socket of their own, so the replies can be
+// sent back to the right peer. The socket is closed once the peer's
+// session times out.
+func relayPacketServer(ctx context.Context, cfg Config, local, remote string, dump *dumper) *server.PacketServer {
+	chain := server.NewPacketChain(server.RecoverPacket(logger))
+	srv := server.NewPacketServer(server.PacketConfig{
+		Network:        cfg.Network,
+		Addr:           local,
+		Workers:        1, // a peer's socket is made by its first datagram
+		SessionTimeout: cfg.IdleTimeout,
+	}, chain.Then(func(w server.PacketWriter, p *server.Packet) {
+		if p.Session == nil {
+			return
+		}
+		up, _ := p.Session.Get("up").(net.Conn)
+		if up == nil {
+			conn, err := dial(ctx, cfg.Network, remote, cfg.DialTimeout, nil)
+			if err != nil {
+				logger.Printf("%s: %v", p.Addr, err)
+				return
+			}
+			vlogf("%s: relaying to %s", p.Addr, remote)
+			up = dump.conn(p.Addr.String()).wrap(conn)
+			p.Session.Set("up", up)
+			go func(peer net.Addr) {
+				b := make([]byte, 64<<10)
+				for {
+					n, err := up.Read(b)
+					if err != nil {
+						return
+					}
+					if _, err := w.WriteTo(b[:n], peer); err != nil {
+						logger.Printf("%s: %v", peer, err)
+					}
+				}
+			}(p.Addr)
+		}
+		if _, err := up.Write(p.Data); err != nil {
+			logger.Printf("%s: %v", remote, err)
+		}
+	}))
+	srv.ErrorLog = logger
+	srv.OnSessionEnd = func(ps *server.PacketSession) {
+		if up, ok := ps.Get("up").(net.Conn); ok {
+			vlogf("%s: closed", ps.Addr)
+			up.Close()
+		}
+	}
+	return srv
+}
+
+// parseForward splits a -L spec, [host:]port:host:port, into its local and
+// remote addresses. An ipv6 host goes in brackets.
+func parseForward(spec string) (local, remote string, err error) {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range spec {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 {
+				parts = append(parts, spec[start:i])
+				start = i + 1
+			}
+		}
+	}
+	parts = append(parts, spec[start:])
+	for i := range parts {
+		parts[i] = strings.Trim(parts[i], "[]")
+	}
+	switch len(parts) {
+	case 3:
+		local, remote = net.JoinHostPort("", parts[0]), net.JoinHostPort(parts[1], parts[2])
+	case 4:
+		local, remote = net.JoinHostPort(parts[0], parts[1]), net.JoinHostPort(parts[2], parts[3])
+	default:
+		return "", "", fmt.Errorf("bad -L %q, want [host:]port:host:port", spec)
+	}
+	if parts[len(parts)-1] == "" || parts[len(parts)-3] == "" {
+		return "", "", fmt.Errorf("bad -L %q, missing a port", spec)
+	}
+	return local, remote, nil
+}
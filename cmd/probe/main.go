@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/config"
+	"github.com/scottcagno/net-tools/pkg/probe"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// Config holds the settings for probing
+type Config struct {
+	Targets []string `config:"targets" required:"true" usage:"targets to probe: tcp://host:port, tls://host:port, http or https urls, or host:port for tcp"`
+	probe.Config
+	Metrics string `config:"metrics" usage:"address to serve prometheus metrics on at /metrics, e.g. :9115, off if empty"`
+	Quiet   bool   `config:"quiet" usage:"only print the stats at the end, not every probe"`
+}
+
+// main probes targets on a schedule, printing each probe like ping does,
+// and their stats when it stops
+func main() {
+	var cfg Config
+	if err := config.Load("PROBE", &cfg); err != nil {
+		if err == config.ErrHelp {
+			return
+		}
+		log.Fatalln(err)
+	}
+	m, err := probe.NewMonitor(cfg.Config, cfg.Targets)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if !cfg.Quiet {
+		m.OnSample = func(t probe.Target, s probe.Sample) {
+			fmt.Println(line(t, s))
+		}
+	}
+	if cfg.Metrics != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", m)
+		srv := &http.Server{Addr: cfg.Metrics, Handler: mux}
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalln(err)
+			}
+		}()
+		defer srv.Close()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	m.Run(ctx)
+	writeStats(os.Stdout, m.Stats())
+}
+
+// line formats a sample on one line
+func line(t probe.Target, s probe.Sample) string {
+	if s.Err != nil {
+		return fmt.Sprintf("%s: error: %v", t.Name, s.Err)
+	}
+	parts := []string{t.Name + ":", "connect=" + ms(s.Connect)}
+	if s.TLS > 0 {
+		parts = append(parts, "tls="+ms(s.TLS))
+	}
+	if s.TTFB > 0 {
+		parts = append(parts, "ttfb="+ms(s.TTFB))
+	}
+	if s.Status != 0 {
+		parts = append(parts, fmt.Sprintf("status=%d", s.Status))
+	}
+	return strings.Join(parts, " ")
+}
+
+// writeStats writes the stats of each target like ping's summary
+func writeStats(w io.Writer, stats []probe.Stats) {
+	for _, st := range stats {
+		fmt.Fprintf(w, "\n--- %s probe statistics ---\n", st.Target.Name)
+		fmt.Fprintf(w, "%d probes sent, %d lost, %.1f%% loss\n", st.Sent, st.Lost, st.Loss*100)
+		for _, p := range []struct {
+			name string
+			probe.Summary
+		}{{"connect", st.Connect}, {"tls", st.TLS}, {"ttfb", st.TTFB}} {
+			if p.Count > 0 {
+				fmt.Fprintf(w, "%s min/avg/max/jitter = %.3f/%.3f/%.3f/%.3f ms\n",
+					p.name, msf(p.Min), msf(p.Avg), msf(p.Max), msf(p.Jitter))
+			}
+		}
+	}
+}
+
+func ms(d time.Duration) string {
+	return fmt.Sprintf("%.3fms", msf(d))
+}
+
+func msf(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
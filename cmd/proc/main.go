@@ -1,24 +1,49 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"github.com/scottcagno/net-tools/pkg/probe"
+	"github.com/scottcagno/net-tools/pkg/proc"
 	"log"
-	"os/exec"
+	"os"
+	"time"
 )
 
 func main() {
 
-	Exec("bash")
-	out := Exec("ping", "-c5", "8.8.8.8")
+	if _, err := Exec("bash"); err != nil {
+		log.Println(err)
+	}
+	out := Ping("tcp://8.8.8.8:53", 5)
 
 	fmt.Println(out)
 
 }
 
-func Exec(name string, arg ...string) string {
-	b, err := exec.Command(name, arg...).Output()
+// Exec runs a command, passing its output on a line at a time, and stops
+// it and anything it started if it runs over a minute
+func Exec(name string, arg ...string) (*proc.Result, error) {
+	cmd := proc.Command(name, arg...)
+	cmd.Timeout = time.Minute
+	cmd.Stdout = func(line string) { fmt.Println(line) }
+	cmd.Stderr = func(line string) { fmt.Fprintln(os.Stderr, line) }
+	return cmd.Run(context.Background())
+}
+
+// Ping probes target count times a second apart, like ping -c does but
+// with tcp connects, so it needs no raw sockets or root, and returns the
+// stats
+func Ping(target string, count int) string {
+	m, err := probe.NewMonitor(probe.Config{Interval: time.Second, Count: count}, []string{target})
 	if err != nil {
-		log.Fatalf("executing command, error: %v\n", err)
+		return err.Error()
+	}
+	m.Run(context.Background())
+	st := m.Stats()[0]
+	out := fmt.Sprintf("%s: %d probes sent, %d lost, %.1f%% loss", target, st.Sent, st.Lost, st.Loss*100)
+	if c := st.Connect; c.Count > 0 {
+		out += fmt.Sprintf("\nconnect min/avg/max/jitter = %v/%v/%v/%v", c.Min, c.Avg, c.Max, c.Jitter)
 	}
-	return string(b)
+	return out
 }
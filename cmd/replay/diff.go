@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// maxDiffs is the most differences listed for one body
+const maxDiffs = 10
+
+// diffBodies compares a replayed body with the recorded one, and returns
+// what differs, nothing if they match. A recorded body that was cut short
+// only has to be the start of the replayed one. Json bodies are compared
+// as values, so key order and spacing don't matter, leaving out the
+// fields in ignore.
+func diffBodies(recorded, replayed []byte, truncated bool, ignore []string) []string {
+	if truncated {
+		if len(replayed) > len(recorded) {
+			replayed = replayed[:len(recorded)]
+		}
+		if bytes.Equal(recorded, replayed) {
+			return nil
+		}
+		return []string{byteDiff(recorded, replayed)}
+	}
+	var a, b interface{}
+	if json.Unmarshal(recorded, &a) == nil && json.Unmarshal(replayed, &b) == nil {
+		skip := make(map[string]bool, len(ignore))
+		for _, k := range ignore {
+			skip[k] = true
+		}
+		var diffs []string
+		jsonDiff("$", a, b, skip, &diffs)
+		return diffs
+	}
+	if bytes.Equal(recorded, replayed) {
+		return nil
+	}
+	return []string{byteDiff(recorded, replayed)}
+}
+
+// byteDiff describes where two bodies first differ
+func byteDiff(a, b []byte) string {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	snip := func(p []byte) string {
+		lo, hi := i-16, i+24
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > len(p) {
+			hi = len(p)
+		}
+		if lo > hi {
+			lo = hi
+		}
+		return strconv.Quote(string(p[lo:hi]))
+	}
+	return fmt.Sprintf("body differs at byte %d (%d bytes recorded, %d replayed): %s != %s",
+		i, len(a), len(b), snip(a), snip(b))
+}
+
+// jsonDiff appends the paths where a and b differ to diffs
+func jsonDiff(path string, a, b interface{}, ignore map[string]bool, diffs *[]string) {
+	if len(*diffs) >= maxDiffs {
+		return
+	}
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(av)+len(bv))
+		for k := range av {
+			keys = append(keys, k)
+		}
+		for k := range bv {
+			if _, ok := av[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if ignore[k] {
+				continue
+			}
+			p := path + "." + k
+			x, inA := av[k]
+			y, inB := bv[k]
+			switch {
+			case !inB:
+				add(diffs, "%s: missing, recorded %s", p, short(x))
+			case !inA:
+				add(diffs, "%s: unexpected %s", p, short(y))
+			default:
+				jsonDiff(p, x, y, ignore, diffs)
+			}
+		}
+		return
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		if len(av) != len(bv) {
+			add(diffs, "%s: %d elements recorded, %d replayed", path, len(av), len(bv))
+		}
+		for i := 0; i < len(av) && i < len(bv); i++ {
+			jsonDiff(path+"["+strconv.Itoa(i)+"]", av[i], bv[i], ignore, diffs)
+		}
+		return
+	}
+	if !reflect.DeepEqual(a, b) {
+		add(diffs, "%s: recorded %s, replayed %s", path, short(a), short(b))
+	}
+}
+
+func add(diffs *[]string, format string, v ...interface{}) {
+	if len(*diffs) < maxDiffs {
+		*diffs = append(*diffs, fmt.Sprintf(format, v...))
+	}
+}
+
+// short formats a json value, cut down to fit on a line
+func short(v interface{}) string {
+	b, _ := json.Marshal(v)
+	if len(b) > 60 {
+		return string(b[:57]) + "..."
+	}
+	return string(b)
+}
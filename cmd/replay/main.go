@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/config"
+	"github.com/scottcagno/net-tools/pkg/web"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config holds the settings for a replay
+type Config struct {
+	Capture     string        `config:"capture" required:"true" usage:"json lines recording to replay, from web.Capture or a web.Proxy"`
+	Target      string        `config:"target" required:"true" usage:"base url of the server to replay against, e.g. http://localhost:8080"`
+	Speed       float64       `config:"speed" default:"1" usage:"pacing relative to the recording: 1 is the original pace, 2 twice as fast, 0 as fast as possible"`
+	Concurrency int           `config:"concurrency" default:"16" usage:"max requests in flight"`
+	Timeout     time.Duration `config:"timeout" default:"30s" usage:"max duration of a single request"`
+	Methods     []string      `config:"methods" usage:"only replay these methods, e.g. GET,HEAD, all if empty"`
+	Header      []string      `config:"header" usage:"headers to set on every request as Name:value, e.g. to put back a redacted Authorization"`
+	KeepHost    bool          `config:"keep-host" usage:"send the recorded Host header rather than the target's"`
+	IgnoreBody  bool          `config:"ignore-body" usage:"only compare the status codes"`
+	IgnoreJSON  []string      `config:"ignore-json" usage:"json fields left out when comparing json bodies, e.g. id,created_at"`
+	Format      string        `config:"format" default:"text" usage:"report format: text or json"`
+	Report      string        `config:"report" usage:"file to write the report to, stdout if empty"`
+	Show        int           `config:"show" default:"20" usage:"max mismatches listed in a text report"`
+}
+
+// main replays a recording of http requests against a server and
+// reports how its responses differ from the recorded ones. It exits with
+// status 1 if any of them do.
+func main() {
+	var cfg Config
+	if err := config.Load("REPLAY", &cfg); err != nil {
+		if err == config.ErrHelp {
+			return
+		}
+		log.Fatalln(err)
+	}
+	target, err := url.Parse(cfg.Target)
+	if err != nil || target.Scheme == "" || target.Host == "" {
+		log.Fatalf("bad target %q, want a url like http://localhost:8080\n", cfg.Target)
+	}
+	header, err := parseHeaders(cfg.Header)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if cfg.Format != "text" && cfg.Format != "json" {
+		log.Fatalf("bad format %q, want text or json\n", cfg.Format)
+	}
+
+	exs, skipped, truncated, err := load(cfg.Capture, cfg.Methods)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	r := &replayer{
+		cfg:    cfg,
+		target: target,
+		header: header,
+		client: &http.Client{
+			Transport: &http.Transport{
+				MaxIdleConnsPerHost: cfg.Concurrency,
+				// compare bodies as they were sent
+				DisableCompression: true,
+			},
+			Timeout: cfg.Timeout,
+			// compare redirects, rather than where they lead
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	start := time.Now()
+	results := r.run(exs)
+	rep := newReport(cfg, exs, results, skipped, truncated, time.Since(start))
+
+	var w io.Writer = os.Stdout
+	if cfg.Report != "" {
+		f, err := os.Create(cfg.Report)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if cfg.Format == "json" {
+		err = rep.writeJSON(w)
+	} else {
+		err = rep.writeText(w, cfg.Show)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if rep.StatusMismatches+rep.BodyMismatches+rep.Errors > 0 {
+		os.Exit(1)
+	}
+}
+
+// load reads the exchanges to replay. Lines that are not requests, and
+// requests for other methods, are skipped. Requests whose body was cut
+// short by the recorder can't be replayed as they were sent, so they are
+// left out too, and counted as truncated.
+func load(path string, methods []string) (exs []*web.Exchange, skipped, truncated int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer f.Close()
+	err = web.ReadExchanges(f, func(ex *web.Exchange) error {
+		if ex.Request.Method == "" || ex.Request.URL == "" || ex.Request.Method == http.MethodConnect ||
+			(len(methods) > 0 && !contains(methods, ex.Request.Method)) {
+			skipped++
+			return nil
+		}
+		if ex.Request.Truncated {
+			truncated++
+			return nil
+		}
+		exs = append(exs, ex)
+		return nil
+	})
+	return exs, skipped, truncated, err
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHeaders parses Name:value pairs
+func parseHeaders(list []string) (http.Header, error) {
+	h := make(http.Header)
+	for _, s := range list {
+		i := strings.Index(s, ":")
+		if i < 1 {
+			return nil, fmt.Errorf("bad header %q, want Name:value", s)
+		}
+		h.Add(strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:]))
+	}
+	return h, nil
+}
+
+// result is the outcome of replaying one exchange
+type result struct {
+	status  int
+	body    []byte
+	latency time.Duration
+	err     error
+}
+
+type replayer struct {
+	cfg    Config
+	target *url.URL
+	header http.Header
+	client *http.Client
+}
+
+// run replays exs, keeping to their recorded pacing scaled by the speed,
+// with at most Concurrency requests in flight. It returns the results in
+// the same order.
+func (r *replayer) run(exs []*web.Exchange) []result {
+	results := make([]result, len(exs))
+	if len(exs) == 0 {
+		return results
+	}
+	sem := make(chan struct{}, max(r.cfg.Concurrency, 1))
+	var wg sync.WaitGroup
+	start, first := time.Now(), exs[0].Time
+	for i, ex := range exs {
+		if r.cfg.Speed > 0 {
+			at := start.Add(time.Duration(float64(ex.Time.Sub(first)) / r.cfg.Speed))
+			time.Sleep(time.Until(at))
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, ex *web.Exchange) {
+			defer func() { <-sem; wg.Done() }()
+			results[i] = r.replay(ex)
+		}(i, ex)
+	}
+	wg.Wait()
+	return results
+}
+
+// replay sends the request of ex to the target
+func (r *replayer) replay(ex *web.Exchange) result {
+	req, err := r.request(ex)
+	if err != nil {
+		return result{err: err}
+	}
+	start := time.Now()
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return result{err: err}
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return result{status: resp.StatusCode, body: body, latency: time.Since(start), err: err}
+}
+
+// hopHeaders are not replayed, the transport sets its own
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", "Content-Length",
+}
+
+// request builds the request to replay ex against the target
+func (r *replayer) request(ex *web.Exchange) (*http.Request, error) {
+	u, err := url.Parse(ex.Request.URL)
+	if err != nil {
+		return nil, err
+	}
+	out := *r.target
+	out.Path = strings.TrimSuffix(out.Path, "/") + u.Path
+	out.RawPath = ""
+	if u.RawPath != "" {
+		out.RawPath = strings.TrimSuffix(r.target.EscapedPath(), "/") + u.RawPath
+	}
+	out.RawQuery = u.RawQuery
+	body, err := ex.Request.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(context.Background(), ex.Request.Method, out.String(), strings.NewReader(string(body)))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) == 0 {
+		req.Body = http.NoBody
+	}
+	for k, vv := range ex.Request.Header {
+		for _, v := range vv {
+			// masked values are no use to the server
+			if !strings.Contains(v, web.Redacted) {
+				req.Header.Add(k, v)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		req.Header.Del(k)
+	}
+	for k, vv := range r.header {
+		req.Header[k] = vv
+	}
+	if r.cfg.KeepHost && ex.Request.Host != "" {
+		req.Host = ex.Request.Host
+	}
+	return req, nil
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
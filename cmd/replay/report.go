@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/web"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Report summarizes a replay
+type Report struct {
+	Capture          string      `json:"capture"`
+	Target           string      `json:"target"`
+	Speed            float64     `json:"speed"`
+	Duration         float64     `json:"duration_ms"`
+	Replayed         int         `json:"replayed"`
+	Skipped          int         `json:"skipped"`
+	Truncated        int         `json:"truncated"`
+	Matched          int         `json:"matched"`
+	StatusMismatches int         `json:"status_mismatches"`
+	BodyMismatches   int         `json:"body_mismatches"`
+	Errors           int         `json:"errors"`
+	Recorded         Latency     `json:"recorded_latency"`
+	Replay           Latency     `json:"replay_latency"`
+	Endpoints        []*Endpoint `json:"endpoints"`
+	Mismatches       []Mismatch  `json:"mismatches,omitempty"`
+}
+
+// Latency is a summary of response times, in milliseconds
+type Latency struct {
+	Avg float64 `json:"avg"`
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// Endpoint sums up the replays of one method and path
+type Endpoint struct {
+	Method      string  `json:"method"`
+	Path        string  `json:"path"`
+	Count       int     `json:"count"`
+	Mismatches  int     `json:"mismatches"`
+	Errors      int     `json:"errors"`
+	AvgRecorded float64 `json:"avg_recorded_ms"`
+	AvgReplay   float64 `json:"avg_replay_ms"`
+}
+
+// Mismatch is a replayed request whose response differed, or failed
+type Mismatch struct {
+	Index          int      `json:"index"`
+	Method         string   `json:"method"`
+	URL            string   `json:"url"`
+	RecordedStatus int      `json:"recorded_status"`
+	Status         int      `json:"status,omitempty"`
+	Diffs          []string `json:"diffs,omitempty"`
+	Error          string   `json:"error,omitempty"`
+}
+
+// newReport compares the results with the recorded responses
+func newReport(cfg Config, exs []*web.Exchange, results []result, skipped, truncated int, took time.Duration) *Report {
+	rep := &Report{
+		Capture:   cfg.Capture,
+		Target:    cfg.Target,
+		Speed:     cfg.Speed,
+		Duration:  ms(took),
+		Replayed:  len(exs),
+		Skipped:   skipped,
+		Truncated: truncated,
+	}
+	var recorded, replayed []float64
+	byKey := make(map[string]*Endpoint)
+	for i, ex := range exs {
+		res := results[i]
+		path := ex.Request.URL
+		if u, err := url.Parse(ex.Request.URL); err == nil {
+			path = u.Path
+		}
+		key := ex.Request.Method + " " + path
+		ep := byKey[key]
+		if ep == nil {
+			ep = &Endpoint{Method: ex.Request.Method, Path: path}
+			byKey[key] = ep
+			rep.Endpoints = append(rep.Endpoints, ep)
+		}
+		ep.Count++
+		ep.AvgRecorded += ex.Duration
+		recorded = append(recorded, ex.Duration)
+
+		m := Mismatch{Index: i, Method: ex.Request.Method, URL: ex.Request.URL, Status: res.status}
+		if ex.Response != nil {
+			m.RecordedStatus = ex.Response.Status
+		}
+		if res.err != nil {
+			rep.Errors++
+			ep.Errors++
+			m.Error = res.err.Error()
+			rep.Mismatches = append(rep.Mismatches, m)
+			continue
+		}
+		ep.AvgReplay += ms(res.latency)
+		replayed = append(replayed, ms(res.latency))
+		switch {
+		case ex.Response == nil:
+			// nothing was recorded to compare with
+			rep.Matched++
+			continue
+		case res.status != ex.Response.Status:
+			rep.StatusMismatches++
+			m.Diffs = []string{fmt.Sprintf("status %d, recorded %d", res.status, ex.Response.Status)}
+		case !cfg.IgnoreBody:
+			body, err := ex.Response.Bytes()
+			if err != nil {
+				m.Diffs = []string{"recorded body: " + err.Error()}
+			} else {
+				m.Diffs = diffBodies(body, res.body, ex.Response.Truncated, cfg.IgnoreJSON)
+			}
+			if len(m.Diffs) > 0 {
+				rep.BodyMismatches++
+			}
+		}
+		if len(m.Diffs) == 0 {
+			rep.Matched++
+			continue
+		}
+		ep.Mismatches++
+		rep.Mismatches = append(rep.Mismatches, m)
+	}
+	for _, ep := range rep.Endpoints {
+		if n := ep.Count; n > 0 {
+			ep.AvgRecorded /= float64(n)
+		}
+		if n := ep.Count - ep.Errors; n > 0 {
+			ep.AvgReplay /= float64(n)
+		}
+	}
+	sort.Slice(rep.Endpoints, func(i, j int) bool {
+		a, b := rep.Endpoints[i], rep.Endpoints[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Method+" "+a.Path < b.Method+" "+b.Path
+	})
+	rep.Recorded = latency(recorded)
+	rep.Replay = latency(replayed)
+	return rep
+}
+
+func latency(ms []float64) Latency {
+	if len(ms) == 0 {
+		return Latency{}
+	}
+	sort.Float64s(ms)
+	sum := 0.0
+	for _, v := range ms {
+		sum += v
+	}
+	at := func(p float64) float64 {
+		i := int(p*float64(len(ms))+0.5) - 1
+		if i < 0 {
+			i = 0
+		}
+		if i >= len(ms) {
+			i = len(ms) - 1
+		}
+		return ms[i]
+	}
+	return Latency{
+		Avg: sum / float64(len(ms)),
+		P50: at(0.50),
+		P95: at(0.95),
+		P99: at(0.99),
+		Max: ms[len(ms)-1],
+	}
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (rep *Report) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rep)
+}
+
+func (rep *Report) writeText(w io.Writer, show int) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "replayed %s against %s at speed %g in %.0fms\n\n", rep.Capture, rep.Target, rep.Speed, rep.Duration)
+	fmt.Fprintf(tw, "requests\t%d\t(%d skipped, %d with a truncated body)\n", rep.Replayed, rep.Skipped, rep.Truncated)
+	fmt.Fprintf(tw, "matched\t%d\n", rep.Matched)
+	fmt.Fprintf(tw, "status mismatches\t%d\n", rep.StatusMismatches)
+	fmt.Fprintf(tw, "body mismatches\t%d\n", rep.BodyMismatches)
+	fmt.Fprintf(tw, "errors\t%d\n\n", rep.Errors)
+
+	fmt.Fprintf(tw, "latency ms\tavg\tp50\tp95\tp99\tmax\n")
+	for _, l := range []struct {
+		name string
+		Latency
+	}{{"recorded", rep.Recorded}, {"replay", rep.Replay}} {
+		fmt.Fprintf(tw, "%s\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\n", l.name, l.Avg, l.P50, l.P95, l.P99, l.Max)
+	}
+
+	fmt.Fprintf(tw, "\nendpoint\tcount\tmismatches\terrors\trecorded ms\treplay ms\n")
+	for _, ep := range rep.Endpoints {
+		fmt.Fprintf(tw, "%s %s\t%d\t%d\t%d\t%.1f\t%.1f\n",
+			ep.Method, ep.Path, ep.Count, ep.Mismatches, ep.Errors, ep.AvgRecorded, ep.AvgReplay)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(rep.Mismatches) > 0 {
+		fmt.Fprintf(w, "\nmismatches:\n")
+	}
+	for i, m := range rep.Mismatches {
+		if i == show {
+			fmt.Fprintf(w, "  ... and %d more\n", len(rep.Mismatches)-show)
+			break
+		}
+		fmt.Fprintf(w, "  #%d %s %s\n", m.Index, m.Method, m.URL)
+		if m.Error != "" {
+			fmt.Fprintf(w, "      error: %s\n", m.Error)
+		}
+		for _, d := range m.Diffs {
+			fmt.Fprintf(w, "      %s\n", strings.TrimSpace(d))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/config"
+	"github.com/scottcagno/net-tools/pkg/scan"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// Config holds the settings for a scan
+type Config struct {
+	Hosts []string `config:"hosts" required:"true" usage:"hosts to scan: ips, cidrs, ranges like 10.0.0.1-20 or 10.0.0.1-10.0.1.5, or host names"`
+	Ports string   `config:"ports" usage:"ports and ranges to scan, e.g. 22,80,8000-8100, or - for all, common ports if empty"`
+	scan.Config
+	All    bool   `config:"all" usage:"list closed, filtered and failed ports too, not just open ones"`
+	Format string `config:"format" default:"text" usage:"output format: text, json or csv"`
+	Output string `config:"output" usage:"file to write the results to, stdout if empty"`
+}
+
+// main runs a tcp connect scan of some hosts and ports, and lists the open
+// ones with their banners
+func main() {
+	var cfg Config
+	if err := config.Load("SCAN", &cfg); err != nil {
+		if err == config.ErrHelp {
+			return
+		}
+		log.Fatalln(err)
+	}
+	hosts, err := scan.ExpandHosts(cfg.Hosts)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if cfg.Ports == "" {
+		cfg.Ports = scan.DefaultPorts
+	}
+	ports, err := scan.ParsePorts(cfg.Ports)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if cfg.Format != "text" && cfg.Format != "json" && cfg.Format != "csv" {
+		log.Fatalf("bad format %q, want text, json or csv\n", cfg.Format)
+	}
+	s, err := scan.NewScanner(cfg.Config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// stop on ^C, and still write what was found
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	var results []scan.Result
+	sum := summary{Hosts: len(hosts), Ports: len(ports)}
+	start := time.Now()
+	err = s.Scan(ctx, hosts, ports, func(r scan.Result) {
+		sum.add(r.State)
+		if r.State == scan.Open || cfg.All {
+			results = append(results, r)
+		}
+	})
+	sum.Duration = time.Since(start)
+	if err != nil {
+		log.Printf("scan stopped: %v\n", err)
+	}
+
+	order := make(map[string]int, len(hosts))
+	for i, h := range hosts {
+		order[h] = i
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Host != b.Host {
+			return order[a.Host] < order[b.Host]
+		}
+		return a.Port < b.Port
+	})
+
+	var w io.Writer = os.Stdout
+	if cfg.Output != "" {
+		f, err := os.Create(cfg.Output)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	switch cfg.Format {
+	case "json":
+		err = writeJSON(w, results, sum)
+	case "csv":
+		err = writeCSV(w, results)
+	default:
+		err = writeText(w, results, sum)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// summary counts the ports scanned in each state
+type summary struct {
+	Hosts    int           `json:"hosts"`
+	Ports    int           `json:"ports"`
+	Scanned  int           `json:"scanned"`
+	Open     int           `json:"open"`
+	Closed   int           `json:"closed"`
+	Filtered int           `json:"filtered"`
+	Failed   int           `json:"failed"`
+	Duration time.Duration `json:"-"`
+}
+
+func (s *summary) add(state scan.State) {
+	s.Scanned++
+	switch state {
+	case scan.Open:
+		s.Open++
+	case scan.Closed:
+		s.Closed++
+	case scan.Filtered:
+		s.Filtered++
+	case scan.Failed:
+		s.Failed++
+	}
+}
+
+// record is a result as written out
+type record struct {
+	Host    string     `json:"host"`
+	Port    int        `json:"port"`
+	State   scan.State `json:"state"`
+	Latency float64    `json:"latency_ms"`
+	Service string     `json:"service,omitempty"`
+	Banner  string     `json:"banner,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+func newRecord(r scan.Result) record {
+	rec := record{
+		Host:    r.Host,
+		Port:    r.Port,
+		State:   r.State,
+		Latency: float64(r.Latency) / float64(time.Millisecond),
+		Service: r.Service,
+		Banner:  r.Banner,
+	}
+	if r.Err != nil {
+		rec.Error = r.Err.Error()
+	}
+	return rec
+}
+
+func writeText(w io.Writer, results []scan.Result, sum summary) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if len(results) > 0 {
+		fmt.Fprintf(tw, "HOST\tPORT\tSTATE\tLATENCY\tSERVICE\tBANNER\n")
+	}
+	for _, r := range results {
+		rec := newRecord(r)
+		banner := rec.Banner
+		if rec.Error != "" {
+			banner = rec.Error
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%.1fms\t%s\t%s\n", rec.Host, rec.Port, rec.State, rec.Latency, rec.Service, banner)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\nscanned %d of %d ports on %d hosts in %v: %d open, %d closed, %d filtered, %d failed\n",
+		sum.Scanned, sum.Hosts*sum.Ports, sum.Hosts, sum.Duration.Round(time.Millisecond),
+		sum.Open, sum.Closed, sum.Filtered, sum.Failed)
+	return err
+}
+
+func writeJSON(w io.Writer, results []scan.Result, sum summary) error {
+	out := struct {
+		summary
+		Duration float64  `json:"duration_ms"`
+		Results  []record `json:"results"`
+	}{summary: sum, Duration: float64(sum.Duration) / float64(time.Millisecond), Results: []record{}}
+	for _, r := range results {
+		out.Results = append(out.Results, newRecord(r))
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+func writeCSV(w io.Writer, results []scan.Result) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"host", "port", "state", "latency_ms", "service", "banner", "error"})
+	for _, r := range results {
+		rec := newRecord(r)
+		cw.Write([]string{
+			rec.Host,
+			strconv.Itoa(rec.Port),
+			rec.State.String(),
+			strconv.FormatFloat(rec.Latency, 'f', 3, 64),
+			rec.Service,
+			rec.Banner,
+			rec.Error,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -1,42 +1,176 @@
 package main
 
 import (
+	"crypto/rand"
 	"fmt"
+	"github.com/scottcagno/net-tools/pkg/config"
 	"github.com/scottcagno/net-tools/pkg/web"
 	"log"
+	"math/big"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
+// Config holds the settings for shurl
+type Config struct {
+	web.Config
+	Data         string        `config:"data" default:"./data" usage:"directory for the link store"`
+	CompactEvery time.Duration `config:"compact-every" default:"1m" usage:"how often the link store log is compacted"`
+	Stats        string        `config:"stats" default:"./stats/clicks.dat" usage:"path of the click analytics log"`
+}
+
 func main() {
 
 	//StoreTest() return
 
-	s := NewSimpleStore("./")
+	// load the settings from flags, env (SHURL_*) or a config file
+	var cfg Config
+	err := config.Load("SHURL", &cfg)
+	if err != nil {
+		if err == config.ErrHelp {
+			return
+		}
+		log.Fatal(err)
+	}
+
+	s, err := OpenLogStore(cfg.Data, cfg.CompactEvery)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer s.Close()
+
+	err = CreateDirIfNotExist(filepath.Dir(cfg.Stats))
+	if err != nil {
+		log.Fatal(err)
+	}
+	st, err := OpenStats(cfg.Stats)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer st.Close()
 
 	mux := http.NewServeMux()
 	mux.Handle("/favicon.ico", http.NotFoundHandler())
-	mux.Handle("/", handleIndex(s))
+	mux.Handle("/", handleIndex(s, st))
 
 	chain := web.Logger(mux)
-	err := web.ListenAndServe(":8080", chain)
+	err = web.NewServerWithConfig(cfg.Config, chain).ListenAndServe()
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func handleIndex(store Store) http.Handler {
+// handleIndex routes requests for the root, short codes and their stats:
+//
+//	GET  /              index
+//	POST /              shorten the url in the "url" form value
+//	GET  /{code}        redirect to the url stored for code
+//	GET  /{code}/stats  click analytics for code
+func handleIndex(store Store, stats *Stats) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Trim(r.URL.Path, "/")
+		if path == "" {
+			switch r.Method {
+			case http.MethodGet:
+				fmt.Fprintf(w, "index handler hit")
+			case http.MethodPost:
+				handleShorten(store).ServeHTTP(w, r)
+			default:
+				code := http.StatusMethodNotAllowed
+				http.Error(w, http.StatusText(code), code)
+			}
+			return
+		}
+		code, rest := path, ""
+		if i := strings.IndexByte(path, '/'); i > 0 {
+			code, rest = path[:i], path[i+1:]
+		}
+		switch rest {
+		case "":
+			web.Get(handleRedirect(store, stats, code)).ServeHTTP(w, r)
+		case "stats":
+			web.Get(handleStats(stats, code)).ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	}
+	return http.HandlerFunc(fn)
+}
+
+// handleRedirect sends the client on to the url stored for code and
+// records the click.
+func handleRedirect(store Store, stats *Stats, code string) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		v, err := store.Get(code)
+		if err == ErrNotFound || len(v) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		stats.Track(code, r)
+		// use a temporary redirect so clients come back through us every time
+		http.Redirect(w, r, v[0], http.StatusFound)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// handleShorten stores the url in the "url" form value under a new code
+// and replies with the short path.
+func handleShorten(store Store) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		// do stuff
-		fmt.Fprintf(w, "index handler hit")
+		u, err := url.Parse(r.FormValue("url"))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			http.Error(w, "invalid url", http.StatusBadRequest)
+			return
+		}
+		// retry a few times in the unlikely case of a collision
+		var code string
+		for i := 0; i < 3; i++ {
+			code, err = newCode(6)
+			if err == nil {
+				err = store.Add(code, []string{u.String()})
+			}
+			if err != ErrKeyExists {
+				break
+			}
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "/%s\n", code)
 	}
 	return http.HandlerFunc(fn)
 }
 
+const codeAlphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// newCode returns a random short code of length n
+func newCode(n int) (string, error) {
+	b := make([]byte, n)
+	max := big.NewInt(int64(len(codeAlphabet)))
+	for i := range b {
+		x, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = codeAlphabet[x.Int64()]
+	}
+	return string(b), nil
+}
+
 func CreateDirIfNotExist(path string) error {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
-		if err := os.MkdirAll(path, 0655); err != nil {
-			fmt.Errorf("could not create static file path %q: %v\n", path, err)
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return fmt.Errorf("could not create static file path %q: %v\n", path, err)
 		}
 	}
 	return nil
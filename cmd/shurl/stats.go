@@ -0,0 +1,876 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/data"
+	"hash/fnv"
+	"html/template"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	clickQueueSize  = 4096
+	clickBatchSize  = 256
+	clickFlushEvery = time.Second
+	hourlyRetention = 7 * 24 * time.Hour
+
+	// statsCompactAfter is how many clicks the log may hold before the
+	// counters are written to a snapshot and the log is emptied
+	statsCompactAfter = 100000
+	// visitorsPerRecord keeps a popular code's snapshot records well under
+	// maxEntrySZ
+	visitorsPerRecord = 1 << 16
+)
+
+// Record kinds in the click log and the snapshot. Both start with a
+// recHeader holding the snapshot generation they follow on from.
+const (
+	recHeader   = byte(0x01)
+	recClick    = byte(0x02)
+	recCounter  = byte(0x03)
+	recVisitors = byte(0x04)
+)
+
+// errStaleLog is returned while replaying a click log that was already
+// written into the snapshot
+var errStaleLog = errors.New("click log is older than the snapshot")
+
+// Click is a single redirect of a short code
+type Click struct {
+	Code     string
+	Time     int64  // unix seconds
+	Visitor  uint64 // hash of the client ip and user agent
+	Referrer string // referrer domain
+	Agent    string // user agent family
+}
+
+// counter holds the running totals for a single short code
+type counter struct {
+	total     uint64
+	visitors  map[uint64]struct{}
+	referrers map[string]uint64
+	agents    map[string]uint64
+	hourly    map[int64]uint64
+	daily     map[int64]uint64
+}
+
+func newCounter() *counter {
+	return &counter{
+		visitors:  make(map[uint64]struct{}),
+		referrers: make(map[string]uint64),
+		agents:    make(map[string]uint64),
+		hourly:    make(map[int64]uint64),
+		daily:     make(map[int64]uint64),
+	}
+}
+
+func (c *counter) add(click Click) {
+	c.total++
+	c.visitors[click.Visitor] = struct{}{}
+	c.referrers[click.Referrer]++
+	c.agents[click.Agent]++
+	c.hourly[click.Time-click.Time%3600]++
+	c.daily[click.Time-click.Time%86400]++
+}
+
+// trim drops any hourly buckets that have fallen out of the retention window
+func (c *counter) trim(now int64) {
+	cutoff := now - int64(hourlyRetention/time.Second)
+	for t := range c.hourly {
+		if t < cutoff {
+			delete(c.hourly, t)
+		}
+	}
+}
+
+// Stats collects click analytics for short codes. Clicks are queued by
+// Track and appended to a log in batches by a background goroutine so
+// that redirects never wait on the disk. Once the log holds enough clicks
+// the counters are written to a snapshot and the log is emptied, so a
+// restart only has to load the snapshot and the clicks since.
+type Stats struct {
+	mu      sync.RWMutex
+	path    string
+	log     *os.File
+	gen     uint64 // generation of the last snapshot
+	logged  int    // clicks in the log since the last snapshot
+	counts  map[string]*counter
+	clicks  chan Click
+	done    chan struct{}
+	dropped uint64
+
+	closeMu sync.RWMutex // guards closed, and sends on clicks against Close
+	closed  bool
+}
+
+// OpenStats opens (or creates) the click log at path, and its snapshot
+// next to it, rebuilds the counters from them and starts the background
+// writer.
+func OpenStats(path string) (*Stats, error) {
+	s := &Stats{
+		path:   path,
+		counts: make(map[string]*counter),
+		clicks: make(chan Click, clickQueueSize),
+		done:   make(chan struct{}),
+	}
+	err := s.loadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	s.log, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.replay(); err != nil {
+		s.log.Close()
+		return nil, err
+	}
+	now := time.Now().Unix()
+	for _, c := range s.counts {
+		c.trim(now)
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *Stats) snapPath() string {
+	return s.path + ".snap"
+}
+
+// loadSnapshot loads the counters from the last snapshot, if there is one
+func (s *Stats) loadSnapshot() error {
+	fd, err := os.Open(s.snapPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer fd.Close()
+	first := true
+	// snapshots are written atomically, so any bad record is a real error
+	_, err = readRecords(fd, func(payload []byte) error {
+		kind, dr, err := readKind(payload)
+		if err != nil {
+			return err
+		}
+		if first {
+			first = false
+			if kind != recHeader {
+				return ErrBadEntry
+			}
+			s.gen, err = dr.ReadUvarint()
+			return err
+		}
+		return s.applySnapshot(kind, dr, len(payload))
+	})
+	if err != nil {
+		return fmt.Errorf("reading stats snapshot: %v", err)
+	}
+	return nil
+}
+
+// replay applies the clicks logged since the last snapshot. The log is cut
+// back at the first record that is torn or fails its checksum, since
+// nothing past it can be trusted. A log left over from before the last
+// snapshot, by a crash part way through compact, is emptied.
+func (s *Stats) replay() error {
+	first := true
+	good, err := readRecords(s.log, func(payload []byte) error {
+		kind, dr, err := readKind(payload)
+		if err != nil {
+			return ErrBadEntry
+		}
+		if first {
+			first = false
+			gen, err := dr.ReadUvarint()
+			if kind != recHeader || err != nil {
+				return ErrBadEntry
+			}
+			if gen != s.gen {
+				return errStaleLog
+			}
+			return nil
+		}
+		if kind != recClick {
+			return ErrBadEntry
+		}
+		click, err := decodeClick(dr)
+		if err != nil {
+			return ErrBadEntry
+		}
+		s.counter(click.Code).add(click)
+		s.logged++
+		return nil
+	})
+	switch err {
+	case nil:
+	case errStaleLog:
+		log.Printf("stats: %v, emptying it\n", err)
+		good = 0
+	case ErrBadEntry, io.ErrUnexpectedEOF:
+		log.Printf("stats: truncating click log at offset %d: %v\n", good, err)
+	default:
+		return fmt.Errorf("replaying click log: %v", err)
+	}
+	if good == 0 {
+		return s.resetLog()
+	}
+	if err = s.log.Truncate(good); err != nil {
+		return err
+	}
+	_, err = s.log.Seek(good, io.SeekStart)
+	return err
+}
+
+// resetLog empties the click log and starts it with a header for the
+// current snapshot generation
+func (s *Stats) resetLog() error {
+	if err := s.log.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.log.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	b, err := encodeHeader(s.gen)
+	if err != nil {
+		return err
+	}
+	if _, err = s.log.Write(b); err != nil {
+		return err
+	}
+	s.logged = 0
+	return s.log.Sync()
+}
+
+// counter returns the counter for code, creating it if need be. The
+// caller must hold the write lock (or be the only user, as in replay).
+func (s *Stats) counter(code string) *counter {
+	c, ok := s.counts[code]
+	if !ok {
+		c = newCounter()
+		s.counts[code] = c
+	}
+	return c
+}
+
+// Track queues a click on code made by r. It never blocks; if the queue
+// is full the click is dropped and counted in Dropped.
+func (s *Stats) Track(code string, r *http.Request) {
+	click := Click{
+		Code:     code,
+		Time:     time.Now().Unix(),
+		Visitor:  visitorID(r),
+		Referrer: referrerDomain(r.Referer()),
+		Agent:    agentFamily(r.UserAgent()),
+	}
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+	if s.closed {
+		// a request still in flight during shutdown
+		return
+	}
+	select {
+	case s.clicks <- click:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// Dropped returns the number of clicks dropped because the queue was full
+func (s *Stats) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// run drains the click queue, writing a batch whenever it fills up or
+// the flush interval passes, until the queue is closed.
+func (s *Stats) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(clickFlushEvery)
+	defer ticker.Stop()
+	batch := make([]Click, 0, clickBatchSize)
+	for {
+		select {
+		case click, ok := <-s.clicks:
+			if !ok {
+				s.flush(batch)
+				return
+			}
+			batch = append(batch, click)
+			if len(batch) < clickBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		s.flush(batch)
+		batch = batch[:0]
+		if s.logged >= statsCompactAfter {
+			if err := s.compact(); err != nil {
+				log.Printf("stats: compacting: %v\n", err)
+			}
+		}
+	}
+}
+
+// flush persists a batch of clicks and then applies them to the counters.
+// If the write fails the log is cut back to where it was, so a torn batch
+// doesn't take the ones written after it down with it on the next replay.
+func (s *Stats) flush(batch []Click) {
+	if len(batch) == 0 {
+		return
+	}
+	var buf bytes.Buffer
+	n := 0
+	for _, click := range batch {
+		b, err := encodeClick(click)
+		if err != nil {
+			log.Printf("stats: encoding click: %v\n", err)
+			continue
+		}
+		buf.Write(b)
+		n++
+	}
+	if err := s.appendLog(buf.Bytes()); err != nil {
+		log.Printf("stats: writing clicks: %v\n", err)
+	} else {
+		s.logged += n
+	}
+	now := time.Now().Unix()
+	s.mu.Lock()
+	for _, click := range batch {
+		s.counter(click.Code).add(click)
+	}
+	for _, c := range s.counts {
+		c.trim(now)
+	}
+	s.mu.Unlock()
+}
+
+// appendLog writes b to the end of the click log and syncs it, rolling
+// the log back if that fails
+func (s *Stats) appendLog(b []byte) error {
+	offset, err := s.log.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = s.log.Write(b); err == nil {
+		err = s.log.Sync()
+	}
+	if err != nil {
+		if terr := s.log.Truncate(offset); terr != nil {
+			return fmt.Errorf("%v, and rolling back: %v", err, terr)
+		}
+		if _, serr := s.log.Seek(offset, io.SeekStart); serr != nil {
+			return fmt.Errorf("%v, and rolling back: %v", err, serr)
+		}
+	}
+	return err
+}
+
+// compact writes the counters to a new snapshot and empties the click
+// log. The snapshot is written to a temp file, synced and renamed into
+// place, and carries the next generation, so if we crash before the log
+// is emptied the old log is seen to be stale rather than counted twice.
+// Only the run goroutine, or Close once it has stopped, may call it.
+func (s *Stats) compact() error {
+	tmp := s.snapPath() + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(fd)
+	s.mu.RLock()
+	err = s.writeSnapshot(bw, s.gen+1)
+	s.mu.RUnlock()
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, s.snapPath()); err != nil {
+		return err
+	}
+	if err = syncDir(filepath.Dir(s.path)); err != nil {
+		return err
+	}
+	s.gen++
+	return s.resetLog()
+}
+
+// writeSnapshot writes a header for gen, then the records for every counter
+func (s *Stats) writeSnapshot(w io.Writer, gen uint64) error {
+	b, err := encodeHeader(gen)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(b); err != nil {
+		return err
+	}
+	for code, c := range s.counts {
+		if b, err = encodeCounter(code, c); err != nil {
+			return err
+		}
+		if _, err = w.Write(b); err != nil {
+			return err
+		}
+		ids := make([]uint64, 0, len(c.visitors))
+		for id := range c.visitors {
+			ids = append(ids, id)
+		}
+		for len(ids) > 0 {
+			n := len(ids)
+			if n > visitorsPerRecord {
+				n = visitorsPerRecord
+			}
+			if b, err = encodeVisitors(code, ids[:n]); err != nil {
+				return err
+			}
+			if _, err = w.Write(b); err != nil {
+				return err
+			}
+			ids = ids[n:]
+		}
+	}
+	return nil
+}
+
+// applySnapshot applies a counter or visitors record to the counters
+func (s *Stats) applySnapshot(kind byte, dr *data.DataReader, size int) error {
+	code, err := dr.ReadString()
+	if err != nil {
+		return err
+	}
+	c := s.counter(code)
+	switch kind {
+	case recCounter:
+		if c.total, err = dr.ReadUvarint(); err != nil {
+			return err
+		}
+		if c.referrers, err = readCounts(dr, size); err != nil {
+			return err
+		}
+		if c.agents, err = readCounts(dr, size); err != nil {
+			return err
+		}
+		if c.hourly, err = readBuckets(dr, size); err != nil {
+			return err
+		}
+		c.daily, err = readBuckets(dr, size)
+		return err
+	case recVisitors:
+		n, err := dr.ReadUvarint()
+		if err != nil {
+			return err
+		}
+		if n > uint64(size/8) {
+			return ErrBadEntry
+		}
+		for i := uint64(0); i < n; i++ {
+			id, err := dr.ReadUint64()
+			if err != nil {
+				return err
+			}
+			c.visitors[id] = struct{}{}
+		}
+		return nil
+	}
+	return ErrBadEntry
+}
+
+// Close stops accepting clicks, writes out anything still queued, folds
+// the log into the snapshot and closes it. Clicks tracked after Close are
+// ignored.
+func (s *Stats) Close() error {
+	s.closeMu.Lock()
+	if s.closed {
+		s.closeMu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.clicks)
+	s.closeMu.Unlock()
+	<-s.done
+	var err error
+	if s.logged > 0 {
+		if err = s.compact(); err != nil {
+			err = fmt.Errorf("compacting: %v", err)
+		}
+	}
+	if cerr := s.log.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Bucket is the number of clicks in a single time slot
+type Bucket struct {
+	Time   time.Time `json:"time"`
+	Clicks uint64    `json:"clicks"`
+}
+
+// Report is a point in time summary of the clicks on a short code
+type Report struct {
+	Code      string            `json:"code"`
+	Total     uint64            `json:"total"`
+	Unique    int               `json:"unique"`
+	Referrers map[string]uint64 `json:"referrers"`
+	Agents    map[string]uint64 `json:"agents"`
+	Hourly    []Bucket          `json:"hourly"`
+	Daily     []Bucket          `json:"daily"`
+}
+
+// Report returns the current analytics for code
+func (s *Stats) Report(code string) *Report {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rep := &Report{
+		Code:      code,
+		Referrers: make(map[string]uint64),
+		Agents:    make(map[string]uint64),
+		Hourly:    []Bucket{},
+		Daily:     []Bucket{},
+	}
+	c, ok := s.counts[code]
+	if !ok {
+		return rep
+	}
+	rep.Total = c.total
+	rep.Unique = len(c.visitors)
+	for k, v := range c.referrers {
+		rep.Referrers[k] = v
+	}
+	for k, v := range c.agents {
+		rep.Agents[k] = v
+	}
+	rep.Hourly = buckets(c.hourly)
+	rep.Daily = buckets(c.daily)
+	return rep
+}
+
+func buckets(m map[int64]uint64) []Bucket {
+	bs := make([]Bucket, 0, len(m))
+	for t, n := range m {
+		bs = append(bs, Bucket{Time: time.Unix(t, 0).UTC(), Clicks: n})
+	}
+	sort.Slice(bs, func(i, j int) bool {
+		return bs[i].Time.Before(bs[j].Time)
+	})
+	return bs
+}
+
+// The encode funcs below write to a bytes.Buffer through a bufio.Writer,
+// which keeps the first error it hits, so only Flush needs checking.
+
+// newRecord returns a buffer with room for the record header, and a
+// writer for the payload that starts with kind
+func newRecord(kind byte) (*bytes.Buffer, *data.DataWriter) {
+	buf := bytes.NewBuffer(make([]byte, entryHeaderSZ, 64))
+	dw := data.NewDataWriter(buf)
+	dw.WriteUint8(kind)
+	return buf, dw
+}
+
+// sealData flushes dw and returns the finished record in buf
+func sealData(buf *bytes.Buffer, dw *data.DataWriter) ([]byte, error) {
+	if err := dw.Flush(); err != nil {
+		return nil, err
+	}
+	return sealRecord(buf.Bytes()), nil
+}
+
+// readKind returns the kind of a record and a reader for the rest of it
+func readKind(payload []byte) (byte, *data.DataReader, error) {
+	dr := data.NewDataReader(bytes.NewReader(payload))
+	kind, err := dr.ReadUint8()
+	return kind, dr, err
+}
+
+func encodeHeader(gen uint64) ([]byte, error) {
+	buf, dw := newRecord(recHeader)
+	dw.WriteUvarint(gen)
+	return sealData(buf, dw)
+}
+
+func encodeClick(click Click) ([]byte, error) {
+	buf, dw := newRecord(recClick)
+	dw.WriteString(click.Code)
+	dw.WriteVarint(click.Time)
+	dw.WriteUint64(click.Visitor)
+	dw.WriteString(click.Referrer)
+	dw.WriteString(click.Agent)
+	return sealData(buf, dw)
+}
+
+func decodeClick(dr *data.DataReader) (Click, error) {
+	var click Click
+	var err error
+	if click.Code, err = dr.ReadString(); err != nil {
+		return click, err
+	}
+	if click.Time, err = dr.ReadVarint(); err != nil {
+		return click, err
+	}
+	if click.Visitor, err = dr.ReadUint64(); err != nil {
+		return click, err
+	}
+	if click.Referrer, err = dr.ReadString(); err != nil {
+		return click, err
+	}
+	if click.Agent, err = dr.ReadString(); err != nil {
+		return click, err
+	}
+	return click, nil
+}
+
+// encodeCounter writes everything in c but the visitors, which go in
+// their own records
+func encodeCounter(code string, c *counter) ([]byte, error) {
+	buf, dw := newRecord(recCounter)
+	dw.WriteString(code)
+	dw.WriteUvarint(c.total)
+	writeCounts(dw, c.referrers)
+	writeCounts(dw, c.agents)
+	writeBuckets(dw, c.hourly)
+	writeBuckets(dw, c.daily)
+	return sealData(buf, dw)
+}
+
+func encodeVisitors(code string, ids []uint64) ([]byte, error) {
+	buf, dw := newRecord(recVisitors)
+	dw.WriteString(code)
+	dw.WriteUvarint(uint64(len(ids)))
+	for _, id := range ids {
+		dw.WriteUint64(id)
+	}
+	return sealData(buf, dw)
+}
+
+func writeCounts(dw *data.DataWriter, m map[string]uint64) {
+	dw.WriteUvarint(uint64(len(m)))
+	for k, n := range m {
+		dw.WriteString(k)
+		dw.WriteUvarint(n)
+	}
+}
+
+// readCounts reads a map written by writeCounts from a record of size
+// bytes, which bounds how many entries it can hold
+func readCounts(dr *data.DataReader, size int) (map[string]uint64, error) {
+	n, err := dr.ReadUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(size) {
+		return nil, ErrBadEntry
+	}
+	m := make(map[string]uint64, n)
+	for i := uint64(0); i < n; i++ {
+		k, err := dr.ReadString()
+		if err != nil {
+			return nil, err
+		}
+		if m[k], err = dr.ReadUvarint(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func writeBuckets(dw *data.DataWriter, m map[int64]uint64) {
+	dw.WriteUvarint(uint64(len(m)))
+	for t, n := range m {
+		dw.WriteVarint(t)
+		dw.WriteUvarint(n)
+	}
+}
+
+// readBuckets reads a map written by writeBuckets, bounded like readCounts
+func readBuckets(dr *data.DataReader, size int) (map[int64]uint64, error) {
+	n, err := dr.ReadUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(size) {
+		return nil, ErrBadEntry
+	}
+	m := make(map[int64]uint64, n)
+	for i := uint64(0); i < n; i++ {
+		t, err := dr.ReadVarint()
+		if err != nil {
+			return nil, err
+		}
+		if m[t], err = dr.ReadUvarint(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// visitorID identifies a unique visitor by their ip and user agent
+func visitorID(r *http.Request) uint64 {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	h := fnv.New64a()
+	h.Write([]byte(host))
+	h.Write([]byte{0})
+	h.Write([]byte(r.UserAgent()))
+	return h.Sum64()
+}
+
+// referrerDomain reduces a referrer url down to its domain
+func referrerDomain(ref string) string {
+	if ref == "" {
+		return "(direct)"
+	}
+	u, err := url.Parse(ref)
+	if err != nil || u.Hostname() == "" {
+		return "(unknown)"
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
+
+// agentFamily reduces a user agent string down to a browser or client family.
+// Order matters here, most browsers claim to be several of the others.
+func agentFamily(ua string) string {
+	if ua == "" {
+		return "(unknown)"
+	}
+	lua := strings.ToLower(ua)
+	switch {
+	case strings.Contains(lua, "bot"), strings.Contains(lua, "spider"), strings.Contains(lua, "crawl"):
+		return "Bot"
+	case strings.Contains(ua, "Edg/"), strings.Contains(ua, "Edge/"):
+		return "Edge"
+	case strings.Contains(ua, "OPR/"), strings.Contains(ua, "Opera"):
+		return "Opera"
+	case strings.Contains(ua, "Firefox/"):
+		return "Firefox"
+	case strings.Contains(ua, "Chrome/"), strings.Contains(ua, "CriOS/"):
+		return "Chrome"
+	case strings.Contains(ua, "Safari/"):
+		return "Safari"
+	case strings.HasPrefix(lua, "curl/"):
+		return "curl"
+	case strings.HasPrefix(lua, "wget/"):
+		return "Wget"
+	case strings.HasPrefix(ua, "Go-http-client/"):
+		return "Go"
+	}
+	return "Other"
+}
+
+// handleStats serves the report for code as JSON, or as a small chart
+// page when the client asks for html.
+func handleStats(stats *Stats, code string) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		rep := stats.Report(code)
+		if strings.Contains(r.Header.Get("Accept"), "text/html") {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			if err := statsPage.Execute(w, rep); err != nil {
+				log.Printf("stats: rendering page: %v\n", err)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(rep); err != nil {
+			log.Printf("stats: encoding report: %v\n", err)
+		}
+	}
+	return http.HandlerFunc(fn)
+}
+
+var statsPage = template.Must(template.New("stats").Funcs(template.FuncMap{
+	"bars": bars,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>/{{.Code}} stats</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+svg { background: #f6f6f6; }
+rect { fill: #4a7fb5; }
+td { padding: 0 1em 0 0; }
+</style>
+</head>
+<body>
+<h1>/{{.Code}}</h1>
+<p>{{.Total}} clicks, {{.Unique}} unique</p>
+<h2>Daily</h2>
+{{template "chart" bars .Daily}}
+<h2>Hourly</h2>
+{{template "chart" bars .Hourly}}
+<h2>Referrers</h2>
+<table>{{range $k, $v := .Referrers}}<tr><td>{{$k}}</td><td>{{$v}}</td></tr>{{end}}</table>
+<h2>Agents</h2>
+<table>{{range $k, $v := .Agents}}<tr><td>{{$k}}</td><td>{{$v}}</td></tr>{{end}}</table>
+</body>
+</html>
+{{define "chart"}}<svg width="{{.Width}}" height="{{.Height}}">{{range .Bars}}<rect x="{{.X}}" y="{{.Y}}" width="{{.W}}" height="{{.H}}"><title>{{.Label}}: {{.Clicks}}</title></rect>{{end}}</svg>{{end}}
+`))
+
+type bar struct {
+	X, Y, W, H int
+	Label      string
+	Clicks     uint64
+}
+
+type chart struct {
+	Width, Height int
+	Bars          []bar
+}
+
+// bars lays out a set of buckets as a simple svg bar chart
+func bars(bs []Bucket) chart {
+	ch := chart{Width: 720, Height: 160}
+	if len(bs) == 0 {
+		return ch
+	}
+	var max uint64
+	for _, b := range bs {
+		if b.Clicks > max {
+			max = b.Clicks
+		}
+	}
+	w := ch.Width / len(bs)
+	if w < 1 {
+		w = 1
+	}
+	for i, b := range bs {
+		h := int(b.Clicks * uint64(ch.Height) / max)
+		ch.Bars = append(ch.Bars, bar{
+			X:      i * w,
+			Y:      ch.Height - h,
+			W:      w - 1,
+			H:      h,
+			Label:  b.Time.Format("2006-01-02 15:04"),
+			Clicks: b.Clicks,
+		})
+	}
+	return ch
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openStats(t *testing.T, path string) *Stats {
+	t.Helper()
+	s, err := OpenStats(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// appendLog writes records straight onto the end of the click log, the
+// way a run that crashed before compacting would have left them
+func appendLog(t *testing.T, path string, recs ...[]byte) {
+	t.Helper()
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	for _, b := range recs {
+		if _, err = fd.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func clickRecord(t *testing.T, code string, at time.Time) []byte {
+	t.Helper()
+	b, err := encodeClick(Click{Code: code, Time: at.Unix(), Visitor: 1, Referrer: "(direct)", Agent: "Go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+func TestStatsReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clicks.dat")
+	s := openStats(t, path)
+	for _, ua := range []string{"curl/8.0", "curl/8.0", "Wget/1.21"} {
+		r := httptest.NewRequest("GET", "/abc", nil)
+		r.Header.Set("User-Agent", ua)
+		s.Track("abc", r)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Close folds the clicks into the snapshot and leaves only the header
+	header, _ := encodeHeader(1)
+	if n := fileSize(t, path); n != int64(len(header)) {
+		t.Fatalf("click log is %d bytes after Close, want %d", n, len(header))
+	}
+	s = openStats(t, path)
+	defer s.Close()
+	rep := s.Report("abc")
+	if rep.Total != 3 || rep.Unique != 2 || rep.Agents["curl"] != 2 || rep.Agents["Wget"] != 1 {
+		t.Fatalf("got %+v", rep)
+	}
+	if len(rep.Hourly) != 1 || len(rep.Daily) != 1 {
+		t.Fatalf("got %d hourly and %d daily buckets", len(rep.Hourly), len(rep.Daily))
+	}
+}
+
+func TestStatsBadRecord(t *testing.T) {
+	now := time.Now()
+	for name, garbage := range map[string][]byte{
+		// a length header far past anything we would write
+		"length": {0, 0, 0, 0, 0xff, 0xff, 0xff, 0x7f},
+		"checksum": func() []byte {
+			b := clickRecord(t, "abc", now)
+			b[0] ^= 0xff
+			return b
+		}(),
+		"torn": clickRecord(t, "abc", now)[:entryHeaderSZ+2],
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "clicks.dat")
+			openStats(t, path).Close()
+			appendLog(t, path, clickRecord(t, "abc", now), clickRecord(t, "abc", now))
+			good := fileSize(t, path)
+			appendLog(t, path, garbage, clickRecord(t, "abc", now))
+			s := openStats(t, path)
+			defer s.Close()
+			if rep := s.Report("abc"); rep.Total != 2 {
+				t.Fatalf("got %d clicks, want 2", rep.Total)
+			}
+			if n := fileSize(t, path); n != good {
+				t.Fatalf("click log is %d bytes, want it cut back to %d", n, good)
+			}
+		})
+	}
+}
+
+func TestStatsStaleLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clicks.dat")
+	openStats(t, path).Close()
+	now := time.Now()
+	appendLog(t, path, clickRecord(t, "abc", now), clickRecord(t, "abc", now))
+	stale, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = openStats(t, path).Close(); err != nil {
+		t.Fatal(err)
+	}
+	// put the log back the way it was before it was compacted, as if we
+	// had crashed between writing the snapshot and emptying the log
+	if err = ioutil.WriteFile(path, stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := openStats(t, path)
+	defer s.Close()
+	if rep := s.Report("abc"); rep.Total != 2 {
+		t.Fatalf("got %d clicks, want 2", rep.Total)
+	}
+}
+
+func TestStatsTrimOnReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clicks.dat")
+	openStats(t, path).Close()
+	appendLog(t, path, clickRecord(t, "abc", time.Now().Add(-2*hourlyRetention)))
+	s := openStats(t, path)
+	defer s.Close()
+	rep := s.Report("abc")
+	if rep.Total != 1 || len(rep.Daily) != 1 || len(rep.Hourly) != 0 {
+		t.Fatalf("got %d clicks, %d daily and %d hourly buckets", rep.Total, len(rep.Daily), len(rep.Hourly))
+	}
+}
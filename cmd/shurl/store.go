@@ -1,8 +1,13 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"github.com/scottcagno/net-tools/pkg/data"
+	"hash/crc32"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -10,203 +15,469 @@ import (
 	"time"
 )
 
+var (
+	ErrNotFound   = errors.New("key not found")
+	ErrKeyExists  = errors.New("key already exists")
+	ErrBadEntry   = errors.New("bad log entry")
+	ErrStoreClose = errors.New("store is closed")
+)
+
 type Store interface {
-	Add(string, []string)
-	Set(string, []string)
-	Get(string) []string
-	Del(string)
+	Add(string, []string) error
+	Set(string, []string) error
+	Get(string) ([]string, error)
+	Del(string) error
 }
 
-type SimpleStore struct {
+const (
+	opSet = byte(0x01)
+	opDel = byte(0x02)
+
+	logName  = "store.log"
+	snapName = "store.snap"
+
+	// entryHeaderSZ is the crc32 and the payload length in front of every entry
+	entryHeaderSZ = 8
+	// maxEntrySZ guards against allocating for a garbage length on replay
+	maxEntrySZ = 1 << 24
+)
+
+// LogStore is a crash safe Store. Every Set and Del is appended to a log
+// file as a checksummed entry and synced before returning. On open, the
+// last snapshot is loaded and the log is replayed on top of it. The log is
+// periodically compacted into a fresh snapshot so it does not grow forever.
+type LogStore struct {
 	mu   sync.Mutex
 	path string
 	data map[string][]string
-	fd   *os.File
+	log  *os.File
+	ops  int // entries in the log since the last compaction
+	once sync.Once
+	stop chan struct{}
+	done chan struct{}
 }
 
-func NewSimpleStore(path string) *SimpleStore {
+// OpenLogStore opens (or creates) a LogStore in the directory at path. If
+// compactEvery is greater than zero, the log is compacted on that interval.
+func OpenLogStore(path string, compactEvery time.Duration) (*LogStore, error) {
 	err := CreateDirIfNotExist(path)
 	if err != nil {
-		log.Fatal(err)
-	}
-	if path[len(path)-1] != '/' {
-		path = path + "/"
+		return nil, err
 	}
-	ss := &SimpleStore{
+	s := &LogStore{
 		path: path,
 		data: make(map[string][]string),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
 	}
-	ss.readFileIntoMap()
-	return ss
+	// load the last snapshot, if there is one
+	err = s.loadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	// open the log and replay it on top of the snapshot
+	s.log, err = os.OpenFile(filepath.Join(path, logName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = s.replayLog()
+	if err != nil {
+		s.log.Close()
+		return nil, err
+	}
+	if compactEvery > 0 {
+		go s.compactor(compactEvery)
+	} else {
+		close(s.done)
+	}
+	return s, nil
 }
 
-func (s *SimpleStore) readFileIntoMap() {
-	files, err := os.ReadDir(s.path)
+func (s *LogStore) loadSnapshot() error {
+	fd, err := os.Open(filepath.Join(s.path, snapName))
 	if err != nil {
-		log.Fatal(err)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer fd.Close()
+	// snapshots are written atomically, so any bad entry is a real error
+	_, err = readEntries(fd, s.apply)
+	if err != nil {
+		return fmt.Errorf("reading snapshot: %v", err)
+	}
+	return nil
+}
+
+func (s *LogStore) replayLog() error {
+	// replayed entries count toward the next compaction just like new ones,
+	// otherwise a long log is only compacted once something is written
+	good, err := readEntries(s.log, func(op byte, k string, v []string) {
+		s.apply(op, k, v)
+		s.ops++
+	})
+	if err == ErrBadEntry {
+		// a bad entry may have acknowledged writes after it, so truncating
+		// would lose them; leave the log as it is for someone to look at
+		return fmt.Errorf("replaying log: %v at offset %d, move %s aside to start without it",
+			err, good, filepath.Join(s.path, logName))
 	}
-	for _, file := range files {
-		if file.IsDir() {
-			continue
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("replaying log: %v", err)
+	}
+	if err != nil {
+		// the file ends part way through an entry, we crashed mid write and
+		// everything up to the last good entry is still valid
+		log.Printf("store: truncating log at offset %d: %v\n", good, err)
+		if err = s.log.Truncate(good); err != nil {
+			return err
 		}
-		b, err := os.ReadFile(s.path + file.Name())
+	}
+	_, err = s.log.Seek(good, io.SeekStart)
+	return err
+}
+
+// apply applies a single decoded entry to the in memory map
+func (s *LogStore) apply(op byte, k string, v []string) {
+	switch op {
+	case opSet:
+		s.data[k] = v
+	case opDel:
+		delete(s.data, k)
+	}
+}
+
+// readEntries reads entries from r until EOF, calling fn for each one. It
+// returns the offset just past the last good entry.
+func readEntries(r io.Reader, fn func(op byte, k string, v []string)) (int64, error) {
+	return readRecords(r, func(payload []byte) error {
+		op, k, v, err := decodeEntry(payload)
 		if err != nil {
-			log.Fatalf("error reading file: %v\n", err)
+			return ErrBadEntry
+		}
+		fn(op, k, v)
+		return nil
+	})
+}
+
+// readRecords reads checksummed records from r until EOF, calling fn with
+// the payload of each one and stopping at the first error it returns. It
+// returns the offset just past the last good record.
+func readRecords(r io.Reader, fn func(payload []byte) error) (int64, error) {
+	var offset int64
+	var hdr [entryHeaderSZ]byte
+	for {
+		_, err := io.ReadFull(r, hdr[:])
+		if err == io.EOF {
+			return offset, nil
 		}
-		var ss []string
-		err = json.Unmarshal(b, &ss)
 		if err != nil {
-			log.Fatalf("error unmarshaling: %v\n", err)
+			return offset, err
+		}
+		sum := binary.LittleEndian.Uint32(hdr[0:4])
+		n := binary.LittleEndian.Uint32(hdr[4:8])
+		if n > maxEntrySZ {
+			return offset, ErrBadEntry
+		}
+		payload := make([]byte, n)
+		if _, err = io.ReadFull(r, payload); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return offset, err
+		}
+		if crc32.ChecksumIEEE(payload) != sum {
+			return offset, ErrBadEntry
 		}
-		s.data[file.Name()] = ss
+		if err = fn(payload); err != nil {
+			return offset, err
+		}
+		offset += int64(entryHeaderSZ) + int64(n)
 	}
 }
 
-func (s *SimpleStore) deleteEntry(k string) error {
-	// look for contents on disk
-	fi, err := os.Stat(s.path + k + ".json")
-	if err != nil && os.IsNotExist(err) {
-		return fmt.Errorf("error, can't locate file (%s): %v\n",
-			s.path+k+".json", err)
+// sealRecord fills in the header of b, which holds entryHeaderSZ bytes of
+// room for it followed by the payload
+func sealRecord(b []byte) []byte {
+	payload := b[entryHeaderSZ:]
+	binary.LittleEndian.PutUint32(b[0:4], crc32.ChecksumIEEE(payload))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(len(payload)))
+	return b
+}
+
+// encodeEntry returns a complete entry (header and payload) for the operation
+func encodeEntry(op byte, k string, v []string) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, entryHeaderSZ))
+	dw := data.NewDataWriter(&buf)
+	if err := dw.WriteUint8(op); err != nil {
+		return nil, err
 	}
-	// contents are there, so lets remove them
-	err = os.Remove(fi.Name())
-	if err != nil {
-		return fmt.Errorf("error removing file: %v\n", err)
+	if err := dw.WriteString(k); err != nil {
+		return nil, err
 	}
-	// check for entry in map and remove
-	if _, ok := s.data[k]; ok {
-		delete(s.data, k)
+	if err := dw.WriteUvarint(uint64(len(v))); err != nil {
+		return nil, err
 	}
-	return nil
+	for _, s := range v {
+		if err := dw.WriteString(s); err != nil {
+			return nil, err
+		}
+	}
+	if err := dw.Flush(); err != nil {
+		return nil, err
+	}
+	return sealRecord(buf.Bytes()), nil
 }
 
-func (s *SimpleStore) writeEntry(overwrite bool, k string, v []string) error {
-	// check if key exists
-	if _, ok := s.data[k]; ok {
-		if overwrite {
-			err := s.deleteEntry(k)
-			if err != nil {
-				return err
-			}
-		}
-		return nil
+func decodeEntry(payload []byte) (byte, string, []string, error) {
+	dr := data.NewDataReader(bytes.NewReader(payload))
+	op, err := dr.ReadUint8()
+	if err != nil {
+		return 0, "", nil, err
+	}
+	if op != opSet && op != opDel {
+		return 0, "", nil, ErrBadEntry
 	}
-	// if no key found, then marshal data...
-	b, err := json.Marshal(v)
+	k, err := dr.ReadString()
 	if err != nil {
-		return fmt.Errorf("error marshaling: %v\n", err)
+		return 0, "", nil, err
 	}
-	// ...and write contents to file
-	err = os.WriteFile(s.path+k+".json", b, 0666)
+	n, err := dr.ReadUvarint()
 	if err != nil {
-		return fmt.Errorf("error writing file: %v\n", err)
+		return 0, "", nil, err
 	}
-	// update map if overwrite is true
-	if overwrite {
-		s.data[k] = v
+	if n > uint64(len(payload)) {
+		return 0, "", nil, ErrBadEntry
 	}
-	return nil
+	v := make([]string, 0, n)
+	for i := uint64(0); i < n; i++ {
+		s, err := dr.ReadString()
+		if err != nil {
+			return 0, "", nil, err
+		}
+		v = append(v, s)
+	}
+	return op, k, v, nil
 }
 
-func (s *SimpleStore) readEntryFile(k string) ([]string, error) {
-	// look for contents in map
-	if v, ok := s.data[k]; ok {
-		return v, nil
+// append writes an entry to the log and syncs it. If that fails the log
+// is cut back to where it was, so a torn entry doesn't hide the ones
+// written after it on the next replay. The caller must hold the lock.
+func (s *LogStore) append(op byte, k string, v []string) error {
+	if s.log == nil {
+		return ErrStoreClose
 	}
-	// look for contents on disk
-	fi, err := os.Stat(s.path + k + ".json")
-	if err != nil && os.IsNotExist(err) {
-		return nil,
-			fmt.Errorf("error, can't locate file (%s): %v\n",
-				s.path+k+".json", err)
+	b, err := encodeEntry(op, k, v)
+	if err != nil {
+		return err
 	}
-	// read file contents from disk (i really dont think this should happen)
-	b, err := os.ReadFile(fi.Name())
+	offset, err := s.log.Seek(0, io.SeekCurrent)
 	if err != nil {
-		return nil, fmt.Errorf("error reading file: %v\n", err)
+		return err
+	}
+	if _, err = s.log.Write(b); err == nil {
+		err = s.log.Sync()
 	}
-	// unmarshal contents and add back into map (this also really should happen)
-	var ss []string
-	err = json.Unmarshal(b, &ss)
 	if err != nil {
-		return nil, fmt.Errorf("error unmarshaling: %v\n", err)
+		if terr := s.log.Truncate(offset); terr != nil {
+			return fmt.Errorf("%v, and rolling back: %v", err, terr)
+		}
+		if _, serr := s.log.Seek(offset, io.SeekStart); serr != nil {
+			return fmt.Errorf("%v, and rolling back: %v", err, serr)
+		}
+		return err
 	}
-	s.data[k] = ss
-	return s.data[k], nil
+	s.ops++
+	return nil
 }
 
-func (s *SimpleStore) Add(k string, v []string) {
+// Add stores v under k, it returns ErrKeyExists if k is already in use
+func (s *LogStore) Add(k string, v []string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	err := s.writeEntry(false, k, v)
-	if err != nil {
-		log.Fatal(err)
+	if _, ok := s.data[k]; ok {
+		return ErrKeyExists
 	}
+	if err := s.append(opSet, k, v); err != nil {
+		return err
+	}
+	s.data[k] = v
+	return nil
 }
 
-func (s *SimpleStore) Set(k string, v []string) {
+// Set stores v under k, overwriting anything already there
+func (s *LogStore) Set(k string, v []string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	err := s.writeEntry(true, k, v)
-	if err != nil {
-		log.Fatal(err)
+	if err := s.append(opSet, k, v); err != nil {
+		return err
+	}
+	s.data[k] = v
+	return nil
+}
+
+// Get returns the value stored under k, or ErrNotFound
+func (s *LogStore) Get(k string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.data[k]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return v, nil
+}
+
+// Del removes k, it returns ErrNotFound if k is not in the store
+func (s *LogStore) Del(k string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data[k]; !ok {
+		return ErrNotFound
+	}
+	if err := s.append(opDel, k, nil); err != nil {
+		return err
+	}
+	delete(s.data, k)
+	return nil
+}
+
+func (s *LogStore) compactor(every time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Compact(); err != nil {
+				log.Printf("store: compacting: %v\n", err)
+			}
+		case <-s.stop:
+			return
+		}
 	}
 }
 
-func (s *SimpleStore) Get(k string) []string {
+// Compact writes the current contents of the store to a new snapshot and
+// empties the log. The snapshot is written to a temp file, synced and then
+// renamed into place, so a crash at any point leaves a usable store behind.
+func (s *LogStore) Compact() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	v, err := s.readEntryFile(k)
+	if s.log == nil {
+		return ErrStoreClose
+	}
+	if s.ops == 0 {
+		return nil
+	}
+	// write the snapshot out to a temp file
+	tmp := filepath.Join(s.path, snapName+".tmp")
+	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	for k, v := range s.data {
+		b, err := encodeEntry(opSet, k, v)
+		if err != nil {
+			fd.Close()
+			return err
+		}
+		if _, err = fd.Write(b); err != nil {
+			fd.Close()
+			return err
+		}
+	}
+	if err = fd.Sync(); err != nil {
+		fd.Close()
+		return err
+	}
+	if err = fd.Close(); err != nil {
+		return err
+	}
+	// swap it in for the old snapshot and make the rename durable
+	if err = os.Rename(tmp, filepath.Join(s.path, snapName)); err != nil {
+		return err
+	}
+	if err = syncDir(s.path); err != nil {
+		return err
+	}
+	// everything in the log is now in the snapshot. if we crash before the
+	// truncate, replaying the old log over the new snapshot is harmless.
+	if err = s.log.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = s.log.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err = s.log.Sync(); err != nil {
+		return err
 	}
-	return v
+	s.ops = 0
+	return nil
 }
 
-func (s *SimpleStore) Del(k string) {
+// Close stops the compactor and closes the log
+func (s *LogStore) Close() error {
+	s.once.Do(func() { close(s.stop) })
+	<-s.done
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	err := s.deleteEntry(k)
+	if s.log == nil {
+		return ErrStoreClose
+	}
+	err := s.log.Close()
+	s.log = nil
+	return err
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer dir.Close()
+	return dir.Sync()
 }
 
 func StoreTest() {
 
-	fmt.Println("Creating new simple store")
-	s := NewSimpleStore(".")
-	time.Sleep(time.Second * 3)
+	fmt.Println("Creating new log store")
+	s, err := OpenLogStore("./data", time.Second*5)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer s.Close()
 
 	fmt.Printf("adding %q\n", "foo")
-	s.Add("foo", []string{"foo1", "foo2", "foo3"})
-	time.Sleep(time.Second * 3)
+	checkErr(s.Add("foo", []string{"foo1", "foo2", "foo3"}))
 
 	fmt.Printf("adding %q\n", "bar")
-	s.Add("bar", []string{"baz"})
-	time.Sleep(time.Second * 3)
+	checkErr(s.Add("bar", []string{"baz"}))
 
-	fmt.Printf("getting %q->%v\n", "foo", s.Get("foo"))
-	time.Sleep(time.Second * 3)
+	v, err := s.Get("foo")
+	fmt.Printf("getting %q->%v (%v)\n", "foo", v, err)
 
 	fmt.Printf("setting %q\n", "foo")
-	s.Set("foo", []string{"bar"})
-	time.Sleep(time.Second * 3)
+	checkErr(s.Set("foo", []string{"bar"}))
 
-	fmt.Printf("getting %q->%v\n", "foo", s.Get("foo"))
-	time.Sleep(time.Second * 3)
+	v, err = s.Get("foo")
+	fmt.Printf("getting %q->%v (%v)\n", "foo", v, err)
 
-	fmt.Printf("setting %q\n", "bar")
-	s.Set("bar", []string{"dang"})
-	time.Sleep(time.Second * 3)
-
-	fmt.Printf("getting %q->%v\n", "bar", s.Get("bar"))
-	time.Sleep(time.Second * 3)
+	fmt.Printf("compacting\n")
+	checkErr(s.Compact())
 
 	fmt.Printf("removing %q\n", "bar")
-	s.Del("bar")
-	time.Sleep(time.Second * 3)
+	checkErr(s.Del("bar"))
+
+	v, err = s.Get("bar")
+	fmt.Printf("getting %q->%v (%v)\n", "bar", v, err)
+}
+
+func checkErr(err error) {
+	if err != nil {
+		log.Println(err)
+	}
 }
 
 func listDir(path string) []os.FileInfo {
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCompactAfterReplay(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenLogStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		if err = s.Set(k, []string{"http://example.com/" + k}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// nothing has been written since the reopen, but the replayed log
+	// should still be folded into a snapshot
+	s, err = OpenLogStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err = s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if n := fileSize(t, filepath.Join(dir, logName)); n != 0 {
+		t.Fatalf("log is %d bytes after Compact, want 0", n)
+	}
+	if n := fileSize(t, filepath.Join(dir, snapName)); n == 0 {
+		t.Fatal("no snapshot after Compact")
+	}
+	if v, err := s.Get("b"); err != nil || v[0] != "http://example.com/b" {
+		t.Fatalf("got %v, %v", v, err)
+	}
+}
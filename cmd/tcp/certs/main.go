@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/config"
+	"github.com/scottcagno/net-tools/pkg/tcp/tlsutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Config holds the settings for generating certificates
+type Config struct {
+	Dir      string        `config:"dir" default:"./certs" usage:"directory to write the pem files to"`
+	Hosts    []string      `config:"hosts" default:"localhost,127.0.0.1,::1" usage:"host names and ips for the server certificate"`
+	Server   string        `config:"server" default:"server" usage:"common name of the server certificate"`
+	Client   string        `config:"client" default:"client" usage:"common name of the client certificate"`
+	ValidFor time.Duration `config:"valid-for" default:"8760h" usage:"how long the certificates are valid for"`
+}
+
+// main writes a local CA, and a server and client certificate signed by
+// it, for trying out tls and mutual tls with cmd/tcp/server and cmd/nc.
+// An existing CA in the directory is reused, so new certificates can be
+// issued without redistributing it.
+func main() {
+	var cfg Config
+	if err := config.Load("CERTS", &cfg); err != nil {
+		if err == config.ErrHelp {
+			return
+		}
+		log.Fatalln(err)
+	}
+	path := func(name string) string {
+		return filepath.Join(cfg.Dir, name)
+	}
+
+	ca, err := tlsutil.LoadCA(path("ca.pem"), path("ca-key.pem"))
+	if os.IsNotExist(err) {
+		if ca, err = tlsutil.GenerateCA("net-tools dev ca", cfg.ValidFor); err == nil {
+			err = ca.WriteFiles(path("ca.pem"), path("ca-key.pem"))
+		}
+		fmt.Printf("wrote %s\n", path("ca.pem"))
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	srv, err := ca.IssueServer(cfg.Server, cfg.Hosts, cfg.ValidFor)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err = srv.WriteFiles(path("server.pem"), path("server-key.pem")); err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Printf("wrote %s for %v\n", path("server.pem"), cfg.Hosts)
+
+	cli, err := ca.IssueClient(cfg.Client, nil, cfg.ValidFor)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err = cli.WriteFiles(path("client.pem"), path("client-key.pem")); err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Printf("wrote %s for %q\n", path("client.pem"), cfg.Client)
+}
@@ -1,57 +1,242 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/config"
+	"github.com/scottcagno/net-tools/pkg/tcp/line"
+	"github.com/scottcagno/net-tools/pkg/tcp/memcache"
+	"github.com/scottcagno/net-tools/pkg/tcp/resp"
 	"github.com/scottcagno/net-tools/pkg/tcp/server"
+	"github.com/scottcagno/net-tools/pkg/tcp/socks5"
 	"io"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"time"
 )
 
 func main() {
 
+	// load the server settings from flags, env (TCP_*) or a config file
+	var cfg server.Config
+	if err := config.Load("TCP", &cfg); err != nil {
+		if err == config.ErrHelp {
+			return
+		}
+		log.Fatalln(err)
+	}
+
 	// run example one
-	ServerExample1()
+	//ServerExample1(cfg.Addr)
 
 	// run example two
-	//ServerExample2()
+	//ServerExample2(cfg.Addr)
 
 	// run example three
-	//ServerExample3()
+	//ServerExample3(cfg.Addr)
 
 	// run example four
-	//ServerExample4()
+	//ServerExample4(cfg.Addr)
+
+	// run example five, the only one that uses every setting in cfg
+	ServerExample5(cfg)
+
+	// run example six
+	//ServerExample6(cfg)
+
+	// run example seven
+	//ServerExample7(server.PacketConfig{Network: "udp", Addr: cfg.Addr})
+
+	// run example eight
+	//ServerExample8(cfg, "cmd/tcp/server/data/kv.dat")
+
+	// run example nine
+	//ServerExample9(cfg, memcache.DefaultConfig)
+
+	// run example ten
+	//ServerExample10(cfg, socks5.Config{Users: []string{"user:password"}, Deny: []string{"*:25"}})
 }
 
-func ServerExample1() {
-	err := server.ListenAndServe(":8080")
+func ServerExample1(addr string) {
+	err := server.ListenAndServe(addr)
 	if err != nil {
 		log.Fatalln(err)
 	}
 }
 
-func ServerExample2() {
-	err := server.ListenAndServeTCP(":8080")
+func ServerExample2(addr string) {
+	err := server.ListenAndServeTCP(addr)
 	if err != nil {
 		log.Fatalln(err)
 	}
 }
 
-func ServerExample3() {
-	err := server.ListenAndServeTCPWithHandler(":8080", server.HandleEcho())
+func ServerExample3(addr string) {
+	err := server.ListenAndServeTCPWithHandler(addr, server.HandleEcho())
 	if err != nil {
 		log.Fatalln(err)
 	}
 }
 
-func ServerExample4() {
+func ServerExample4(addr string) {
 	// the power of closures
 	customFn := func(conn net.Conn) {
 		defer conn.Close()
 		// echo all incoming data
 		io.Copy(conn, conn)
 	}
-	err := server.ListenAndServeTCPWithHandler(":8080", customFn)
+	err := server.ListenAndServeTCPWithHandler(addr, customFn)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func ServerExample5(cfg server.Config) {
+	// a server with limits, timeouts and a graceful shutdown on ctrl-c
+	chain := server.NewChain(
+		server.LogConn(nil),
+		server.Recover(nil),
+		server.RateLimit(50, 10),
+	)
+	// serves tls when -tls-cert is given, see cmd/tcp/certs
+	srv, err := server.NewServer(cfg, chain.Then(server.HandleEcho()))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt)
+		<-sig
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("shutdown: %v, closing remaining connections\n", err)
+			srv.Close()
+		}
+	}()
+	err = srv.ListenAndServe()
+	if err != nil && err != server.ErrServerClosed {
+		log.Fatalln(err)
+	}
+}
+
+func ServerExample6(cfg server.Config) {
+	// a small key value store speaking a line protocol, try it with
+	// netcat and send HELP
+	var mu sync.Mutex
+	kv := make(map[string]string)
+
+	mux := line.NewMux()
+	mux.Greeting = "kv ready"
+	mux.NewSession = func(s *line.Session) {
+		s.Set("count", 0)
+	}
+	mux.Handle(line.Command{
+		Name: "SET", Usage: "key value", Help: "set a key", MinArgs: 2, MaxArgs: 2,
+		Handle: func(s *line.Session, args []string) error {
+			mu.Lock()
+			kv[args[0]] = args[1]
+			mu.Unlock()
+			s.Set("count", s.Get("count").(int)+1)
+			return s.OK("")
+		},
+	})
+	mux.Handle(line.Command{
+		Name: "GET", Usage: "key", Help: "get a key", MinArgs: 1, MaxArgs: 1,
+		Handle: func(s *line.Session, args []string) error {
+			mu.Lock()
+			v, ok := kv[args[0]]
+			mu.Unlock()
+			if !ok {
+				return errors.New("not found")
+			}
+			return s.OK(v)
+		},
+	})
+	mux.Handle(line.Command{
+		Name: "COUNT", Help: "number of keys set on this connection", MaxArgs: 0,
+		Handle: func(s *line.Session, args []string) error {
+			return s.OK(strconv.Itoa(s.Get("count").(int)))
+		},
+	})
+	srv, err := server.NewServer(cfg, server.NewChain(server.LogConn(nil), server.Recover(nil)).Then(mux.ServeConn))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := srv.ListenAndServe(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func ServerExample7(cfg server.PacketConfig) {
+	// a udp (or unixgram) echo server that counts packets per peer
+	chain := server.NewPacketChain(server.LogPacket(nil), server.RecoverPacket(nil))
+	srv := server.NewPacketServer(cfg, chain.Then(func(w server.PacketWriter, p *server.Packet) {
+		if p.Session == nil {
+			// an unnamed unix socket, there is no way to reply
+			return
+		}
+		reply := fmt.Sprintf("%d: %s", p.Session.Packets(), p.Data)
+		w.WriteTo([]byte(reply), p.Addr)
+	}))
+	if err := srv.ListenAndServe(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func ServerExample8(cfg server.Config, path string) {
+	// a redis compatible key value store, try it with redis-cli
+	ds, err := resp.OpenDataStorage(path)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer ds.Close()
+	rs := resp.NewServer(ds)
+	go func() {
+		// the store buffers its writes, commit them every second
+		for range time.Tick(time.Second) {
+			if err := ds.Sync(); err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+	srv, err := server.NewServer(cfg, server.NewChain(server.LogConn(nil), server.Recover(nil)).Then(rs.ServeConn))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := srv.ListenAndServe(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func ServerExample9(cfg server.Config, cacheCfg memcache.Config) {
+	// a memcached compatible cache, try it with telnet or any memcached client
+	ms := memcache.NewServer(memcache.New(cacheCfg))
+	srv, err := server.NewServer(cfg, server.NewChain(server.LogConn(nil), server.Recover(nil)).Then(ms.ServeConn))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := srv.ListenAndServe(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func ServerExample10(cfg server.Config, socksCfg socks5.Config) {
+	// a socks5 proxy, try it with curl --socks5-hostname user:password@localhost:8080
+	ps, err := socks5.NewServer(socksCfg)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	srv, err := server.NewServer(cfg, server.NewChain(server.Recover(nil), server.IdleTimeout(5*time.Minute)).Then(ps.ServeConn))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := srv.ListenAndServe(); err != nil {
+		log.Fatalln(err)
+	}
 }
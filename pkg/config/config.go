@@ -0,0 +1,319 @@
+package config
+
+import (
+	"encoding"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrHelp is returned by Load when the help flag was given. The usage
+// has already been written out by the time it is returned.
+var ErrHelp = flag.ErrHelp
+
+var (
+	durationType        = reflect.TypeOf(time.Duration(0))
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// Loader fills a config struct from, in increasing order of precedence:
+//
+//  1. the `default:"..."` struct tags
+//  2. a JSON (.json) or TOML subset (.toml) config file
+//  3. environment variables, named PREFIX_NAME
+//  4. command line flags, named -name
+//
+// Fields are named by their `config:"name"` tag, or the lower cased
+// field name. A tag of "-" skips the field. Nested structs are named
+// parent.child; as flags that is -parent.child, in the environment
+// PREFIX_PARENT_CHILD, and in a config file a nested object or table.
+// A `required:"true"` field must be set by one of the sources, and the
+// `usage:"..."` tag documents the field in the generated help.
+//
+// The config file is given by the -config flag, the PREFIX_CONFIG
+// environment variable, or File, in that order.
+type Loader struct {
+	Name      string    // program name shown in the help, defaults to os.Args[0]
+	EnvPrefix string    // prefix for environment variables, e.g. "SHURL"
+	File      string    // default config file, may be empty
+	Args      []string  // command line arguments, defaults to os.Args[1:]
+	Output    io.Writer // where help and flag errors go, defaults to os.Stderr
+}
+
+// Load fills v, which must be a pointer to a struct, using a Loader with
+// the given environment prefix and the process arguments.
+func Load(prefix string, v interface{}) error {
+	l := &Loader{EnvPrefix: prefix}
+	return l.Load(v)
+}
+
+// field is a single settable value in the config struct
+type field struct {
+	name     string // dotted name, e.g. "web.addr"
+	value    reflect.Value
+	def      string
+	hasDef   bool
+	required bool
+	usage    string
+	set      bool // set by the file, the environment or a flag
+}
+
+// Load fills v, which must be a pointer to a struct
+func (l *Loader) Load(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return errors.New("config: value must be a pointer to a struct")
+	}
+	fields, err := collect(rv.Elem(), "")
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]*field, len(fields))
+	for _, f := range fields {
+		if f.name == "config" {
+			return errors.New("config: the name config is reserved for the config file flag")
+		}
+		byName[f.name] = f
+	}
+	// 1. defaults
+	for _, f := range fields {
+		if !f.hasDef {
+			continue
+		}
+		if err = setValue(f.value, f.def); err != nil {
+			return fmt.Errorf("config: default for %s: %v", f.name, err)
+		}
+	}
+	// parse the flags now, so we can find the config file, but hold on
+	// to the values until everything else has been applied
+	fs, flags := l.flagSet(fields)
+	if err = fs.Parse(l.args()); err != nil {
+		return err
+	}
+	// 2. config file
+	file := l.File
+	if env := os.Getenv(l.envName("config")); env != "" {
+		file = env
+	}
+	if flags.config != "" {
+		file = flags.config
+	}
+	if file != "" {
+		if err = l.loadFile(file, byName); err != nil {
+			return err
+		}
+	}
+	// 3. environment
+	for _, f := range fields {
+		env, ok := os.LookupEnv(l.envName(f.name))
+		if !ok {
+			continue
+		}
+		if err = setValue(f.value, env); err != nil {
+			return fmt.Errorf("config: %s: %v", l.envName(f.name), err)
+		}
+		f.set = true
+	}
+	// 4. flags
+	var ferr error
+	fs.Visit(func(fl *flag.Flag) {
+		f, ok := byName[fl.Name]
+		if !ok || ferr != nil {
+			return
+		}
+		if err := setValue(f.value, flags.values[fl.Name]); err != nil {
+			ferr = fmt.Errorf("config: -%s: %v", fl.Name, err)
+			return
+		}
+		f.set = true
+	})
+	if ferr != nil {
+		return ferr
+	}
+	// check that everything required made it in
+	var missing []string
+	for _, f := range fields {
+		if f.required && !f.set && !f.hasDef {
+			missing = append(missing, f.name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("config: missing required values: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// collect walks the struct rv and returns its settable fields
+func collect(rv reflect.Value, prefix string) ([]*field, error) {
+	var fields []*field
+	typ := rv.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		sf := typ.Field(i)
+		if sf.PkgPath != "" {
+			// unexported
+			continue
+		}
+		tag := sf.Tag.Get("config")
+		if tag == "-" {
+			continue
+		}
+		name := tag
+		if name == "" {
+			name = strings.ToLower(sf.Name)
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		fv := rv.Field(i)
+		// nested structs get their own names, unless they know how to
+		// parse themselves. untagged embedded structs are flattened.
+		if sf.Type.Kind() == reflect.Struct && !reflect.PtrTo(sf.Type).Implements(textUnmarshalerType) {
+			if sf.Anonymous && tag == "" {
+				name = prefix
+			}
+			nested, err := collect(fv, name)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, nested...)
+			continue
+		}
+		if !supported(sf.Type) {
+			return nil, fmt.Errorf("config: %s: unsupported type %s", name, sf.Type)
+		}
+		def, hasDef := sf.Tag.Lookup("default")
+		fields = append(fields, &field{
+			name:     name,
+			value:    fv,
+			def:      def,
+			hasDef:   hasDef,
+			required: sf.Tag.Get("required") == "true",
+			usage:    sf.Tag.Get("usage"),
+		})
+	}
+	return fields, nil
+}
+
+func supported(typ reflect.Type) bool {
+	if reflect.PtrTo(typ).Implements(textUnmarshalerType) {
+		return true
+	}
+	switch typ.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Slice:
+		return typ.Elem().Kind() != reflect.Slice && supported(typ.Elem())
+	}
+	return false
+}
+
+// setValue parses s into v. Slices are comma separated.
+func setValue(v reflect.Value, s string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	case reflect.Slice:
+		var parts []string
+		if s != "" {
+			parts = strings.Split(s, ",")
+		}
+		for i := range parts {
+			parts[i] = strings.TrimSpace(parts[i])
+		}
+		return setList(v, parts)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// setList sets the slice v from a list of elements
+func setList(v reflect.Value, parts []string) error {
+	if v.Kind() != reflect.Slice {
+		return fmt.Errorf("a list can not be used for %s", v.Type())
+	}
+	out := reflect.MakeSlice(v.Type(), len(parts), len(parts))
+	for i, p := range parts {
+		if err := setValue(out.Index(i), p); err != nil {
+			return err
+		}
+	}
+	v.Set(out)
+	return nil
+}
+
+// envName returns the environment variable for the dotted field name
+func (l *Loader) envName(name string) string {
+	r := strings.NewReplacer(".", "_", "-", "_")
+	name = strings.ToUpper(r.Replace(name))
+	if l.EnvPrefix == "" {
+		return name
+	}
+	return strings.ToUpper(l.EnvPrefix) + "_" + name
+}
+
+func (l *Loader) name() string {
+	if l.Name != "" {
+		return l.Name
+	}
+	return filepath.Base(os.Args[0])
+}
+
+func (l *Loader) args() []string {
+	if l.Args != nil {
+		return l.Args
+	}
+	return os.Args[1:]
+}
+
+func (l *Loader) output() io.Writer {
+	if l.Output != nil {
+		return l.Output
+	}
+	return os.Stderr
+}
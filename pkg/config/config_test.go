@@ -0,0 +1,213 @@
+package config_test
+
+import (
+	"github.com/scottcagno/net-tools/pkg/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type Web struct {
+	Host string `config:"host" default:"localhost"`
+	Port int    `config:"port" default:"80"`
+}
+
+type testConfig struct {
+	Addr    string        `config:"addr" default:":8080" usage:"address to listen on"`
+	Timeout time.Duration `config:"timeout" default:"1s"`
+	Tags    []string      `config:"tags"`
+	Debug   bool
+	Web     Web    `config:"web"`
+	Skipped string `config:"-"`
+}
+
+const prefix = "CFGTEST"
+
+// setenv sets an environment variable for the rest of the test
+func setenv(t *testing.T, k, v string) {
+	t.Helper()
+	os.Setenv(k, v)
+	t.Cleanup(func() { os.Unsetenv(k) })
+}
+
+// writeFile writes a config file into a temp dir and returns its path
+func writeFile(t *testing.T, name, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func load(t *testing.T, file string, args ...string) (testConfig, error) {
+	t.Helper()
+	var cfg testConfig
+	if args == nil {
+		// a nil Args would read the test binary's own flags
+		args = []string{}
+	}
+	l := &config.Loader{Name: "test", EnvPrefix: prefix, File: file, Args: args, Output: ioutil.Discard}
+	err := l.Load(&cfg)
+	return cfg, err
+}
+
+func TestPrecedence(t *testing.T) {
+	toml := `
+addr = ":1"
+timeout = "2s"
+tags = ["file"]
+[web]
+host = "file.example.com"
+port = 81
+`
+	for _, tc := range []struct {
+		name string
+		file string // toml, or "" for no file
+		env  map[string]string
+		args []string
+		want testConfig
+	}{
+		{
+			name: "defaults",
+			want: testConfig{Addr: ":8080", Timeout: time.Second, Web: Web{Host: "localhost", Port: 80}},
+		},
+		{
+			name: "file over defaults",
+			file: toml,
+			want: testConfig{Addr: ":1", Timeout: 2 * time.Second, Tags: []string{"file"}, Web: Web{Host: "file.example.com", Port: 81}},
+		},
+		{
+			name: "env over file",
+			file: toml,
+			env:  map[string]string{prefix + "_ADDR": ":2", prefix + "_WEB_PORT": "82", prefix + "_TAGS": "a, b"},
+			want: testConfig{Addr: ":2", Timeout: 2 * time.Second, Tags: []string{"a", "b"}, Web: Web{Host: "file.example.com", Port: 82}},
+		},
+		{
+			name: "flags over env",
+			file: toml,
+			env:  map[string]string{prefix + "_ADDR": ":2", prefix + "_WEB_PORT": "82", prefix + "_DEBUG": "false"},
+			args: []string{"-addr", ":3", "-debug", "-tags", "x", "-tags", "y"},
+			want: testConfig{Addr: ":3", Timeout: 2 * time.Second, Tags: []string{"x", "y"}, Debug: true, Web: Web{Host: "file.example.com", Port: 82}},
+		},
+		{
+			name: "flags over defaults",
+			args: []string{"-web.host", "flag.example.com", "-timeout", "5m"},
+			want: testConfig{Addr: ":8080", Timeout: 5 * time.Minute, Web: Web{Host: "flag.example.com", Port: 80}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var file string
+			if tc.file != "" {
+				file = writeFile(t, "test.toml", tc.file)
+			}
+			for k, v := range tc.env {
+				setenv(t, k, v)
+			}
+			got, err := load(t, file, tc.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got  %+v\nwant %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestConfigFileChoice(t *testing.T) {
+	def := writeFile(t, "default.toml", `addr = ":1"`)
+	env := writeFile(t, "env.json", `{"addr": ":2", "web": {"port": 82}, "tags": ["a", "b"]}`)
+	flag := writeFile(t, "flag.toml", `addr = ":3"`)
+	cfg, err := load(t, def)
+	if err != nil || cfg.Addr != ":1" {
+		t.Fatalf("File: got %q, %v", cfg.Addr, err)
+	}
+	setenv(t, prefix+"_CONFIG", env)
+	cfg, err = load(t, def)
+	if err != nil || cfg.Addr != ":2" || cfg.Web.Port != 82 || !reflect.DeepEqual(cfg.Tags, []string{"a", "b"}) {
+		t.Fatalf("env: got %+v, %v", cfg, err)
+	}
+	cfg, err = load(t, def, "-config", flag)
+	if err != nil || cfg.Addr != ":3" {
+		t.Fatalf("flag: got %q, %v", cfg.Addr, err)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		file string
+		body string
+		env  map[string]string
+		args []string
+		err  string
+	}{
+		{name: "unknown key", file: "c.toml", body: "adr = \":1\"", err: `unknown key "adr"`},
+		{name: "unknown nested key", file: "c.json", body: `{"web": {"hots": "x"}}`, err: `unknown key "web.hots"`},
+		{name: "skipped field", file: "c.toml", body: `skipped = "x"`, err: `unknown key "skipped"`},
+		{name: "bad file value", file: "c.toml", body: `timeout = "soon"`, err: "timeout:"},
+		{name: "bad toml", file: "c.toml", body: "[web", err: "line 1: bad table header"},
+		{name: "bad json", file: "c.json", body: "{", err: "c.json"},
+		{name: "unknown file type", file: "c.yaml", body: "addr: x", err: "unknown config file type"},
+		{name: "bad env value", env: map[string]string{prefix + "_WEB_PORT": "eighty"}, err: prefix + "_WEB_PORT"},
+		{name: "bad flag value", args: []string{"-debug=maybe"}, err: "-debug"},
+		{name: "unknown flag", args: []string{"-nope"}, err: "flag provided but not defined"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var file string
+			if tc.file != "" {
+				file = writeFile(t, tc.file, tc.body)
+			}
+			for k, v := range tc.env {
+				setenv(t, k, v)
+			}
+			_, err := load(t, file, tc.args...)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("got %v, want an error containing %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestRequired(t *testing.T) {
+	var cfg struct {
+		Name  string `config:"name" required:"true"`
+		Level int    `config:"level" required:"true" default:"1"`
+	}
+	l := &config.Loader{Args: []string{}, Output: ioutil.Discard}
+	if err := l.Load(&cfg); err == nil || !strings.Contains(err.Error(), "missing required values: name") {
+		t.Fatalf("got %v", err)
+	}
+	l.Args = []string{"-name", "x"}
+	if err := l.Load(&cfg); err != nil || cfg.Name != "x" || cfg.Level != 1 {
+		t.Fatalf("got %+v, %v", cfg, err)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	l := &config.Loader{Name: "test", EnvPrefix: prefix}
+	usage, err := l.Usage(&testConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Usage: test [flags]",
+		"-addr string\n    \taddress to listen on (default \":8080\") [$CFGTEST_ADDR]",
+		"-web.port int",
+		"-timeout duration",
+		"-tags list",
+		"[$CFGTEST_CONFIG]",
+	} {
+		if !strings.Contains(usage, want) {
+			t.Fatalf("usage is missing %q:\n%s", want, usage)
+		}
+	}
+	if strings.Contains(usage, "skipped") {
+		t.Fatalf("usage lists a skipped field:\n%s", usage)
+	}
+}
@@ -0,0 +1,311 @@
+package config
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// loadFile applies the config file at path to the fields. Keys in the
+// file that do not match a field are an error, to catch typos early.
+func (l *Loader) loadFile(path string, byName map[string]*field) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("config: %v", err)
+	}
+	defer fd.Close()
+	var m map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		dec := json.NewDecoder(fd)
+		dec.UseNumber()
+		err = dec.Decode(&m)
+	case ".toml":
+		m, err = parseTOML(fd)
+	default:
+		return fmt.Errorf("config: %s: unknown config file type, want .json or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("config: %s: %v", path, err)
+	}
+	if err = apply(m, "", byName); err != nil {
+		return fmt.Errorf("config: %s: %v", path, err)
+	}
+	return nil
+}
+
+// apply sets the fields named by the (possibly nested) keys of m
+func apply(m map[string]interface{}, prefix string, byName map[string]*field) error {
+	// go in order so errors are stable
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name := k
+		if prefix != "" {
+			name = prefix + "." + k
+		}
+		if nested, ok := m[k].(map[string]interface{}); ok {
+			if err := apply(nested, name, byName); err != nil {
+				return err
+			}
+			continue
+		}
+		f, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("unknown key %q", name)
+		}
+		var err error
+		if list, ok := m[k].([]interface{}); ok {
+			parts := make([]string, len(list))
+			for i, v := range list {
+				parts[i] = scalar(v)
+			}
+			err = setList(f.value, parts)
+		} else {
+			err = setValue(f.value, scalar(m[k]))
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		f.set = true
+	}
+	return nil
+}
+
+// scalar returns the string form of a decoded value
+func scalar(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case json.Number:
+		return t.String()
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// parseTOML parses the subset of TOML that config files need: tables,
+// dotted keys, comments, strings, numbers, booleans and single line
+// arrays of those. Multi-line strings, inline tables and arrays of
+// tables are not supported.
+func parseTOML(r io.Reader) (map[string]interface{}, error) {
+	root := make(map[string]interface{})
+	table := root
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(sc.Text()))
+		if line == "" {
+			continue
+		}
+		// table header
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("line %d: bad table header %q", n, line)
+			}
+			path, err := splitKey(strings.TrimSpace(line[1 : len(line)-1]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			if table, err = subTable(root, path); err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			continue
+		}
+		// key = value
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		path, err := splitKey(strings.TrimSpace(line[:i]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		val, err := parseValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		t, err := subTable(table, path[:len(path)-1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		key := path[len(path)-1]
+		if _, ok := t[key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key %q", n, key)
+		}
+		t[key] = val
+	}
+	return root, sc.Err()
+}
+
+// subTable walks (and creates) the nested tables named by path
+func subTable(t map[string]interface{}, path []string) (map[string]interface{}, error) {
+	for _, k := range path {
+		next, ok := t[k]
+		if !ok {
+			m := make(map[string]interface{})
+			t[k] = m
+			t = m
+			continue
+		}
+		m, ok := next.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("key %q is already a value", k)
+		}
+		t = m
+	}
+	return t, nil
+}
+
+// splitKey splits a dotted key into its parts, parts may be quoted
+func splitKey(s string) ([]string, error) {
+	var parts []string
+	for s != "" {
+		var part string
+		if s[0] == '"' || s[0] == '\'' {
+			end := strings.IndexByte(s[1:], s[0])
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated key %q", s)
+			}
+			part, s = s[1:end+1], strings.TrimSpace(s[end+2:])
+		} else {
+			end := strings.IndexByte(s, '.')
+			if end < 0 {
+				end = len(s)
+			}
+			part, s = strings.TrimSpace(s[:end]), s[end:]
+			if !bareKey(part) {
+				return nil, fmt.Errorf("bad key %q", part)
+			}
+		}
+		parts = append(parts, part)
+		if s == "" {
+			break
+		}
+		if s[0] != '.' {
+			return nil, fmt.Errorf("bad key near %q", s)
+		}
+		s = strings.TrimSpace(s[1:])
+		if s == "" {
+			return nil, fmt.Errorf("key ends with a dot")
+		}
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("empty key")
+	}
+	return parts, nil
+}
+
+func bareKey(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func parseValue(s string) (interface{}, error) {
+	switch {
+	case s == "":
+		return nil, fmt.Errorf("missing value")
+	case s[0] == '"':
+		return strconv.Unquote(s)
+	case s[0] == '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return nil, fmt.Errorf("unterminated string %s", s)
+		}
+		return s[1 : len(s)-1], nil
+	case s[0] == '[':
+		return parseArray(s)
+	case s == "true":
+		return true, nil
+	case s == "false":
+		return false, nil
+	}
+	num := strings.Replace(s, "_", "", -1)
+	if n, err := strconv.ParseInt(num, 0, 64); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(num, 64); err == nil {
+		return f, nil
+	}
+	return nil, fmt.Errorf("bad value %s", s)
+}
+
+func parseArray(s string) ([]interface{}, error) {
+	if s[len(s)-1] != ']' {
+		return nil, fmt.Errorf("arrays must be on a single line")
+	}
+	s = strings.TrimSpace(s[1 : len(s)-1])
+	var out []interface{}
+	for s != "" {
+		// find the end of this element, skipping over strings
+		end := 0
+		for end < len(s) && s[end] != ',' {
+			if s[end] == '"' || s[end] == '\'' {
+				q := s[end]
+				end++
+				for end < len(s) && s[end] != q {
+					if q == '"' && s[end] == '\\' {
+						end++
+					}
+					end++
+				}
+			}
+			end++
+		}
+		if end > len(s) {
+			end = len(s)
+		}
+		elem := strings.TrimSpace(s[:end])
+		if elem != "" {
+			v, err := parseValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := v.([]interface{}); ok {
+				return nil, fmt.Errorf("nested arrays are not supported")
+			}
+			out = append(out, v)
+		}
+		if end >= len(s) {
+			break
+		}
+		s = strings.TrimSpace(s[end+1:])
+	}
+	return out, nil
+}
+
+// stripComment removes a trailing # comment that is not inside a string
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
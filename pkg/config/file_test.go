@@ -0,0 +1,106 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   string
+		want map[string]interface{}
+	}{
+		{"scalars", `
+s = "hello"
+n = 1_000
+neg = -5
+hex = 0x1f
+f = 2.5
+yes = true
+no = false
+`, map[string]interface{}{
+			"s": "hello", "n": int64(1000), "neg": int64(-5), "hex": int64(31),
+			"f": 2.5, "yes": true, "no": false,
+		}},
+		{"quoting", `
+escaped = "a\tb \"c\""
+literal = 'C:\path\n'
+hash = "not # a comment" # but this is
+`, map[string]interface{}{
+			"escaped": "a\tb \"c\"", "literal": `C:\path\n`, "hash": "not # a comment",
+		}},
+		{"arrays", `
+strs = ["a", "b,c", 'd']
+nums = [1, 2, 3,]
+empty = []
+`, map[string]interface{}{
+			"strs":  []interface{}{"a", "b,c", "d"},
+			"nums":  []interface{}{int64(1), int64(2), int64(3)},
+			"empty": []interface{}(nil),
+		}},
+		{"sections", `
+top = 1
+# a comment line
+[web]
+addr = ":80"
+tls.cert = "cert.pem"
+
+[web.proxy]
+policy = "allow"
+
+[ "quoted key" ]
+"a.b" = 2
+`, map[string]interface{}{
+			"top": int64(1),
+			"web": map[string]interface{}{
+				"addr":  ":80",
+				"tls":   map[string]interface{}{"cert": "cert.pem"},
+				"proxy": map[string]interface{}{"policy": "allow"},
+			},
+			"quoted key": map[string]interface{}{"a.b": int64(2)},
+		}},
+		{"empty", "\n# nothing here\n\n", map[string]interface{}{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseTOML(strings.NewReader(tc.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got  %#v\nwant %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   string
+		err  string
+	}{
+		{"no equals", "a\n", "line 1: expected key = value"},
+		{"no value", "a =\n", "line 1: missing value"},
+		{"bad value", "a = nope\n", "line 1: bad value nope"},
+		{"unterminated string", "a = \"abc\n", "line 1: invalid syntax"},
+		{"unterminated literal", "a = 'abc\n", "line 1: unterminated string"},
+		{"bad header", "[web\n", "line 1: bad table header"},
+		{"array of tables", "[[web]]\n", "line 1: bad table header"},
+		{"duplicate key", "a = 1\na = 2\n", "line 2: duplicate key \"a\""},
+		{"table over value", "a = 1\n[a]\n", "line 2: key \"a\" is already a value"},
+		{"multi-line array", "a = [1,\n2]\n", "line 1: arrays must be on a single line"},
+		{"nested array", "a = [[1], [2]]\n", "line 1: nested arrays are not supported"},
+		{"bad key", "a b = 1\n", "line 1: bad key \"a b\""},
+		{"trailing dot", "a. = 1\n", "line 1: key ends with a dot"},
+		{"unterminated key", "\"a = 1\n", "line 1: unterminated key"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseTOML(strings.NewReader(tc.in))
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("got %v, want an error containing %q", err, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// flagValues holds the raw values of the flags that were given, they are
+// only applied once the defaults, file and environment have been
+type flagValues struct {
+	config string
+	values map[string]string
+}
+
+// rawValue is a flag.Value that records the raw string it was given
+type rawValue struct {
+	name   string
+	values map[string]string
+	isBool bool
+	isList bool
+}
+
+func (r *rawValue) String() string {
+	if r == nil || r.values == nil {
+		return ""
+	}
+	return r.values[r.name]
+}
+
+func (r *rawValue) Set(s string) error {
+	if old, ok := r.values[r.name]; ok && r.isList {
+		// repeated list flags add to the list
+		s = old + "," + s
+	}
+	r.values[r.name] = s
+	return nil
+}
+
+func (r *rawValue) IsBoolFlag() bool {
+	return r.isBool
+}
+
+// flagSet returns a flag set with a flag for every field, plus -config
+func (l *Loader) flagSet(fields []*field) (*flag.FlagSet, *flagValues) {
+	fv := &flagValues{values: make(map[string]string)}
+	fs := flag.NewFlagSet(l.name(), flag.ContinueOnError)
+	fs.SetOutput(l.output())
+	fs.StringVar(&fv.config, "config", "", "")
+	for _, f := range fields {
+		fs.Var(&rawValue{
+			name:   f.name,
+			values: fv.values,
+			isBool: f.value.Kind() == reflect.Bool,
+			isList: f.value.Kind() == reflect.Slice,
+		}, f.name, f.usage)
+	}
+	fs.Usage = func() {
+		fmt.Fprint(l.output(), l.usage(fields))
+	}
+	return fs, fv
+}
+
+// Usage returns the help text for the config struct v, as printed for -help
+func (l *Loader) Usage(v interface{}) (string, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return "", fmt.Errorf("config: value must be a pointer to a struct")
+	}
+	fields, err := collect(rv.Elem(), "")
+	if err != nil {
+		return "", err
+	}
+	return l.usage(fields), nil
+}
+
+// usage formats the help text for a set of fields
+func (l *Loader) usage(fields []*field) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Usage: %s [flags]\n\nFlags:\n", l.name())
+	fmt.Fprintf(&sb, "  -config file\n    \tpath to a JSON (.json) or TOML (.toml) config file [$%s]\n",
+		l.envName("config"))
+	for _, f := range fields {
+		sb.WriteString("  -")
+		sb.WriteString(f.name)
+		if typ := typeName(f.value.Type()); typ != "" {
+			sb.WriteString(" ")
+			sb.WriteString(typ)
+		}
+		if f.required && !f.hasDef {
+			sb.WriteString(" (required)")
+		}
+		sb.WriteString("\n    \t")
+		sb.WriteString(f.usage)
+		if f.hasDef && f.def != "" {
+			if f.usage != "" {
+				sb.WriteString(" ")
+			}
+			fmt.Fprintf(&sb, "(default %q)", f.def)
+		}
+		fmt.Fprintf(&sb, " [$%s]\n", l.envName(f.name))
+	}
+	return sb.String()
+}
+
+func typeName(typ reflect.Type) string {
+	if typ == durationType {
+		return "duration"
+	}
+	if reflect.PtrTo(typ).Implements(textUnmarshalerType) {
+		// it parses itself from text, whatever its kind
+		return "string"
+	}
+	switch typ.Kind() {
+	case reflect.Bool:
+		return ""
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "int"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "uint"
+	case reflect.Float32, reflect.Float64:
+		return "float"
+	case reflect.Slice:
+		return "list"
+	}
+	return "string"
+}
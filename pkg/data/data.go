@@ -3,9 +3,9 @@ package data
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"io"
 	"math"
-	"reflect"
 	"unsafe"
 )
 
@@ -157,6 +157,11 @@ func (dw *DataWriter) WriteBinary(b []byte) error {
 	return nil
 }
 
+// Write writes the raw bytes in p, without a length in front
+func (dw *DataWriter) Write(p []byte) (int, error) {
+	return dw.bw.Write(p)
+}
+
 // WriteBytes writes bytes
 func (dw *DataWriter) WriteBytes(b []byte) error {
 	return dw.WriteString(*(*string)(unsafe.Pointer(&b)))
@@ -181,6 +186,11 @@ func NewDataReaderSize(r io.Reader, size int) *DataReader {
 	}
 }
 
+// Read reads raw bytes into p, without a length in front
+func (dr *DataReader) Read(p []byte) (int, error) {
+	return dr.br.Read(p)
+}
+
 // PeekUint64 reads a uint64 without advancing the reader
 func (dr *DataReader) PeekUint64() (uint64, error) {
 	buf, err := dr.br.Peek(8)
@@ -310,6 +320,31 @@ func (dr *DataReader) ReadBinary() ([]byte, error) {
 	return b, nil
 }
 
+// ErrTooLarge is returned by ReadBinaryMax for a length over its max
+var ErrTooLarge = errors.New("data: length is over the max")
+
+// ReadBinaryMax is ReadBinary for lengths that can't be trusted, such as
+// ones read back off a disk after a crash. A length over max returns
+// ErrTooLarge before anything is allocated, and a record that ends early
+// returns io.ErrUnexpectedEOF.
+func (dr *DataReader) ReadBinaryMax(max uint64) ([]byte, error) {
+	n, err := dr.ReadUint64()
+	if err != nil {
+		return nil, err
+	}
+	if n > max {
+		return nil, ErrTooLarge
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(dr.br, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
 // ReadString reads a string
 func (dr *DataReader) ReadString() (string, error) {
 	b, err := dr.ReadBytes()
@@ -321,20 +356,13 @@ func (dr *DataReader) ReadString() (string, error) {
 
 // UnsafeBytesToString converts bytes to string saving allocations
 func UnsafeBytesToString(bytes []byte) string {
-	sliceHeader := (*reflect.SliceHeader)(unsafe.Pointer(&bytes))
-
-	return *(*string)(unsafe.Pointer(&reflect.StringHeader{
-		Data: sliceHeader.Data,
-		Len:  sliceHeader.Len,
-	}))
+	return *(*string)(unsafe.Pointer(&bytes))
 }
 
 // UnsafeStringToBytes converts bytes to string saving allocations by re-using
 func UnsafeStringToBytes(s string) []byte {
-	stringHeader := (*reflect.StringHeader)(unsafe.Pointer(&s))
-	return *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
-		Data: stringHeader.Data,
-		Len:  stringHeader.Len,
-		Cap:  stringHeader.Len,
-	}))
+	return *(*[]byte)(unsafe.Pointer(&struct {
+		string
+		Cap int
+	}{s, len(s)}))
 }
@@ -51,6 +51,14 @@ func (s *Store) ReadData() ([]byte, error) {
 	return s.r.ReadBinary()
 }
 
+// ReadDataMax reads the next record like ReadData, but returns ErrTooLarge
+// rather than allocate for a length over max
+func (s *Store) ReadDataMax(max uint64) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.r.ReadBinaryMax(max)
+}
+
 func (s *Store) DeleteData() ([]byte, error) {
 	s.Lock()
 	defer s.Unlock()
@@ -180,6 +188,34 @@ func (s *Store) GetEntryOffset(n int) (int64, error) {
 	return offset, nil
 }
 
+// Sync flushes any buffered writes and commits them to stable storage
+func (s *Store) Sync() error {
+	s.Lock()
+	defer s.Unlock()
+	err := s.w.Flush()
+	if err != nil {
+		return err
+	}
+	return s.fd.Sync()
+}
+
+// Truncate cuts the store down to size bytes and positions the store at
+// the new end. It is used to drop a partially written trailing record.
+func (s *Store) Truncate(size int64) error {
+	s.Lock()
+	defer s.Unlock()
+	err := s.w.Flush()
+	if err != nil {
+		return err
+	}
+	err = s.fd.Truncate(size)
+	if err != nil {
+		return err
+	}
+	_, err = s.seek(size, io.SeekStart)
+	return err
+}
+
 func (s *Store) Close() error {
 	s.Lock()
 	defer s.Unlock()
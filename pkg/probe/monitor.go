@@ -0,0 +1,226 @@
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultWindow is how many of the latest probes of a target a monitor
+// sums up
+const DefaultWindow = 100
+
+// Config holds the settings for a Monitor. The tags let it be filled in
+// by pkg/config.
+type Config struct {
+	Interval time.Duration `config:"interval" default:"1s" usage:"time between probes of a target"`
+	Count    int           `config:"count" usage:"stop after this many probes of each target, 0 to go on until stopped"`
+	Timeout  time.Duration `config:"timeout" default:"5s" usage:"max duration of a probe, after which it counts as lost"`
+	Window   int           `config:"window" default:"100" usage:"number of the latest probes of a target the stats cover"`
+	Insecure bool          `config:"insecure" usage:"don't verify tls certificates"`
+}
+
+// Monitor probes targets on a schedule and keeps their stats. It serves
+// them as Prometheus style metrics over http.
+type Monitor struct {
+	Prober   *Prober
+	Targets  []Target
+	Interval time.Duration
+	// Count is how many times each target is probed, forever if zero
+	Count int
+	// Window is how many samples the stats cover, DefaultWindow if zero
+	Window int
+	// OnSample is called with each sample, if set. Calls for different
+	// targets may be concurrent.
+	OnSample func(Target, Sample)
+
+	mu      sync.Mutex
+	samples map[string]*history
+}
+
+// history is the latest samples of a target, and its all time counts
+type history struct {
+	ring []Sample
+	next int
+	sent int
+	lost int
+}
+
+// NewMonitor returns a new Monitor of the targets using the settings in
+// cfg
+func NewMonitor(cfg Config, targets []string) (*Monitor, error) {
+	m := &Monitor{
+		Prober: &Prober{
+			Timeout:   cfg.Timeout,
+			TLSConfig: &tls.Config{InsecureSkipVerify: cfg.Insecure},
+		},
+		Interval: cfg.Interval,
+		Count:    cfg.Count,
+		Window:   cfg.Window,
+	}
+	for _, s := range targets {
+		t, err := ParseTarget(s)
+		if err != nil {
+			return nil, err
+		}
+		m.Targets = append(m.Targets, t)
+	}
+	if len(m.Targets) == 0 {
+		return nil, fmt.Errorf("probe: no targets")
+	}
+	return m, nil
+}
+
+// Run probes every target each Interval, spreading the targets out over
+// it, until each has been probed Count times or ctx is done. Probes of a
+// target don't overlap, so one slower than Interval delays the next.
+func (m *Monitor) Run(ctx context.Context) error {
+	interval := m.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	var wg sync.WaitGroup
+	for i, t := range m.Targets {
+		wg.Add(1)
+		go func(t Target, offset time.Duration) {
+			defer wg.Done()
+			next := time.Now().Add(offset)
+			timer := time.NewTimer(offset)
+			defer timer.Stop()
+			for n := 0; m.Count <= 0 || n < m.Count; n++ {
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					return
+				}
+				next = next.Add(interval)
+				timer.Reset(time.Until(next))
+				s := m.Prober.Probe(ctx, t)
+				if ctx.Err() != nil {
+					// the probe was cut short, not lost
+					return
+				}
+				m.add(t, s)
+				if m.OnSample != nil {
+					m.OnSample(t, s)
+				}
+			}
+		}(t, interval*time.Duration(i)/time.Duration(len(m.Targets)))
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+func (m *Monitor) add(t Target, s Sample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.samples == nil {
+		m.samples = make(map[string]*history)
+	}
+	h := m.samples[t.Name]
+	if h == nil {
+		window := m.Window
+		if window <= 0 {
+			window = DefaultWindow
+		}
+		h = &history{ring: make([]Sample, 0, window)}
+		m.samples[t.Name] = h
+	}
+	h.sent++
+	if s.Err != nil {
+		h.lost++
+	}
+	if len(h.ring) < cap(h.ring) {
+		h.ring = append(h.ring, s)
+		return
+	}
+	h.ring[h.next] = s
+	h.next = (h.next + 1) % len(h.ring)
+}
+
+// Stats returns the stats of each target, in the order of Targets
+func (m *Monitor) Stats() []Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := make([]Stats, 0, len(m.Targets))
+	for _, t := range m.Targets {
+		h := m.samples[t.Name]
+		if h == nil {
+			stats = append(stats, Stats{Target: t})
+			continue
+		}
+		// oldest first
+		samples := append(append([]Sample(nil), h.ring[h.next:]...), h.ring[:h.next]...)
+		st := Summarize(t, samples)
+		st.Sent, st.Lost = h.sent, h.lost
+		stats = append(stats, st)
+	}
+	return stats
+}
+
+// ServeHTTP writes the stats in the Prometheus text format. Durations
+// are in seconds, summed up over the window.
+func (m *Monitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	var b strings.Builder
+	stats := m.Stats()
+	metric := func(name, typ, help string, value func(st Stats, emit func(labels string, v float64))) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, st := range stats {
+			value(st, func(labels string, v float64) {
+				fmt.Fprintf(&b, "%s{target=\"%s\",kind=\"%s\"%s} %g\n", name, label(st.Target.Name), st.Target.Kind, labels, v)
+			})
+		}
+	}
+	metric("probe_up", "gauge", "Whether the last probe succeeded.", func(st Stats, emit func(string, float64)) {
+		if st.Sent > 0 {
+			emit("", boolValue(st.Last.Err == nil))
+		}
+	})
+	metric("probe_sent_total", "counter", "Probes made.", func(st Stats, emit func(string, float64)) {
+		emit("", float64(st.Sent))
+	})
+	metric("probe_lost_total", "counter", "Probes that failed.", func(st Stats, emit func(string, float64)) {
+		emit("", float64(st.Lost))
+	})
+	metric("probe_loss_ratio", "gauge", "Share of the probes in the window that failed.", func(st Stats, emit func(string, float64)) {
+		emit("", st.Loss)
+	})
+	metric("probe_duration_seconds", "gauge", "Duration of each phase of the probes in the window.", func(st Stats, emit func(string, float64)) {
+		phases := []struct {
+			name string
+			Summary
+		}{{"connect", st.Connect}, {"tls", st.TLS}, {"ttfb", st.TTFB}}
+		for _, p := range phases {
+			if p.Count == 0 {
+				continue
+			}
+			for _, v := range []struct {
+				stat string
+				d    time.Duration
+			}{{"min", p.Min}, {"avg", p.Avg}, {"max", p.Max}, {"jitter", p.Jitter}, {"last", p.Last}} {
+				emit(",phase=\""+p.name+"\",stat=\""+v.stat+"\"", v.d.Seconds())
+			}
+		}
+	})
+	metric("probe_http_status", "gauge", "Status of the last http response.", func(st Stats, emit func(string, float64)) {
+		if st.Last.Status != 0 {
+			emit("", float64(st.Last.Status))
+		}
+	})
+	w.Write([]byte(b.String()))
+}
+
+// label escapes a label value for the text format
+var label = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
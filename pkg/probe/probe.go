@@ -0,0 +1,210 @@
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout is the longest a probe takes before it counts as lost
+const DefaultTimeout = 5 * time.Second
+
+// Kind is how a target is probed
+type Kind string
+
+const (
+	// TCP times a connect
+	TCP Kind = "tcp"
+	// TLS times a connect and a tls handshake
+	TLS Kind = "tls"
+	// HTTP times a connect, a tls handshake for https, and the first
+	// byte of the response to a GET
+	HTTP Kind = "http"
+)
+
+// Target is something to probe
+type Target struct {
+	// Name is the target as it was given, and labels its results
+	Name string
+	Kind Kind
+	// Addr is the host:port to connect to
+	Addr string
+	// URL is the url to get, for HTTP targets
+	URL string
+}
+
+// ParseTarget parses a target given as tcp://host:port, tls://host:port,
+// an http:// or https:// url, or a bare host:port for tcp
+func ParseTarget(s string) (Target, error) {
+	t := Target{Name: s}
+	if !strings.Contains(s, "://") {
+		s = "tcp://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return t, fmt.Errorf("probe: bad target %q", t.Name)
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case "tcp", "tls":
+		if port == "" {
+			return t, fmt.Errorf("probe: target %q has no port", t.Name)
+		}
+		t.Kind = Kind(u.Scheme)
+	case "http", "https":
+		t.Kind, t.URL = HTTP, u.String()
+		if port == "" {
+			port = "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+		}
+	default:
+		return t, fmt.Errorf("probe: bad target %q, want tcp, tls, http or https", t.Name)
+	}
+	t.Addr = net.JoinHostPort(u.Hostname(), port)
+	return t, nil
+}
+
+// Sample is the outcome of one probe. Phases that didn't happen are zero.
+type Sample struct {
+	Time time.Time
+	// Connect is how long the tcp connect took
+	Connect time.Duration
+	// TLS is how long the tls handshake took
+	TLS time.Duration
+	// TTFB is the time from the start of the probe to the first byte of
+	// the response, for HTTP targets
+	TTFB time.Duration
+	// Status is the response status, for HTTP targets
+	Status int
+	// Err is why the probe failed, in which case it counts as lost
+	Err error
+}
+
+// Prober probes targets. It makes ordinary connections, so it needs no
+// raw sockets or root, unlike ping.
+type Prober struct {
+	// Timeout is the longest a probe may take, DefaultTimeout if zero
+	Timeout time.Duration
+	// TLSConfig is used for handshakes, with the target's host as the
+	// ServerName if it has none
+	TLSConfig *tls.Config
+	// Dial makes the connections, a net.Dialer if nil
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Probe probes a target once
+func (p *Prober) Probe(ctx context.Context, t Target) Sample {
+	s := Sample{Time: time.Now()}
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if t.Kind == HTTP {
+		s.Err = p.probeHTTP(ctx, t, &s)
+		return s
+	}
+	conn, err := p.dial(ctx, t.Addr, &s)
+	if err != nil {
+		s.Err = err
+		return s
+	}
+	defer conn.Close()
+	if t.Kind == TLS {
+		start := time.Now()
+		deadline, _ := ctx.Deadline()
+		conn.SetDeadline(deadline)
+		tc := tls.Client(conn, p.tlsConfig(t.Addr))
+		if s.Err = tc.Handshake(); s.Err == nil {
+			s.TLS = time.Since(start)
+		}
+	}
+	return s
+}
+
+// dial connects to addr, timing it in s
+func (p *Prober) dial(ctx context.Context, addr string, s *Sample) (net.Conn, error) {
+	dial := p.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	start := time.Now()
+	conn, err := dial(ctx, "tcp", addr)
+	if err == nil {
+		s.Connect = time.Since(start)
+	}
+	return conn, err
+}
+
+func (p *Prober) tlsConfig(addr string) *tls.Config {
+	cfg := &tls.Config{}
+	if p.TLSConfig != nil {
+		cfg = p.TLSConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	return cfg
+}
+
+// probeHTTP gets t's url on a new connection, and times it in s. Error
+// statuses, 400 and up, fail the probe.
+func (p *Prober) probeHTTP(ctx context.Context, t Target, s *Sample) error {
+	start := time.Now()
+	var tlsStart time.Time
+	trace := &httptrace.ClientTrace{
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				s.TLS = time.Since(tlsStart)
+			}
+		},
+		GotFirstResponseByte: func() { s.TTFB = time.Since(start) },
+	}
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return p.dial(ctx, addr, s)
+		},
+		TLSClientConfig: p.TLSConfig,
+		// time a new connection every probe
+		DisableKeepAlives:  true,
+		DisableCompression: true,
+	}
+	defer tr.CloseIdleConnections()
+	client := &http.Client{
+		Transport: tr,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), "GET", t.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "net-tools-probe")
+	resp, err := client.Do(req)
+	if err != nil {
+		if ue, ok := err.(*url.Error); ok {
+			err = ue.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	s.Status = resp.StatusCode
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("probe: status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package probe_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/probe"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseTarget(t *testing.T) {
+	for s, want := range map[string]probe.Target{
+		"localhost:22":           {Kind: probe.TCP, Addr: "localhost:22"},
+		"tcp://[::1]:53":         {Kind: probe.TCP, Addr: "[::1]:53"},
+		"tls://example.com:8443": {Kind: probe.TLS, Addr: "example.com:8443"},
+		"http://example.com/up":  {Kind: probe.HTTP, Addr: "example.com:80", URL: "http://example.com/up"},
+		"https://example.com":    {Kind: probe.HTTP, Addr: "example.com:443", URL: "https://example.com"},
+	} {
+		want.Name = s
+		got, err := probe.ParseTarget(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("%s parsed as %+v, want %+v", s, got, want)
+		}
+	}
+	for _, bad := range []string{"localhost", "tls://example.com", "udp://example.com:53", "http://"} {
+		if _, err := probe.ParseTarget(bad); err == nil {
+			t.Fatalf("%q parsed", bad)
+		}
+	}
+}
+
+// target parses s, which is known to be good
+func target(t *testing.T, s string) probe.Target {
+	tg, err := probe.ParseTarget(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tg
+}
+
+func TestTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	p := &probe.Prober{}
+	s := p.Probe(context.Background(), target(t, addr))
+	if s.Err != nil || s.Connect <= 0 || s.TLS != 0 || s.TTFB != 0 || s.Time.IsZero() {
+		t.Fatalf("sample %+v", s)
+	}
+	ln.Close()
+	if s := p.Probe(context.Background(), target(t, addr)); s.Err == nil {
+		t.Fatalf("probe of a closed port succeeded")
+	}
+}
+
+func TestTLS(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	// the failed handshake is expected
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+	tg := target(t, "tls://"+srv.Listener.Addr().String())
+	// the test server's certificate isn't trusted
+	if s := (&probe.Prober{}).Probe(context.Background(), tg); s.Err == nil {
+		t.Fatalf("untrusted certificate accepted")
+	}
+	p := &probe.Prober{TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+	s := p.Probe(context.Background(), tg)
+	if s.Err != nil || s.Connect <= 0 || s.TLS <= 0 {
+		t.Fatalf("sample %+v", s)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		if r.URL.Path != "/up" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	p := &probe.Prober{}
+	s := p.Probe(context.Background(), target(t, srv.URL+"/up"))
+	if s.Err != nil || s.Status != 200 || s.Connect <= 0 || s.TLS != 0 {
+		t.Fatalf("sample %+v", s)
+	}
+	if s.TTFB < 50*time.Millisecond || s.TTFB > time.Second {
+		t.Fatalf("ttfb %v of a 50ms handler", s.TTFB)
+	}
+	if s := p.Probe(context.Background(), target(t, srv.URL+"/down")); s.Err == nil || s.Status != 404 {
+		t.Fatalf("404 sample %+v", s)
+	}
+}
+
+func TestHTTPS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	p := &probe.Prober{TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+	tg := target(t, srv.URL)
+	for i := 0; i < 2; i++ {
+		// a new connection and handshake every time
+		s := p.Probe(context.Background(), tg)
+		if s.Err != nil || s.Connect <= 0 || s.TLS <= 0 || s.TTFB < s.Connect+s.TLS {
+			t.Fatalf("sample %d %+v", i, s)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	p := &probe.Prober{
+		Timeout: 50 * time.Millisecond,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	start := time.Now()
+	s := p.Probe(context.Background(), target(t, "10.9.9.9:80"))
+	if !errors.Is(s.Err, context.DeadlineExceeded) || time.Since(start) > time.Second {
+		t.Fatalf("sample %+v after %v", s, time.Since(start))
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	ms := time.Millisecond
+	st := probe.Summarize(target(t, "localhost:1"), []probe.Sample{
+		{Connect: 10 * ms},
+		{Connect: 14 * ms},
+		{Err: errors.New("lost")},
+		{Connect: 12 * ms},
+		{Connect: 20 * ms, Err: errors.New("timed out later")},
+	})
+	if st.Sent != 5 || st.Lost != 2 || st.Loss != 0.4 {
+		t.Fatalf("sent %d lost %d loss %g", st.Sent, st.Lost, st.Loss)
+	}
+	// jitter is the mean of |14-10| and |12-14|
+	want := probe.Summary{Count: 3, Min: 10 * ms, Avg: 12 * ms, Max: 14 * ms, Jitter: 3 * ms, Last: 12 * ms}
+	if st.Connect != want {
+		t.Fatalf("connect %+v, want %+v", st.Connect, want)
+	}
+	if st.TLS.Count != 0 || st.Last.Err == nil {
+		t.Fatalf("stats %+v", st)
+	}
+}
+
+// monitor returns a monitor of a listener that closes every connection
+// it accepts, which it runs to completion
+func monitor(count, window int) (*probe.Monitor, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+	m, err := probe.NewMonitor(probe.Config{Interval: 5 * time.Millisecond, Count: count, Window: window},
+		[]string{ln.Addr().String(), "http://" + ln.Addr().String() + "/"})
+	if err != nil {
+		return nil, err
+	}
+	// the http target's probes fail, as nothing answers them
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	var n int32
+	m.OnSample = func(probe.Target, probe.Sample) { atomic.AddInt32(&n, 1) }
+	if err := m.Run(context.Background()); err != nil {
+		return nil, err
+	}
+	if n := int(n); n != 2*count {
+		return nil, fmt.Errorf("%d samples, want %d", n, 2*count)
+	}
+	return m, nil
+}
+
+func TestMonitor(t *testing.T) {
+	m, err := monitor(8, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := m.Stats()
+	if len(stats) != 2 {
+		t.Fatalf("%d stats", len(stats))
+	}
+	tcp, web := stats[0], stats[1]
+	// every probe is counted, but the stats cover the window
+	if tcp.Sent != 8 || tcp.Lost != 0 || tcp.Connect.Count != 5 || tcp.Loss != 0 {
+		t.Fatalf("tcp stats %+v", tcp)
+	}
+	if web.Sent != 8 || web.Lost != 8 || web.Loss != 1 || web.Last.Err == nil {
+		t.Fatalf("http stats %+v", web)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := m.Run(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("cancelled run returned %v", err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m, err := monitor(3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(rec.Body)
+	tcp := m.Targets[0].Name
+	for _, want := range []string{
+		"# TYPE probe_up gauge\n",
+		`probe_up{target="` + tcp + `",kind="tcp"} 1` + "\n",
+		`probe_sent_total{target="` + tcp + `",kind="tcp"} 3` + "\n",
+		`probe_loss_ratio{target="http://` + tcp + `/",kind="http"} 1` + "\n",
+		`probe_duration_seconds{target="` + tcp + `",kind="tcp",phase="connect",stat="avg"} `,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Fatalf("metrics missing %q:\n%s", want, body)
+		}
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("content type %q", ct)
+	}
+}
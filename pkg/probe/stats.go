@@ -0,0 +1,88 @@
+package probe
+
+import (
+	"time"
+)
+
+// Summary sums up the durations of one phase of the successful probes.
+// Jitter is the mean difference between consecutive ones.
+type Summary struct {
+	Count  int
+	Min    time.Duration
+	Avg    time.Duration
+	Max    time.Duration
+	Jitter time.Duration
+	Last   time.Duration
+}
+
+// Stats sums up the probes of a target. A Monitor counts every probe it
+// has made in Sent and Lost, and sums up the rest over its window.
+type Stats struct {
+	Target Target
+	Sent   int
+	Lost   int
+	// Loss is the share of the probes summed up that failed
+	Loss    float64
+	Connect Summary
+	TLS     Summary
+	TTFB    Summary
+	// Last is the latest probe
+	Last Sample
+}
+
+// Summarize returns the stats of samples
+func Summarize(t Target, samples []Sample) Stats {
+	st := Stats{Target: t}
+	var connect, hs, ttfb []time.Duration
+	for _, s := range samples {
+		st.Sent++
+		if s.Err != nil {
+			st.Lost++
+			continue
+		}
+		connect = append(connect, s.Connect)
+		if s.TLS > 0 {
+			hs = append(hs, s.TLS)
+		}
+		if s.TTFB > 0 {
+			ttfb = append(ttfb, s.TTFB)
+		}
+	}
+	if st.Sent > 0 {
+		st.Loss = float64(st.Lost) / float64(st.Sent)
+		st.Last = samples[len(samples)-1]
+	}
+	st.Connect = summarize(connect)
+	st.TLS = summarize(hs)
+	st.TTFB = summarize(ttfb)
+	return st
+}
+
+func summarize(ds []time.Duration) Summary {
+	if len(ds) == 0 {
+		return Summary{}
+	}
+	s := Summary{Count: len(ds), Min: ds[0], Max: ds[0], Last: ds[len(ds)-1]}
+	var sum, jitter time.Duration
+	for i, d := range ds {
+		sum += d
+		if d < s.Min {
+			s.Min = d
+		}
+		if d > s.Max {
+			s.Max = d
+		}
+		if i > 0 {
+			diff := d - ds[i-1]
+			if diff < 0 {
+				diff = -diff
+			}
+			jitter += diff
+		}
+	}
+	s.Avg = sum / time.Duration(len(ds))
+	if len(ds) > 1 {
+		s.Jitter = jitter / time.Duration(len(ds)-1)
+	}
+	return s
+}
@@ -0,0 +1,252 @@
+package proc
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultKillDelay is how long a command has to exit after it is asked
+// to stop, before it is killed
+const DefaultKillDelay = 5 * time.Second
+
+// maxLine is the longest line passed to a callback, longer ones are split
+const maxLine = 1 << 20
+
+// Cmd is a command to run. The command is started in its own process
+// group, so stopping it stops anything it started too.
+type Cmd struct {
+	Path string
+	Args []string
+	// Env is added to the environment of this process, or replaces it if
+	// ClearEnv is set. Entries are key=value.
+	Env      []string
+	ClearEnv bool
+	// Dir is the working directory, this process's if empty
+	Dir string
+	// Stdin is piped to the command, no input if nil
+	Stdin io.Reader
+	// Timeout stops the command if it runs longer, no limit if zero
+	Timeout time.Duration
+	// KillDelay is how long the command has to exit after SIGTERM, before
+	// it gets SIGKILL, DefaultKillDelay if zero
+	KillDelay time.Duration
+	// Stdout and Stderr are called with each line of output, without its
+	// line ending. Calls are never concurrent. Output is dropped if nil.
+	Stdout func(line string)
+	Stderr func(line string)
+}
+
+// Command returns a Cmd to run name with args
+func Command(name string, args ...string) *Cmd {
+	return &Cmd{Path: name, Args: args}
+}
+
+// Result is how a command ran
+type Result struct {
+	Pid int
+	// ExitCode is the exit status, or -1 if a signal ended the command
+	ExitCode int
+	// Signal is the signal that ended the command, if one did
+	Signal string
+	// TimedOut is set if the command was stopped for running past its
+	// Timeout
+	TimedOut bool
+	Duration time.Duration
+	Usage    Usage
+}
+
+// Usage is the resources a command and the children it waited for used
+type Usage struct {
+	User   time.Duration
+	System time.Duration
+	// MaxRSS is the peak resident set size in bytes
+	MaxRSS int64
+}
+
+// ExitError is returned when a command exits with a non-zero status or
+// is ended by a signal
+type ExitError struct {
+	*Result
+}
+
+func (e *ExitError) Error() string {
+	if e.Signal != "" {
+		return "proc: signal: " + e.Signal
+	}
+	return "proc: exit status " + strconv.Itoa(e.ExitCode)
+}
+
+// Run runs the command and waits for it and its output to finish. The
+// error is an *ExitError if it ran but failed, the context's error if it
+// was stopped because ctx ended or it timed out, and otherwise why it
+// didn't start, in which case the result is nil.
+//
+// A background child still holding the command's output open keeps Run
+// waiting until it exits, or ctx ends and the group is stopped.
+func (c *Cmd) Run(ctx context.Context) (*Result, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	cmd := exec.Command(c.Path, c.Args...)
+	cmd.Dir = c.Dir
+	cmd.Stdin = c.Stdin
+	if c.ClearEnv {
+		cmd.Env = append([]string{}, c.Env...)
+	} else if len(c.Env) > 0 {
+		cmd.Env = append(os.Environ(), c.Env...)
+	}
+	setGroup(cmd)
+
+	var mu sync.Mutex
+	var readers sync.WaitGroup
+	var files []*os.File
+	pipe := func(fn func(string)) (*os.File, error) {
+		if fn == nil {
+			return nil, nil
+		}
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, w)
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			defer r.Close()
+			readLines(r, func(line string) {
+				mu.Lock()
+				defer mu.Unlock()
+				fn(line)
+			})
+		}()
+		return w, nil
+	}
+	closeFiles := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	stdout, err := pipe(c.Stdout)
+	if err == nil {
+		var stderr *os.File
+		stderr, err = pipe(c.Stderr)
+		// a nil *os.File in an io.Writer isn't a nil writer
+		if stdout != nil {
+			cmd.Stdout = stdout
+		}
+		if stderr != nil {
+			cmd.Stderr = stderr
+		}
+	}
+	if err == nil {
+		err = cmd.Start()
+	}
+	// the command has its own copies of the write ends
+	closeFiles()
+	if err != nil {
+		readers.Wait()
+		return nil, err
+	}
+
+	res := &Result{Pid: cmd.Process.Pid}
+	start := time.Now()
+	exited := make(chan struct{})
+	stopped := make(chan struct{})
+	killed := false
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+		case <-exited:
+			return
+		}
+		killed = true
+		delay := c.KillDelay
+		if delay <= 0 {
+			delay = DefaultKillDelay
+		}
+		stopGroup(cmd, delay, exited)
+	}()
+	waitErr := cmd.Wait()
+	res.Duration = time.Since(start)
+	readers.Wait()
+	close(exited)
+	<-stopped
+
+	if cmd.ProcessState == nil {
+		return res, waitErr
+	}
+	res.ExitCode = cmd.ProcessState.ExitCode()
+	res.Signal = signal(cmd.ProcessState)
+	res.Usage = usage(cmd.ProcessState)
+	if killed {
+		err := ctx.Err()
+		res.TimedOut = err == context.DeadlineExceeded
+		return res, err
+	}
+	if res.ExitCode != 0 {
+		return res, &ExitError{res}
+	}
+	if waitErr != nil {
+		// e.g. copying stdin failed
+		return res, waitErr
+	}
+	return res, nil
+}
+
+// Output runs the command and returns its stdout, and its stderr if it
+// fails, each line ending with a newline
+func (c *Cmd) Output(ctx context.Context) (string, *Result, error) {
+	var out, errOut strings.Builder
+	cc := *c
+	cc.Stdout = func(line string) {
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	cc.Stderr = func(line string) {
+		errOut.WriteString(line)
+		errOut.WriteByte('\n')
+	}
+	res, err := cc.Run(ctx)
+	if err != nil && errOut.Len() > 0 {
+		err = fmt.Errorf("%w: %s", err, strings.TrimSpace(errOut.String()))
+	}
+	return out.String(), res, err
+}
+
+// readLines calls fn with each line read from r
+func readLines(r io.Reader, fn func(string)) {
+	br := bufio.NewReaderSize(r, 64<<10)
+	var long []byte
+	for {
+		line, err := br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			long = append(long, line...)
+			if len(long) >= maxLine {
+				fn(string(long))
+				long = long[:0]
+			}
+			continue
+		}
+		if len(long) > 0 {
+			line = append(long, line...)
+			long = long[:0]
+		}
+		if len(line) > 0 {
+			fn(strings.TrimRight(string(line), "\r\n"))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
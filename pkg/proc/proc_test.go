@@ -0,0 +1,264 @@
+//go:build !windows
+// +build !windows
+
+package proc_test
+
+import (
+	"context"
+	"errors"
+	"github.com/scottcagno/net-tools/pkg/proc"
+	"github.com/scottcagno/net-tools/pkg/tcp/client"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// sh returns a command that runs script with sh, collecting its output
+func sh(script string) (*proc.Cmd, *[]string, *[]string) {
+	var stdout, stderr []string
+	c := proc.Command("sh", "-c", script)
+	c.Stdout = func(line string) { stdout = append(stdout, line) }
+	c.Stderr = func(line string) { stderr = append(stderr, line) }
+	return c, &stdout, &stderr
+}
+
+func TestLines(t *testing.T) {
+	c, stdout, stderr := sh(`echo one; echo two >&2; printf 'three\r\nfour'; i=0; while [ $i -lt 200 ]; do echo $i; echo $i >&2; i=$((i+1)); done`)
+	res, err := c.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*stdout) != 202 || !reflect.DeepEqual((*stdout)[:3], []string{"one", "three", "four0"}) {
+		t.Fatalf("stdout %d lines, starting %q", len(*stdout), (*stdout)[:3])
+	}
+	if len(*stderr) != 201 || (*stderr)[0] != "two" || (*stderr)[200] != "199" {
+		t.Fatalf("stderr %d lines", len(*stderr))
+	}
+	if res.ExitCode != 0 || res.Signal != "" || res.Pid == 0 || res.Duration <= 0 || res.Usage.MaxRSS <= 0 {
+		t.Fatalf("result %+v", res)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	c, _, _ := sh("exit 3")
+	res, err := c.Run(context.Background())
+	var ee *proc.ExitError
+	if !errors.As(err, &ee) || ee.ExitCode != 3 || res.ExitCode != 3 {
+		t.Fatalf("exit 3 gave %v, %+v", err, res)
+	}
+	c, _, _ = sh("kill -KILL $$")
+	res, err = c.Run(context.Background())
+	if !errors.As(err, &ee) || res.ExitCode != -1 || res.Signal != "killed" || res.TimedOut {
+		t.Fatalf("killed gave %v, %+v", err, res)
+	}
+}
+
+func TestEnvDir(t *testing.T) {
+	dir, _ := filepath.EvalSymlinks(t.TempDir())
+	c, stdout, _ := sh(`echo "$PROC_CHECK"; pwd; echo "${HOME:-no home}"`)
+	c.Env = []string{"PROC_CHECK=yes"}
+	c.Dir = dir
+	if _, err := c.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"yes", dir, os.Getenv("HOME")}; !reflect.DeepEqual(*stdout, want) {
+		t.Fatalf("output %q, want %q", *stdout, want)
+	}
+	c, stdout, _ = sh(`echo "$PROC_CHECK"; echo "${HOME:-no home}"`)
+	c.Env = []string{"PROC_CHECK=only", "PATH=" + os.Getenv("PATH")}
+	c.ClearEnv = true
+	if _, err := c.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"only", "no home"}; !reflect.DeepEqual(*stdout, want) {
+		t.Fatalf("cleared env output %q, want %q", *stdout, want)
+	}
+}
+
+func TestStdin(t *testing.T) {
+	c, stdout, _ := sh("tr a-z A-Z")
+	c.Stdin = strings.NewReader("abc\ndef\n")
+	if _, err := c.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ABC", "DEF"}; !reflect.DeepEqual(*stdout, want) {
+		t.Fatalf("output %q, want %q", *stdout, want)
+	}
+	// no stdin reads as empty
+	c, stdout, _ = sh("cat; echo done")
+	if _, err := c.Run(context.Background()); err != nil || len(*stdout) != 1 {
+		t.Fatalf("output %q, %v", *stdout, err)
+	}
+}
+
+func TestLongLine(t *testing.T) {
+	c, stdout, _ := sh(`head -c 300000 /dev/zero | tr '\0' x; echo; echo end`)
+	if _, err := c.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(*stdout) != 2 || len((*stdout)[0]) != 300000 || (*stdout)[1] != "end" {
+		t.Fatalf("%d lines", len(*stdout))
+	}
+}
+
+// alive reports whether a process is still running. A zombie isn't, it
+// is only waiting for whoever inherited it to reap it.
+func alive(pid int) bool {
+	if stat, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat"); err == nil {
+		if i := strings.LastIndex(string(stat), ") "); i > 0 && i+2 < len(stat) {
+			return stat[i+2] != 'Z'
+		}
+	}
+	return syscall.Kill(pid, 0) == nil
+}
+
+func TestTimeoutGroup(t *testing.T) {
+	// the grandchild is in the group, and holds the output open
+	c, stdout, _ := sh("sleep 30 & echo $!; wait")
+	c.Timeout = 200 * time.Millisecond
+	start := time.Now()
+	res, err := c.Run(context.Background())
+	if err != context.DeadlineExceeded || !res.TimedOut || res.Signal != "terminated" {
+		t.Fatalf("timed out run gave %v, %+v", err, res)
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Fatalf("took %v", took)
+	}
+	if len(*stdout) != 1 {
+		t.Fatalf("output %q", *stdout)
+	}
+	pid, _ := strconv.Atoi((*stdout)[0])
+	if pid == 0 {
+		t.Fatalf("output %q", *stdout)
+	}
+	// the signal is sent, but the grandchild may take a moment to die
+	for i := 0; alive(pid); i++ {
+		if i == 100 {
+			t.Fatalf("grandchild %d still running", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKillDelay(t *testing.T) {
+	// ignored signals stay ignored in the children
+	c, _, _ := sh(`trap "" TERM; sleep 30`)
+	c.Timeout = 100 * time.Millisecond
+	c.KillDelay = 200 * time.Millisecond
+	start := time.Now()
+	res, err := c.Run(context.Background())
+	took := time.Since(start)
+	if err != context.DeadlineExceeded || res.Signal != "killed" {
+		t.Fatalf("run gave %v, %+v", err, res)
+	}
+	if took < 300*time.Millisecond || took > 2*time.Second {
+		t.Fatalf("killed after %v, want about 300ms", took)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	c, _, _ := sh("sleep 30")
+	res, err := c.Run(ctx)
+	if err != context.Canceled || res.TimedOut {
+		t.Fatalf("cancelled run gave %v, %+v", err, res)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	res, err := proc.Command("/no/such/command").Run(context.Background())
+	if err == nil || res != nil {
+		t.Fatalf("missing command gave %v, %+v", err, res)
+	}
+}
+
+func TestOutput(t *testing.T) {
+	out, res, err := proc.Command("sh", "-c", "echo a; echo b").Output(context.Background())
+	if err != nil || out != "a\nb\n" || res.ExitCode != 0 {
+		t.Fatalf("output %q, %v", out, err)
+	}
+	_, _, err = proc.Command("sh", "-c", "echo bad thing >&2; exit 2").Output(context.Background())
+	var ee *proc.ExitError
+	if !errors.As(err, &ee) || ee.ExitCode != 2 || !strings.HasSuffix(err.Error(), ": bad thing") {
+		t.Fatalf("failed output gave %v", err)
+	}
+}
+
+// quiet is a supervisor log that drops everything
+var quiet = log.New(ioutil.Discard, "", 0)
+
+func TestSupervisorRestarts(t *testing.T) {
+	dir := t.TempDir()
+	// fails twice, then exits cleanly
+	c, _, _ := sh(`n=$(cat count 2>/dev/null || echo 0); n=$((n+1)); echo $n > count; [ $n -ge 3 ]`)
+	c.Dir = dir
+	var codes []int
+	s := &proc.Supervisor{
+		Cmd:      c,
+		Backoff:  client.Backoff{Min: 10 * time.Millisecond},
+		OnExit:   func(res *proc.Result, err error) { codes = append(codes, res.ExitCode) },
+		ErrorLog: quiet,
+	}
+	start := time.Now()
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{1, 1, 0}; !reflect.DeepEqual(codes, want) {
+		t.Fatalf("exit codes %v, want %v", codes, want)
+	}
+	// waits of 10ms then 20ms
+	if took := time.Since(start); took < 30*time.Millisecond {
+		t.Fatalf("restarted without backing off, in %v", took)
+	}
+}
+
+func TestSupervisorGivesUp(t *testing.T) {
+	runs := 0
+	c, _, _ := sh("exit 1")
+	s := &proc.Supervisor{
+		Cmd:         c,
+		Backoff:     client.Backoff{Min: time.Millisecond, Max: 2 * time.Millisecond},
+		MaxRestarts: 3,
+		OnExit:      func(*proc.Result, error) { runs++ },
+		ErrorLog:    quiet,
+	}
+	err := s.Run(context.Background())
+	var ee *proc.ExitError
+	if !errors.As(err, &ee) || runs != 4 {
+		t.Fatalf("gave %v after %d runs, want 4", err, runs)
+	}
+	// a missing command counts as a crash
+	s.Cmd, runs = proc.Command("/no/such/command"), 0
+	if err := s.Run(context.Background()); err == nil || runs != 4 {
+		t.Fatalf("missing command gave %v after %d runs", err, runs)
+	}
+}
+
+func TestSupervisorCancel(t *testing.T) {
+	runs := 0
+	c, _, _ := sh("sleep 0.05")
+	s := &proc.Supervisor{
+		Cmd:      c,
+		Backoff:  client.Backoff{Min: time.Millisecond},
+		Always:   true,
+		OnExit:   func(*proc.Result, error) { runs++ },
+		ErrorLog: quiet,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := s.Run(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("run gave %v", err)
+	}
+	if took := time.Since(start); runs < 2 || took > 2*time.Second {
+		t.Fatalf("%d runs in %v, want clean exits restarted", runs, took)
+	}
+}
@@ -0,0 +1,56 @@
+//go:build !windows
+// +build !windows
+
+package proc
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// setGroup starts the command in a new process group, with the same id
+// as its pid
+func setGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// stopGroup sends SIGTERM to the command's process group, and SIGKILL if
+// it hasn't finished by the time delay is up
+func stopGroup(cmd *exec.Cmd, delay time.Duration, exited <-chan struct{}) {
+	pgid := cmd.Process.Pid
+	syscall.Kill(-pgid, syscall.SIGTERM)
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-exited:
+	case <-t.C:
+		syscall.Kill(-pgid, syscall.SIGKILL)
+	}
+}
+
+func signal(ps *os.ProcessState) string {
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return ws.Signal().String()
+	}
+	return ""
+}
+
+func usage(ps *os.ProcessState) Usage {
+	ru, ok := ps.SysUsage().(*syscall.Rusage)
+	if !ok || ru == nil {
+		return Usage{}
+	}
+	u := Usage{
+		User:   time.Duration(ru.Utime.Nano()),
+		System: time.Duration(ru.Stime.Nano()),
+		MaxRSS: int64(ru.Maxrss),
+	}
+	// darwin counts bytes, the rest kilobytes
+	if runtime.GOOS != "darwin" {
+		u.MaxRSS *= 1024
+	}
+	return u
+}
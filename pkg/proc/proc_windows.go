@@ -0,0 +1,27 @@
+//go:build windows
+// +build windows
+
+package proc
+
+import (
+	"os"
+	"os/exec"
+	"time"
+)
+
+// setGroup does nothing, windows has no process groups to signal
+func setGroup(cmd *exec.Cmd) {}
+
+// stopGroup kills the command, there being no way to ask it to stop or to
+// reach its children
+func stopGroup(cmd *exec.Cmd, delay time.Duration, exited <-chan struct{}) {
+	cmd.Process.Kill()
+}
+
+func signal(ps *os.ProcessState) string {
+	return ""
+}
+
+func usage(ps *os.ProcessState) Usage {
+	return Usage{User: ps.UserTime(), System: ps.SystemTime()}
+}
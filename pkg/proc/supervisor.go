@@ -0,0 +1,91 @@
+package proc
+
+import (
+	"context"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/tcp/client"
+	"log"
+	"time"
+)
+
+// DefaultResetAfter is how long a run has to last for a supervisor to
+// stop counting it as one of a run of crashes
+const DefaultResetAfter = time.Minute
+
+// Supervisor runs a command and restarts it when it crashes, waiting
+// longer after each crash in a row so a command that can't start doesn't
+// spin.
+type Supervisor struct {
+	Cmd *Cmd
+	// Backoff is the wait before each restart, client.DefaultBackoff if
+	// zero
+	Backoff client.Backoff
+	// ResetAfter is how long a run has to last to start the backoff over,
+	// DefaultResetAfter if zero
+	ResetAfter time.Duration
+	// MaxRestarts is how many crashes in a row to restart after before
+	// giving up, no limit if zero
+	MaxRestarts int
+	// Always restarts the command after it exits cleanly too
+	Always bool
+	// OnExit is called after each run, if set, with what Cmd.Run returned
+	OnExit func(res *Result, err error)
+	// ErrorLog logs restarts, the log package's standard logger if nil
+	ErrorLog *log.Logger
+}
+
+// Run runs the command until it exits cleanly, or for good if Always is
+// set. It returns nil after a clean exit, the context's error when ctx
+// ends, or the last error once MaxRestarts crashes in a row are used up.
+func (s *Supervisor) Run(ctx context.Context) error {
+	backoff := s.Backoff
+	if backoff == (client.Backoff{}) {
+		backoff = client.DefaultBackoff
+	}
+	resetAfter := s.ResetAfter
+	if resetAfter <= 0 {
+		resetAfter = DefaultResetAfter
+	}
+	crashes := 0
+	for {
+		start := time.Now()
+		res, err := s.Cmd.Run(ctx)
+		if s.OnExit != nil {
+			s.OnExit(res, err)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil && !s.Always {
+			return nil
+		}
+		if err == nil || time.Since(start) >= resetAfter {
+			crashes = 0
+		}
+		if err != nil && s.MaxRestarts > 0 && crashes >= s.MaxRestarts {
+			return fmt.Errorf("proc: gave up on %s after %d restarts: %w", s.Cmd.Path, crashes, err)
+		}
+		wait := backoff.Duration(crashes)
+		if err != nil {
+			crashes++
+			s.logf("proc: %s failed: %v, restarting in %v", s.Cmd.Path, err, wait)
+		} else {
+			s.logf("proc: %s exited, restarting in %v", s.Cmd.Path, wait)
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *Supervisor) logf(format string, v ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
@@ -0,0 +1,169 @@
+package scan
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// maxBanner is the longest banner kept
+const maxBanner = 256
+
+// Probe finds out what service is on an open port. Run is given what the
+// service said first, empty if it waited for the client, and returns
+// the service and a banner, or false if it doesn't apply or the service
+// didn't answer as expected. Probes are tried in order until one does.
+type Probe struct {
+	Name string
+	Run  func(conn net.Conn, r *bufio.Reader, host, greeting string) (service, banner string, ok bool)
+}
+
+var probes = map[string]Probe{
+	"http": {Name: "http", Run: probeHTTP},
+	"smtp": {Name: "smtp", Run: probeSMTP},
+	"ssh":  {Name: "ssh", Run: probeSSH},
+}
+
+// grab reads the banner of an open port, then runs the probes. A service
+// that waits for the client costs a full BannerTimeout before the probes
+// run.
+func (s *Scanner) grab(ctx context.Context, conn net.Conn, host string) (service, banner string) {
+	timeout := s.BannerTimeout
+	if timeout <= 0 {
+		timeout = DefaultBannerTimeout
+	}
+	// unblock reads and writes if the scan is cancelled
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	r := bufio.NewReaderSize(conn, 1024)
+	conn.SetDeadline(time.Now().Add(timeout))
+	greeting, _ := readLine(r)
+	for _, p := range s.Probes {
+		if ctx.Err() != nil {
+			break
+		}
+		conn.SetDeadline(time.Now().Add(timeout))
+		if service, banner, ok := p.Run(conn, r, host, greeting); ok {
+			return service, clean(banner)
+		}
+	}
+	if strings.HasPrefix(greeting, "SSH-") {
+		service = "ssh"
+	}
+	return service, clean(greeting)
+}
+
+// probeHTTP sends a HEAD request to services that wait for the client,
+// and returns the status line and Server header of the response
+func probeHTTP(conn net.Conn, r *bufio.Reader, host, greeting string) (string, string, bool) {
+	if greeting != "" {
+		return "", "", false
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	_, err := conn.Write([]byte("HEAD / HTTP/1.0\r\nHost: " + host +
+		"\r\nUser-Agent: net-tools-scan\r\nConnection: close\r\n\r\n"))
+	if err != nil {
+		return "", "", false
+	}
+	status, err := readLine(r)
+	if !strings.HasPrefix(status, "HTTP/") {
+		return "", "", false
+	}
+	banner := status
+	for err == nil {
+		var line string
+		if line, err = readLine(r); line == "" {
+			break
+		}
+		if i := strings.Index(line, ":"); i > 0 && strings.EqualFold(line[:i], "Server") {
+			banner += "; Server: " + strings.TrimSpace(line[i+1:])
+		}
+	}
+	return "http", banner, true
+}
+
+// probeSMTP says EHLO to services that greet with 220, and returns the
+// greeting and the extensions the server supports
+func probeSMTP(conn net.Conn, r *bufio.Reader, host, greeting string) (string, string, bool) {
+	if !strings.HasPrefix(greeting, "220") {
+		return "", "", false
+	}
+	// the rest of a multi line greeting
+	line := greeting
+	for len(line) > 3 && line[3] == '-' {
+		var err error
+		if line, err = readLine(r); err != nil {
+			return "", "", false
+		}
+	}
+	if _, err := conn.Write([]byte("EHLO net-tools-scan\r\n")); err != nil {
+		return "", "", false
+	}
+	var exts []string
+	for first := true; ; first = false {
+		line, err := readLine(r)
+		if err != nil || !strings.HasPrefix(line, "250") {
+			return "", "", false
+		}
+		if !first && len(line) > 4 {
+			if f := strings.Fields(line[4:]); len(f) > 0 {
+				exts = append(exts, f[0])
+			}
+		}
+		if len(line) < 4 || line[3] != '-' {
+			break
+		}
+	}
+	conn.Write([]byte("QUIT\r\n"))
+	banner := greeting
+	if len(exts) > 0 {
+		banner += "; EHLO " + strings.Join(exts, " ")
+	}
+	return "smtp", banner, true
+}
+
+// probeSSH answers an ssh server's version with its own, so the server
+// logs a client that went away rather than a protocol error
+func probeSSH(conn net.Conn, r *bufio.Reader, host, greeting string) (string, string, bool) {
+	if !strings.HasPrefix(greeting, "SSH-") {
+		return "", "", false
+	}
+	conn.Write([]byte("SSH-2.0-net-tools-scan\r\n"))
+	return "ssh", greeting, true
+}
+
+// readLine reads a line without its line ending, or as much of one as
+// fits in the buffer or came in before an error
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		err = nil
+	}
+	return strings.TrimRight(string(line), "\r\n"), err
+}
+
+// clean makes a banner printable and cuts it down to maxBanner
+func clean(s string) string {
+	b := []byte(strings.TrimSpace(s))
+	if len(b) > maxBanner {
+		b = b[:maxBanner]
+	}
+	for i, c := range b {
+		if c < ' ' || c > '~' {
+			b[i] = '.'
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,248 @@
+package scan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultTimeout is the longest a scanner waits for a connection
+	DefaultTimeout = 2 * time.Second
+	// DefaultBannerTimeout is the longest a scanner waits for a service
+	// to say something, or answer a probe
+	DefaultBannerTimeout = 2 * time.Second
+	// DefaultConcurrency is the most connections a scanner has open at
+	// once
+	DefaultConcurrency = 100
+)
+
+// State is what a scan found on a port
+type State int
+
+const (
+	// Closed ports refused the connection
+	Closed State = iota
+	// Open ports accepted it
+	Open
+	// Filtered ports didn't answer in time, likely because of a firewall
+	Filtered
+	// Failed ports couldn't be tried, e.g. the host name didn't resolve
+	// or there is no route to the host
+	Failed
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case Filtered:
+		return "filtered"
+	case Failed:
+		return "failed"
+	}
+	return "State(" + strconv.Itoa(int(s)) + ")"
+}
+
+// MarshalText lets a State be written as its name, e.g. in json
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Result is the outcome of scanning one port
+type Result struct {
+	Host  string
+	Port  int
+	State State
+	// Latency is how long the connection took, or failed after
+	Latency time.Duration
+	// Service is the protocol the banner or a probe identified, if any
+	Service string
+	// Banner is what the service said, cleaned up to one line
+	Banner string
+	// Err is why a Failed port failed
+	Err error
+}
+
+// Config holds the settings for a Scanner. The tags let it be filled in
+// by pkg/config.
+type Config struct {
+	Timeout       time.Duration `config:"timeout" default:"2s" usage:"max duration to wait for a connection"`
+	Concurrency   int           `config:"concurrency" default:"100" usage:"max connections open at once"`
+	Rate          float64       `config:"rate" usage:"max connections started per second, 0 for no limit"`
+	Banner        bool          `config:"banner" usage:"read a banner from open ports"`
+	BannerTimeout time.Duration `config:"banner-timeout" default:"2s" usage:"max duration to wait for a banner or a probe's answer"`
+	Probes        []string      `config:"probes" usage:"probes to send to open ports that say nothing or greet: http, smtp, ssh"`
+}
+
+// Scanner is a TCP connect scanner. It only makes full connections, so
+// it needs no special privileges, and with Banner set it reads what open
+// ports say and can probe them to find out what they are.
+type Scanner struct {
+	// Timeout is the longest to wait for a connection, DefaultTimeout if
+	// zero
+	Timeout time.Duration
+	// Concurrency is the most connections open at once,
+	// DefaultConcurrency if zero
+	Concurrency int
+	// Rate is the most connections started per second, no limit if zero
+	Rate float64
+	// Banner makes the scanner read a banner from open ports
+	Banner bool
+	// BannerTimeout is the longest to wait for a banner or an answer to
+	// a probe, DefaultBannerTimeout if zero
+	BannerTimeout time.Duration
+	// Probes are sent to open ports, when Banner is set
+	Probes []Probe
+	// Dial makes the connections, a net.Dialer if nil
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// NewScanner returns a new Scanner using the settings in cfg
+func NewScanner(cfg Config) (*Scanner, error) {
+	s := &Scanner{
+		Timeout:       cfg.Timeout,
+		Concurrency:   cfg.Concurrency,
+		Rate:          cfg.Rate,
+		Banner:        cfg.Banner || len(cfg.Probes) > 0,
+		BannerTimeout: cfg.BannerTimeout,
+	}
+	for _, name := range cfg.Probes {
+		p, ok := probes[name]
+		if !ok {
+			return nil, fmt.Errorf("scan: unknown probe %q, want http, smtp or ssh", name)
+		}
+		s.Probes = append(s.Probes, p)
+	}
+	return s, nil
+}
+
+// Scan scans every port of every host, and calls fn with each result as
+// it comes in. Calls to fn are not concurrent. Hosts are scanned in turn
+// for each port, so the load is spread across them. It returns early
+// with the context's error if ctx is done.
+func (s *Scanner) Scan(ctx context.Context, hosts []string, ports []int, fn func(Result)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type job struct {
+		host string
+		port int
+	}
+	jobs := make(chan job)
+	go func() {
+		defer close(jobs)
+		start, i := time.Now(), 0
+		for _, port := range ports {
+			for _, host := range hosts {
+				if s.Rate > 0 {
+					at := start.Add(time.Duration(float64(i) * float64(time.Second) / s.Rate))
+					if !sleep(ctx, time.Until(at)) {
+						return
+					}
+					i++
+				}
+				select {
+				case jobs <- job{host, port}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	results := make(chan Result)
+	var wg sync.WaitGroup
+	workers := s.Concurrency
+	if workers <= 0 {
+		workers = DefaultConcurrency
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				r := s.ScanPort(ctx, j.host, j.port)
+				if ctx.Err() != nil {
+					// the result may be down to the cancel
+					return
+				}
+				results <- r
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	for r := range results {
+		fn(r)
+	}
+	return ctx.Err()
+}
+
+// ScanPort scans a single port
+func (s *Scanner) ScanPort(ctx context.Context, host string, port int) Result {
+	r := Result{Host: host, Port: port}
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	dctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	dial := s.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	start := time.Now()
+	conn, err := dial(dctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	r.Latency = time.Since(start)
+	if err != nil {
+		r.State = stateFor(err)
+		if r.State == Failed {
+			r.Err = err
+		}
+		return r
+	}
+	defer conn.Close()
+	r.State = Open
+	if s.Banner {
+		r.Service, r.Banner = s.grab(ctx, conn, host)
+	}
+	return r
+}
+
+// stateFor returns the state of a port that couldn't be connected to
+func stateFor(err error) State {
+	var ne net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return Closed
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &ne) && ne.Timeout():
+		return Filtered
+	}
+	return Failed
+}
+
+// sleep sleeps for d, and reports whether ctx is still going
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,349 @@
+package scan_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/scottcagno/net-tools/pkg/scan"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestExpandHosts(t *testing.T) {
+	for _, c := range []struct {
+		specs []string
+		want  []string
+	}{
+		{[]string{"10.0.0.0/30"}, []string{"10.0.0.0", "10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		{[]string{"10.0.0.254-10.0.1.1"}, []string{"10.0.0.254", "10.0.0.255", "10.0.1.0", "10.0.1.1"}},
+		{[]string{"192.168.1.5-7", "192.168.1.6"}, []string{"192.168.1.5", "192.168.1.6", "192.168.1.7"}},
+		{[]string{"fd00::/127"}, []string{"fd00::", "fd00::1"}},
+		{[]string{"my-host.local", "127.0.0.1"}, []string{"my-host.local", "127.0.0.1"}},
+	} {
+		got, err := scan.ExpandHosts(c.specs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Fatalf("%v expanded to %v, want %v", c.specs, got, c.want)
+		}
+	}
+	for _, bad := range []string{"10.0.0.0/8", "10.0.0.9-3", "10.0.0.1-::1", "10.0.0.0/33", "a b"} {
+		if _, err := scan.ExpandHosts([]string{bad}); err == nil {
+			t.Fatalf("%q expanded", bad)
+		}
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	got, err := scan.ParsePorts("8002, 22,8000-8002,80,22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{22, 80, 8000, 8001, 8002}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("ports %v, want %v", got, want)
+	}
+	if all, err := scan.ParsePorts("-"); err != nil || len(all) != 65535 {
+		t.Fatalf("all ports: %d, %v", len(all), err)
+	}
+	if _, err := scan.ParsePorts(scan.DefaultPorts); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{"0", "65536", "10-5", "http", ""} {
+		if _, err := scan.ParsePorts(bad); err == nil {
+			t.Fatalf("%q parsed", bad)
+		}
+	}
+}
+
+// listen starts a loopback listener that runs fn on each connection, and
+// returns its port
+func listen(fn func(net.Conn)) (int, func(), error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, nil, err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				fn(conn)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, func() { ln.Close() }, nil
+}
+
+// closedPort returns a loopback port nothing listens on
+func closedPort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+// scanAll scans and returns the results by port
+func scanAll(s *scan.Scanner, hosts []string, ports []int) (map[int]scan.Result, error) {
+	got := make(map[int]scan.Result)
+	err := s.Scan(context.Background(), hosts, ports, func(r scan.Result) {
+		got[r.Port] = r
+	})
+	return got, err
+}
+
+func TestOpenClosed(t *testing.T) {
+	open, done, err := listen(func(net.Conn) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	closed, err := closedPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := scanAll(&scan.Scanner{Timeout: time.Second}, []string{"127.0.0.1"}, []int{open, closed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := got[open]; r.State != scan.Open || r.Host != "127.0.0.1" || r.Latency <= 0 {
+		t.Fatalf("open port %+v", r)
+	}
+	if r := got[closed]; r.State != scan.Closed {
+		t.Fatalf("closed port %+v", r)
+	}
+}
+
+func TestFilteredFailed(t *testing.T) {
+	s := &scan.Scanner{
+		Timeout: 50 * time.Millisecond,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if strings.HasSuffix(addr, ":1") {
+				// a firewall dropping the syn
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.EHOSTUNREACH}
+		},
+	}
+	start := time.Now()
+	got, err := scanAll(s, []string{"10.9.9.9"}, []int{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := got[1]; r.State != scan.Filtered || r.Err != nil {
+		t.Fatalf("filtered port %+v", r)
+	}
+	if r := got[2]; r.State != scan.Failed || !errors.Is(r.Err, syscall.EHOSTUNREACH) {
+		t.Fatalf("failed port %+v", r)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("timeout not kept, took %v", took)
+	}
+}
+
+func TestBanner(t *testing.T) {
+	port, done, err := listen(func(conn net.Conn) {
+		conn.Write([]byte("* OK [\x01\x02] IMAP4rev1 ready\r\n"))
+		time.Sleep(time.Second)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	s := &scan.Scanner{Banner: true, BannerTimeout: time.Second}
+	r := s.ScanPort(context.Background(), "127.0.0.1", port)
+	if r.State != scan.Open || r.Banner != "* OK [..] IMAP4rev1 ready" || r.Service != "" {
+		t.Fatalf("result %+v", r)
+	}
+}
+
+// probe returns a scanner that runs the named probes
+func probe(names ...string) (*scan.Scanner, error) {
+	return scan.NewScanner(scan.Config{Probes: names, BannerTimeout: 200 * time.Millisecond})
+}
+
+func TestProbeHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "check/1.0")
+		if r.Method != "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer srv.Close()
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+	s, err := probe("smtp", "ssh", "http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := s.ScanPort(context.Background(), "127.0.0.1", port)
+	if r.Service != "http" || !strings.Contains(r.Banner, " 200 OK") || !strings.HasSuffix(r.Banner, "; Server: check/1.0") {
+		t.Fatalf("result %+v", r)
+	}
+	if _, err := probe("gopher"); err == nil {
+		t.Fatalf("unknown probe allowed")
+	}
+}
+
+func TestProbeSMTP(t *testing.T) {
+	quit := make(chan bool, 1)
+	port, done, err := listen(func(conn net.Conn) {
+		conn.Write([]byte("220-mail.example.com ESMTP\r\n220 ready\r\n"))
+		r := bufio.NewReader(conn)
+		if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "EHLO ") {
+			conn.Write([]byte("500 what\r\n"))
+			return
+		}
+		conn.Write([]byte("250-mail.example.com\r\n250-PIPELINING\r\n250-SIZE 10240000\r\n250 STARTTLS\r\n"))
+		line, _ := r.ReadString('\n')
+		quit <- line == "QUIT\r\n"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	s, err := probe("http", "smtp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := s.ScanPort(context.Background(), "127.0.0.1", port)
+	if r.Service != "smtp" || r.Banner != "220-mail.example.com ESMTP; EHLO PIPELINING SIZE STARTTLS" {
+		t.Fatalf("result %+v", r)
+	}
+	select {
+	case ok := <-quit:
+		if !ok {
+			t.Fatalf("no QUIT sent")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no QUIT sent")
+	}
+}
+
+func TestProbeSSH(t *testing.T) {
+	ident := make(chan string, 1)
+	port, done, err := listen(func(conn net.Conn) {
+		conn.Write([]byte("SSH-2.0-OpenSSH_9.6 Ubuntu\r\n"))
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		ident <- line
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	// the version is known from the banner alone
+	r := (&scan.Scanner{Banner: true, BannerTimeout: time.Second}).ScanPort(context.Background(), "127.0.0.1", port)
+	if r.Service != "ssh" || r.Banner != "SSH-2.0-OpenSSH_9.6 Ubuntu" {
+		t.Fatalf("result without probe %+v", r)
+	}
+	<-ident
+	s, err := probe("ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := s.ScanPort(context.Background(), "127.0.0.1", port); r.Service != "ssh" {
+		t.Fatalf("result %+v", r)
+	}
+	if line := <-ident; !strings.HasPrefix(line, "SSH-2.0-") {
+		t.Fatalf("client version %q", line)
+	}
+}
+
+// refuse is a dial that refuses every connection at once
+func refuse(ctx context.Context, network, addr string) (net.Conn, error) {
+	return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+}
+
+func TestRate(t *testing.T) {
+	ports := make([]int, 21)
+	for i := range ports {
+		ports[i] = 1000 + i
+	}
+	s := &scan.Scanner{Rate: 100, Dial: refuse}
+	start := time.Now()
+	n := 0
+	err := s.Scan(context.Background(), []string{"127.0.0.1"}, ports, func(r scan.Result) { n++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 21 connections at 100 a second take 200ms
+	if took := time.Since(start); took < 190*time.Millisecond || took > time.Second {
+		t.Fatalf("21 ports at 100/s took %v", took)
+	}
+	if n != 21 {
+		t.Fatalf("%d results", n)
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, most := 0, 0
+	s := &scan.Scanner{
+		Concurrency: 5,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			mu.Lock()
+			inFlight++
+			if inFlight > most {
+				most = inFlight
+			}
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			return refuse(ctx, network, addr)
+		},
+	}
+	hosts, err := scan.ExpandHosts([]string{"10.0.0.1-10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	err = s.Scan(context.Background(), hosts, []int{22, 80, 443, 8080}, func(r scan.Result) {
+		seen[r.Host+":"+strconv.Itoa(r.Port)] = true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 40 {
+		t.Fatalf("%d results, want 40", len(seen))
+	}
+	if most != 5 {
+		t.Fatalf("%d connections at once, want 5", most)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &scan.Scanner{
+		Concurrency: 2,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	time.AfterFunc(50*time.Millisecond, cancel)
+	ports, _ := scan.ParsePorts("1-1000")
+	start := time.Now()
+	n := 0
+	err := s.Scan(ctx, []string{"127.0.0.1"}, ports, func(scan.Result) { n++ })
+	if err != context.Canceled {
+		t.Fatalf("scan returned %v", err)
+	}
+	if took := time.Since(start); took > time.Second || n != 0 {
+		t.Fatalf("stopped after %v with %d results", took, n)
+	}
+}
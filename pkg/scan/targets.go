@@ -0,0 +1,172 @@
+package scan
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MaxHosts is the most hosts ExpandHosts will return, so a typo like /8
+// fails rather than scanning for a week
+const MaxHosts = 1 << 16
+
+// DefaultPorts are common service ports, scanned when none are given
+const DefaultPorts = "21-23,25,53,80,110,111,135,139,143,443,445,465,587,993,995," +
+	"1433,1521,2049,3306,3389,5432,5900,6379,8000,8080,8443,9200,11211,27017"
+
+// ExpandHosts expands host specs into a list of hosts. A spec is an IP,
+// a CIDR like 10.0.0.0/24, a range like 10.0.0.1-10.0.0.20 or its short
+// form 10.0.0.1-20, or a host name. Duplicates are dropped, and the order
+// of the specs is kept.
+func ExpandHosts(specs []string) ([]string, error) {
+	var hosts []string
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		ips, err := expand(spec)
+		if err != nil {
+			return nil, err
+		}
+		if ips == nil {
+			// a host name
+			if strings.ContainsAny(spec, " /:") {
+				return nil, fmt.Errorf("scan: bad host %q", spec)
+			}
+			ips = []string{spec}
+		}
+		for _, h := range ips {
+			if seen[h] {
+				continue
+			}
+			if len(hosts) == MaxHosts {
+				return nil, fmt.Errorf("scan: more than %d hosts", MaxHosts)
+			}
+			seen[h] = true
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts, nil
+}
+
+// expand expands a single IP, CIDR or range, or returns nil if spec is
+// none of those
+func expand(spec string) ([]string, error) {
+	if strings.Contains(spec, "/") {
+		ip, ipnet, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, fmt.Errorf("scan: bad cidr %q", spec)
+		}
+		ones, bits := ipnet.Mask.Size()
+		if bits-ones > 16 {
+			return nil, fmt.Errorf("scan: cidr %q has more than %d hosts", spec, MaxHosts)
+		}
+		first := ipnet.IP
+		if ip.To4() != nil {
+			first = first.To4()
+		}
+		last := make(net.IP, len(first))
+		for i := range first {
+			last[i] = first[i] | ^ipnet.Mask[i]
+		}
+		return ipRange(first, last)
+	}
+	if ip := net.ParseIP(spec); ip != nil {
+		return []string{ip.String()}, nil
+	}
+	i := strings.LastIndex(spec, "-")
+	if i < 0 {
+		return nil, nil
+	}
+	first := net.ParseIP(spec[:i])
+	if first == nil {
+		// a host name with a dash in it
+		return nil, nil
+	}
+	if last := net.ParseIP(spec[i+1:]); last != nil {
+		if (first.To4() == nil) != (last.To4() == nil) {
+			return nil, fmt.Errorf("scan: bad range %q, mixes ipv4 and ipv6", spec)
+		}
+		if first.To4() != nil {
+			first, last = first.To4(), last.To4()
+		}
+		return ipRange(first, last)
+	}
+	// the short form, with only the last octet of the end
+	n, err := strconv.Atoi(spec[i+1:])
+	first = first.To4()
+	if err != nil || first == nil || n < int(first[3]) || n > 255 {
+		return nil, fmt.Errorf("scan: bad range %q", spec)
+	}
+	last := append(net.IP(nil), first...)
+	last[3] = byte(n)
+	return ipRange(first, last)
+}
+
+// ipRange lists the ips from first to last, which are the same length
+func ipRange(first, last net.IP) ([]string, error) {
+	if bytes.Compare(first, last) > 0 {
+		return nil, fmt.Errorf("scan: bad range %s-%s", first, last)
+	}
+	var ips []string
+	ip := append(net.IP(nil), first...)
+	for {
+		if len(ips) == MaxHosts {
+			return nil, fmt.Errorf("scan: range %s-%s has more than %d hosts", first, last, MaxHosts)
+		}
+		ips = append(ips, ip.String())
+		if ip.Equal(last) {
+			return ips, nil
+		}
+		for i := len(ip) - 1; i >= 0; i-- {
+			ip[i]++
+			if ip[i] != 0 {
+				break
+			}
+		}
+	}
+}
+
+// ParsePorts parses a list of ports and ranges like 22,80,8000-8100 into
+// sorted ports without duplicates. A bare - is every port.
+func ParsePorts(spec string) ([]int, error) {
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi := part, part
+		if i := strings.Index(part, "-"); i >= 0 {
+			lo, hi = part[:i], part[i+1:]
+			if lo == "" {
+				lo = "1"
+			}
+			if hi == "" {
+				hi = "65535"
+			}
+		}
+		a, err1 := strconv.Atoi(lo)
+		b, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || a < 1 || b > 65535 || a > b {
+			return nil, fmt.Errorf("scan: bad port %q", part)
+		}
+		for p := a; p <= b; p++ {
+			seen[p] = true
+		}
+	}
+	if len(seen) == 0 {
+		return nil, fmt.Errorf("scan: no ports in %q", spec)
+	}
+	ports := make([]int, 0, len(seen))
+	for p := range seen {
+		ports = append(ports, p)
+	}
+	sort.Ints(ports)
+	return ports, nil
+}
@@ -0,0 +1,56 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Codec encodes and decodes values to and from a file's contents. Encode
+// and Decode handle a single value, EncodeAll and DecodeAll handle a list
+// of values written out together.
+type Codec interface {
+	Encode(w io.Writer, v interface{}) error
+	Decode(r io.Reader, v interface{}) error
+	EncodeAll(w io.Writer, vv []interface{}) error
+	DecodeAll(r io.Reader, vv []interface{}) error
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		".json": JSON,
+		".xml":  XML,
+		".gob":  Gob,
+		".csv":  CSV,
+	}
+)
+
+// RegisterCodec makes codec the one used for files with extension ext
+// (such as ".yaml"). It replaces any codec already registered for ext.
+func RegisterCodec(ext string, codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[normalizeExt(ext)] = codec
+}
+
+// CodecFor returns the codec registered for the extension of path
+func CodecFor(path string) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	codec, ok := codecs[normalizeExt(filepath.Ext(path))]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownExt, path)
+	}
+	return codec, nil
+}
+
+func normalizeExt(ext string) string {
+	ext = strings.ToLower(ext)
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return ext
+}
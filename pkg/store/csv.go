@@ -1,29 +1,344 @@
 package store
 
-type csvStore struct {
+import (
+	"encoding"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrCSVValue = errors.New("csv: value must be a struct, or a slice of structs")
+	ErrCSVLoad  = errors.New("csv: value must be a pointer to a struct, or a slice of structs")
+)
+
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// CSV is the Codec for csv files of structs. The first row is a header
+// naming each column. Columns are mapped to exported struct fields by the
+// `csv:"name"` tag, or the field name when there is no tag. A tag of "-"
+// skips the field. Fields may be strings, bools, numbers, pointers to
+// those, or anything implementing encoding.TextMarshaler and
+// encoding.TextUnmarshaler (such as time.Time).
+var CSV Codec = csvCodec{}
+
+type csvCodec struct{}
+
+// Encode writes v, which may be a struct, a pointer to a struct, or a
+// slice of either, as a header row followed by a row per struct.
+func (c csvCodec) Encode(w io.Writer, v interface{}) error {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	switch rv.Kind() {
+	case reflect.Struct:
+		return c.write(w, rv.Type(), []reflect.Value{rv})
+	case reflect.Slice, reflect.Array:
+		typ := rv.Type().Elem()
+		if typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+		if typ.Kind() != reflect.Struct {
+			return ErrCSVValue
+		}
+		rows := make([]reflect.Value, 0, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			row := rv.Index(i)
+			if row.Kind() == reflect.Ptr && row.IsNil() {
+				return fmt.Errorf("csv: row %d is nil", i)
+			}
+			rows = append(rows, reflect.Indirect(row))
+		}
+		return c.write(w, typ, rows)
+	}
+	return ErrCSVValue
 }
 
-/*
-func (c *csvStore) Save(path string, v interface{}) error {
-	f, err := os.Create(path)
-	defer f.Close()
+// EncodeAll writes each value as a row. The values must all be structs
+// (or pointers to structs) of the same type.
+func (c csvCodec) EncodeAll(w io.Writer, vv []interface{}) error {
+	var typ reflect.Type
+	rows := make([]reflect.Value, 0, len(vv))
+	for _, v := range vv {
+		rv := reflect.Indirect(reflect.ValueOf(v))
+		if rv.Kind() != reflect.Struct {
+			return ErrCSVValue
+		}
+		if typ == nil {
+			typ = rv.Type()
+		}
+		if rv.Type() != typ {
+			return fmt.Errorf("csv: mixed types %s and %s", typ, rv.Type())
+		}
+		rows = append(rows, rv)
+	}
+	if typ == nil {
+		// nothing to describe, leave the file empty
+		return nil
+	}
+	return c.write(w, typ, rows)
+}
 
-	if err != nil {
-		return fmt.Errorf("failed to open file: %v\n", err)
+func (c csvCodec) write(w io.Writer, typ reflect.Type, rows []reflect.Value) error {
+	cols := columns(typ, nil)
+	cw := csv.NewWriter(w)
+	header := make([]string, len(cols))
+	for i, col := range cols {
+		header[i] = col.name
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	rec := make([]string, len(cols))
+	for _, row := range rows {
+		for i, col := range cols {
+			s, err := formatField(row.FieldByIndex(col.index))
+			if err != nil {
+				return fmt.Errorf("csv: column %q: %v", col.name, err)
+			}
+			rec[i] = s
+		}
+		if err := cw.Write(rec); err != nil {
+			return err
+		}
 	}
+	cw.Flush()
+	return cw.Error()
+}
 
-	w := csv.NewWriter(f)
-	defer w.Flush()
+// Decode reads csv rows into v. If v points to a struct, it is filled
+// from the first row. If v points to a slice, a struct is appended for
+// every row.
+func (c csvCodec) Decode(r io.Reader, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return ErrCSVLoad
+	}
+	dst := rv.Elem()
+	header, rows, err := c.read(r)
+	if err != nil {
+		return err
+	}
+	switch dst.Kind() {
+	case reflect.Struct:
+		if len(rows) == 0 {
+			return ErrShortRead
+		}
+		return fill(dst, header, rows[0])
+	case reflect.Slice:
+		typ := dst.Type().Elem()
+		isPtr := typ.Kind() == reflect.Ptr
+		if isPtr {
+			typ = typ.Elem()
+		}
+		if typ.Kind() != reflect.Struct {
+			return ErrCSVLoad
+		}
+		out := reflect.MakeSlice(dst.Type(), 0, len(rows))
+		for _, row := range rows {
+			elem := reflect.New(typ)
+			if err = fill(elem.Elem(), header, row); err != nil {
+				return err
+			}
+			if isPtr {
+				out = reflect.Append(out, elem)
+			} else {
+				out = reflect.Append(out, elem.Elem())
+			}
+		}
+		dst.Set(out)
+		return nil
+	}
+	return ErrCSVLoad
+}
 
-	for _, record := range records {
-		if err := w.Write(record); err != nil {
-			log.Fatalln("error writing record to file", err)
+// DecodeAll fills each value, which must be a pointer to a struct, from
+// the rows in order.
+func (c csvCodec) DecodeAll(r io.Reader, vv []interface{}) error {
+	header, rows, err := c.read(r)
+	if err != nil {
+		return err
+	}
+	if len(rows) < len(vv) {
+		return ErrShortRead
+	}
+	for i, v := range vv {
+		rv := reflect.ValueOf(v)
+		if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+			return ErrCSVLoad
+		}
+		if err = fill(rv.Elem(), header, rows[i]); err != nil {
+			return err
 		}
 	}
 	return nil
 }
-*/
-func (c *csvStore) Load(path string, v interface{}) error {
 
+// read returns the header and the remaining rows
+func (c csvCodec) read(r io.Reader) ([]string, [][]string, error) {
+	recs, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(recs) == 0 {
+		return nil, nil, nil
+	}
+	return recs[0], recs[1:], nil
+}
+
+type column struct {
+	name  string
+	index []int
+}
+
+// columns returns the csv columns for the struct type typ. Embedded
+// structs without a tag have their fields promoted, like encoding/json.
+func columns(typ reflect.Type, index []int) []column {
+	var cols []column
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		tag := f.Tag.Get("csv")
+		if tag == "-" {
+			continue
+		}
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		idx := append(append([]int(nil), index...), i)
+		if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct &&
+			!reflect.PtrTo(f.Type).Implements(textMarshalerType) {
+			cols = append(cols, columns(f.Type, idx)...)
+			continue
+		}
+		name := f.Name
+		if tag != "" {
+			name = strings.Split(tag, ",")[0]
+		}
+		cols = append(cols, column{name: name, index: idx})
+	}
+	return cols
+}
+
+// fill sets the fields of the struct dst from a csv row, matching
+// columns up by the header
+func fill(dst reflect.Value, header, row []string) error {
+	byName := make(map[string][]int)
+	for _, col := range columns(dst.Type(), nil) {
+		byName[col.name] = col.index
+	}
+	for i, name := range header {
+		idx, ok := byName[name]
+		if !ok || i >= len(row) {
+			continue
+		}
+		if err := setField(dst.FieldByIndex(idx), row[i]); err != nil {
+			return fmt.Errorf("csv: column %q: %v", name, err)
+		}
+	}
 	return nil
 }
+
+func formatField(f reflect.Value) (string, error) {
+	if f.Kind() == reflect.Ptr {
+		if f.IsNil() {
+			return "", nil
+		}
+		if m, ok := f.Interface().(encoding.TextMarshaler); ok {
+			b, err := m.MarshalText()
+			return string(b), err
+		}
+		f = f.Elem()
+	}
+	if m, ok := f.Interface().(encoding.TextMarshaler); ok {
+		b, err := m.MarshalText()
+		return string(b), err
+	}
+	if f.CanAddr() {
+		if m, ok := f.Addr().Interface().(encoding.TextMarshaler); ok {
+			b, err := m.MarshalText()
+			return string(b), err
+		}
+	}
+	switch f.Kind() {
+	case reflect.String:
+		return f.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(f.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(f.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(f.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(f.Float(), 'g', -1, f.Type().Bits()), nil
+	}
+	return "", fmt.Errorf("unsupported type %s", f.Type())
+}
+
+func setField(f reflect.Value, s string) error {
+	if f.Kind() == reflect.Ptr {
+		if s == "" {
+			f.Set(reflect.Zero(f.Type()))
+			return nil
+		}
+		if f.IsNil() {
+			f.Set(reflect.New(f.Type().Elem()))
+		}
+		f = f.Elem()
+	}
+	if u, ok := f.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+		return nil
+	case reflect.Bool:
+		if s == "" {
+			f.SetBool(false)
+			return nil
+		}
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if s == "" {
+			f.SetInt(0)
+			return nil
+		}
+		n, err := strconv.ParseInt(s, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if s == "" {
+			f.SetUint(0)
+			return nil
+		}
+		n, err := strconv.ParseUint(s, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetUint(n)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		if s == "" {
+			f.SetFloat(0)
+			return nil
+		}
+		n, err := strconv.ParseFloat(s, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetFloat(n)
+		return nil
+	}
+	return fmt.Errorf("unsupported type %s", f.Type())
+}
@@ -0,0 +1,50 @@
+package store
+
+import (
+	"encoding/gob"
+	"io"
+)
+
+// Gob is the Codec for encoding/gob. EncodeAll writes a record count
+// followed by each of the values.
+var Gob Codec = gobCodec{}
+
+type gobCodec struct{}
+
+func (gobCodec) Encode(w io.Writer, v interface{}) error {
+	return gob.NewEncoder(w).Encode(v)
+}
+
+func (gobCodec) EncodeAll(w io.Writer, vv []interface{}) error {
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(len(vv)); err != nil {
+		return err
+	}
+	for _, v := range vv {
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (gobCodec) Decode(r io.Reader, v interface{}) error {
+	return gob.NewDecoder(r).Decode(v)
+}
+
+func (gobCodec) DecodeAll(r io.Reader, vv []interface{}) error {
+	dec := gob.NewDecoder(r)
+	var n int
+	if err := dec.Decode(&n); err != nil {
+		return err
+	}
+	if n < len(vv) {
+		return ErrShortRead
+	}
+	for _, v := range vv {
+		if err := dec.Decode(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
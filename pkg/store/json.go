@@ -1,14 +1,44 @@
 package store
 
-type jsonStore struct {
-}
+import (
+	"encoding/json"
+	"io"
+)
 
-func (j *jsonStore) Save(path string, v interface{}) error {
+// JSON is the Codec for indented JSON. EncodeAll writes a single array.
+var JSON Codec = jsonCodec{}
 
-	return nil
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(v)
 }
 
-func (j *jsonStore) Load(path string, v interface{}) error {
+func (c jsonCodec) EncodeAll(w io.Writer, vv []interface{}) error {
+	if vv == nil {
+		vv = []interface{}{}
+	}
+	return c.Encode(w, vv)
+}
+
+func (jsonCodec) Decode(r io.Reader, v interface{}) error {
+	return json.NewDecoder(r).Decode(v)
+}
 
+func (c jsonCodec) DecodeAll(r io.Reader, vv []interface{}) error {
+	var raw []json.RawMessage
+	if err := c.Decode(r, &raw); err != nil {
+		return err
+	}
+	if len(raw) < len(vv) {
+		return ErrShortRead
+	}
+	for i := range vv {
+		if err := json.Unmarshal(raw[i], vv[i]); err != nil {
+			return err
+		}
+	}
 	return nil
 }
@@ -0,0 +1,70 @@
+package store
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// locks is shared by every Store in the package
+var locks = &pathLocks{
+	locks: make(map[string]*pathLock),
+}
+
+// pathLocks hands out a read/write lock per file path, so that saves and
+// loads of different files never wait on each other. Locks are reference
+// counted and dropped once nobody is holding or waiting on them.
+type pathLocks struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.RWMutex
+	refs int
+}
+
+// acquire returns the lock for path with its reference count bumped
+func (p *pathLocks) acquire(path string) (string, *pathLock) {
+	key, err := filepath.Abs(path)
+	if err != nil {
+		key = filepath.Clean(path)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l, ok := p.locks[key]
+	if !ok {
+		l = new(pathLock)
+		p.locks[key] = l
+	}
+	l.refs++
+	return key, l
+}
+
+func (p *pathLocks) release(key string, l *pathLock) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l.refs--
+	if l.refs == 0 {
+		delete(p.locks, key)
+	}
+}
+
+// lock takes the write lock for path and returns the func that releases it
+func (p *pathLocks) lock(path string) func() {
+	key, l := p.acquire(path)
+	l.Lock()
+	return func() {
+		l.Unlock()
+		p.release(key, l)
+	}
+}
+
+// rlock takes the read lock for path and returns the func that releases it
+func (p *pathLocks) rlock(path string) func() {
+	key, l := p.acquire(path)
+	l.RLock()
+	return func() {
+		l.RUnlock()
+		p.release(key, l)
+	}
+}
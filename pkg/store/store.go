@@ -1,5 +1,17 @@
 package store
 
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var (
+	ErrUnknownExt = errors.New("no store for file extension")
+	ErrShortRead  = errors.New("fewer records than values to load into")
+)
+
 type Store interface {
 	Save(path string, v interface{}) error
 	SaveAll(path string, vv []interface{}) error
@@ -8,3 +20,180 @@ type Store interface {
 	Delete(path string) error
 	DeleteAll(path string) error
 }
+
+// New returns the Store for the codec registered to the extension of
+// path. The built in extensions are .json, .xml, .csv and .gob.
+func New(path string) (Store, error) {
+	codec, err := CodecFor(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewStore(codec), nil
+}
+
+// NewStore returns a Store that encodes values with codec. Every Store
+// shares the same per path locks, so stores with different codecs can
+// safely be pointed at the same files.
+func NewStore(codec Codec) Store {
+	return &codecStore{codec: codec}
+}
+
+// NewJSONStore returns a Store that encodes values as indented JSON.
+// SaveAll writes the values out as a single JSON array.
+func NewJSONStore() Store {
+	return NewStore(JSON)
+}
+
+// NewXMLStore returns a Store that encodes values as indented XML.
+// SaveAll wraps the values in a single <values> element.
+func NewXMLStore() Store {
+	return NewStore(XML)
+}
+
+// NewGobStore returns a Store that encodes values with encoding/gob.
+// SaveAll writes a record count followed by each of the values.
+func NewGobStore() Store {
+	return NewStore(Gob)
+}
+
+// NewCSVStore returns a Store that writes structs as csv rows, see CSV
+// for how fields are mapped to columns.
+func NewCSVStore() Store {
+	return NewStore(CSV)
+}
+
+// Save saves a representation of v to the file at path, using the codec
+// registered for the extension of path.
+func Save(path string, v interface{}) error {
+	st, err := New(path)
+	if err != nil {
+		return err
+	}
+	return st.Save(path, v)
+}
+
+// Load loads the file at path into v, using the codec registered for the
+// extension of path. Use os.IsNotExist() to see if the returned error is
+// due to the file being missing.
+func Load(path string, v interface{}) error {
+	st, err := New(path)
+	if err != nil {
+		return err
+	}
+	return st.Load(path, v)
+}
+
+type codecStore struct {
+	codec Codec
+}
+
+func (s *codecStore) Save(path string, v interface{}) error {
+	unlock := locks.lock(path)
+	defer unlock()
+	return writeFile(path, func(w io.Writer) error {
+		return s.codec.Encode(w, v)
+	})
+}
+
+func (s *codecStore) SaveAll(path string, vv []interface{}) error {
+	unlock := locks.lock(path)
+	defer unlock()
+	return writeFile(path, func(w io.Writer) error {
+		return s.codec.EncodeAll(w, vv)
+	})
+}
+
+func (s *codecStore) Load(path string, v interface{}) error {
+	unlock := locks.rlock(path)
+	defer unlock()
+	return readFile(path, func(r io.Reader) error {
+		return s.codec.Decode(r, v)
+	})
+}
+
+func (s *codecStore) LoadAll(path string, vv []interface{}) error {
+	unlock := locks.rlock(path)
+	defer unlock()
+	return readFile(path, func(r io.Reader) error {
+		return s.codec.DecodeAll(r, vv)
+	})
+}
+
+// Delete removes the file at path.
+// Use os.IsNotExist() to see if the returned error is due
+// to the file being missing.
+func (s *codecStore) Delete(path string) error {
+	unlock := locks.lock(path)
+	defer unlock()
+	return os.Remove(path)
+}
+
+// DeleteAll removes path and anything it contains. It returns
+// nil if path does not exist.
+func (s *codecStore) DeleteAll(path string) error {
+	unlock := locks.lock(path)
+	defer unlock()
+	return os.RemoveAll(path)
+}
+
+// writeFile atomically replaces the file at path with whatever fn writes.
+// The data goes to a temp file in the same directory which is synced and
+// then renamed over path, so readers only ever see the old or new file.
+func writeFile(path string, fn func(w io.Writer) error) error {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	fd, err := os.CreateTemp(dir, "."+base+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := fd.Name()
+	// clean up the temp file if anything goes wrong before the rename
+	defer func() {
+		if err != nil {
+			fd.Close()
+			os.Remove(tmp)
+		}
+	}()
+	// temp files are created 0600, give it the usual permissions
+	if err = fd.Chmod(0644); err != nil {
+		return err
+	}
+	if err = fn(fd); err != nil {
+		return err
+	}
+	if err = fd.Sync(); err != nil {
+		return err
+	}
+	if err = fd.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir commits a rename in dir to stable storage
+func syncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return fd.Sync()
+}
+
+// readFile opens the file at path and hands it to fn
+func readFile(path string, fn func(r io.Reader) error) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return fn(fd)
+}
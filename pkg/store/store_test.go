@@ -0,0 +1,191 @@
+package store_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/store"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Record is the value every backend is checked against. It covers the
+// field types the csv backend has to map by hand.
+type Record struct {
+	ID      int       `json:"id" csv:"id"`
+	Name    string    `json:"name" csv:"name"`
+	Score   float64   `json:"score" csv:"score"`
+	Active  bool      `json:"active" csv:"active"`
+	Created time.Time `json:"created" csv:"created"`
+	Note    *string   `json:"note" csv:"note"`
+}
+
+// TestBackends runs the checks below against every store backend
+func TestBackends(t *testing.T) {
+	for _, ext := range []string{".json", ".xml", ".csv", ".gob"} {
+		st, err := store.New("records" + ext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, check := range checks {
+			t.Run(ext[1:]+"/"+check.name, func(t *testing.T) {
+				check.fn(t, st, filepath.Join(t.TempDir(), "records"+ext))
+			})
+		}
+	}
+}
+
+func TestNewUnknownExtension(t *testing.T) {
+	if _, err := store.New("records.txt"); err == nil {
+		t.Fatal("expected an error for an unknown extension")
+	}
+}
+
+func TestCSVNilRow(t *testing.T) {
+	r := record(1)
+	var b bytes.Buffer
+	if err := store.CSV.Encode(&b, []*Record{&r, nil}); err == nil {
+		t.Fatal("expected an error for a nil row")
+	}
+}
+
+var checks = []struct {
+	name string
+	fn   func(t *testing.T, st store.Store, path string)
+}{
+	{"save-load", checkSaveLoad},
+	{"save-overwrite", checkOverwrite},
+	{"save-all-load-all", checkSaveAllLoadAll},
+	{"load-all-short", checkLoadAllShort},
+	{"load-missing", checkLoadMissing},
+	{"delete", checkDelete},
+	{"delete-all", checkDeleteAll},
+}
+
+func record(id int) Record {
+	note := fmt.Sprintf("note %d, with a comma", id)
+	return Record{
+		ID:      id,
+		Name:    fmt.Sprintf("record \"%d\"", id),
+		Score:   float64(id) + 0.25,
+		Active:  id%2 == 0,
+		Created: time.Date(2021, 4, id, 12, 30, 0, 0, time.UTC),
+		Note:    &note,
+	}
+}
+
+func compare(got, want Record) error {
+	if !got.Created.Equal(want.Created) {
+		return fmt.Errorf("created: got %v, want %v", got.Created, want.Created)
+	}
+	got.Created, want.Created = time.Time{}, time.Time{}
+	if !reflect.DeepEqual(got, want) {
+		return fmt.Errorf("got %+v, want %+v", got, want)
+	}
+	return nil
+}
+
+func checkSaveLoad(t *testing.T, st store.Store, path string) {
+	want := record(1)
+	if err := st.Save(path, &want); err != nil {
+		t.Fatal(err)
+	}
+	var got Record
+	if err := st.Load(path, &got); err != nil {
+		t.Fatal(err)
+	}
+	if err := compare(got, want); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkOverwrite(t *testing.T, st store.Store, path string) {
+	if err := st.Save(path, record(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Save(path, record(2)); err != nil {
+		t.Fatal(err)
+	}
+	var got Record
+	if err := st.Load(path, &got); err != nil {
+		t.Fatal(err)
+	}
+	if err := compare(got, record(2)); err != nil {
+		t.Fatal(err)
+	}
+	// the atomic write must not leave temp files behind
+	ents, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 1 {
+		t.Fatalf("expected 1 file in %s, found %d", filepath.Dir(path), len(ents))
+	}
+}
+
+func checkSaveAllLoadAll(t *testing.T, st store.Store, path string) {
+	vv := []interface{}{record(1), record(2), record(3)}
+	if err := st.SaveAll(path, vv); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]Record, len(vv))
+	dst := make([]interface{}, len(got))
+	for i := range got {
+		dst[i] = &got[i]
+	}
+	if err := st.LoadAll(path, dst); err != nil {
+		t.Fatal(err)
+	}
+	for i := range got {
+		if err := compare(got[i], vv[i].(Record)); err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+	}
+}
+
+func checkLoadAllShort(t *testing.T, st store.Store, path string) {
+	if err := st.SaveAll(path, []interface{}{record(1)}); err != nil {
+		t.Fatal(err)
+	}
+	var a, b Record
+	if err := st.LoadAll(path, []interface{}{&a, &b}); err != store.ErrShortRead {
+		t.Fatalf("expected ErrShortRead, got %v", err)
+	}
+}
+
+func checkLoadMissing(t *testing.T, st store.Store, path string) {
+	var got Record
+	if err := st.Load(path, &got); !os.IsNotExist(err) {
+		t.Fatalf("expected a not exist error, got %v", err)
+	}
+}
+
+func checkDelete(t *testing.T, st store.Store, path string) {
+	if err := st.Save(path, record(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Delete(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("file still exists after delete")
+	}
+}
+
+func checkDeleteAll(t *testing.T, st store.Store, path string) {
+	dir := filepath.Dir(path)
+	if err := st.Save(path, record(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Save(filepath.Join(dir, "nested", filepath.Base(path)), record(2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.DeleteAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("directory still exists after delete all")
+	}
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+	"encoding/xml"
+	"io"
+)
+
+// XML is the Codec for indented XML. EncodeAll wraps the values in a
+// single <values> element.
+var XML Codec = xmlCodec{}
+
+type xmlCodec struct{}
+
+func (xmlCodec) Encode(w io.Writer, v interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func (xmlCodec) EncodeAll(w io.Writer, vv []interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	start := xml.StartElement{Name: xml.Name{Local: "values"}}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, v := range vv {
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+	}
+	if err := enc.EncodeToken(start.End()); err != nil {
+		return err
+	}
+	if err := enc.Flush(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func (xmlCodec) Decode(r io.Reader, v interface{}) error {
+	return xml.NewDecoder(r).Decode(v)
+}
+
+func (xmlCodec) DecodeAll(r io.Reader, vv []interface{}) error {
+	dec := xml.NewDecoder(r)
+	// depth tracks where we are, the values are the children of the root
+	depth, i := 0, 0
+	for i < len(vv) {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return ErrShortRead
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				depth++
+				continue
+			}
+			if err = dec.DecodeElement(vv[i], &t); err != nil {
+				return err
+			}
+			i++
+		case xml.EndElement:
+			// the root closed before we filled every value
+			return ErrShortRead
+		}
+	}
+	return nil
+}
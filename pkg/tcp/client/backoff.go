@@ -0,0 +1,62 @@
+package client
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Backoff computes how long to wait between reconnect attempts. The wait
+// doubles (by Factor) with every attempt, from Min up to Max, and then
+// a random amount of up to Jitter of it is taken off so a crowd of
+// clients does not all come back at the same moment.
+type Backoff struct {
+	Min    time.Duration // first wait, 100ms if zero
+	Max    time.Duration // longest wait, 10s if zero
+	Factor float64       // growth per attempt, 2 if zero
+	Jitter float64       // fraction of the wait that is random, 0 to 1
+}
+
+// DefaultBackoff is the backoff a Dialer uses when it has none set
+var DefaultBackoff = Backoff{
+	Min:    100 * time.Millisecond,
+	Max:    10 * time.Second,
+	Factor: 2,
+	Jitter: 0.5,
+}
+
+var (
+	jitterMu  sync.Mutex
+	jitterRnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Duration returns the wait before the given attempt, counting from 0
+func (b Backoff) Duration(attempt int) time.Duration {
+	min, max, factor := b.Min, b.Max, b.Factor
+	if min <= 0 {
+		min = 100 * time.Millisecond
+	}
+	if max <= 0 {
+		max = 10 * time.Second
+	}
+	if factor < 1 {
+		factor = 2
+	}
+	d := float64(min)
+	for i := 0; i < attempt && d < float64(max); i++ {
+		d *= factor
+	}
+	if d > float64(max) {
+		d = float64(max)
+	}
+	if b.Jitter > 0 {
+		jitter := b.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		jitterMu.Lock()
+		d -= d * jitter * jitterRnd.Float64()
+		jitterMu.Unlock()
+	}
+	return time.Duration(d)
+}
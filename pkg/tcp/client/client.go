@@ -1 +1,212 @@
 package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/scottcagno/net-tools/pkg/tcp/frame"
+	"github.com/scottcagno/net-tools/pkg/tcp/tlsutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrClientClosed is returned by a Client after it has been closed
+var ErrClientClosed = errors.New("tcp: client closed")
+
+// Config holds the settings for a client. The tags let it be filled in
+// by pkg/config.
+type Config struct {
+	Addr         string        `config:"addr" default:"localhost:8080" usage:"address to connect to"`
+	DialTimeout  time.Duration `config:"dial-timeout" default:"5s" usage:"max duration of a single connect attempt"`
+	ReadTimeout  time.Duration `config:"read-timeout" default:"30s" usage:"max duration to wait for a reply, 0 for no limit"`
+	WriteTimeout time.Duration `config:"write-timeout" default:"30s" usage:"max duration of a single write, 0 for no limit"`
+	KeepAlive    time.Duration `config:"keep-alive" default:"15s" usage:"tcp keep alive period, negative to turn it off"`
+	MaxRetries   int           `config:"max-retries" default:"5" usage:"connect attempts before giving up, 0 for no limit"`
+	MaxConns     int           `config:"max-conns" default:"8" usage:"max number of pooled connections"`
+	TLS          bool          `config:"tls" usage:"connect with tls, trusting the system roots unless tls-ca is set"`
+	TLSCA        string        `config:"tls-ca" usage:"ca bundle to verify the server against, turns on tls"`
+	TLSCert      string        `config:"tls-cert" usage:"client certificate file for mutual tls"`
+	TLSKey       string        `config:"tls-key" usage:"private key file for the client certificate"`
+	TLSServer    string        `config:"tls-server-name" usage:"name to verify the server certificate against, defaults to the host in addr"`
+}
+
+// TLSConfig returns the tls settings described by the config, or nil if
+// neither TLS nor TLSCA is set
+func (c Config) TLSConfig() (*tls.Config, error) {
+	if !c.TLS && c.TLSCA == "" {
+		return nil, nil
+	}
+	return tlsutil.ClientConfig(c.TLSCA, c.TLSCert, c.TLSKey, c.TLSServer)
+}
+
+// Dialer connects to a server, retrying with a jittered exponential
+// backoff when it can't.
+type Dialer struct {
+	Network      string        // "tcp" if empty
+	Addr         string        // address to connect to
+	Timeout      time.Duration // max duration of a single connect attempt, 0 for no limit
+	ReadTimeout  time.Duration // deadline for reads made by the Conn helpers, 0 for no limit
+	WriteTimeout time.Duration // deadline for writes made by the Conn helpers, 0 for no limit
+	KeepAlive    time.Duration // tcp keep alive period, see net.Dialer
+	MaxRetries   int           // connect attempts made by DialRetry, 0 for no limit
+	Backoff      Backoff       // wait between attempts, DefaultBackoff if zero
+	TLSConfig    *tls.Config   // connect with tls if set
+}
+
+// NewDialer returns a new Dialer using the settings in cfg. The tls
+// settings are not loaded, set TLSConfig from cfg.TLSConfig() for that.
+func NewDialer(cfg Config) *Dialer {
+	return &Dialer{
+		Addr:         cfg.Addr,
+		Timeout:      cfg.DialTimeout,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		KeepAlive:    cfg.KeepAlive,
+		MaxRetries:   cfg.MaxRetries,
+	}
+}
+
+// Dial makes a single attempt to connect
+func (d *Dialer) Dial(ctx context.Context) (*Conn, error) {
+	network := d.Network
+	if network == "" {
+		network = "tcp"
+	}
+	nd := &net.Dialer{
+		Timeout:   d.Timeout,
+		KeepAlive: d.KeepAlive,
+	}
+	var conn net.Conn
+	var err error
+	if d.TLSConfig != nil {
+		// tls.Dialer fills in the server name from the address
+		td := &tls.Dialer{NetDialer: nd, Config: d.TLSConfig}
+		conn, err = td.DialContext(ctx, network, d.Addr)
+	} else {
+		conn, err = nd.DialContext(ctx, network, d.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn, d.ReadTimeout, d.WriteTimeout), nil
+}
+
+// DialRetry tries to connect until it succeeds, MaxRetries attempts have
+// failed, or ctx is done. It waits according to Backoff between attempts
+// and returns the last error when it gives up.
+func (d *Dialer) DialRetry(ctx context.Context) (*Conn, error) {
+	backoff := d.Backoff
+	if backoff == (Backoff{}) {
+		backoff = DefaultBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		conn, err := d.Dial(ctx)
+		if err == nil {
+			return conn, nil
+		}
+		if d.MaxRetries > 0 && attempt+1 >= d.MaxRetries {
+			return nil, err
+		}
+		t := time.NewTimer(backoff.Duration(attempt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Client is a single connection to a server that reconnects on its own.
+// When a request fails with a connection error the connection is
+// dropped, and the next request dials a new one. Requests are not
+// retried, since the client can't tell whether the server acted on them.
+type Client struct {
+	Dialer *Dialer
+
+	mu     sync.Mutex
+	conn   *Conn
+	closed bool
+}
+
+// NewClient returns a new Client using the settings in cfg. It does not
+// connect until the first request.
+func NewClient(cfg Config) *Client {
+	return &Client{
+		Dialer: NewDialer(cfg),
+	}
+}
+
+// Do runs fn with the connection, connecting first if need be. Requests
+// are serialized, only one fn runs at a time.
+func (c *Client) Do(ctx context.Context, fn func(conn *Conn) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClientClosed
+	}
+	if c.conn == nil {
+		conn, err := c.Dialer.DialRetry(ctx)
+		if err != nil {
+			return err
+		}
+		c.conn = conn
+	}
+	err := fn(c.conn)
+	if c.conn.Err() != nil {
+		// the connection is broken, reconnect on the next request
+		c.conn.Close()
+		c.conn = nil
+	}
+	return err
+}
+
+// Line sends a line and returns the line the server replies with
+func (c *Client) Line(ctx context.Context, line string) (string, error) {
+	var reply string
+	err := c.Do(ctx, func(conn *Conn) error {
+		var err error
+		reply, err = conn.Line(line)
+		return err
+	})
+	return reply, err
+}
+
+// Frame sends a length prefixed frame and returns the frame the server
+// replies with
+func (c *Client) Frame(ctx context.Context, b []byte) ([]byte, error) {
+	var reply []byte
+	err := c.Do(ctx, func(conn *Conn) error {
+		var err error
+		reply, err = conn.Frame(b)
+		return err
+	})
+	return reply, err
+}
+
+// Message sends a frame from pkg/tcp/frame and returns the reply frame.
+// The reply's payload is a copy, so it can be kept.
+func (c *Client) Message(ctx context.Context, fr frame.Frame) (frame.Frame, error) {
+	var reply frame.Frame
+	err := c.Do(ctx, func(conn *Conn) error {
+		var err error
+		reply, err = conn.Message(fr)
+		reply.Payload = append([]byte(nil), reply.Payload...)
+		return err
+	})
+	return reply, err
+}
+
+// Close closes the connection, if there is one
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
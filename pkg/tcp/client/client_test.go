@@ -0,0 +1,636 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/data"
+	"github.com/scottcagno/net-tools/pkg/tcp/client"
+	"github.com/scottcagno/net-tools/pkg/tcp/frame"
+	"github.com/scottcagno/net-tools/pkg/tcp/line"
+	"github.com/scottcagno/net-tools/pkg/tcp/server"
+	"github.com/scottcagno/net-tools/pkg/tcp/tlsutil"
+	"io"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startServer serves handler on a loopback port, and returns the server
+// and its address
+func startServer(handler server.Handler) (*server.Server, string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, "", err
+	}
+	srv := &server.Server{Handler: handler}
+	go srv.Serve(ln)
+	return srv, ln.Addr().String(), nil
+}
+
+// lineServer replies to ECHO with its argument, using pkg/tcp/line
+func lineServer() server.Handler {
+	mux := line.NewMux()
+	mux.Handle(line.Command{
+		Name: "ECHO", MinArgs: 1, MaxArgs: 1,
+		Handle: func(s *line.Session, args []string) error {
+			return s.OK(args[0])
+		},
+	})
+	return mux.ServeConn
+}
+
+// frameServer echoes back every frame, using pkg/data for the framing
+func frameServer(conn net.Conn) {
+	dr := data.NewDataReader(conn)
+	dw := data.NewDataWriter(conn)
+	for {
+		b, err := dr.ReadBinary()
+		if err != nil {
+			return
+		}
+		if err = dw.WriteBinary(b); err != nil {
+			return
+		}
+		if err = dw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func dialer(addr string) *client.Dialer {
+	return &client.Dialer{
+		Addr:         addr,
+		Timeout:      time.Second,
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+		MaxRetries:   5,
+		Backoff:      client.Backoff{Min: 10 * time.Millisecond, Max: 100 * time.Millisecond, Jitter: 0.5},
+	}
+}
+
+func TestLine(t *testing.T) {
+	srv, addr, err := startServer(lineServer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	c := &client.Client{Dialer: dialer(addr)}
+	defer c.Close()
+	reply, err := c.Line(context.Background(), `ECHO "hello there"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "+OK hello there" {
+		t.Fatalf("got reply %q", reply)
+	}
+}
+
+func TestFrame(t *testing.T) {
+	srv, addr, err := startServer(frameServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	c := &client.Client{Dialer: dialer(addr)}
+	defer c.Close()
+	for _, msg := range [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte{0, 1, 2}, 100000)} {
+		reply, err := c.Frame(context.Background(), msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(reply, msg) {
+			t.Fatalf("got %d bytes back, sent %d", len(reply), len(msg))
+		}
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	srv, addr, err := startServer(frameServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	conn, err := dialer(addr).Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.MaxFrameSize = 10
+	if _, err = conn.Frame(make([]byte, 11)); err != client.ErrFrameTooLarge {
+		t.Fatalf("expected ErrFrameTooLarge, got %v", err)
+	}
+	if conn.Err() == nil {
+		t.Fatal("expected the connection to be marked broken")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	// a server that hangs up after every reply
+	srv, addr, err := startServer(func(conn net.Conn) {
+		c := client.NewConn(conn, time.Second, time.Second)
+		if l, err := c.ReadLine(); err == nil {
+			c.WriteLine(l)
+			c.Flush()
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	c := &client.Client{Dialer: dialer(addr)}
+	defer c.Close()
+	if _, err = c.Line(context.Background(), "one"); err != nil {
+		t.Fatal(err)
+	}
+	// the server has hung up, so this one fails...
+	time.Sleep(50 * time.Millisecond)
+	if _, err = c.Line(context.Background(), "two"); err == nil {
+		t.Fatal("expected the request on the closed connection to fail")
+	}
+	// ...and this one reconnects
+	reply, err := c.Line(context.Background(), "three")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "three" {
+		t.Fatalf("got reply %q", reply)
+	}
+}
+
+func TestDialRetry(t *testing.T) {
+	// find a free port, then only start listening on it after a while
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	srv := &server.Server{Addr: addr, Handler: lineServer()}
+	defer srv.Close()
+	time.AfterFunc(100*time.Millisecond, func() { srv.ListenAndServe() })
+	d := dialer(addr)
+	d.MaxRetries = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := d.DialRetry(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestDialGiveUp(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	d := dialer(addr)
+	d.MaxRetries = 3
+	start := time.Now()
+	if _, err = d.DialRetry(context.Background()); err == nil {
+		t.Fatal("expected dialing a closed port to fail")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("took %v to give up", time.Since(start))
+	}
+}
+
+func TestPoolReuse(t *testing.T) {
+	var conns int32
+	srv, addr, err := startServer(func(conn net.Conn) {
+		atomic.AddInt32(&conns, 1)
+		lineServer()(conn)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	p := client.NewPool(dialer(addr), 2)
+	defer p.Close()
+	for i := 0; i < 10; i++ {
+		err = p.Do(context.Background(), func(conn *client.Conn) error {
+			_, err := conn.Line("ECHO x")
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Fatalf("expected 1 connection, server saw %d", n)
+	}
+}
+
+func TestPoolBounded(t *testing.T) {
+	srv, addr, err := startServer(lineServer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	p := client.NewPool(dialer(addr), 2)
+	defer p.Close()
+	a, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	short, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = p.Get(short); err != context.DeadlineExceeded {
+		t.Fatalf("expected the third Get to time out, got %v", err)
+	}
+	p.Put(a)
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != a {
+		t.Fatal("expected the idle connection to be reused")
+	}
+	p.Put(b)
+	p.Put(c)
+	if p.Idle() != 2 {
+		t.Fatalf("expected 2 idle connections, got %d", p.Idle())
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	srv, addr, err := startServer(lineServer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := client.NewPool(dialer(addr), 2)
+	defer p.Close()
+	a, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(a)
+	// restart the server on the same address, dropping the idle connection
+	srv.Close()
+	time.Sleep(50 * time.Millisecond)
+	srv = &server.Server{Addr: addr, Handler: lineServer()}
+	defer srv.Close()
+	go srv.ListenAndServe()
+	time.Sleep(50 * time.Millisecond)
+	b, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Put(b)
+	if b == a {
+		t.Fatal("expected the dead idle connection to be replaced")
+	}
+	reply, err := b.Line("ECHO y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "+OK y" {
+		t.Fatalf("got reply %q", reply)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := client.Backoff{Min: 10 * time.Millisecond, Max: 80 * time.Millisecond, Factor: 2}
+	want := []time.Duration{10, 20, 40, 80, 80}
+	for i, w := range want {
+		if d := b.Duration(i); d != w*time.Millisecond {
+			t.Fatalf("attempt %d: got %v, want %v", i, d, w*time.Millisecond)
+		}
+	}
+	b.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := b.Duration(3); d < 40*time.Millisecond || d > 80*time.Millisecond {
+			t.Fatalf("jittered wait %v out of range", d)
+		}
+	}
+}
+
+// messageServer echoes every frame back with its type bumped by one
+var messageServer = frame.NewHandler(0, func(f *frame.Framer, fr frame.Frame) error {
+	fr.Type++
+	return f.WriteFrame(fr)
+})
+
+func TestMessage(t *testing.T) {
+	srv, addr, err := startServer(messageServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	c := &client.Client{Dialer: dialer(addr)}
+	defer c.Close()
+	for i, size := range []int{0, 1, 5000, 1 << 20} {
+		msg := frame.Frame{Type: uint8(i), Flags: 0xbeef, Payload: bytes.Repeat([]byte{byte(i)}, size)}
+		reply, err := c.Message(context.Background(), msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Type != msg.Type+1 || reply.Flags != msg.Flags || !bytes.Equal(reply.Payload, msg.Payload) {
+			t.Fatalf("got %v back for %v", reply, msg)
+		}
+	}
+}
+
+func TestMessagePipelined(t *testing.T) {
+	srv, addr, err := startServer(messageServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	conn, err := dialer(addr).Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	f := conn.Framer()
+	for i := 0; i < 100; i++ {
+		if err = f.WriteFrame(frame.Frame{Type: uint8(i), Payload: []byte(fmt.Sprint(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = f.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		fr, err := f.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fr.Type != uint8(i+1) || string(fr.Payload) != fmt.Sprint(i) {
+			t.Fatalf("reply %d out of order: %v %q", i, fr, fr.Payload)
+		}
+	}
+}
+
+// trickleReader hands out one byte per read, and a timeout error every
+// other read, the way a slow connection with a read deadline does
+type trickleReader struct {
+	b    []byte
+	tick bool
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func (r *trickleReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	if r.tick = !r.tick; r.tick {
+		return 0, timeoutError{}
+	}
+	p[0] = r.b[0]
+	r.b = r.b[1:]
+	return 1, nil
+}
+
+func TestDecoderPartial(t *testing.T) {
+	var stream []byte
+	for i := 0; i < 3; i++ {
+		stream = frame.Frame{Type: uint8(i), Payload: bytes.Repeat([]byte("ab"), 3000)}.Append(stream)
+	}
+	dec := frame.NewDecoder(&trickleReader{b: stream})
+	timeouts := 0
+	for i := 0; i < 3; {
+		fr, err := dec.Decode()
+		if _, ok := err.(timeoutError); ok {
+			timeouts++
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fr.Type != uint8(i) || len(fr.Payload) != 6000 {
+			t.Fatalf("frame %d: got %v", i, fr)
+		}
+		i++
+	}
+	if timeouts == 0 {
+		t.Fatal("expected the reader to time out")
+	}
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Fatalf("expected io.EOF at the end, got %v", err)
+	}
+}
+
+func TestDecoderChecksum(t *testing.T) {
+	b := frame.Frame{Type: 1, Payload: []byte("hello")}.Append(nil)
+	b[len(b)-1] ^= 0xff
+	if _, err := frame.NewDecoder(bytes.NewReader(b)).Decode(); err != frame.ErrChecksum {
+		t.Fatalf("expected ErrChecksum, got %v", err)
+	}
+	b = frame.Frame{Payload: make([]byte, 100)}.Append(nil)
+	dec := frame.NewDecoder(bytes.NewReader(b))
+	dec.MaxSize = 99
+	if _, err := dec.Decode(); err != frame.ErrTooLarge {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+	if _, err := frame.NewDecoder(bytes.NewReader(b[:20])).Decode(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF for a cut off frame, got %v", err)
+	}
+}
+
+// certs writes a CA, a server certificate for 127.0.0.1 and a client
+// certificate to a temp dir
+func certs(t *testing.T) (string, *tlsutil.CA) {
+	dir := t.TempDir()
+	ca, err := tlsutil.GenerateCA("test ca", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ca.WriteFiles(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")); err != nil {
+		t.Fatal(err)
+	}
+	srv, err := ca.IssueServer("server", []string{"127.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = srv.WriteFiles(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem")); err != nil {
+		t.Fatal(err)
+	}
+	cli, err := ca.IssueClient("alice", nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.WriteFiles(filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")); err != nil {
+		t.Fatal(err)
+	}
+	return dir, ca
+}
+
+// startTLSServer serves handler over tls with the certs in dir, requiring
+// client certificates if mutual is set. The idle timeout puts the
+// server's own wrapper around the tls connections.
+func startTLSServer(dir string, mutual bool, handler server.Handler) (*server.Server, string, error) {
+	cfg := server.Config{
+		IdleTimeout: time.Minute,
+		TLSCert:     filepath.Join(dir, "server.pem"),
+		TLSKey:      filepath.Join(dir, "server-key.pem"),
+	}
+	if mutual {
+		cfg.TLSClientCA = filepath.Join(dir, "ca.pem")
+	}
+	srv, err := server.NewServer(cfg, handler)
+	if err != nil {
+		return nil, "", err
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, "", err
+	}
+	go srv.ServeTLS(ln)
+	return srv, ln.Addr().String(), nil
+}
+
+func tlsDialer(dir, addr string, clientCert bool) (*client.Dialer, error) {
+	cfg := client.Config{TLSCA: filepath.Join(dir, "ca.pem")}
+	if clientCert {
+		cfg.TLSCert = filepath.Join(dir, "client.pem")
+		cfg.TLSKey = filepath.Join(dir, "client-key.pem")
+	}
+	tlsConfig, err := cfg.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	d := dialer(addr)
+	d.MaxRetries = 1
+	d.TLSConfig = tlsConfig
+	return d, nil
+}
+
+func TestTLS(t *testing.T) {
+	dir, _ := certs(t)
+	srv, addr, err := startTLSServer(dir, false, lineServer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	d, err := tlsDialer(dir, addr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &client.Client{Dialer: d}
+	defer c.Close()
+	reply, err := c.Line(context.Background(), "ECHO secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "+OK secret" {
+		t.Fatalf("got reply %q", reply)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, _ := certs(t)
+	// reply with who the client is, through the server's conn wrappers
+	srv, addr, err := startTLSServer(dir, true, server.NewChain(server.LogConn(nil)).Then(func(conn net.Conn) {
+		c := client.NewConn(conn, time.Second, time.Second)
+		id, err := tlsutil.PeerIdentity(conn)
+		if err != nil {
+			c.WriteLine("error " + err.Error())
+		} else {
+			c.WriteLine(fmt.Sprintf("%s %v", id, id.Verified))
+		}
+		c.Flush()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	d, err := tlsDialer(dir, addr, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	line, err := conn.ReadLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "alice true" {
+		t.Fatalf("server saw %q", line)
+	}
+	id, err := tlsutil.PeerIdentity(conn.Conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.CommonName != "server" || len(id.IPAddresses) != 1 {
+		t.Fatalf("client saw server %v %v", id, id.IPAddresses)
+	}
+}
+
+func TestMutualTLSNoCert(t *testing.T) {
+	dir, _ := certs(t)
+	srv, addr, err := startTLSServer(dir, true, lineServer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	d, err := tlsDialer(dir, addr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.Dial(context.Background())
+	if err != nil {
+		// refused during the handshake, fine
+		return
+	}
+	defer conn.Close()
+	// with tls 1.3 the client finds out on its first read
+	if _, err = conn.Line("ECHO x"); err == nil {
+		t.Fatal("expected a client without a certificate to be refused")
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir, ca := certs(t)
+	srv, addr, err := startTLSServer(dir, false, lineServer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	serial := func() (string, error) {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: ca.Pool()})
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.String(), nil
+	}
+	before, err := serial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rotate the certificate on disk
+	next, err := ca.IssueServer("server", []string{"127.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = next.WriteFiles(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	after, err := serial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after == before || after != next.Cert.SerialNumber.String() {
+		t.Fatal("expected the new certificate to be served")
+	}
+}
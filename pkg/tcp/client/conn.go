@@ -0,0 +1,217 @@
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/tcp/frame"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// DefaultMaxFrameSize is the largest frame a Conn will read when its
+// MaxFrameSize is not set.
+const DefaultMaxFrameSize = 16 << 20
+
+// ErrFrameTooLarge is returned when a frame is larger than MaxFrameSize
+var ErrFrameTooLarge = errors.New("tcp: frame too large")
+
+// Conn is a client connection with buffered request/response helpers for
+// line based and length prefixed protocols. The first error from a read
+// or write is kept, see Err, and marks the connection as broken.
+type Conn struct {
+	net.Conn
+	MaxFrameSize int // largest frame ReadFrame accepts, DefaultMaxFrameSize if zero
+
+	r            *bufio.Reader
+	w            *bufio.Writer
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	err          error
+	framer       *frame.Framer
+	idleSince    time.Time // set by the Pool
+}
+
+// NewConn wraps conn. The timeouts apply to each request made with the
+// helpers, zero means no limit.
+func NewConn(conn net.Conn, readTimeout, writeTimeout time.Duration) *Conn {
+	return &Conn{
+		Conn:         conn,
+		r:            bufio.NewReader(conn),
+		w:            bufio.NewWriter(conn),
+		readTimeout:  readTimeout,
+		writeTimeout: writeTimeout,
+	}
+}
+
+// Err returns the first error the connection ran into, if any
+func (c *Conn) Err() error {
+	return c.err
+}
+
+// fail records err if it means the connection can no longer be used
+func (c *Conn) fail(err error) error {
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return err
+}
+
+func (c *Conn) setReadDeadline() error {
+	if c.readTimeout <= 0 {
+		return nil
+	}
+	return c.fail(c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout)))
+}
+
+func (c *Conn) setWriteDeadline() error {
+	if c.writeTimeout <= 0 {
+		return nil
+	}
+	return c.fail(c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout)))
+}
+
+// Reader returns the buffered reader for the connection. Reading from it
+// directly, rather than from the Conn, keeps the buffer in sync with the
+// helpers.
+func (c *Conn) Reader() *bufio.Reader {
+	return c.r
+}
+
+// Writer returns the buffered writer for the connection
+func (c *Conn) Writer() *bufio.Writer {
+	return c.w
+}
+
+// Flush sends any buffered data
+func (c *Conn) Flush() error {
+	if err := c.setWriteDeadline(); err != nil {
+		return err
+	}
+	return c.fail(c.w.Flush())
+}
+
+// WriteLine buffers line followed by "\r\n". Call Flush to send it.
+func (c *Conn) WriteLine(line string) error {
+	if strings.ContainsAny(line, "\r\n") {
+		return fmt.Errorf("tcp: line contains a line break")
+	}
+	if _, err := c.w.WriteString(line); err != nil {
+		return c.fail(err)
+	}
+	_, err := c.w.WriteString("\r\n")
+	return c.fail(err)
+}
+
+// ReadLine reads a line and returns it without its line ending
+func (c *Conn) ReadLine() (string, error) {
+	if err := c.setReadDeadline(); err != nil {
+		return "", err
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", c.fail(err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Line sends a line and reads the reply line
+func (c *Conn) Line(line string) (string, error) {
+	if err := c.WriteLine(line); err != nil {
+		return "", err
+	}
+	if err := c.Flush(); err != nil {
+		return "", err
+	}
+	return c.ReadLine()
+}
+
+// WriteFrame buffers b with its length in front, as an 8 byte little
+// endian integer. That is the same layout data.DataWriter.WriteBinary
+// uses, so either side can use pkg/data. Call Flush to send it.
+func (c *Conn) WriteFrame(b []byte) error {
+	var hdr [8]byte
+	binary.LittleEndian.PutUint64(hdr[:], uint64(len(b)))
+	if _, err := c.w.Write(hdr[:]); err != nil {
+		return c.fail(err)
+	}
+	_, err := c.w.Write(b)
+	return c.fail(err)
+}
+
+// ReadFrame reads a length prefixed frame
+func (c *Conn) ReadFrame() ([]byte, error) {
+	if err := c.setReadDeadline(); err != nil {
+		return nil, err
+	}
+	var hdr [8]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return nil, c.fail(err)
+	}
+	max := c.MaxFrameSize
+	if max <= 0 {
+		max = DefaultMaxFrameSize
+	}
+	n := binary.LittleEndian.Uint64(hdr[:])
+	if n > uint64(max) {
+		// the rest of the stream can't be trusted
+		return nil, c.fail(ErrFrameTooLarge)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return nil, c.fail(err)
+	}
+	return b, nil
+}
+
+// Frame sends a length prefixed frame and reads the reply frame
+func (c *Conn) Frame(b []byte) ([]byte, error) {
+	if err := c.WriteFrame(b); err != nil {
+		return nil, err
+	}
+	if err := c.Flush(); err != nil {
+		return nil, err
+	}
+	return c.ReadFrame()
+}
+
+// Framer returns a frame.Framer for the connection, for protocols that
+// use the checksummed frames of pkg/tcp/frame instead of plain length
+// prefixes. It shares the connection's buffers with the other helpers.
+func (c *Conn) Framer() *frame.Framer {
+	if c.framer == nil {
+		c.framer = frame.NewFramerRW(c.r, c.w)
+		c.framer.SetMaxSize(c.MaxFrameSize)
+	}
+	return c.framer
+}
+
+// Message sends a frame and reads the reply frame. The reply's payload
+// is only valid until the next call to Message.
+func (c *Conn) Message(fr frame.Frame) (frame.Frame, error) {
+	f := c.Framer()
+	if err := c.setWriteDeadline(); err != nil {
+		return frame.Frame{}, err
+	}
+	if err := f.WriteFrame(fr); err != nil {
+		if err == frame.ErrTooLarge {
+			// nothing was written, the connection is still good
+			return frame.Frame{}, err
+		}
+		return frame.Frame{}, c.fail(err)
+	}
+	if err := f.Flush(); err != nil {
+		return frame.Frame{}, c.fail(err)
+	}
+	if err := c.setReadDeadline(); err != nil {
+		return frame.Frame{}, err
+	}
+	reply, err := f.ReadFrame()
+	if err != nil {
+		return frame.Frame{}, c.fail(err)
+	}
+	return reply, nil
+}
@@ -0,0 +1,182 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrPoolClosed is returned by Get after the pool has been closed
+var ErrPoolClosed = errors.New("tcp: pool closed")
+
+// Pool is a bounded pool of connections to one server. Get hands out an
+// idle connection if there is a healthy one, or dials a new one, and
+// blocks while MaxConns connections are already out.
+type Pool struct {
+	Dialer      *Dialer
+	MaxIdle     int           // idle connections kept, MaxConns if zero
+	IdleTimeout time.Duration // idle connections older than this are closed, 0 for no limit
+
+	// HealthCheck, if set, is called on an idle connection before Get
+	// hands it out. A connection that fails it is closed and another
+	// one is tried. CheckConn is always run first.
+	HealthCheck func(conn *Conn) error
+
+	sem    chan struct{} // a slot for every connection that is out
+	mu     sync.Mutex
+	idle   []*Conn
+	closed bool
+}
+
+// NewPool returns a pool of at most maxConns connections made with d
+func NewPool(d *Dialer, maxConns int) *Pool {
+	if maxConns <= 0 {
+		maxConns = 1
+	}
+	return &Pool{
+		Dialer: d,
+		sem:    make(chan struct{}, maxConns),
+	}
+}
+
+// Get returns a connection from the pool. It must be given back with Put
+// once the caller is done with it.
+func (p *Pool) Get(ctx context.Context) (*Conn, error) {
+	select {
+	case p.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	for {
+		conn, err := p.popIdle()
+		if err != nil {
+			<-p.sem
+			return nil, err
+		}
+		if conn == nil {
+			break
+		}
+		if err = p.check(conn); err != nil {
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+	conn, err := p.Dialer.Dial(ctx)
+	if err != nil {
+		<-p.sem
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Put gives a connection back to the pool. Broken connections, ones that
+// have an Err, are closed instead of being kept.
+func (p *Pool) Put(conn *Conn) {
+	defer func() { <-p.sem }()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	max := p.MaxIdle
+	if max <= 0 {
+		max = cap(p.sem)
+	}
+	if p.closed || conn.Err() != nil || len(p.idle) >= max {
+		conn.Close()
+		return
+	}
+	conn.idleSince = time.Now()
+	p.idle = append(p.idle, conn)
+}
+
+// Do runs fn with a connection from the pool
+func (p *Pool) Do(ctx context.Context, fn func(conn *Conn) error) error {
+	conn, err := p.Get(ctx)
+	if err != nil {
+		return err
+	}
+	defer p.Put(conn)
+	return fn(conn)
+}
+
+// Close closes the idle connections. Connections that are out are
+// closed when they are put back.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, conn := range p.idle {
+		conn.Close()
+	}
+	p.idle = nil
+	return nil
+}
+
+// Idle returns the number of idle connections in the pool
+func (p *Pool) Idle() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle)
+}
+
+// popIdle takes the most recently used idle connection, closing any that
+// have been idle for too long
+func (p *Pool) popIdle() (*Conn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+	for len(p.idle) > 0 {
+		conn := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if p.IdleTimeout > 0 && time.Since(conn.idleSince) > p.IdleTimeout {
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+	return nil, nil
+}
+
+func (p *Pool) check(conn *Conn) error {
+	if err := CheckConn(conn); err != nil {
+		return err
+	}
+	if p.HealthCheck != nil {
+		return p.HealthCheck(conn)
+	}
+	return nil
+}
+
+// errUnexpectedData is returned by CheckConn for an idle connection that
+// has something waiting to be read
+var errUnexpectedData = errors.New("tcp: unexpected data on idle connection")
+
+// CheckConn checks that an idle connection has not been closed by the
+// server. It does a read with a very short deadline: a timeout means the
+// connection is fine, anything else (EOF, a reset or stray data) means
+// it is not. The deadline can't be in the past, or the runtime reports
+// the timeout without looking at the socket at all.
+func CheckConn(conn *Conn) error {
+	if conn.r.Buffered() > 0 {
+		return errUnexpectedData
+	}
+	if err := conn.Conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return err
+	}
+	defer conn.Conn.SetReadDeadline(time.Time{})
+	var b [1]byte
+	n, err := conn.Conn.Read(b[:])
+	if n > 0 {
+		return errUnexpectedData
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil
+	}
+	if err == nil {
+		return errUnexpectedData
+	}
+	return err
+}
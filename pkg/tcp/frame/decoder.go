@@ -0,0 +1,105 @@
+package frame
+
+import (
+	"io"
+)
+
+// Decoder reads frames from a stream. It keeps whatever it has read of a
+// frame between calls, so a read that times out part way through a frame
+// can simply be retried without losing the stream's place.
+//
+// The payloads it returns point into its own buffer, which is reused:
+// a payload is only valid until the next call to Decode. Copy it to keep
+// it around.
+type Decoder struct {
+	MaxSize int // largest payload accepted, DefaultMaxSize if zero
+
+	r     io.Reader
+	buf   []byte
+	start int // start of the unread data in buf
+	end   int // end of the unread data in buf
+	err   error
+}
+
+// NewDecoder returns a new Decoder reading from r
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		r:   r,
+		buf: make([]byte, 4096),
+	}
+}
+
+// Decode returns the next frame. Framing errors (a bad magic, version or
+// checksum, or a frame over MaxSize) are sticky, since the stream can no
+// longer be trusted after one.
+func (d *Decoder) Decode() (Frame, error) {
+	if d.err != nil {
+		return Frame{}, d.err
+	}
+	max := d.MaxSize
+	if max <= 0 {
+		max = DefaultMaxSize
+	}
+	for {
+		f, n, err := Parse(d.buf[d.start:d.end], max)
+		if err != nil {
+			d.err = err
+			return Frame{}, err
+		}
+		if n > 0 {
+			d.start += n
+			return f, nil
+		}
+		// we need more data, make sure there is room for the whole frame
+		need := HeaderSize
+		if d.end-d.start >= HeaderSize {
+			size, _ := parseHeader(d.buf[d.start:d.end], max)
+			need += size
+		}
+		d.makeRoom(need)
+		m, err := d.r.Read(d.buf[d.end:])
+		d.end += m
+		if err != nil {
+			if m > 0 {
+				// look at what we got before reporting the error
+				if _, n, _ := Parse(d.buf[d.start:d.end], max); n > 0 {
+					continue
+				}
+			}
+			if err == io.EOF && d.end > d.start {
+				err = io.ErrUnexpectedEOF
+			}
+			return Frame{}, err
+		}
+	}
+}
+
+// Buffered returns the number of bytes read from the stream but not yet
+// returned as frames
+func (d *Decoder) Buffered() int {
+	return d.end - d.start
+}
+
+// makeRoom makes sure the buffer can hold need bytes from start, moving
+// the unread data to the front or growing the buffer as needed
+func (d *Decoder) makeRoom(need int) {
+	if d.start == d.end {
+		d.start, d.end = 0, 0
+	}
+	if len(d.buf)-d.start >= need && d.end < len(d.buf) {
+		return
+	}
+	if need > len(d.buf) {
+		size := 2 * len(d.buf)
+		for size < need {
+			size *= 2
+		}
+		buf := make([]byte, size)
+		d.end = copy(buf, d.buf[d.start:d.end])
+		d.start = 0
+		d.buf = buf
+		return
+	}
+	d.end = copy(d.buf, d.buf[d.start:d.end])
+	d.start = 0
+}
@@ -0,0 +1,109 @@
+package frame
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// The header that goes in front of every frame, little endian like the
+// rest of pkg/data:
+//
+//	magic    uint16  always Magic
+//	version  uint8   always Version
+//	type     uint8   message type, up to the application
+//	flags    uint16  message flags, up to the application
+//	length   uint32  payload length
+//	checksum uint32  CRC-32C of the header fields above and the payload
+const (
+	Magic      uint16 = 0x544e // "NT"
+	Version    uint8  = 1
+	HeaderSize        = 14
+)
+
+// DefaultMaxSize is the largest payload accepted when no max is set
+const DefaultMaxSize = 4 << 20
+
+var (
+	ErrBadMagic   = errors.New("frame: bad magic")
+	ErrBadVersion = errors.New("frame: unsupported version")
+	ErrTooLarge   = errors.New("frame: payload too large")
+	ErrChecksum   = errors.New("frame: checksum mismatch")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Frame is a single message
+type Frame struct {
+	Type    uint8
+	Flags   uint16
+	Payload []byte
+}
+
+func (f Frame) String() string {
+	return fmt.Sprintf("frame{type: %d, flags: %#04x, length: %d}", f.Type, f.Flags, len(f.Payload))
+}
+
+// header fills in the first HeaderSize bytes of b for f
+func (f Frame) header(b []byte) {
+	binary.LittleEndian.PutUint16(b[0:], Magic)
+	b[2] = Version
+	b[3] = f.Type
+	binary.LittleEndian.PutUint16(b[4:], f.Flags)
+	binary.LittleEndian.PutUint32(b[6:], uint32(len(f.Payload)))
+	crc := crc32.Update(crc32.Checksum(b[:10], castagnoli), castagnoli, f.Payload)
+	binary.LittleEndian.PutUint32(b[10:], crc)
+}
+
+// Append appends the encoded frame to b and returns the result
+func (f Frame) Append(b []byte) []byte {
+	var hdr [HeaderSize]byte
+	f.header(hdr[:])
+	b = append(b, hdr[:]...)
+	return append(b, f.Payload...)
+}
+
+// parseHeader checks the header in b and returns the payload length
+func parseHeader(b []byte, max int) (int, error) {
+	if binary.LittleEndian.Uint16(b[0:]) != Magic {
+		return 0, ErrBadMagic
+	}
+	if b[2] != Version {
+		return 0, ErrBadVersion
+	}
+	n := binary.LittleEndian.Uint32(b[6:])
+	if uint64(n) > uint64(max) {
+		return 0, ErrTooLarge
+	}
+	return int(n), nil
+}
+
+// Parse decodes the frame at the start of b. It returns the number of
+// bytes the frame takes up, or 0 if b does not hold a whole frame yet.
+// The payload points into b, it is not copied.
+func Parse(b []byte, max int) (Frame, int, error) {
+	if max <= 0 {
+		max = DefaultMaxSize
+	}
+	if len(b) < HeaderSize {
+		return Frame{}, 0, nil
+	}
+	n, err := parseHeader(b, max)
+	if err != nil {
+		return Frame{}, 0, err
+	}
+	if len(b) < HeaderSize+n {
+		return Frame{}, 0, nil
+	}
+	payload := b[HeaderSize : HeaderSize+n : HeaderSize+n]
+	crc := crc32.Update(crc32.Checksum(b[:10], castagnoli), castagnoli, payload)
+	if crc != binary.LittleEndian.Uint32(b[10:]) {
+		return Frame{}, 0, ErrChecksum
+	}
+	return Frame{
+		Type:    b[3],
+		Flags:   binary.LittleEndian.Uint16(b[4:]),
+		Payload: payload,
+	}, HeaderSize + n, nil
+}
@@ -0,0 +1,110 @@
+package frame
+
+import (
+	"encoding/binary"
+	"github.com/scottcagno/net-tools/pkg/data"
+	"io"
+)
+
+// Framer sends and receives frames over a connection. Writes are
+// buffered until Flush. Reads use a Decoder, so a payload returned by
+// ReadFrame is only valid until the next call to ReadFrame.
+//
+// A Framer may be used by one reader and one writer at the same time,
+// but not by several of either.
+type Framer struct {
+	w   io.Writer
+	dw  *data.DataWriter
+	dec *Decoder
+	hdr [HeaderSize]byte
+}
+
+// NewFramer returns a new Framer for rw, usually a net.Conn
+func NewFramer(rw io.ReadWriter) *Framer {
+	return NewFramerRW(rw, rw)
+}
+
+// NewFramerRW returns a new Framer reading from r and writing to w. If w
+// has a Flush method, Flush calls it too.
+func NewFramerRW(r io.Reader, w io.Writer) *Framer {
+	return &Framer{
+		w:   w,
+		dw:  data.NewDataWriter(w),
+		dec: NewDecoder(r),
+	}
+}
+
+// SetMaxSize sets the largest payload ReadFrame and WriteFrame accept
+func (f *Framer) SetMaxSize(max int) {
+	f.dec.MaxSize = max
+}
+
+func (f *Framer) maxSize() int {
+	if f.dec.MaxSize > 0 {
+		return f.dec.MaxSize
+	}
+	return DefaultMaxSize
+}
+
+// WriteFrame buffers a frame. Call Flush to send it.
+func (f *Framer) WriteFrame(fr Frame) error {
+	if len(fr.Payload) > f.maxSize() {
+		return ErrTooLarge
+	}
+	fr.header(f.hdr[:])
+	// write the header through the data codecs, so the layout stays in
+	// step with pkg/data
+	if err := f.dw.WriteUint16(Magic); err != nil {
+		return err
+	}
+	if err := f.dw.WriteUint8(Version); err != nil {
+		return err
+	}
+	if err := f.dw.WriteUint8(fr.Type); err != nil {
+		return err
+	}
+	if err := f.dw.WriteUint16(fr.Flags); err != nil {
+		return err
+	}
+	if err := f.dw.WriteUint32(uint32(len(fr.Payload))); err != nil {
+		return err
+	}
+	if err := f.dw.WriteUint32(binary.LittleEndian.Uint32(f.hdr[10:])); err != nil {
+		return err
+	}
+	if _, err := f.dw.Write(fr.Payload); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Flush sends the buffered frames
+func (f *Framer) Flush() error {
+	if err := f.dw.Flush(); err != nil {
+		return err
+	}
+	if fl, ok := f.w.(interface{ Flush() error }); ok {
+		return fl.Flush()
+	}
+	return nil
+}
+
+// Send writes a single frame and flushes it
+func (f *Framer) Send(fr Frame) error {
+	if err := f.WriteFrame(fr); err != nil {
+		return err
+	}
+	return f.Flush()
+}
+
+// ReadFrame reads the next frame
+func (f *Framer) ReadFrame() (Frame, error) {
+	return f.dec.Decode()
+}
+
+// Buffered returns the number of bytes read but not yet returned as
+// frames. A server can use it to flush its replies once a batch of
+// pipelined requests has been handled.
+func (f *Framer) Buffered() int {
+	return f.dec.Buffered()
+}
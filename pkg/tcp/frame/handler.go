@@ -0,0 +1,44 @@
+package frame
+
+import (
+	"errors"
+	"github.com/scottcagno/net-tools/pkg/tcp/server"
+	"io"
+	"log"
+	"net"
+)
+
+// HandlerFunc handles a single frame read from a connection, writing any
+// replies with f.WriteFrame. Returning an error closes the connection.
+type HandlerFunc func(f *Framer, fr Frame) error
+
+// NewHandler returns a server.Handler that reads frames from each
+// connection and hands them to fn, as an alternative to the newline
+// framing of server.HandleConn. Replies are flushed once every frame the
+// client sent together has been handled. A maxSize of zero means
+// DefaultMaxSize.
+func NewHandler(maxSize int, fn HandlerFunc) server.Handler {
+	return func(conn net.Conn) {
+		defer conn.Close()
+		f := NewFramer(conn)
+		f.SetMaxSize(maxSize)
+		for {
+			fr, err := f.ReadFrame()
+			if err != nil {
+				if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+					log.Printf("frame: reading from %s: %v\n", conn.RemoteAddr(), err)
+				}
+				return
+			}
+			if err = fn(f, fr); err != nil {
+				f.Flush()
+				return
+			}
+			if f.Buffered() == 0 {
+				if err = f.Flush(); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
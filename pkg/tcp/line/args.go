@@ -0,0 +1,59 @@
+package line
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrUnterminatedQuote is returned by ParseArgs for a quoted argument
+// that is missing its closing quote.
+var ErrUnterminatedQuote = errors.New("line: unterminated quote")
+
+// ParseArgs splits a command line into arguments on spaces and tabs.
+// An argument may be wrapped in double quotes, where \" and \\ are
+// escapes, or in single quotes, which are taken literally. Quoted parts
+// and bare parts next to each other make up a single argument, the way
+// they do in a shell, so `a"b c"` is the one argument "ab c".
+func ParseArgs(line string) ([]string, error) {
+	var args []string
+	var sb strings.Builder
+	inArg := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			if inArg {
+				args = append(args, sb.String())
+				sb.Reset()
+				inArg = false
+			}
+		case '"':
+			inArg = true
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+				sb.WriteByte(line[i])
+			}
+			if i >= len(line) {
+				return nil, ErrUnterminatedQuote
+			}
+		case '\'':
+			inArg = true
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, ErrUnterminatedQuote
+			}
+			sb.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+		default:
+			inArg = true
+			sb.WriteByte(c)
+		}
+	}
+	if inArg {
+		args = append(args, sb.String())
+	}
+	return args, nil
+}
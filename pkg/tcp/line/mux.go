@@ -0,0 +1,249 @@
+package line
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+)
+
+// DefaultMaxLineLength is the longest line a Mux accepts when its
+// MaxLineLength is not set.
+const DefaultMaxLineLength = 4096
+
+// HandlerFunc handles a single command. The args do not include the
+// command name. Returning an error sends it to the client as a -ERR
+// reply; otherwise the handler writes its own reply.
+type HandlerFunc func(s *Session, args []string) error
+
+// Command describes a command registered with a Mux
+type Command struct {
+	Name    string      // the name the command is called by, case insensitive
+	Usage   string      // the arguments, e.g. "key [value]", shown by HELP
+	Help    string      // a short description, shown by HELP
+	MinArgs int         // the least number of arguments allowed
+	MaxArgs int         // the most number of arguments allowed, -1 for no limit
+	Handle  HandlerFunc // called to run the command
+}
+
+// Mux is a line oriented command protocol. Every line the client sends
+// is a command name followed by its arguments, which are split up by
+// ParseArgs. Replies are a single line starting with "+OK" or "-ERR",
+// and a multi-line reply ends with a line holding only a ".". A client
+// can send several commands at once; the replies are written back
+// together once all of them have been handled. HELP and QUIT are built
+// in.
+type Mux struct {
+	Greeting      string      // sent as "+OK greeting" when a client connects, if set
+	MaxLineLength int         // the longest line accepted, DefaultMaxLineLength if zero
+	ErrorLog      *log.Logger // logs connection errors, log.Default() if nil
+
+	// NewSession, if set, is called for every new connection before any
+	// commands are read, so it can set up the session state.
+	NewSession func(s *Session)
+
+	cmds map[string]*Command
+}
+
+// NewMux returns a new, empty Mux
+func NewMux() *Mux {
+	return &Mux{
+		cmds: make(map[string]*Command),
+	}
+}
+
+// Handle registers cmd, replacing any command with the same name
+func (m *Mux) Handle(cmd Command) {
+	if cmd.Handle == nil {
+		panic("line: nil handler for " + cmd.Name)
+	}
+	if m.cmds == nil {
+		m.cmds = make(map[string]*Command)
+	}
+	name := strings.ToUpper(cmd.Name)
+	cmd.Name = name
+	m.cmds[name] = &cmd
+}
+
+// HandleFunc registers fn as the command name, taking any arguments
+func (m *Mux) HandleFunc(name string, fn HandlerFunc) {
+	m.Handle(Command{Name: name, MaxArgs: -1, Handle: fn})
+}
+
+// ServeConn serves the line protocol on conn until the client quits or
+// goes away. It has the signature of a server.Handler, so it can be
+// passed straight to a server in pkg/tcp/server.
+func (m *Mux) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	max := m.MaxLineLength
+	if max <= 0 {
+		max = DefaultMaxLineLength
+	}
+	s := &Session{
+		Conn: conn,
+		// the reader needs room for the line and its \r\n
+		r: bufio.NewReaderSize(conn, max+2),
+		w: bufio.NewWriter(conn),
+	}
+	if m.NewSession != nil {
+		m.NewSession(s)
+	}
+	if m.Greeting != "" {
+		s.OK(m.Greeting)
+		if err := s.Flush(); err != nil {
+			return
+		}
+	}
+	for !s.quit {
+		line, err := m.readLine(s.r)
+		if err == errLineTooLong {
+			s.Err(fmt.Sprintf("line too long, max is %d bytes", max))
+		} else if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				m.logf("line: reading from %s: %v", conn.RemoteAddr(), err)
+			}
+			s.Flush()
+			return
+		} else {
+			m.dispatch(s, line)
+		}
+		// flush once the client has no more pipelined commands waiting
+		if s.r.Buffered() == 0 || s.quit {
+			if err = s.Flush(); err != nil {
+				m.logf("line: writing to %s: %v", conn.RemoteAddr(), err)
+				return
+			}
+		}
+	}
+}
+
+var errLineTooLong = errors.New("line: line too long")
+
+// readLine reads a line, without its line ending. A line that does not
+// fit in the reader's buffer is thrown away and errLineTooLong returned.
+func (m *Mux) readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// skip the rest of the line
+		for err == bufio.ErrBufferFull {
+			_, err = r.ReadSlice('\n')
+		}
+		if err != nil {
+			return "", err
+		}
+		return "", errLineTooLong
+	}
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			// a last line without a line ending
+			return string(line), nil
+		}
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// dispatch parses line and runs the command
+func (m *Mux) dispatch(s *Session, line string) {
+	args, err := ParseArgs(line)
+	if err != nil {
+		s.Err(err.Error())
+		return
+	}
+	if len(args) == 0 {
+		// ignore empty lines
+		return
+	}
+	name := strings.ToUpper(args[0])
+	args = args[1:]
+	switch name {
+	case "HELP":
+		m.help(s, args)
+		return
+	case "QUIT":
+		s.OK("bye")
+		s.Quit()
+		return
+	}
+	cmd, ok := m.cmds[name]
+	if !ok {
+		s.Err(fmt.Sprintf("unknown command %q, try HELP", shorten(name)))
+		return
+	}
+	if len(args) < cmd.MinArgs || (cmd.MaxArgs >= 0 && len(args) > cmd.MaxArgs) {
+		s.Err("wrong number of arguments, usage: " + usage(cmd))
+		return
+	}
+	if err = cmd.Handle(s, args); err != nil {
+		s.Err(err.Error())
+	}
+}
+
+// help replies with the list of commands, or the usage of one command
+func (m *Mux) help(s *Session, args []string) {
+	if len(args) > 0 {
+		name := strings.ToUpper(args[0])
+		switch name {
+		case "HELP":
+			s.OK("HELP [command] - list the commands, or show the usage of one")
+		case "QUIT":
+			s.OK("QUIT - close the connection")
+		default:
+			cmd, ok := m.cmds[name]
+			if !ok {
+				s.Err(fmt.Sprintf("unknown command %q", shorten(name)))
+				return
+			}
+			s.OK(usage(cmd) + helpSuffix(cmd))
+		}
+		return
+	}
+	names := make([]string, 0, len(m.cmds))
+	for name := range m.cmds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := make([]string, 0, len(names)+2)
+	for _, name := range names {
+		cmd := m.cmds[name]
+		lines = append(lines, usage(cmd)+helpSuffix(cmd))
+	}
+	lines = append(lines,
+		"HELP [command] - list the commands, or show the usage of one",
+		"QUIT - close the connection")
+	s.Lines(fmt.Sprintf("%d commands", len(lines)), lines)
+}
+
+func usage(cmd *Command) string {
+	if cmd.Usage == "" {
+		return cmd.Name
+	}
+	return cmd.Name + " " + cmd.Usage
+}
+
+func helpSuffix(cmd *Command) string {
+	if cmd.Help == "" {
+		return ""
+	}
+	return " - " + cmd.Help
+}
+
+// shorten shortens a command name for an error reply
+func shorten(name string) string {
+	if len(name) > 32 {
+		return name[:32] + "..."
+	}
+	return name
+}
+
+func (m *Mux) logf(format string, v ...interface{}) {
+	if m.ErrorLog != nil {
+		m.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
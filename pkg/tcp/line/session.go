@@ -0,0 +1,89 @@
+package line
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Session is the state of a single connection. A Session is only used
+// by the goroutine serving its connection, apart from Get and Set which
+// are safe to call from anywhere.
+type Session struct {
+	Conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+	quit bool
+
+	mu     sync.Mutex
+	values map[string]interface{}
+}
+
+// Get returns the session value stored under key, or nil
+func (s *Session) Get(key string) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.values[key]
+}
+
+// Set stores a session value under key, it lives as long as the connection
+func (s *Session) Set(key string, v interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = v
+}
+
+// OK writes a "+OK msg" reply
+func (s *Session) OK(msg string) error {
+	return s.reply("+OK", msg)
+}
+
+// Err writes a "-ERR msg" reply
+func (s *Session) Err(msg string) error {
+	return s.reply("-ERR", msg)
+}
+
+// Lines writes a "+OK msg" reply followed by the lines and a line with
+// a single ".". Lines starting with a "." get an extra one in front, so
+// the client can strip it back off.
+func (s *Session) Lines(msg string, lines []string) error {
+	if err := s.OK(msg); err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if strings.HasPrefix(line, ".") {
+			line = "." + line
+		}
+		if _, err := s.w.WriteString(line + "\r\n"); err != nil {
+			return err
+		}
+	}
+	_, err := s.w.WriteString(".\r\n")
+	return err
+}
+
+// Flush sends any buffered replies. Replies are flushed automatically
+// once every command that was sent together has been handled, so
+// handlers only need this to push out a reply early.
+func (s *Session) Flush() error {
+	return s.w.Flush()
+}
+
+// Quit ends the session once the current command has been handled
+func (s *Session) Quit() {
+	s.quit = true
+}
+
+func (s *Session) reply(status, msg string) error {
+	// a reply is always a single line
+	msg = strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+	if msg != "" {
+		status += " " + msg
+	}
+	_, err := s.w.WriteString(status + "\r\n")
+	return err
+}
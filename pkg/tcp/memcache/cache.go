@@ -0,0 +1,557 @@
+package memcache
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotStored   = errors.New("memcache: not stored")
+	ErrNotFound    = errors.New("memcache: not found")
+	ErrExists      = errors.New("memcache: changed since it was read")
+	ErrTooLarge    = errors.New("memcache: object too large for cache")
+	ErrOutOfMemory = errors.New("memcache: out of memory storing object")
+	ErrNotNumber   = errors.New("memcache: cannot increment or decrement non-numeric value")
+)
+
+// Config holds the cache settings. The tags let it be filled in by
+// pkg/config.
+type Config struct {
+	MaxMemory    int64   `config:"max-memory" default:"67108864" usage:"most memory used for items, in bytes"`
+	PageSize     int     `config:"page-size" default:"1048576" usage:"size of a slab page, and of the largest item"`
+	MinChunkSize int     `config:"min-chunk-size" default:"96" usage:"size of the smallest slab chunk"`
+	GrowthFactor float64 `config:"growth-factor" default:"1.25" usage:"chunk size of each slab class over the one before"`
+}
+
+// DefaultConfig is the config used for any unset fields
+var DefaultConfig = Config{
+	MaxMemory:    64 << 20,
+	PageSize:     1 << 20,
+	MinChunkSize: 96,
+	GrowthFactor: 1.25,
+}
+
+func (cfg Config) fill() Config {
+	if cfg.MaxMemory <= 0 {
+		cfg.MaxMemory = DefaultConfig.MaxMemory
+	}
+	if cfg.PageSize <= 0 {
+		cfg.PageSize = DefaultConfig.PageSize
+	}
+	if cfg.MinChunkSize <= 0 {
+		cfg.MinChunkSize = DefaultConfig.MinChunkSize
+	}
+	if cfg.GrowthFactor <= 1 {
+		cfg.GrowthFactor = DefaultConfig.GrowthFactor
+	}
+	return cfg
+}
+
+// Item is a cache entry
+type Item struct {
+	Key     string
+	Value   []byte
+	Flags   uint32    // opaque to the cache, stored and handed back
+	Expires time.Time // the zero time for never
+	CAS     uint64    // set by the cache on every change
+}
+
+// item is an entry as stored. Its key and value live in a chunk of one
+// of the slab pages, and it sits on its slab class's LRU list.
+type item struct {
+	key     string
+	chunk   []byte // key then value
+	flags   uint32
+	expires time.Time
+	stored  time.Time
+	cas     uint64
+	class   *slabClass
+
+	prev, next *item // towards the head (newer) and the tail (older)
+}
+
+func (it *item) value() []byte {
+	return it.chunk[len(it.key):]
+}
+
+// slabClass hands out chunks of a single size, carved from pages
+type slabClass struct {
+	id     int
+	size   int
+	pages  int
+	free   [][]byte
+	used   int
+	head   *item
+	tail   *item
+	evicts int64
+}
+
+func (sc *slabClass) push(it *item) {
+	it.prev, it.next = nil, sc.head
+	if sc.head != nil {
+		sc.head.prev = it
+	}
+	sc.head = it
+	if sc.tail == nil {
+		sc.tail = it
+	}
+}
+
+func (sc *slabClass) unlink(it *item) {
+	if it.prev != nil {
+		it.prev.next = it.next
+	} else {
+		sc.head = it.next
+	}
+	if it.next != nil {
+		it.next.prev = it.prev
+	} else {
+		sc.tail = it.prev
+	}
+	it.prev, it.next = nil, nil
+}
+
+// Cache is an LRU cache that keeps its items in slabs, the way memcached
+// does. Memory is handed out a page at a time to slab classes, each of
+// which cuts its pages into chunks of one size, and an item is stored in
+// the smallest chunk it fits in. Once every page has been handed out, a
+// class that needs room evicts its own least recently used item, so the
+// cache never goes over MaxMemory and never fragments. As in memcached,
+// pages stay with the class they were first given to.
+type Cache struct {
+	cfg      Config
+	mu       sync.Mutex
+	classes  []*slabClass
+	items    map[string]*item
+	pages    int
+	maxPages int
+	cas      uint64
+	flushAt  time.Time // items stored before this are gone once it passes
+	stats    cacheStats
+}
+
+// cacheStats are the counters reported by stats
+type cacheStats struct {
+	totalItems  int64
+	bytes       int64
+	getHits     int64
+	getMisses   int64
+	evictions   int64
+	expirations int64
+}
+
+// New returns a new, empty Cache
+func New(cfg Config) *Cache {
+	cfg = cfg.fill()
+	c := &Cache{
+		cfg:      cfg,
+		items:    make(map[string]*item),
+		maxPages: int(cfg.MaxMemory / int64(cfg.PageSize)),
+	}
+	if c.maxPages < 1 {
+		c.maxPages = 1
+	}
+	for size := cfg.MinChunkSize; ; {
+		// keep chunks 8 byte aligned
+		size = (size + 7) &^ 7
+		if size >= cfg.PageSize/2 {
+			break
+		}
+		c.classes = append(c.classes, &slabClass{id: len(c.classes) + 1, size: size})
+		next := int(float64(size) * cfg.GrowthFactor)
+		if next <= size {
+			next = size + 8
+		}
+		size = next
+	}
+	// the last class holds items up to a whole page
+	c.classes = append(c.classes, &slabClass{id: len(c.classes) + 1, size: cfg.PageSize})
+	return c
+}
+
+// classFor returns the smallest class with chunks of at least n bytes
+func (c *Cache) classFor(n int) *slabClass {
+	for _, sc := range c.classes {
+		if sc.size >= n {
+			return sc
+		}
+	}
+	return nil
+}
+
+// alloc returns a chunk of at least n bytes, evicting if need be. The
+// caller must hold the lock.
+func (c *Cache) alloc(n int, now time.Time) ([]byte, *slabClass, error) {
+	sc := c.classFor(n)
+	if sc == nil {
+		return nil, nil, ErrTooLarge
+	}
+	if len(sc.free) == 0 && c.pages < c.maxPages {
+		page := make([]byte, sc.size*(c.cfg.PageSize/sc.size))
+		for off := 0; off+sc.size <= len(page); off += sc.size {
+			sc.free = append(sc.free, page[off:off+sc.size:off+sc.size])
+		}
+		sc.pages++
+		c.pages++
+	}
+	if len(sc.free) == 0 {
+		// look at a few of the oldest items for an expired one before
+		// evicting the oldest
+		victim := sc.tail
+		for it, i := sc.tail, 0; it != nil && i < 5; it, i = it.prev, i+1 {
+			if c.dead(it, now) {
+				victim = it
+				break
+			}
+		}
+		if victim == nil {
+			return nil, nil, ErrOutOfMemory
+		}
+		if c.dead(victim, now) {
+			c.stats.expirations++
+		} else {
+			c.stats.evictions++
+			sc.evicts++
+		}
+		c.remove(victim)
+	}
+	chunk := sc.free[len(sc.free)-1]
+	sc.free = sc.free[:len(sc.free)-1]
+	sc.used++
+	return chunk[:n], sc, nil
+}
+
+// dead reports whether it has expired or been flushed
+func (c *Cache) dead(it *item, now time.Time) bool {
+	if !it.expires.IsZero() && !now.Before(it.expires) {
+		return true
+	}
+	return !c.flushAt.IsZero() && !now.Before(c.flushAt) && !it.stored.After(c.flushAt)
+}
+
+// remove takes it out of the cache and frees its chunk. The caller must
+// hold the lock.
+func (c *Cache) remove(it *item) {
+	sc := it.class
+	sc.unlink(it)
+	sc.free = append(sc.free, it.chunk[:0:sc.size])
+	sc.used--
+	c.stats.bytes -= int64(len(it.chunk))
+	delete(c.items, it.key)
+}
+
+// lookup returns the live item for key, removing it if it has expired.
+// The caller must hold the lock.
+func (c *Cache) lookup(key string, now time.Time) *item {
+	it, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	if c.dead(it, now) {
+		c.stats.expirations++
+		c.remove(it)
+		return nil
+	}
+	return it
+}
+
+// store puts a new item in the cache, replacing any with the same key.
+// The caller must hold the lock.
+func (c *Cache) store(key string, value []byte, flags uint32, expires, now time.Time) (*item, error) {
+	chunk, sc, err := c.alloc(len(key)+len(value), now)
+	if err != nil {
+		return nil, err
+	}
+	if old, ok := c.items[key]; ok {
+		c.remove(old)
+	}
+	copy(chunk, key)
+	copy(chunk[len(key):], value)
+	c.cas++
+	it := &item{
+		key:     key,
+		chunk:   chunk,
+		flags:   flags,
+		expires: expires,
+		stored:  now,
+		cas:     c.cas,
+		class:   sc,
+	}
+	sc.push(it)
+	c.items[key] = it
+	c.stats.totalItems++
+	c.stats.bytes += int64(len(chunk))
+	return it, nil
+}
+
+func (it *item) export() Item {
+	return Item{
+		Key:     it.key,
+		Value:   append([]byte(nil), it.value()...),
+		Flags:   it.flags,
+		Expires: it.expires,
+		CAS:     it.cas,
+	}
+}
+
+// Get returns a copy of the item for key, marking it recently used
+func (c *Cache) Get(key string) (Item, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	it := c.lookup(key, time.Now())
+	if it == nil {
+		c.stats.getMisses++
+		return Item{}, false
+	}
+	c.stats.getHits++
+	it.class.unlink(it)
+	it.class.push(it)
+	return it.export(), true
+}
+
+// Set stores item, whether or not the key is already there
+func (c *Cache) Set(item Item) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	it, err := c.store(item.Key, item.Value, item.Flags, item.Expires, now)
+	if err != nil {
+		// a failed set still drops the old value, as memcached does
+		if old := c.lookup(item.Key, now); old != nil {
+			c.remove(old)
+		}
+		return 0, err
+	}
+	return it.cas, nil
+}
+
+// Add stores item only if the key is not already there
+func (c *Cache) Add(item Item) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if c.lookup(item.Key, now) != nil {
+		return 0, ErrNotStored
+	}
+	it, err := c.store(item.Key, item.Value, item.Flags, item.Expires, now)
+	if err != nil {
+		return 0, err
+	}
+	return it.cas, nil
+}
+
+// Replace stores item only if the key is already there
+func (c *Cache) Replace(item Item) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if c.lookup(item.Key, now) == nil {
+		return 0, ErrNotStored
+	}
+	it, err := c.store(item.Key, item.Value, item.Flags, item.Expires, now)
+	if err != nil {
+		return 0, err
+	}
+	return it.cas, nil
+}
+
+// Append adds data to the end of an existing item's value, keeping its
+// flags and expiry
+func (c *Cache) Append(key string, data []byte) (uint64, error) {
+	return c.concat(key, data, false)
+}
+
+// Prepend adds data to the start of an existing item's value, keeping
+// its flags and expiry
+func (c *Cache) Prepend(key string, data []byte) (uint64, error) {
+	return c.concat(key, data, true)
+}
+
+func (c *Cache) concat(key string, data []byte, before bool) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	old := c.lookup(key, now)
+	if old == nil {
+		return 0, ErrNotStored
+	}
+	// copy the old value out, making room may evict it
+	value := make([]byte, 0, len(old.value())+len(data))
+	if before {
+		value = append(append(value, data...), old.value()...)
+	} else {
+		value = append(append(value, old.value()...), data...)
+	}
+	it, err := c.store(key, value, old.flags, old.expires, now)
+	if err != nil {
+		return 0, err
+	}
+	return it.cas, nil
+}
+
+// CompareAndSwap stores item only if it has not changed since item.CAS
+// was read. It returns ErrNotFound if the key is gone, and ErrExists if
+// it has changed.
+func (c *Cache) CompareAndSwap(item Item) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	old := c.lookup(item.Key, now)
+	if old == nil {
+		return 0, ErrNotFound
+	}
+	if old.cas != item.CAS {
+		return 0, ErrExists
+	}
+	it, err := c.store(item.Key, item.Value, item.Flags, item.Expires, now)
+	if err != nil {
+		return 0, err
+	}
+	return it.cas, nil
+}
+
+// Delete removes key, returning ErrNotFound if it isn't there
+func (c *Cache) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	it := c.lookup(key, time.Now())
+	if it == nil {
+		return ErrNotFound
+	}
+	c.remove(it)
+	return nil
+}
+
+// Incr adds delta to the decimal number stored under key, wrapping
+// around at 2^64, and returns the new value
+func (c *Cache) Incr(key string, delta uint64) (uint64, error) {
+	return c.incr(key, delta, false)
+}
+
+// Decr subtracts delta from the decimal number stored under key,
+// stopping at zero, and returns the new value
+func (c *Cache) Decr(key string, delta uint64) (uint64, error) {
+	return c.incr(key, delta, true)
+}
+
+func (c *Cache) incr(key string, delta uint64, decr bool) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	old := c.lookup(key, now)
+	if old == nil {
+		return 0, ErrNotFound
+	}
+	n, err := strconv.ParseUint(string(old.value()), 10, 64)
+	if err != nil {
+		return 0, ErrNotNumber
+	}
+	switch {
+	case !decr:
+		n += delta
+	case delta > n:
+		n = 0
+	default:
+		n -= delta
+	}
+	if _, err := c.store(key, strconv.AppendUint(nil, n, 10), old.flags, old.expires, now); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Touch sets a new expiry time on key, returning ErrNotFound if it isn't
+// there
+func (c *Cache) Touch(key string, expires time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	it := c.lookup(key, time.Now())
+	if it == nil {
+		return ErrNotFound
+	}
+	it.expires = expires
+	it.class.unlink(it)
+	it.class.push(it)
+	return nil
+}
+
+// FlushAll drops every item stored up to now, once delay has passed. With
+// no delay they are dropped straight away.
+func (c *Cache) FlushAll(delay time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if delay > 0 {
+		c.flushAt = now.Add(delay)
+		return
+	}
+	c.flushAt = time.Time{}
+	for _, it := range c.items {
+		c.remove(it)
+	}
+}
+
+// Len returns the number of items in the cache, some of which may have
+// expired without being noticed yet
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.items)
+}
+
+// Stats is a snapshot of the cache's counters
+type Stats struct {
+	Items       int   // items in the cache now
+	TotalItems  int64 // items ever stored
+	Bytes       int64 // bytes used by the items' keys and values
+	GetHits     int64
+	GetMisses   int64
+	Evictions   int64 // live items dropped to make room
+	Expirations int64 // expired items noticed and dropped
+	MaxBytes    int64
+	Pages       int // slab pages handed out
+	Slabs       []SlabStats
+}
+
+// SlabStats describes one slab class that has been given pages
+type SlabStats struct {
+	ID         int
+	ChunkSize  int
+	Pages      int
+	UsedChunks int
+	FreeChunks int
+	Evictions  int64
+}
+
+// Stats returns a snapshot of the cache's counters
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := Stats{
+		Items:       len(c.items),
+		TotalItems:  c.stats.totalItems,
+		Bytes:       c.stats.bytes,
+		GetHits:     c.stats.getHits,
+		GetMisses:   c.stats.getMisses,
+		Evictions:   c.stats.evictions,
+		Expirations: c.stats.expirations,
+		MaxBytes:    c.cfg.MaxMemory,
+		Pages:       c.pages,
+	}
+	for _, sc := range c.classes {
+		if sc.pages == 0 {
+			continue
+		}
+		st.Slabs = append(st.Slabs, SlabStats{
+			ID:         sc.id,
+			ChunkSize:  sc.size,
+			Pages:      sc.pages,
+			UsedChunks: sc.used,
+			FreeChunks: len(sc.free),
+			Evictions:  sc.evicts,
+		})
+	}
+	return st
+}
@@ -0,0 +1,504 @@
+package memcache_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/tcp/memcache"
+	"github.com/scottcagno/net-tools/pkg/tcp/server"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var quiet = log.New(ioutil.Discard, "", 0)
+
+func TestSlabClasses(t *testing.T) {
+	c := memcache.New(memcache.Config{MaxMemory: 8 << 20})
+	for _, size := range []int{10, 100, 1000, 10000, 100000} {
+		if _, err := c.Set(memcache.Item{Key: "k" + strconv.Itoa(size), Value: make([]byte, size)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st := c.Stats()
+	if len(st.Slabs) != 5 || st.Pages != 5 {
+		t.Fatalf("%d slabs on %d pages, want 5 on 5", len(st.Slabs), st.Pages)
+	}
+	for i, sl := range st.Slabs {
+		if i > 0 && sl.ChunkSize <= st.Slabs[i-1].ChunkSize {
+			t.Fatalf("chunk sizes not increasing: %+v", st.Slabs)
+		}
+		if sl.UsedChunks != 1 {
+			t.Fatalf("slab %d: %d used chunks", sl.ID, sl.UsedChunks)
+		}
+	}
+	// the item must fit its chunk, and the class below must be too small
+	if sz := st.Slabs[1].ChunkSize; sz < 102 || sz > 200 {
+		t.Fatalf("102 byte item in a %d byte chunk", sz)
+	}
+	if _, err := c.Set(memcache.Item{Key: "big", Value: make([]byte, 2<<20)}); err != memcache.ErrTooLarge {
+		t.Fatalf("2MB item: got %v", err)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	// two pages of 64KB, so about 100 of these 1KB items fit
+	c := memcache.New(memcache.Config{MaxMemory: 128 << 10, PageSize: 64 << 10})
+	value := make([]byte, 1000)
+	for i := 0; i < 50; i++ {
+		if _, err := c.Set(memcache.Item{Key: "k" + strconv.Itoa(i), Value: value}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// k0 is read, so it is the most recently used once the rest are in
+	if _, ok := c.Get("k0"); !ok {
+		t.Fatalf("k0 missing before eviction")
+	}
+	for i := 50; i < 300; i++ {
+		if _, err := c.Set(memcache.Item{Key: "k" + strconv.Itoa(i), Value: value}); err != nil {
+			t.Fatal(err)
+		}
+		if i%20 == 0 {
+			c.Get("k0")
+		}
+	}
+	st := c.Stats()
+	if st.Pages != 2 || st.Bytes > 128<<10 {
+		t.Fatalf("over the limit: %d pages, %d bytes", st.Pages, st.Bytes)
+	}
+	if st.Evictions == 0 {
+		t.Fatalf("no evictions")
+	}
+	if _, ok := c.Get("k0"); !ok {
+		t.Fatalf("recently used k0 was evicted")
+	}
+	if _, ok := c.Get("k1"); ok {
+		t.Fatalf("least recently used k1 survived")
+	}
+	if _, ok := c.Get("k299"); !ok {
+		t.Fatalf("newest item missing")
+	}
+	// every page went to the 1KB class, so a different size has no room
+	if _, err := c.Set(memcache.Item{Key: "small", Value: []byte("x")}); err != memcache.ErrOutOfMemory {
+		t.Fatalf("item needing a new class: got %v", err)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	c := memcache.New(memcache.Config{})
+	now := time.Now()
+	c.Set(memcache.Item{Key: "short", Value: []byte("x"), Expires: now.Add(30 * time.Millisecond)})
+	c.Set(memcache.Item{Key: "long", Value: []byte("x"), Expires: now.Add(time.Hour)})
+	c.Set(memcache.Item{Key: "touched", Value: []byte("x"), Expires: now.Add(30 * time.Millisecond)})
+	if err := c.Touch("touched", now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := c.Get("short"); ok {
+		t.Fatalf("short lived item still there")
+	}
+	for _, key := range []string{"long", "touched"} {
+		if _, ok := c.Get(key); !ok {
+			t.Fatalf("%s expired", key)
+		}
+	}
+	if st := c.Stats(); st.Expirations != 1 || st.Items != 2 {
+		t.Fatalf("%d expirations and %d items, want 1 and 2", st.Expirations, st.Items)
+	}
+}
+
+func TestCAS(t *testing.T) {
+	c := memcache.New(memcache.Config{})
+	if _, err := c.CompareAndSwap(memcache.Item{Key: "k", Value: []byte("x"), CAS: 1}); err != memcache.ErrNotFound {
+		t.Fatalf("cas on a missing key: %v", err)
+	}
+	cas, err := c.Set(memcache.Item{Key: "k", Value: []byte("1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	it, _ := c.Get("k")
+	if it.CAS != cas {
+		t.Fatalf("get cas %d, set returned %d", it.CAS, cas)
+	}
+	if _, err := c.CompareAndSwap(memcache.Item{Key: "k", Value: []byte("2"), CAS: cas}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CompareAndSwap(memcache.Item{Key: "k", Value: []byte("3"), CAS: cas}); err != memcache.ErrExists {
+		t.Fatalf("stale cas: %v", err)
+	}
+	if it, _ := c.Get("k"); string(it.Value) != "2" {
+		t.Fatalf("value %q, want 2", it.Value)
+	}
+}
+
+func TestIncrDecr(t *testing.T) {
+	c := memcache.New(memcache.Config{})
+	c.Set(memcache.Item{Key: "n", Value: []byte("10"), Flags: 7})
+	if n, err := c.Incr("n", 5); err != nil || n != 15 {
+		t.Fatalf("incr: %d, %v", n, err)
+	}
+	if n, err := c.Decr("n", 100); err != nil || n != 0 {
+		t.Fatalf("decr below zero: %d, %v", n, err)
+	}
+	c.Set(memcache.Item{Key: "max", Value: []byte("18446744073709551615")})
+	if n, err := c.Incr("max", 2); err != nil || n != 1 {
+		t.Fatalf("incr wrap: %d, %v", n, err)
+	}
+	c.Set(memcache.Item{Key: "s", Value: []byte("abc")})
+	if _, err := c.Incr("s", 1); err != memcache.ErrNotNumber {
+		t.Fatalf("incr on text: %v", err)
+	}
+	if _, err := c.Incr("missing", 1); err != memcache.ErrNotFound {
+		t.Fatalf("incr on missing: %v", err)
+	}
+	if it, _ := c.Get("n"); it.Flags != 7 {
+		t.Fatalf("incr lost the flags: %d", it.Flags)
+	}
+}
+
+func TestFlushDelay(t *testing.T) {
+	c := memcache.New(memcache.Config{})
+	c.Set(memcache.Item{Key: "a", Value: []byte("x")})
+	c.FlushAll(time.Second / 20)
+	if _, ok := c.Get("a"); !ok {
+		t.Fatalf("flushed before the delay")
+	}
+	time.Sleep(time.Second / 10)
+	if _, ok := c.Get("a"); ok {
+		t.Fatalf("not flushed after the delay")
+	}
+	c.Set(memcache.Item{Key: "b", Value: []byte("x")})
+	if _, ok := c.Get("b"); !ok {
+		t.Fatalf("item stored after the flush is gone")
+	}
+	c.FlushAll(0)
+	if c.Len() != 0 {
+		t.Fatalf("%d items after flush_all", c.Len())
+	}
+}
+
+// session is a raw text protocol connection to a fresh server
+type session struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	stop  func()
+	cache *memcache.Cache
+}
+
+func start(cfg memcache.Config) (*session, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	cache := memcache.New(cfg)
+	ms := memcache.NewServer(cache)
+	ms.ErrorLog = quiet
+	srv := &server.Server{Handler: ms.ServeConn, ErrorLog: quiet}
+	go srv.Serve(ln)
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &session{conn: conn, r: bufio.NewReader(conn), stop: func() { conn.Close(); srv.Close() }, cache: cache}, nil
+}
+
+// expect sends req and checks that the reply is exactly want
+func (s *session) expect(req, want string) error {
+	if _, err := s.conn.Write([]byte(req)); err != nil {
+		return err
+	}
+	got := make([]byte, len(want))
+	if _, err := ioReadFull(s.r, got); err != nil {
+		return fmt.Errorf("%q: %v (got %q)", req, err, got)
+	}
+	if string(got) != want {
+		return fmt.Errorf("%q: got %q, want %q", req, got, want)
+	}
+	return nil
+}
+
+func ioReadFull(r *bufio.Reader, b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		m, err := r.Read(b[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (s *session) script(steps [][2]string) error {
+	for _, step := range steps {
+		if err := s.expect(step[0], step[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestStorageCommands(t *testing.T) {
+	s, err := start(memcache.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.stop()
+	if err := s.script([][2]string{
+		{"set a 5 0 3\r\nabc\r\n", "STORED\r\n"},
+		{"get a\r\n", "VALUE a 5 3\r\nabc\r\nEND\r\n"},
+		{"add a 0 0 1\r\nx\r\n", "NOT_STORED\r\n"},
+		{"add b 0 0 1\r\nx\r\n", "STORED\r\n"},
+		{"replace c 0 0 1\r\nx\r\n", "NOT_STORED\r\n"},
+		{"replace b 1 0 2\r\nyy\r\n", "STORED\r\n"},
+		{"append a 9 0 3\r\ndef\r\n", "STORED\r\n"},
+		{"prepend a 9 0 3\r\n123\r\n", "STORED\r\n"},
+		{"append nope 0 0 1\r\nx\r\n", "NOT_STORED\r\n"},
+		{"get a b c\r\n", "VALUE a 5 9\r\n123abcdef\r\nVALUE b 1 2\r\nyy\r\nEND\r\n"},
+		{"set empty 0 0 0\r\n\r\n", "STORED\r\n"},
+		{"get empty\r\n", "VALUE empty 0 0\r\n\r\nEND\r\n"},
+		{"set bin 0 0 4\r\n\r\n\r\n\r\n", "STORED\r\n"},
+		{"get bin\r\n", "VALUE bin 0 4\r\n\r\n\r\n\r\nEND\r\n"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGets(t *testing.T) {
+	s, err := start(memcache.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.stop()
+	if err := s.expect("set k 0 0 1\r\n1\r\n", "STORED\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.conn.Write([]byte("gets k\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := strings.Fields(line)
+	if len(f) != 5 || f[0] != "VALUE" {
+		t.Fatalf("gets: %q", line)
+	}
+	cas := f[4]
+	if err := s.expect("", "1\r\nEND\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.script([][2]string{
+		{"cas k 0 0 1 " + cas + "\r\n2\r\n", "STORED\r\n"},
+		{"cas k 0 0 1 " + cas + "\r\n3\r\n", "EXISTS\r\n"},
+		{"cas nope 0 0 1 1\r\n3\r\n", "NOT_FOUND\r\n"},
+		{"get k\r\n", "VALUE k 0 1\r\n2\r\nEND\r\n"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteIncrTouch(t *testing.T) {
+	s, err := start(memcache.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.stop()
+	if err := s.script([][2]string{
+		{"set n 0 0 2\r\n10\r\n", "STORED\r\n"},
+		{"incr n 5\r\n", "15\r\n"},
+		{"decr n 20\r\n", "0\r\n"},
+		{"incr nope 1\r\n", "NOT_FOUND\r\n"},
+		{"incr n x\r\n", "CLIENT_ERROR invalid numeric delta argument\r\n"},
+		{"set s 0 0 1\r\na\r\n", "STORED\r\n"},
+		{"incr s 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n"},
+		{"delete s\r\n", "DELETED\r\n"},
+		{"delete s\r\n", "NOT_FOUND\r\n"},
+		{"set t 0 1 1\r\nx\r\n", "STORED\r\n"},
+		{"touch t 100\r\n", "TOUCHED\r\n"},
+		{"touch nope 100\r\n", "NOT_FOUND\r\n"},
+		{"set gone 0 -1 1\r\nx\r\n", "STORED\r\n"},
+		{"get gone\r\n", "END\r\n"},
+		{"set abs 0 " + strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10) + " 1\r\nx\r\n", "STORED\r\n"},
+		{"get abs\r\n", "VALUE abs 0 1\r\nx\r\nEND\r\n"},
+		{"flush_all\r\n", "OK\r\n"},
+		{"get n t abs\r\n", "END\r\n"},
+		{"version\r\n", "VERSION 1.6.0\r\n"},
+		{"verbosity 1\r\n", "OK\r\n"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNoreplyPipeline(t *testing.T) {
+	s, err := start(memcache.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.stop()
+	// quiet commands, then a pipeline of gets sent in one write
+	var req bytes.Buffer
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&req, "set k%d 0 0 %d noreply\r\n%d\r\n", i, len(strconv.Itoa(i)), i)
+	}
+	req.WriteString("incr k1 1 noreply\r\ndelete k2 noreply\r\n")
+	var want bytes.Buffer
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&req, "get k%d\r\n", i)
+		switch i {
+		case 1:
+			want.WriteString("VALUE k1 0 1\r\n2\r\nEND\r\n")
+		case 2:
+			want.WriteString("END\r\n")
+		default:
+			fmt.Fprintf(&want, "VALUE k%d 0 %d\r\n%d\r\nEND\r\n", i, len(strconv.Itoa(i)), i)
+		}
+	}
+	if err := s.expect(req.String(), want.String()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	s, err := start(memcache.Config{PageSize: 64 << 10, MaxMemory: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.stop()
+	big := strings.Repeat("x", 100<<10)
+	longKey := strings.Repeat("k", 251)
+	err = s.script([][2]string{
+		{"bogus\r\n", "ERROR\r\n"},
+		{"\r\n", "ERROR\r\n"},
+		{"get\r\n", "ERROR\r\n"},
+		{"set a 0 0\r\n", "CLIENT_ERROR bad command line format\r\n"},
+		{"set a x 0 1\r\n", "CLIENT_ERROR bad command line format\r\n"},
+		{"get " + longKey + "\r\n", "CLIENT_ERROR bad command line format\r\n"},
+		// the data is swallowed so the next command works
+		{"set big 0 0 " + strconv.Itoa(len(big)) + "\r\n" + big + "\r\n", "SERVER_ERROR object too large for cache\r\n"},
+		{"set a 0 0 1\r\nx\r\n", "STORED\r\n"},
+		{"stats nope\r\n", "ERROR\r\n"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a data block that doesn't end where it says ends the connection
+	if err := s.expect("set a 0 0 1\r\nxyz\r\n", "CLIENT_ERROR bad data chunk\r\n"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	s, err := start(memcache.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.stop()
+	s.script([][2]string{
+		{"set a 0 0 1\r\nx\r\n", "STORED\r\n"},
+		{"get a b\r\n", "VALUE a 0 1\r\nx\r\nEND\r\n"},
+	})
+	stats := func(cmd string) (map[string]string, error) {
+		if _, err := s.conn.Write([]byte(cmd)); err != nil {
+			return nil, err
+		}
+		m := map[string]string{}
+		for {
+			line, err := s.r.ReadString('\n')
+			if err != nil {
+				return nil, err
+			}
+			if line == "END\r\n" {
+				return m, nil
+			}
+			f := strings.Fields(line)
+			if len(f) != 3 || f[0] != "STAT" {
+				return nil, fmt.Errorf("bad stats line %q", line)
+			}
+			m[f[1]] = f[2]
+		}
+	}
+	m, err := stats("stats\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{
+		"cmd_get": "2", "cmd_set": "1", "get_hits": "1", "get_misses": "1",
+		"curr_items": "1", "curr_connections": "1", "limit_maxbytes": "67108864",
+	} {
+		if m[k] != v {
+			t.Fatalf("stat %s is %q, want %q", k, m[k], v)
+		}
+	}
+	m, err = stats("stats slabs\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m["active_slabs"] != "1" || m["1:used_chunks"] != "1" || m["1:chunk_size"] != "96" {
+		t.Fatalf("slab stats %v", m)
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := memcache.New(memcache.Config{MaxMemory: 2 << 20, PageSize: 64 << 10})
+	srv, err := server.NewServer(server.Config{}, memcache.NewServer(cache).ServeConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.ErrorLog = quiet
+	go srv.Serve(ln)
+	defer srv.Close()
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for g := 0; g < 10; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			for i := 0; i < 300; i++ {
+				key := "k" + strconv.Itoa(i%50)
+				fmt.Fprintf(conn, "set %s 0 0 2\r\n%02d\r\nincr %s 1\r\nget %s\r\n", key, g, key, key)
+				if line, _ := r.ReadString('\n'); line != "STORED\r\n" {
+					errs <- fmt.Errorf("set: %q", line)
+					return
+				}
+				r.ReadString('\n')
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						errs <- err
+						return
+					}
+					if line == "END\r\n" {
+						break
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if st := cache.Stats(); st.Bytes > 2<<20 || st.Items > 50 {
+		t.Fatalf("%d items in %d bytes", st.Items, st.Bytes)
+	}
+}
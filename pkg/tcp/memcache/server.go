@@ -0,0 +1,524 @@
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// version is reported by the version command and stats
+	version = "1.6.0"
+	// MaxKeyLength is the longest key memcached allows
+	MaxKeyLength = 250
+	// maxLineLength is the longest command line, long enough for a get
+	// of a few hundred keys
+	maxLineLength = 64 << 10
+	// relativeLimit is the longest expiry, in seconds, taken as relative
+	// to now; anything larger is a unix time
+	relativeLimit = 60 * 60 * 24 * 30
+)
+
+// Server speaks the memcached text protocol against a Cache. ServeConn
+// is a server.Handler, so it can be used with pkg/tcp/server and its
+// middleware:
+//
+//	srv, err := server.NewServer(cfg, memcache.NewServer(memcache.New(memcache.Config{})).ServeConn)
+//
+// Pipelined commands are all handled before their replies are flushed,
+// in one write.
+type Server struct {
+	Cache    *Cache
+	ErrorLog *log.Logger // logs connection errors, log.Default() if nil
+
+	started time.Time
+	stats   serverStats
+}
+
+// serverStats are the per-command counters reported by stats
+type serverStats struct {
+	currConns   int64
+	totalConns  int64
+	cmdGet      int64
+	cmdSet      int64
+	cmdFlush    int64
+	cmdTouch    int64
+	deleteHits  int64
+	deleteMiss  int64
+	incrHits    int64
+	incrMiss    int64
+	decrHits    int64
+	decrMiss    int64
+	casHits     int64
+	casMiss     int64
+	casBadval   int64
+	touchHits   int64
+	touchMisses int64
+}
+
+// NewServer returns a new Server using cache
+func NewServer(cache *Cache) *Server {
+	return &Server{Cache: cache, started: time.Now()}
+}
+
+// errQuit ends the connection after the quit command
+var errQuit = errors.New("memcache: quit")
+
+// ServeConn serves a single client connection until it quits or the
+// connection is closed
+func (s *Server) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	atomic.AddInt64(&s.stats.currConns, 1)
+	defer atomic.AddInt64(&s.stats.currConns, -1)
+	atomic.AddInt64(&s.stats.totalConns, 1)
+
+	r := bufio.NewReaderSize(conn, 16<<10)
+	w := bufio.NewWriter(conn)
+	defer w.Flush()
+	for {
+		line, err := readLine(r)
+		if err == errLineTooLong {
+			w.WriteString("CLIENT_ERROR line too long\r\n")
+			return
+		}
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				s.logf("memcache: reading from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if err = s.handle(r, w, strings.Fields(line)); err != nil {
+			if err != errQuit {
+				s.logf("memcache: %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		// write the replies once the pipeline is drained
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+var errLineTooLong = errors.New("memcache: line too long")
+
+// readLine reads a line, without its line ending
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		b, err := r.ReadSlice('\n')
+		line = append(line, b...)
+		if len(line) > maxLineLength {
+			return "", errLineTooLong
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return string(bytes.TrimRight(line, "\r\n")), nil
+	}
+}
+
+// handle runs a single command. An error ends the connection.
+func (s *Server) handle(r *bufio.Reader, w *bufio.Writer, args []string) error {
+	if len(args) == 0 {
+		w.WriteString("ERROR\r\n")
+		return nil
+	}
+	switch cmd := args[0]; cmd {
+	case "get", "gets":
+		return s.get(w, args[1:], cmd == "gets")
+	case "set", "add", "replace", "append", "prepend", "cas":
+		return s.storage(r, w, cmd, args[1:])
+	case "delete":
+		return s.delete(w, args[1:])
+	case "incr", "decr":
+		return s.incr(w, cmd == "decr", args[1:])
+	case "touch":
+		return s.touch(w, args[1:])
+	case "stats":
+		return s.writeStats(w, args[1:])
+	case "flush_all":
+		return s.flushAll(w, args[1:])
+	case "version":
+		w.WriteString("VERSION " + version + "\r\n")
+	case "verbosity":
+		reply(w, noreply(args), "OK")
+	case "quit":
+		return errQuit
+	default:
+		w.WriteString("ERROR\r\n")
+	}
+	return nil
+}
+
+// noreply reports whether the last argument is "noreply", which turns
+// off the reply to a command
+func noreply(args []string) bool {
+	return len(args) > 0 && args[len(args)-1] == "noreply"
+}
+
+func reply(w *bufio.Writer, quiet bool, msg string) {
+	if !quiet {
+		w.WriteString(msg + "\r\n")
+	}
+}
+
+func clientError(w *bufio.Writer, msg string) {
+	w.WriteString("CLIENT_ERROR " + msg + "\r\n")
+}
+
+func validKey(key string) bool {
+	if len(key) == 0 || len(key) > MaxKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// expiry turns a memcached expiry time into a time.Time: 0 is never, up
+// to 30 days is seconds from now, anything more a unix time, and less
+// than 0 already expired
+func expiry(n int64, now time.Time) time.Time {
+	switch {
+	case n == 0:
+		return time.Time{}
+	case n < 0:
+		return now
+	case n <= relativeLimit:
+		return now.Add(time.Duration(n) * time.Second)
+	}
+	return time.Unix(n, 0)
+}
+
+func (s *Server) get(w *bufio.Writer, keys []string, withCAS bool) error {
+	if len(keys) == 0 {
+		w.WriteString("ERROR\r\n")
+		return nil
+	}
+	for _, key := range keys {
+		if !validKey(key) {
+			clientError(w, "bad command line format")
+			return nil
+		}
+	}
+	for _, key := range keys {
+		atomic.AddInt64(&s.stats.cmdGet, 1)
+		it, ok := s.Cache.Get(key)
+		if !ok {
+			continue
+		}
+		if withCAS {
+			fmt.Fprintf(w, "VALUE %s %d %d %d\r\n", it.Key, it.Flags, len(it.Value), it.CAS)
+		} else {
+			fmt.Fprintf(w, "VALUE %s %d %d\r\n", it.Key, it.Flags, len(it.Value))
+		}
+		w.Write(it.Value)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("END\r\n")
+	return nil
+}
+
+// storage runs set, add, replace, append, prepend and cas:
+//
+//	<cmd> <key> <flags> <exptime> <bytes> [noreply]
+//	cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]
+//
+// followed by a line of data
+func (s *Server) storage(r *bufio.Reader, w *bufio.Writer, cmd string, args []string) error {
+	quiet := noreply(args)
+	if quiet {
+		args = args[:len(args)-1]
+	}
+	want := 4
+	if cmd == "cas" {
+		want = 5
+	}
+	if len(args) != want || !validKey(args[0]) {
+		clientError(w, "bad command line format")
+		return nil
+	}
+	flags, err1 := strconv.ParseUint(args[1], 10, 32)
+	exptime, err2 := strconv.ParseInt(args[2], 10, 64)
+	size, err3 := strconv.Atoi(args[3])
+	var cas uint64
+	var err4 error
+	if cmd == "cas" {
+		cas, err4 = strconv.ParseUint(args[4], 10, 64)
+	}
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || size < 0 {
+		clientError(w, "bad command line format")
+		return nil
+	}
+	atomic.AddInt64(&s.stats.cmdSet, 1)
+	if size > s.Cache.cfg.PageSize {
+		// swallow the data so the connection stays in step
+		if _, err := r.Discard(size + 2); err != nil {
+			return err
+		}
+		w.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return nil
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	if !bytes.HasSuffix(data, []byte("\r\n")) {
+		clientError(w, "bad data chunk")
+		return errors.New("bad data chunk")
+	}
+	item := Item{
+		Key:     args[0],
+		Value:   data[:size],
+		Flags:   uint32(flags),
+		Expires: expiry(exptime, time.Now()),
+		CAS:     cas,
+	}
+	var err error
+	switch cmd {
+	case "set":
+		_, err = s.Cache.Set(item)
+	case "add":
+		_, err = s.Cache.Add(item)
+	case "replace":
+		_, err = s.Cache.Replace(item)
+	case "append":
+		_, err = s.Cache.Append(item.Key, item.Value)
+	case "prepend":
+		_, err = s.Cache.Prepend(item.Key, item.Value)
+	case "cas":
+		_, err = s.Cache.CompareAndSwap(item)
+		switch err {
+		case nil:
+			atomic.AddInt64(&s.stats.casHits, 1)
+		case ErrNotFound:
+			atomic.AddInt64(&s.stats.casMiss, 1)
+		case ErrExists:
+			atomic.AddInt64(&s.stats.casBadval, 1)
+		}
+	}
+	switch err {
+	case nil:
+		reply(w, quiet, "STORED")
+	case ErrNotStored:
+		reply(w, quiet, "NOT_STORED")
+	case ErrExists:
+		reply(w, quiet, "EXISTS")
+	case ErrNotFound:
+		reply(w, quiet, "NOT_FOUND")
+	case ErrTooLarge:
+		reply(w, quiet, "SERVER_ERROR object too large for cache")
+	default:
+		reply(w, quiet, "SERVER_ERROR "+strings.TrimPrefix(err.Error(), "memcache: "))
+	}
+	return nil
+}
+
+// delete runs delete <key> [noreply]
+func (s *Server) delete(w *bufio.Writer, args []string) error {
+	quiet := noreply(args)
+	if quiet {
+		args = args[:len(args)-1]
+	}
+	// an old form allowed a time after the key, but only 0
+	if len(args) == 2 && args[1] == "0" {
+		args = args[:1]
+	}
+	if len(args) != 1 || !validKey(args[0]) {
+		clientError(w, "bad command line format")
+		return nil
+	}
+	if err := s.Cache.Delete(args[0]); err != nil {
+		atomic.AddInt64(&s.stats.deleteMiss, 1)
+		reply(w, quiet, "NOT_FOUND")
+		return nil
+	}
+	atomic.AddInt64(&s.stats.deleteHits, 1)
+	reply(w, quiet, "DELETED")
+	return nil
+}
+
+// incr runs incr and decr <key> <delta> [noreply]
+func (s *Server) incr(w *bufio.Writer, decr bool, args []string) error {
+	quiet := noreply(args)
+	if quiet {
+		args = args[:len(args)-1]
+	}
+	if len(args) != 2 || !validKey(args[0]) {
+		clientError(w, "bad command line format")
+		return nil
+	}
+	delta, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		clientError(w, "invalid numeric delta argument")
+		return nil
+	}
+	var n uint64
+	if decr {
+		n, err = s.Cache.Decr(args[0], delta)
+	} else {
+		n, err = s.Cache.Incr(args[0], delta)
+	}
+	hits, misses := &s.stats.incrHits, &s.stats.incrMiss
+	if decr {
+		hits, misses = &s.stats.decrHits, &s.stats.decrMiss
+	}
+	switch err {
+	case nil:
+		atomic.AddInt64(hits, 1)
+		reply(w, quiet, strconv.FormatUint(n, 10))
+	case ErrNotFound:
+		atomic.AddInt64(misses, 1)
+		reply(w, quiet, "NOT_FOUND")
+	case ErrNotNumber:
+		clientError(w, "cannot increment or decrement non-numeric value")
+	default:
+		reply(w, quiet, "SERVER_ERROR "+strings.TrimPrefix(err.Error(), "memcache: "))
+	}
+	return nil
+}
+
+// touch runs touch <key> <exptime> [noreply]
+func (s *Server) touch(w *bufio.Writer, args []string) error {
+	quiet := noreply(args)
+	if quiet {
+		args = args[:len(args)-1]
+	}
+	if len(args) != 2 || !validKey(args[0]) {
+		clientError(w, "bad command line format")
+		return nil
+	}
+	exptime, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		clientError(w, "invalid exptime argument")
+		return nil
+	}
+	atomic.AddInt64(&s.stats.cmdTouch, 1)
+	if err := s.Cache.Touch(args[0], expiry(exptime, time.Now())); err != nil {
+		atomic.AddInt64(&s.stats.touchMisses, 1)
+		reply(w, quiet, "NOT_FOUND")
+		return nil
+	}
+	atomic.AddInt64(&s.stats.touchHits, 1)
+	reply(w, quiet, "TOUCHED")
+	return nil
+}
+
+// flushAll runs flush_all [delay] [noreply]
+func (s *Server) flushAll(w *bufio.Writer, args []string) error {
+	quiet := noreply(args)
+	if quiet {
+		args = args[:len(args)-1]
+	}
+	var delay int64
+	if len(args) > 1 {
+		clientError(w, "bad command line format")
+		return nil
+	}
+	if len(args) == 1 {
+		var err error
+		if delay, err = strconv.ParseInt(args[0], 10, 64); err != nil || delay < 0 {
+			clientError(w, "bad command line format")
+			return nil
+		}
+	}
+	atomic.AddInt64(&s.stats.cmdFlush, 1)
+	s.Cache.FlushAll(time.Duration(delay) * time.Second)
+	reply(w, quiet, "OK")
+	return nil
+}
+
+// writeStats runs stats [slabs|settings]
+func (s *Server) writeStats(w *bufio.Writer, args []string) error {
+	st := s.Cache.Stats()
+	stat := func(name string, v interface{}) {
+		fmt.Fprintf(w, "STAT %s %v\r\n", name, v)
+	}
+	section := ""
+	if len(args) > 0 {
+		section = args[0]
+	}
+	switch section {
+	case "":
+		now := time.Now()
+		stat("pid", os.Getpid())
+		stat("uptime", int64(now.Sub(s.started)/time.Second))
+		stat("time", now.Unix())
+		stat("version", version)
+		stat("threads", runtime.GOMAXPROCS(0))
+		stat("curr_connections", atomic.LoadInt64(&s.stats.currConns))
+		stat("total_connections", atomic.LoadInt64(&s.stats.totalConns))
+		stat("cmd_get", atomic.LoadInt64(&s.stats.cmdGet))
+		stat("cmd_set", atomic.LoadInt64(&s.stats.cmdSet))
+		stat("cmd_flush", atomic.LoadInt64(&s.stats.cmdFlush))
+		stat("cmd_touch", atomic.LoadInt64(&s.stats.cmdTouch))
+		stat("get_hits", st.GetHits)
+		stat("get_misses", st.GetMisses)
+		stat("delete_misses", atomic.LoadInt64(&s.stats.deleteMiss))
+		stat("delete_hits", atomic.LoadInt64(&s.stats.deleteHits))
+		stat("incr_misses", atomic.LoadInt64(&s.stats.incrMiss))
+		stat("incr_hits", atomic.LoadInt64(&s.stats.incrHits))
+		stat("decr_misses", atomic.LoadInt64(&s.stats.decrMiss))
+		stat("decr_hits", atomic.LoadInt64(&s.stats.decrHits))
+		stat("cas_misses", atomic.LoadInt64(&s.stats.casMiss))
+		stat("cas_hits", atomic.LoadInt64(&s.stats.casHits))
+		stat("cas_badval", atomic.LoadInt64(&s.stats.casBadval))
+		stat("touch_hits", atomic.LoadInt64(&s.stats.touchHits))
+		stat("touch_misses", atomic.LoadInt64(&s.stats.touchMisses))
+		stat("limit_maxbytes", st.MaxBytes)
+		stat("bytes", st.Bytes)
+		stat("curr_items", st.Items)
+		stat("total_items", st.TotalItems)
+		stat("evictions", st.Evictions)
+		stat("reclaimed", st.Expirations)
+	case "slabs":
+		for _, sl := range st.Slabs {
+			prefix := strconv.Itoa(sl.ID) + ":"
+			stat(prefix+"chunk_size", sl.ChunkSize)
+			stat(prefix+"total_pages", sl.Pages)
+			stat(prefix+"total_chunks", sl.UsedChunks+sl.FreeChunks)
+			stat(prefix+"used_chunks", sl.UsedChunks)
+			stat(prefix+"free_chunks", sl.FreeChunks)
+			stat(prefix+"evicted", sl.Evictions)
+		}
+		stat("active_slabs", len(st.Slabs))
+		stat("total_malloced", int64(st.Pages)*int64(s.Cache.cfg.PageSize))
+	case "settings":
+		stat("maxbytes", st.MaxBytes)
+		stat("item_size_max", s.Cache.cfg.PageSize)
+		stat("slab_chunk_min", s.Cache.cfg.MinChunkSize)
+		stat("growth_factor", s.Cache.cfg.GrowthFactor)
+	default:
+		w.WriteString("ERROR\r\n")
+		return nil
+	}
+	w.WriteString("END\r\n")
+	return nil
+}
+
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
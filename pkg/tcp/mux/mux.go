@@ -0,0 +1,101 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Every message is a frame from pkg/tcp/frame. The frame type is one of
+// the types below, the frame flags hold the flags below, and the payload
+// starts with the 4 byte little endian stream id. What follows depends
+// on the type:
+//
+//	typeData    the stream data
+//	typeWindow  a uint32 window increment
+//	typePing    a uint32 opaque value, echoed back in the ACK
+//	typeGoAway  a uint32 reason code
+const (
+	typeData   uint8 = 1
+	typeWindow uint8 = 2
+	typePing   uint8 = 3
+	typeGoAway uint8 = 4
+)
+
+const (
+	flagSYN uint16 = 1 << iota // opens a stream, or is a ping request
+	flagACK                    // accepts a stream, or is a ping reply
+	flagFIN                    // half closes a stream
+	flagRST                    // resets a stream
+)
+
+// GoAway reason codes
+const (
+	GoAwayNormal        uint32 = 0
+	GoAwayProtocolError uint32 = 1
+	GoAwayInternalError uint32 = 2
+)
+
+// initialWindow is the receive window every stream starts with. A side
+// that wants a bigger one sends the difference when the stream opens.
+const initialWindow = 256 << 10
+
+var (
+	ErrSessionShutdown  = errors.New("mux: session shutdown")
+	ErrRemoteGoAway     = errors.New("mux: remote sent go away, no new streams")
+	ErrStreamClosed     = errors.New("mux: stream closed")
+	ErrStreamReset      = errors.New("mux: stream reset")
+	ErrStreamsExhausted = errors.New("mux: stream ids exhausted")
+	ErrKeepAliveTimeout = errors.New("mux: keep alive timeout")
+	ErrProtocol         = errors.New("mux: protocol error")
+	ErrControlOverflow  = errors.New("mux: too many replies waiting to be sent")
+)
+
+// Config holds the settings for a session. The tags let it be filled in
+// by pkg/config.
+type Config struct {
+	AcceptBacklog     int           `config:"accept-backlog" default:"256" usage:"streams waiting to be accepted before new ones are reset"`
+	MaxStreamWindow   uint32        `config:"max-stream-window" default:"262144" usage:"receive window of each stream in bytes"`
+	KeepAliveInterval time.Duration `config:"keep-alive-interval" default:"30s" usage:"time between keep alive pings, 0 to turn them off"`
+	WriteTimeout      time.Duration `config:"write-timeout" default:"10s" usage:"max duration of a write to the connection, and of a ping"`
+	MaxFrameSize      int           `config:"max-frame-size" default:"65536" usage:"largest data frame sent, in bytes"`
+}
+
+// DefaultConfig returns the default settings
+func DefaultConfig() *Config {
+	return &Config{
+		AcceptBacklog:     256,
+		MaxStreamWindow:   initialWindow,
+		KeepAliveInterval: 30 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		MaxFrameSize:      64 << 10,
+	}
+}
+
+// fill replaces unset values with the defaults
+func (c *Config) fill() *Config {
+	out := DefaultConfig()
+	if c == nil {
+		return out
+	}
+	out.KeepAliveInterval = c.KeepAliveInterval
+	if c.AcceptBacklog > 0 {
+		out.AcceptBacklog = c.AcceptBacklog
+	}
+	if c.MaxStreamWindow > initialWindow {
+		out.MaxStreamWindow = c.MaxStreamWindow
+	}
+	if c.WriteTimeout > 0 {
+		out.WriteTimeout = c.WriteTimeout
+	}
+	if c.MaxFrameSize > 0 {
+		out.MaxFrameSize = c.MaxFrameSize
+	}
+	return out
+}
+
+func putUint32(b []byte, v uint32) []byte {
+	var tmp [4]byte
+	binary.LittleEndian.PutUint32(tmp[:], v)
+	return append(b, tmp[:]...)
+}
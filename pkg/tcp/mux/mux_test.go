@@ -0,0 +1,403 @@
+package mux_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/tcp/frame"
+	"github.com/scottcagno/net-tools/pkg/tcp/mux"
+	"github.com/scottcagno/net-tools/pkg/tcp/server"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pair returns a client and server session over a loopback connection
+func pair(cfg *mux.Config) (*mux.Session, *mux.Session, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ln.Close()
+	conns := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		conns <- conn
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	sconn := <-conns
+	if sconn == nil {
+		return nil, nil, errors.New("accept failed")
+	}
+	return mux.Client(conn, cfg), mux.Server(sconn, cfg), nil
+}
+
+// echo copies everything back, then closes its end
+func echo(conn net.Conn) {
+	io.Copy(conn, conn)
+	conn.Close()
+}
+
+// roundTrip sends msg on a new stream, closes the write side and reads
+// back everything until EOF
+func roundTrip(s *mux.Session, msg []byte) error {
+	st, err := s.Open()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := st.Write(msg)
+		if err == nil {
+			err = st.Close()
+		}
+		errc <- err
+	}()
+	got, err := io.ReadAll(st)
+	if err != nil {
+		return err
+	}
+	if err = <-errc; err != nil {
+		return err
+	}
+	if !bytes.Equal(got, msg) {
+		return fmt.Errorf("stream %d: sent %d bytes, got %d back", st.StreamID(), len(msg), len(got))
+	}
+	return nil
+}
+
+func random(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+func TestOpenAccept(t *testing.T) {
+	c, s, err := pair(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer s.Close()
+	go func() {
+		for {
+			st, err := s.AcceptStream()
+			if err != nil {
+				return
+			}
+			go echo(st)
+		}
+	}()
+	if err := roundTrip(c, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	c, s, err := pair(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer s.Close()
+	go func() {
+		for {
+			st, err := s.AcceptStream()
+			if err != nil {
+				return
+			}
+			go echo(st)
+		}
+	}()
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := roundTrip(c, random(i*20000)); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	if err = <-errs; err != nil {
+		t.Fatal(err)
+	}
+	// give the last FINs a moment to arrive
+	time.Sleep(50 * time.Millisecond)
+	if n := c.NumStreams(); n != 0 {
+		t.Fatalf("%d streams left open", n)
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	c, s, err := pair(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer s.Close()
+	// a slow stream that nobody reads from...
+	slow, err := c.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.AcceptStream(); err != nil {
+		t.Fatal(err)
+	}
+	slow.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := slow.Write(make([]byte, 1<<20))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the write to block and time out, got %v after %d bytes", err, n)
+	}
+	if n != 256<<10 {
+		t.Fatalf("expected one window (%d bytes) to get through, got %d", 256<<10, n)
+	}
+	// ...does not hold up the others
+	go func() {
+		st, err := s.AcceptStream()
+		if err == nil {
+			echo(st)
+		}
+	}()
+	if err := roundTrip(c, random(1<<20)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	c, s, err := pair(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer s.Close()
+	st, err := c.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Write([]byte("question"))
+	st.Close()
+	sst, err := s.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := io.ReadAll(sst)
+	if err != nil || string(q) != "question" {
+		t.Fatalf("got %q, %v", q, err)
+	}
+	// the server can still answer after the client closed its end
+	if _, err = sst.Write([]byte("answer")); err != nil {
+		t.Fatal(err)
+	}
+	sst.Close()
+	a, err := io.ReadAll(st)
+	if err != nil || string(a) != "answer" {
+		t.Fatalf("got %q, %v", a, err)
+	}
+	if _, err = st.Write([]byte("more")); err != mux.ErrStreamClosed {
+		t.Fatalf("expected ErrStreamClosed writing after Close, got %v", err)
+	}
+}
+
+func TestServerServe(t *testing.T) {
+	c, s, err := pair(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// the session is a net.Listener, so a server can serve its streams
+	srv := &server.Server{Handler: echo}
+	go srv.Serve(s)
+	defer srv.Close()
+	if err := roundTrip(c, []byte("served")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &server.Server{Handler: mux.Handler(nil, echo)}
+	go srv.Serve(ln)
+	defer srv.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mux.Client(conn, nil)
+	defer c.Close()
+	for i := 0; i < 3; i++ {
+		if err = roundTrip(c, []byte(fmt.Sprint("stream ", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := srv.ActiveConns(); n != 1 {
+		t.Fatalf("expected 1 connection, server has %d", n)
+	}
+}
+
+func TestPing(t *testing.T) {
+	c, s, err := pair(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer s.Close()
+	if _, err = c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Ping()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	// a peer that reads everything and never answers
+	srv, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	go func() {
+		conn, err := srv.Accept()
+		if err == nil {
+			io.Copy(io.Discard, conn)
+		}
+	}()
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mux.Client(conn, &mux.Config{
+		KeepAliveInterval: 50 * time.Millisecond,
+		WriteTimeout:      100 * time.Millisecond,
+	})
+	defer c.Close()
+	select {
+	case <-c.CloseChan():
+	case <-time.After(time.Second):
+		t.Fatal("the session never noticed the peer was gone")
+	}
+	if _, err = c.Open(); err != mux.ErrSessionShutdown {
+		t.Fatalf("expected ErrSessionShutdown, got %v", err)
+	}
+}
+
+func TestPingFlood(t *testing.T) {
+	// a peer that sends ping requests and never reads the replies
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	s := mux.Server(conn, &mux.Config{KeepAliveInterval: 0})
+	defer s.Close()
+	go func() {
+		f := frame.NewFramer(peer)
+		for i := uint32(0); ; i++ {
+			// a ping (type 3) with SYN set, stream id 0 and i as its value
+			payload := make([]byte, 8)
+			binary.LittleEndian.PutUint32(payload[4:], i)
+			if err := f.Send(frame.Frame{Type: 3, Flags: 1, Payload: payload}); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case <-s.CloseChan():
+	case <-time.After(2 * time.Second):
+		t.Fatal("the session kept queueing replies the peer never read")
+	}
+	if _, err := s.Accept(); err != mux.ErrControlOverflow {
+		t.Fatalf("expected ErrControlOverflow, got %v", err)
+	}
+}
+
+func TestGoAway(t *testing.T) {
+	c, s, err := pair(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer s.Close()
+	go func() {
+		for {
+			st, err := s.AcceptStream()
+			if err != nil {
+				return
+			}
+			go echo(st)
+		}
+	}()
+	st, err := c.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// make sure the server has the stream before it goes away
+	st.Write([]byte("ping"))
+	if _, err = io.ReadFull(st, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.GoAway(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err = c.Open(); err != mux.ErrRemoteGoAway {
+		t.Fatalf("expected ErrRemoteGoAway, got %v", err)
+	}
+	// the stream that was already open carries on
+	st.Write([]byte("still here"))
+	st.Close()
+	b, err := io.ReadAll(st)
+	if err != nil || string(b) != "still here" {
+		t.Fatalf("got %q, %v", b, err)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	c, s, err := pair(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	st, err := c.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sst, err := s.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := sst.Read(make([]byte, 1))
+		errc <- err
+	}()
+	c.Close()
+	if _, err = st.Write([]byte("x")); err != mux.ErrSessionShutdown {
+		t.Fatalf("expected ErrSessionShutdown, got %v", err)
+	}
+	select {
+	case err = <-errc:
+		if err == nil {
+			t.Fatal("expected the remote read to fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the remote read never returned")
+	}
+	if _, err = s.AcceptStream(); err == nil {
+		t.Fatal("expected Accept to fail once the session is closed")
+	}
+}
@@ -0,0 +1,451 @@
+package mux
+
+import (
+	"encoding/binary"
+	"github.com/scottcagno/net-tools/pkg/tcp/frame"
+	"github.com/scottcagno/net-tools/pkg/tcp/server"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// controlQueueSize is how many replies sent by the receive loop (ping ACKs,
+// RSTs and GOAWAYs) may wait to be written before the session is shut
+// down. The other side only gets that far ahead by not reading.
+const controlQueueSize = 64
+
+// control is a reply waiting in the control queue
+type control struct {
+	typ   uint8
+	flags uint16
+	id    uint32
+	body  []byte
+}
+
+// Session multiplexes streams over a single connection. Either side can
+// open streams; the side created with Client uses odd stream ids and the
+// side created with Server even ones. A Session is a net.Listener for
+// the streams the other side opens, so it can be handed to
+// server.Server.Serve like any other listener.
+type Session struct {
+	cfg  *Config
+	conn net.Conn
+	f    *frame.Framer
+	wmu  sync.Mutex // guards writes to f
+	ctrl chan control
+
+	nextID uint32 // the next id to use for a stream we open
+
+	mu           sync.Mutex
+	streams      map[uint32]*Stream
+	localGoAway  bool
+	remoteGoAway bool
+	accept       chan *Stream
+	pings        map[uint32]chan struct{}
+	nextPing     uint32
+	shutdown     bool
+	shutdownErr  error
+	shutdownCh   chan struct{}
+	shutdownOnce sync.Once
+}
+
+// Client starts the client side of a session over conn. A nil cfg uses
+// DefaultConfig.
+func Client(conn net.Conn, cfg *Config) *Session {
+	return newSession(conn, cfg, 1)
+}
+
+// Server starts the server side of a session over conn. A nil cfg uses
+// DefaultConfig.
+func Server(conn net.Conn, cfg *Config) *Session {
+	return newSession(conn, cfg, 2)
+}
+
+func newSession(conn net.Conn, cfg *Config, firstID uint32) *Session {
+	cfg = cfg.fill()
+	s := &Session{
+		cfg:        cfg,
+		conn:       conn,
+		f:          frame.NewFramer(conn),
+		nextID:     firstID,
+		streams:    make(map[uint32]*Stream),
+		accept:     make(chan *Stream, cfg.AcceptBacklog),
+		ctrl:       make(chan control, controlQueueSize),
+		pings:      make(map[uint32]chan struct{}),
+		shutdownCh: make(chan struct{}),
+	}
+	// room for the largest data frame and its stream id
+	s.f.SetMaxSize(cfg.MaxFrameSize + 4)
+	go s.recvLoop()
+	go s.controlLoop()
+	if cfg.KeepAliveInterval > 0 {
+		go s.keepAlive()
+	}
+	return s
+}
+
+// Open opens a new stream
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	switch {
+	case s.shutdown:
+		s.mu.Unlock()
+		return nil, ErrSessionShutdown
+	case s.remoteGoAway:
+		s.mu.Unlock()
+		return nil, ErrRemoteGoAway
+	}
+	id := s.nextID
+	if id >= 1<<31 {
+		s.mu.Unlock()
+		return nil, ErrStreamsExhausted
+	}
+	s.nextID += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+	if err := st.sendWindowUpdate(flagSYN); err != nil {
+		s.mu.Lock()
+		delete(s.streams, id)
+		s.mu.Unlock()
+		return nil, err
+	}
+	return st, nil
+}
+
+// Dial opens a new stream. It lets a Session stand in for a dialer.
+func (s *Session) Dial() (net.Conn, error) {
+	return s.Open()
+}
+
+// AcceptStream waits for the other side to open a stream
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		if err := st.sendWindowUpdate(flagACK); err != nil {
+			return nil, err
+		}
+		return st, nil
+	case <-s.shutdownCh:
+		return nil, s.err()
+	}
+}
+
+// Accept waits for the other side to open a stream, it is part of
+// net.Listener
+func (s *Session) Accept() (net.Conn, error) {
+	return s.AcceptStream()
+}
+
+// Addr returns the local address of the connection, it is part of
+// net.Listener
+func (s *Session) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// LocalAddr returns the local address of the connection
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the connection
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// NumStreams returns the number of open streams
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// CloseChan returns a channel that is closed when the session shuts down
+func (s *Session) CloseChan() <-chan struct{} {
+	return s.shutdownCh
+}
+
+// IsClosed reports whether the session has shut down
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.shutdownCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// GoAway tells the other side not to open any more streams. Streams that
+// are already open carry on, and the session stays up until Close.
+func (s *Session) GoAway() error {
+	s.mu.Lock()
+	s.localGoAway = true
+	s.mu.Unlock()
+	return s.send(typeGoAway, 0, 0, putUint32(nil, GoAwayNormal))
+}
+
+// Ping sends a ping and waits for the reply, returning the round trip
+// time. It gives up after the configured WriteTimeout.
+func (s *Session) Ping() (time.Duration, error) {
+	ch := make(chan struct{})
+	s.mu.Lock()
+	id := s.nextPing
+	s.nextPing++
+	s.pings[id] = ch
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pings, id)
+		s.mu.Unlock()
+	}()
+	start := time.Now()
+	if err := s.send(typePing, flagSYN, 0, putUint32(nil, id)); err != nil {
+		return 0, err
+	}
+	t := time.NewTimer(s.cfg.WriteTimeout)
+	defer t.Stop()
+	select {
+	case <-ch:
+		return time.Since(start), nil
+	case <-t.C:
+		return 0, ErrKeepAliveTimeout
+	case <-s.shutdownCh:
+		return 0, s.err()
+	}
+}
+
+// Close shuts the session down, resetting every open stream, and closes
+// the connection. It is part of net.Listener.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	sentGoAway := s.localGoAway
+	s.localGoAway = true
+	s.mu.Unlock()
+	if !sentGoAway && !s.IsClosed() {
+		// let the other side know this was on purpose, best effort
+		s.send(typeGoAway, 0, 0, putUint32(nil, GoAwayNormal))
+	}
+	s.exit(ErrSessionShutdown)
+	return nil
+}
+
+// exit shuts the session down with err
+func (s *Session) exit(err error) {
+	s.shutdownOnce.Do(func() {
+		s.mu.Lock()
+		s.shutdown = true
+		s.shutdownErr = err
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.mu.Unlock()
+		close(s.shutdownCh)
+		s.conn.Close()
+		for _, st := range streams {
+			st.forceClose()
+		}
+	})
+}
+
+func (s *Session) err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutdownErr != nil {
+		return s.shutdownErr
+	}
+	return ErrSessionShutdown
+}
+
+// send writes a single message
+func (s *Session) send(typ uint8, flags uint16, id uint32, body []byte) error {
+	payload := make([]byte, 0, 4+len(body))
+	payload = putUint32(payload, id)
+	payload = append(payload, body...)
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.IsClosed() {
+		return s.err()
+	}
+	if s.cfg.WriteTimeout > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(s.cfg.WriteTimeout))
+	}
+	err := s.f.Send(frame.Frame{Type: typ, Flags: flags, Payload: payload})
+	if err != nil {
+		// a failed write leaves the stream in an unknown state
+		go s.exit(err)
+	}
+	return err
+}
+
+// sendAsync queues a message for controlLoop to send. The receive loop
+// uses it, so it never blocks on a write while the other side is blocked
+// writing to us. If the queue is full the other side has stopped reading,
+// and the session is shut down rather than let the replies pile up.
+func (s *Session) sendAsync(typ uint8, flags uint16, id uint32, body []byte) {
+	// body may point into the read buffer, which is about to be reused
+	body = append([]byte(nil), body...)
+	select {
+	case s.ctrl <- control{typ: typ, flags: flags, id: id, body: body}:
+	default:
+		s.exit(ErrControlOverflow)
+	}
+}
+
+// controlLoop sends the messages queued by sendAsync, one at a time, until
+// the session shuts down
+func (s *Session) controlLoop() {
+	for {
+		select {
+		case m := <-s.ctrl:
+			s.send(m.typ, m.flags, m.id, m.body)
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// keepAlive pings the other side until the session shuts down, and
+// shuts it down if a ping goes unanswered
+func (s *Session) keepAlive() {
+	t := time.NewTicker(s.cfg.KeepAliveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if _, err := s.Ping(); err != nil {
+				if err == ErrKeepAliveTimeout {
+					s.exit(err)
+				}
+				return
+			}
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// recvLoop reads messages and hands them out until the connection fails
+func (s *Session) recvLoop() {
+	for {
+		fr, err := s.f.ReadFrame()
+		if err != nil {
+			if err == io.EOF {
+				err = ErrSessionShutdown
+			}
+			s.exit(err)
+			return
+		}
+		if len(fr.Payload) < 4 {
+			s.protocolError()
+			return
+		}
+		id := binary.LittleEndian.Uint32(fr.Payload)
+		body := fr.Payload[4:]
+		switch fr.Type {
+		case typeData, typeWindow:
+			err = s.handleStream(fr.Type, fr.Flags, id, body)
+		case typePing:
+			err = s.handlePing(fr.Flags, body)
+		case typeGoAway:
+			s.mu.Lock()
+			s.remoteGoAway = true
+			s.mu.Unlock()
+		default:
+			err = ErrProtocol
+		}
+		if err != nil {
+			s.protocolError()
+			return
+		}
+	}
+}
+
+// protocolError tells the other side it broke the protocol and shuts down
+func (s *Session) protocolError() {
+	s.sendAsync(typeGoAway, 0, 0, putUint32(nil, GoAwayProtocolError))
+	// give the go away a moment to get out
+	time.AfterFunc(10*time.Millisecond, func() { s.exit(ErrProtocol) })
+}
+
+func (s *Session) handlePing(flags uint16, body []byte) error {
+	if len(body) != 4 {
+		return ErrProtocol
+	}
+	if flags&flagSYN != 0 {
+		s.sendAsync(typePing, flagACK, 0, body)
+		return nil
+	}
+	id := binary.LittleEndian.Uint32(body)
+	s.mu.Lock()
+	if ch, ok := s.pings[id]; ok {
+		close(ch)
+		delete(s.pings, id)
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Session) handleStream(typ uint8, flags uint16, id uint32, body []byte) error {
+	s.mu.Lock()
+	st, ok := s.streams[id]
+	if !ok && flags&flagSYN != 0 {
+		// a new stream from the other side, which must use the other
+		// side's ids
+		if id == 0 || id%2 == s.nextID%2 {
+			s.mu.Unlock()
+			return ErrProtocol
+		}
+		if s.localGoAway {
+			s.mu.Unlock()
+			s.sendAsync(typeWindow, flagRST, id, putUint32(nil, 0))
+			return nil
+		}
+		st = newStream(s, id)
+		select {
+		case s.accept <- st:
+			s.streams[id] = st
+		default:
+			// backlog is full
+			s.mu.Unlock()
+			s.sendAsync(typeWindow, flagRST, id, putUint32(nil, 0))
+			return nil
+		}
+	}
+	s.mu.Unlock()
+	if st == nil {
+		// a late message for a stream that is gone, drop it
+		return nil
+	}
+	if typ == typeWindow {
+		if len(body) != 4 {
+			return ErrProtocol
+		}
+		st.handleWindow(flags, binary.LittleEndian.Uint32(body))
+		return nil
+	}
+	return st.handleData(flags, body)
+}
+
+// Handler returns a server.Handler that runs the server side of a session
+// over every connection it is given, and calls handle on its own
+// goroutine for every stream the client opens. Handlers written for plain
+// connections work on streams unchanged.
+func Handler(cfg *Config, handle server.Handler) server.Handler {
+	return func(conn net.Conn) {
+		s := Server(conn, cfg)
+		defer s.Close()
+		for {
+			st, err := s.AcceptStream()
+			if err != nil {
+				return
+			}
+			go handle(st)
+		}
+	}
+}
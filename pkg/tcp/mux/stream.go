@@ -0,0 +1,282 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is a single logical connection within a session. It is a
+// net.Conn. Each direction has its own flow control window, so a stream
+// whose reader has stopped reading only holds up itself, never the other
+// streams on the session.
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	mu            sync.Mutex
+	recvBuf       bytes.Buffer
+	recvWindow    uint32 // bytes the other side may still send us
+	sendWindow    uint32 // bytes we may still send
+	localClosed   bool   // we sent a FIN
+	remoteClosed  bool   // we got a FIN
+	err           error  // set when the stream is reset or the session shuts down
+	readDeadline  time.Time
+	writeDeadline time.Time
+	recvNotify    chan struct{}
+	sendNotify    chan struct{}
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		sess:       s,
+		recvWindow: initialWindow,
+		sendWindow: initialWindow,
+		recvNotify: make(chan struct{}, 1),
+		sendNotify: make(chan struct{}, 1),
+	}
+}
+
+// StreamID returns the id of the stream
+func (st *Stream) StreamID() uint32 {
+	return st.id
+}
+
+// Session returns the session the stream belongs to
+func (st *Stream) Session() *Session {
+	return st.sess
+}
+
+// Read reads data sent on the stream. It returns io.EOF once the other
+// side has closed the stream and all of its data has been read.
+func (st *Stream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.recvBuf.Len() > 0 {
+			n, _ := st.recvBuf.Read(p)
+			st.mu.Unlock()
+			// let the other side know there is room again. if that fails
+			// the session is going down, and the next read says so.
+			st.sendWindowUpdate(0)
+			return n, nil
+		}
+		switch {
+		case st.remoteClosed:
+			st.mu.Unlock()
+			return 0, io.EOF
+		case st.err != nil:
+			err := st.err
+			st.mu.Unlock()
+			return 0, err
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+		if err := wait(st.recvNotify, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write writes data to the stream, blocking while the other side's
+// receive window is full.
+func (st *Stream) Write(p []byte) (int, error) {
+	total := 0
+	for total < len(p) {
+		st.mu.Lock()
+		switch {
+		case st.err != nil:
+			err := st.err
+			st.mu.Unlock()
+			return total, err
+		case st.localClosed:
+			st.mu.Unlock()
+			return total, ErrStreamClosed
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := wait(st.sendNotify, deadline); err != nil {
+				return total, err
+			}
+			continue
+		}
+		n := len(p) - total
+		if n > int(st.sendWindow) {
+			n = int(st.sendWindow)
+		}
+		if n > st.sess.cfg.MaxFrameSize {
+			n = st.sess.cfg.MaxFrameSize
+		}
+		st.sendWindow -= uint32(n)
+		st.mu.Unlock()
+		if err := st.sess.send(typeData, 0, st.id, p[total:total+n]); err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// Close half closes the stream: no more data can be written, but data
+// the other side sends can still be read until it closes its end too.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.localClosed || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	done := st.remoteClosed
+	st.mu.Unlock()
+	notify(st.sendNotify)
+	err := st.sess.send(typeWindow, flagFIN, st.id, putUint32(nil, 0))
+	if done {
+		st.sess.removeStream(st.id)
+	}
+	return err
+}
+
+// LocalAddr returns the local address of the session's connection
+func (st *Stream) LocalAddr() net.Addr {
+	return st.sess.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the session's connection
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.sess.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	st.SetWriteDeadline(t)
+	return nil
+}
+
+// SetReadDeadline sets the read deadline, a zero time means none
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	// wake a blocked reader so it picks up the new deadline
+	notify(st.recvNotify)
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline, a zero time means none. It
+// covers waiting for window space, writes to the connection itself are
+// bounded by the session's WriteTimeout.
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.sendNotify)
+	return nil
+}
+
+// sendWindowUpdate tells the other side how much more it may send. Small
+// updates are held back until there is at least half a window of room,
+// unless flags have to go out anyway.
+func (st *Stream) sendWindowUpdate(flags uint16) error {
+	max := st.sess.cfg.MaxStreamWindow
+	st.mu.Lock()
+	delta := max - st.recvWindow - uint32(st.recvBuf.Len())
+	if delta < max/2 && flags == 0 {
+		st.mu.Unlock()
+		return nil
+	}
+	st.recvWindow += delta
+	st.mu.Unlock()
+	return st.sess.send(typeWindow, flags, st.id, putUint32(nil, delta))
+}
+
+// handleData is called by the receive loop with data for the stream
+func (st *Stream) handleData(flags uint16, body []byte) error {
+	st.mu.Lock()
+	if uint32(len(body)) > st.recvWindow {
+		// the other side ignored the window
+		st.mu.Unlock()
+		return ErrProtocol
+	}
+	st.recvWindow -= uint32(len(body))
+	st.recvBuf.Write(body)
+	st.mu.Unlock()
+	st.handleFlags(flags)
+	notify(st.recvNotify)
+	return nil
+}
+
+// handleWindow is called by the receive loop with a window update
+func (st *Stream) handleWindow(flags uint16, delta uint32) {
+	st.mu.Lock()
+	st.sendWindow += delta
+	st.mu.Unlock()
+	st.handleFlags(flags)
+	notify(st.sendNotify)
+}
+
+func (st *Stream) handleFlags(flags uint16) {
+	remove := false
+	st.mu.Lock()
+	if flags&flagFIN != 0 {
+		st.remoteClosed = true
+		remove = st.localClosed
+	}
+	if flags&flagRST != 0 {
+		if st.err == nil {
+			st.err = ErrStreamReset
+		}
+		remove = true
+	}
+	st.mu.Unlock()
+	if remove {
+		st.sess.removeStream(st.id)
+	}
+	if flags&(flagFIN|flagRST) != 0 {
+		notify(st.recvNotify)
+		notify(st.sendNotify)
+	}
+}
+
+// forceClose is called when the session shuts down
+func (st *Stream) forceClose() {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = ErrSessionShutdown
+	}
+	st.mu.Unlock()
+	notify(st.recvNotify)
+	notify(st.sendNotify)
+}
+
+// notify wakes whoever is waiting on ch, without blocking
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait waits for ch or the deadline, whichever comes first
+func wait(ch chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-t.C:
+		return os.ErrDeadlineExceeded
+	}
+}
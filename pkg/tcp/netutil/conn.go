@@ -0,0 +1,24 @@
+package netutil
+
+import (
+	"net"
+)
+
+// CloseWrite shuts down the writing side of conn, looking for a
+// CloseWrite through any connections wrapped by middleware, and reports
+// whether it found one. Datagram connections have no write side to shut
+// down, so it is up to the caller whether to close them instead.
+func CloseWrite(conn net.Conn) bool {
+	for c := conn; c != nil; {
+		if cw, ok := c.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+			return true
+		}
+		u, ok := c.(interface{ Unwrap() net.Conn })
+		if !ok {
+			return false
+		}
+		c = u.Unwrap()
+	}
+	return false
+}
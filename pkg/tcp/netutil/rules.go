@@ -0,0 +1,153 @@
+package netutil
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DestRule allows or denies destinations. A destination is allowed if it
+// matches one of the allow entries (or any, if there are none), and none
+// of the deny entries.
+type DestRule struct {
+	allow []destMatch
+	deny  []destMatch
+}
+
+// NewDestRule returns a DestRule for the allow and deny entries. Entries
+// are an ip address, a CIDR range, a host name, "*.domain" for a domain
+// and everything under it or "*" for any host, followed by an optional
+// port or port range, e.g. "10.0.0.0/8", "*.internal:443", "*:25",
+// "[::1]:8000-8999".
+//
+// Ip addresses and ranges match the resolved address of a destination
+// given by name, so a name can't be used to get around them. Host names
+// only match destinations given by name.
+func NewDestRule(allow, deny []string) (*DestRule, error) {
+	var r DestRule
+	var err error
+	if r.allow, err = parseMatches(allow); err != nil {
+		return nil, err
+	}
+	if r.deny, err = parseMatches(deny); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Allow reports whether the rule allows a destination. Name is the host
+// name it was given by, empty for an ip address, and ip is the address
+// that will be used, resolved from name if there is one.
+func (r *DestRule) Allow(name string, ip net.IP, port int) bool {
+	if len(r.allow) > 0 && !anyMatch(r.allow, name, ip, port) {
+		return false
+	}
+	return !anyMatch(r.deny, name, ip, port)
+}
+
+// destMatch is a parsed DestRule entry
+type destMatch struct {
+	net    *net.IPNet // set for ip addresses and ranges
+	name   string     // host name, or the domain of a "*." entry
+	suffix bool       // matches name and everything under it
+	any    bool       // "*"
+	lo, hi int        // port range, any port if hi is 0
+}
+
+func (m *destMatch) match(name string, ip net.IP, port int) bool {
+	if m.hi != 0 && (port < m.lo || port > m.hi) {
+		return false
+	}
+	switch {
+	case m.any:
+		return true
+	case m.net != nil:
+		return ip != nil && m.net.Contains(ip)
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return false
+	}
+	return name == m.name || (m.suffix && strings.HasSuffix(name, "."+m.name))
+}
+
+func anyMatch(ms []destMatch, name string, ip net.IP, port int) bool {
+	for i := range ms {
+		if ms[i].match(name, ip, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseMatches(list []string) ([]destMatch, error) {
+	ms := make([]destMatch, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		m, err := parseMatch(s)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+func parseMatch(s string) (destMatch, error) {
+	var m destMatch
+	host, port := s, ""
+	// a port follows a bracketed host, or the only colon
+	if strings.HasPrefix(s, "[") {
+		i := strings.Index(s, "]")
+		if i < 0 {
+			return m, fmt.Errorf("netutil: bad rule %q", s)
+		}
+		host, port = s[1:i], strings.TrimPrefix(s[i+1:], ":")
+		if port == "" && i+1 < len(s) {
+			return m, fmt.Errorf("netutil: bad rule %q", s)
+		}
+	} else if strings.Count(s, ":") == 1 {
+		i := strings.Index(s, ":")
+		host, port = s[:i], s[i+1:]
+	}
+	if port != "" {
+		lo, hi := port, port
+		if i := strings.Index(port, "-"); i >= 0 {
+			lo, hi = port[:i], port[i+1:]
+		}
+		var err1, err2 error
+		m.lo, err1 = strconv.Atoi(lo)
+		m.hi, err2 = strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || m.lo < 1 || m.hi > 0xffff || m.lo > m.hi {
+			return m, fmt.Errorf("netutil: bad port in rule %q", s)
+		}
+	}
+	switch {
+	case host == "*":
+		m.any = true
+	case strings.Contains(host, "/"):
+		_, n, err := net.ParseCIDR(host)
+		if err != nil {
+			return m, fmt.Errorf("netutil: bad rule %q: %v", s, err)
+		}
+		m.net = n
+	case net.ParseIP(host) != nil:
+		ip := net.ParseIP(host)
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		m.net = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	case strings.HasPrefix(host, "*."):
+		m.name, m.suffix = strings.ToLower(host[2:]), true
+	case host != "" && !strings.ContainsAny(host, "*[]"):
+		m.name = strings.ToLower(strings.TrimSuffix(host, "."))
+	default:
+		return m, fmt.Errorf("netutil: bad rule %q", s)
+	}
+	return m, nil
+}
@@ -0,0 +1,434 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	// sigV1 starts a version 1 (text) header
+	sigV1 = []byte("PROXY ")
+	// sigV2 starts a version 2 (binary) header
+	sigV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// maxV1Len is the longest a version 1 header can be, crlf included
+const maxV1Len = 107
+
+var (
+	ErrNoHeader      = errors.New("proxyproto: no PROXY header")
+	ErrInvalidHeader = errors.New("proxyproto: invalid PROXY header")
+	ErrBadChecksum   = errors.New("proxyproto: PROXY header checksum mismatch")
+)
+
+// Command is what the proxy is telling us about the connection
+type Command byte
+
+const (
+	// Local connections were made by the proxy itself, health checks for
+	// example, and carry no addresses
+	Local Command = 0x0
+	// Proxy connections were relayed for a client
+	Proxy Command = 0x1
+)
+
+// Protocol is the address family and transport of the proxied connection
+type Protocol byte
+
+const (
+	Unspec Protocol = 0x00
+	TCP4   Protocol = 0x11
+	UDP4   Protocol = 0x12
+	TCP6   Protocol = 0x21
+	UDP6   Protocol = 0x22
+	Unix   Protocol = 0x31
+	UnixDG Protocol = 0x32
+)
+
+// TLV types defined by the spec
+const (
+	TypeALPN      byte = 0x01
+	TypeAuthority byte = 0x02
+	TypeCRC32C    byte = 0x03
+	TypeNoop      byte = 0x04
+	TypeUniqueID  byte = 0x05
+	TypeSSL       byte = 0x20
+	TypeNetNS     byte = 0x30
+)
+
+// TLV is one of the type-length-value extensions of a version 2 header
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Header is a parsed PROXY protocol header
+type Header struct {
+	Version     int // 1 or 2
+	Command     Command
+	Protocol    Protocol
+	Source      net.Addr // the client, nil for Local or Unspec
+	Destination net.Addr // the address the client connected to, nil for Local or Unspec
+	TLVs        []TLV    // version 2 only
+}
+
+// TLV returns the value of the first TLV of type t
+func (h *Header) TLV(t byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == t {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Authority returns the host name the client asked for (its SNI), if the
+// proxy sent it
+func (h *Header) Authority() string {
+	v, _ := h.TLV(TypeAuthority)
+	return string(v)
+}
+
+// ALPN returns the application protocol the client negotiated, if the
+// proxy sent it
+func (h *Header) ALPN() string {
+	v, _ := h.TLV(TypeALPN)
+	return string(v)
+}
+
+// UniqueID returns the proxy's id for the connection, if it sent one
+func (h *Header) UniqueID() []byte {
+	v, _ := h.TLV(TypeUniqueID)
+	return v
+}
+
+// ReadHeader reads a version 1 or 2 header from r. If r does not start
+// with a header, nothing is consumed and ErrNoHeader is returned. Only as
+// many bytes are peeked as it takes to tell, so a client that sends a few
+// bytes and waits for a reply doesn't block it.
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch b[0] {
+	case sigV1[0]:
+		if ok, err := hasPrefix(r, sigV1); !ok {
+			return nil, err
+		}
+		return readV1(r)
+	case sigV2[0]:
+		if ok, err := hasPrefix(r, sigV2); !ok {
+			return nil, err
+		}
+		return readV2(r)
+	}
+	return nil, ErrNoHeader
+}
+
+// hasPrefix peeks at r one byte at a time for as long as it matches sig
+func hasPrefix(r *bufio.Reader, sig []byte) (bool, error) {
+	for i := 1; i <= len(sig); i++ {
+		b, err := r.Peek(i)
+		if err != nil {
+			return false, err
+		}
+		if b[i-1] != sig[i-1] {
+			return false, ErrNoHeader
+		}
+	}
+	return true, nil
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < maxV1Len {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	h := &Header{Version: 1, Command: Proxy}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		// the proxy couldn't tell, the rest of the line is ignored
+		return h, nil
+	}
+	if len(fields) != 6 {
+		return nil, ErrInvalidHeader
+	}
+	switch fields[1] {
+	case "TCP4":
+		h.Protocol = TCP4
+	case "TCP6":
+		h.Protocol = TCP6
+	default:
+		return nil, ErrInvalidHeader
+	}
+	src, err := parseV1Addr(fields[2], fields[4], h.Protocol == TCP4)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseV1Addr(fields[3], fields[5], h.Protocol == TCP4)
+	if err != nil {
+		return nil, err
+	}
+	h.Source, h.Destination = src, dst
+	return h, nil
+}
+
+func parseV1Addr(host, port string, v4 bool) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (ip.To4() != nil) != v4 {
+		return nil, ErrInvalidHeader
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, ErrInvalidHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, ErrInvalidHeader
+	}
+	h := &Header{
+		Version:  2,
+		Command:  Command(hdr[12] & 0x0f),
+		Protocol: Protocol(hdr[13]),
+	}
+	if h.Command != Local && h.Command != Proxy {
+		return nil, ErrInvalidHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	rest, err := h.parseAddrs(body)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.parseTLVs(rest); err != nil {
+		return nil, err
+	}
+	if sum, ok := h.TLV(TypeCRC32C); ok {
+		if len(sum) != 4 {
+			return nil, ErrInvalidHeader
+		}
+		// the checksum covers the whole header with its own value zeroed
+		want := binary.BigEndian.Uint32(sum)
+		copy(sum, []byte{0, 0, 0, 0})
+		crc := crc32.New(castagnoli)
+		crc.Write(hdr)
+		crc.Write(body)
+		binary.BigEndian.PutUint32(sum, want)
+		if crc.Sum32() != want {
+			return nil, ErrBadChecksum
+		}
+	}
+	return h, nil
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// parseAddrs parses the address block at the start of body, returning
+// what comes after it
+func (h *Header) parseAddrs(body []byte) ([]byte, error) {
+	var n int
+	switch h.Protocol.family() {
+	case 0x1:
+		n = 12
+	case 0x2:
+		n = 36
+	case 0x3:
+		n = 216
+	case 0x0:
+		return body, nil
+	default:
+		return nil, ErrInvalidHeader
+	}
+	if len(body) < n {
+		return nil, ErrInvalidHeader
+	}
+	a := body[:n]
+	switch h.Protocol {
+	case TCP4, UDP4, TCP6, UDP6:
+		l := n/2 - 2
+		src := net.IP(append([]byte(nil), a[:l]...))
+		dst := net.IP(append([]byte(nil), a[l:2*l]...))
+		sport := int(binary.BigEndian.Uint16(a[2*l:]))
+		dport := int(binary.BigEndian.Uint16(a[2*l+2:]))
+		if h.Protocol == TCP4 || h.Protocol == TCP6 {
+			h.Source = &net.TCPAddr{IP: src, Port: sport}
+			h.Destination = &net.TCPAddr{IP: dst, Port: dport}
+		} else {
+			h.Source = &net.UDPAddr{IP: src, Port: sport}
+			h.Destination = &net.UDPAddr{IP: dst, Port: dport}
+		}
+	case Unix, UnixDG:
+		network := "unix"
+		if h.Protocol == UnixDG {
+			network = "unixgram"
+		}
+		h.Source = &net.UnixAddr{Name: cString(a[:108]), Net: network}
+		h.Destination = &net.UnixAddr{Name: cString(a[108:]), Net: network}
+	}
+	// a Local command keeps the addresses out of the way, but they still
+	// take up room in the header
+	if h.Command == Local {
+		h.Source, h.Destination = nil, nil
+	}
+	return body[n:], nil
+}
+
+func (h *Header) parseTLVs(b []byte) error {
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return ErrInvalidHeader
+		}
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+n {
+			return ErrInvalidHeader
+		}
+		h.TLVs = append(h.TLVs, TLV{Type: b[0], Value: b[3 : 3+n]})
+		b = b[3+n:]
+	}
+	return nil
+}
+
+func (p Protocol) family() byte {
+	return byte(p) >> 4
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// Format encodes the header, as version 1 or 2 depending on h.Version. It
+// is what a proxy sends, and is handy for dialing a server that requires
+// the header.
+func (h *Header) Format() ([]byte, error) {
+	switch h.Version {
+	case 1:
+		return h.formatV1()
+	case 2:
+		return h.formatV2()
+	}
+	return nil, fmt.Errorf("proxyproto: unknown version %d", h.Version)
+}
+
+func (h *Header) formatV1() ([]byte, error) {
+	if h.Command == Local || h.Protocol == Unspec {
+		return []byte("PROXY UNKNOWN\r\n"), nil
+	}
+	src, ok1 := h.Source.(*net.TCPAddr)
+	dst, ok2 := h.Destination.(*net.TCPAddr)
+	if !ok1 || !ok2 || (h.Protocol != TCP4 && h.Protocol != TCP6) {
+		return nil, fmt.Errorf("proxyproto: version 1 only carries tcp addresses")
+	}
+	proto := "TCP4"
+	if h.Protocol == TCP6 {
+		proto = "TCP6"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, src.IP, dst.IP, src.Port, dst.Port)), nil
+}
+
+func (h *Header) formatV2() ([]byte, error) {
+	var addrs []byte
+	switch h.Protocol {
+	case Unspec:
+	case TCP4, UDP4, TCP6, UDP6:
+		l := 4
+		if h.Protocol.family() == 0x2 {
+			l = 16
+		}
+		src, sport := ipPort(h.Source)
+		dst, dport := ipPort(h.Destination)
+		if h.Command == Proxy && (src == nil || dst == nil) {
+			return nil, fmt.Errorf("proxyproto: missing addresses")
+		}
+		addrs = make([]byte, 2*l+4)
+		if src != nil && dst != nil {
+			if l == 4 {
+				src, dst = src.To4(), dst.To4()
+			} else {
+				src, dst = src.To16(), dst.To16()
+			}
+			if src == nil || dst == nil {
+				return nil, fmt.Errorf("proxyproto: address family does not match %#x", byte(h.Protocol))
+			}
+			copy(addrs, src)
+			copy(addrs[l:], dst)
+		}
+		binary.BigEndian.PutUint16(addrs[2*l:], uint16(sport))
+		binary.BigEndian.PutUint16(addrs[2*l+2:], uint16(dport))
+	case Unix, UnixDG:
+		addrs = make([]byte, 216)
+		if a, ok := h.Source.(*net.UnixAddr); ok {
+			copy(addrs[:108], a.Name)
+		}
+		if a, ok := h.Destination.(*net.UnixAddr); ok {
+			copy(addrs[108:], a.Name)
+		}
+	default:
+		return nil, fmt.Errorf("proxyproto: unknown protocol %#x", byte(h.Protocol))
+	}
+	n := len(addrs)
+	for _, tlv := range h.TLVs {
+		n += 3 + len(tlv.Value)
+	}
+	if n > 0xffff {
+		return nil, fmt.Errorf("proxyproto: header too long")
+	}
+	b := make([]byte, 0, 16+n)
+	b = append(b, sigV2...)
+	b = append(b, 0x20|byte(h.Command), byte(h.Protocol), byte(n>>8), byte(n))
+	b = append(b, addrs...)
+	crcAt := -1
+	for _, tlv := range h.TLVs {
+		b = append(b, tlv.Type, byte(len(tlv.Value)>>8), byte(len(tlv.Value)))
+		if tlv.Type == TypeCRC32C && len(tlv.Value) == 4 {
+			crcAt = len(b)
+			b = append(b, 0, 0, 0, 0)
+			continue
+		}
+		b = append(b, tlv.Value...)
+	}
+	if crcAt >= 0 {
+		binary.BigEndian.PutUint32(b[crcAt:], crc32.Checksum(b, castagnoli))
+	}
+	return b, nil
+}
+
+func ipPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
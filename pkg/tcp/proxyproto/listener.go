@@ -0,0 +1,352 @@
+package proxyproto
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policy says what to do about the PROXY header on a connection
+type Policy int
+
+const (
+	// Off does not look for a header at all
+	Off Policy = iota
+	// Allow uses the header if there is one
+	Allow
+	// Require closes connections that don't start with a header
+	Require
+)
+
+func (p Policy) String() string {
+	switch p {
+	case Off:
+		return "off"
+	case Allow:
+		return "allow"
+	case Require:
+		return "require"
+	}
+	return fmt.Sprintf("Policy(%d)", int(p))
+}
+
+// UnmarshalText parses "off", "allow" or "require", so a Policy can be
+// set by pkg/config
+func (p *Policy) UnmarshalText(text []byte) error {
+	switch strings.ToLower(string(text)) {
+	case "", "off":
+		*p = Off
+	case "allow":
+		*p = Allow
+	case "require":
+		*p = Require
+	default:
+		return fmt.Errorf("proxyproto: unknown policy %q, want off, allow or require", text)
+	}
+	return nil
+}
+
+// MarshalText returns the policy's name
+func (p Policy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// ErrNoTrusted is returned by NewListener when the policy asks for a
+// header but no source is trusted to send one
+var ErrNoTrusted = errors.New("proxyproto: no trusted sources for the PROXY header, set trusted")
+
+// DefaultHeaderTimeout is how long a connection has to send its header
+// when no timeout is set
+const DefaultHeaderTimeout = 5 * time.Second
+
+// Config holds the PROXY protocol settings for a listener. The tags let it
+// be filled in by pkg/config.
+type Config struct {
+	Policy        Policy        `config:"policy" default:"off" usage:"PROXY protocol header from a load balancer: off, allow or require"`
+	Trusted       []string      `config:"trusted" usage:"ip addresses and cidrs allowed to send the header, required unless the policy is off"`
+	HeaderTimeout time.Duration `config:"header-timeout" default:"5s" usage:"max time to wait for the header"`
+}
+
+// Listener wraps a net.Listener, reading the PROXY header off every
+// connection it accepts so that RemoteAddr and LocalAddr return the
+// client's addresses rather than the load balancer's.
+//
+// Headers are read on their own goroutines, and Accept only returns a
+// connection once its header is in, so a slow or silent client can't
+// hold up the others. Connections with a bad header, or without one when
+// it is required, are closed and never returned.
+//
+// Only sources in Trusted may send a header, and with no Trusted nobody
+// may, except over a unix socket. Connections from anywhere else are
+// passed through as they are without reading from them, so a header they
+// send is left for the handler to read as data. With Allow, a trusted
+// source that sends nothing before the header timeout is passed through
+// too, since it may be waiting for the server to speak first.
+type Listener struct {
+	net.Listener
+	Policy        Policy
+	Trusted       []*net.IPNet  // sources allowed to send a header, none if nil
+	HeaderTimeout time.Duration // DefaultHeaderTimeout if zero
+	ErrorLog      *log.Logger   // logs rejected connections, log.Default() if nil
+
+	once  sync.Once
+	conns chan net.Conn
+	errs  chan error
+	err   error         // the error that stopped acceptLoop
+	dead  chan struct{} // closed once acceptLoop has stopped
+	done  chan struct{} // closed by Close
+	close sync.Once
+
+	mu      sync.Mutex
+	pending map[net.Conn]struct{} // connections still sending their header
+	closed  bool
+}
+
+// NewListener wraps ln using the settings in cfg. Unless the policy is
+// off or ln is a unix socket, cfg must trust at least one source, or
+// ErrNoTrusted is returned.
+func NewListener(ln net.Listener, cfg Config) (*Listener, error) {
+	trusted, err := parseNets(cfg.Trusted)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Policy != Off && trusted == nil && !strings.HasPrefix(ln.Addr().Network(), "unix") {
+		return nil, ErrNoTrusted
+	}
+	return &Listener{
+		Listener:      ln,
+		Policy:        cfg.Policy,
+		Trusted:       trusted,
+		HeaderTimeout: cfg.HeaderTimeout,
+	}, nil
+}
+
+func (l *Listener) init() {
+	l.conns = make(chan net.Conn)
+	l.errs = make(chan error)
+	l.dead = make(chan struct{})
+	l.done = make(chan struct{})
+	l.pending = make(map[net.Conn]struct{})
+	go l.acceptLoop()
+}
+
+// Accept waits for and returns the next connection whose header has been
+// read
+func (l *Listener) Accept() (net.Conn, error) {
+	l.once.Do(l.init)
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.dead:
+		return nil, l.err
+	}
+}
+
+// Close closes the listener. Connections still sending their header are
+// closed too.
+func (l *Listener) Close() error {
+	l.once.Do(l.init)
+	l.close.Do(func() {
+		close(l.done)
+		l.mu.Lock()
+		l.closed = true
+		for conn := range l.pending {
+			conn.Close()
+		}
+		l.mu.Unlock()
+	})
+	return l.Listener.Close()
+}
+
+func (l *Listener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// let the caller decide how to back off
+				select {
+				case l.errs <- err:
+				case <-l.done:
+				}
+				continue
+			}
+			// every Accept from now on returns the error
+			l.err = err
+			close(l.dead)
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+// handshake reads conn's header and passes it on to Accept
+func (l *Listener) handshake(conn net.Conn) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		conn.Close()
+		return
+	}
+	l.pending[conn] = struct{}{}
+	l.mu.Unlock()
+	pc, err := l.readHeader(conn)
+	l.mu.Lock()
+	delete(l.pending, conn)
+	closed := l.closed
+	l.mu.Unlock()
+	if closed {
+		// closed along with the listener, there is nothing to report
+		conn.Close()
+		return
+	}
+	if err != nil {
+		l.logf("proxyproto: closing connection from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	select {
+	case l.conns <- pc:
+	case <-l.done:
+		pc.Close()
+	}
+}
+
+func (l *Listener) readHeader(conn net.Conn) (net.Conn, error) {
+	if l.Policy == Off || !l.trusted(conn.RemoteAddr()) {
+		// only trusted sources get their first bytes looked at, so a
+		// client that waits for the server to speak first isn't held up
+		return conn, nil
+	}
+	timeout := l.HeaderTimeout
+	if timeout <= 0 {
+		timeout = DefaultHeaderTimeout
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	c := &Conn{Conn: conn, r: bufio.NewReader(conn)}
+	h, err := ReadHeader(c.r)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && l.Policy == Allow {
+		// the client may be waiting for us to speak first, hand it on
+		// with whatever it did send
+		err = ErrNoHeader
+	}
+	if err == ErrNoHeader && l.Policy == Allow {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	c.header = h
+	return c, nil
+}
+
+func (l *Listener) trusted(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		// unix sockets have no ip, anything that can reach the socket
+		// file is trusted
+		return true
+	}
+	for _, n := range l.Trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Listener) logf(format string, v ...interface{}) {
+	if l.ErrorLog != nil {
+		l.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// Conn is a connection accepted by a Listener
+type Conn struct {
+	net.Conn
+	r      *bufio.Reader
+	header *Header
+}
+
+// Read reads what is left of anything read along with the header, and
+// then from the connection
+func (c *Conn) Read(p []byte) (int, error) {
+	if c.r != nil && c.r.Buffered() > 0 {
+		return c.r.Read(p)
+	}
+	return c.Conn.Read(p)
+}
+
+// Header returns the connection's PROXY header, or nil if it had none
+func (c *Conn) Header() *Header {
+	return c.header
+}
+
+// RemoteAddr returns the client's address from the header, or the
+// connection's own remote address if the header has none
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to from the header,
+// or the connection's own local address if the header has none
+func (c *Conn) LocalAddr() net.Addr {
+	if c.header != nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// Unwrap returns the underlying connection
+func (c *Conn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// parseNets parses a list of ip addresses and CIDR ranges
+func parseNets(list []string) ([]*net.IPNet, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("proxyproto: invalid ip address %q", s)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("proxyproto: %v", err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
@@ -0,0 +1,532 @@
+package proxyproto_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/config"
+	"github.com/scottcagno/net-tools/pkg/tcp/proxyproto"
+	"github.com/scottcagno/net-tools/pkg/tcp/server"
+	"github.com/scottcagno/net-tools/pkg/web"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+var quiet = log.New(ioutil.Discard, "", 0)
+
+// loopback trusts the tests' own connections to send a header
+var loopback = []string{"127.0.0.1"}
+
+func tcpAddr(s string) *net.TCPAddr {
+	addr, _ := net.ResolveTCPAddr("tcp", s)
+	return addr
+}
+
+func TestV1Parse(t *testing.T) {
+	tests := []struct {
+		in       string
+		src, dst string
+		err      error
+	}{
+		{"PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\r\n", "192.168.0.1:56324", "10.0.0.1:443", nil},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 1000 80\r\n", "[2001:db8::1]:1000", "[2001:db8::2]:80", nil},
+		{"PROXY UNKNOWN ff::1 ff::2 1 2\r\n", "", "", nil},
+		{"PROXY TCP4 192.168.0.1 10.0.0.1 56324\r\n", "", "", proxyproto.ErrInvalidHeader},
+		{"PROXY TCP4 2001:db8::1 10.0.0.1 1 2\r\n", "", "", proxyproto.ErrInvalidHeader},
+		{"PROXY TCP4 192.168.0.1 10.0.0.1 99999 443\r\n", "", "", proxyproto.ErrInvalidHeader},
+		{"PROXY TCP4 192.168.0.1 10.0.0.1 1 2\n", "", "", proxyproto.ErrInvalidHeader},
+		{"PROXY " + strings.Repeat("x", 200) + "\r\n", "", "", proxyproto.ErrInvalidHeader},
+	}
+	for _, tt := range tests {
+		h, err := proxyproto.ReadHeader(bufio.NewReader(strings.NewReader(tt.in)))
+		if err != tt.err {
+			t.Fatalf("%q: got error %v, want %v", tt.in, err, tt.err)
+		}
+		if err != nil {
+			continue
+		}
+		if tt.src == "" {
+			if h.Source != nil {
+				t.Fatalf("%q: got source %v for UNKNOWN", tt.in, h.Source)
+			}
+			continue
+		}
+		if h.Version != 1 || h.Source.String() != tt.src || h.Destination.String() != tt.dst {
+			t.Fatalf("%q: got v%d %v -> %v", tt.in, h.Version, h.Source, h.Destination)
+		}
+		b, err := h.Format()
+		if err != nil || string(b) != tt.in {
+			t.Fatalf("%q: formatted as %q, %v", tt.in, b, err)
+		}
+	}
+}
+
+func TestV2RoundTrip(t *testing.T) {
+	headers := []*proxyproto.Header{
+		{
+			Version: 2, Command: proxyproto.Proxy, Protocol: proxyproto.TCP4,
+			Source: tcpAddr("192.168.0.1:56324"), Destination: tcpAddr("10.0.0.1:443"),
+			TLVs: []proxyproto.TLV{
+				{Type: proxyproto.TypeAuthority, Value: []byte("example.com")},
+				{Type: proxyproto.TypeALPN, Value: []byte("h2")},
+				{Type: proxyproto.TypeUniqueID, Value: []byte{1, 2, 3}},
+			},
+		},
+		{
+			Version: 2, Command: proxyproto.Proxy, Protocol: proxyproto.TCP6,
+			Source: tcpAddr("[2001:db8::1]:1000"), Destination: tcpAddr("[2001:db8::2]:80"),
+		},
+		{
+			Version: 2, Command: proxyproto.Proxy, Protocol: proxyproto.UDP4,
+			Source:      &net.UDPAddr{IP: net.ParseIP("1.2.3.4").To4(), Port: 53},
+			Destination: &net.UDPAddr{IP: net.ParseIP("5.6.7.8").To4(), Port: 53},
+		},
+		{
+			Version: 2, Command: proxyproto.Proxy, Protocol: proxyproto.Unix,
+			Source:      &net.UnixAddr{Name: "/tmp/a.sock", Net: "unix"},
+			Destination: &net.UnixAddr{Name: "/tmp/b.sock", Net: "unix"},
+		},
+		{Version: 2, Command: proxyproto.Local},
+	}
+	for _, want := range headers {
+		b, err := want.Format()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// anything after the header must be left for the connection
+		r := bufio.NewReader(io.MultiReader(bytes.NewReader(b), strings.NewReader("rest")))
+		got, err := proxyproto.ReadHeader(r)
+		if err != nil {
+			t.Fatalf("%v: %v", want.Source, err)
+		}
+		if got.Command != want.Command || got.Protocol != want.Protocol ||
+			fmt.Sprint(got.Source) != fmt.Sprint(want.Source) ||
+			fmt.Sprint(got.Destination) != fmt.Sprint(want.Destination) {
+			t.Fatalf("got %+v, want %+v", got, want)
+		}
+		if got.Authority() != want.Authority() || got.ALPN() != want.ALPN() ||
+			!bytes.Equal(got.UniqueID(), want.UniqueID()) || len(got.TLVs) != len(want.TLVs) {
+			t.Fatalf("got tlvs %v, want %v", got.TLVs, want.TLVs)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "rest" {
+			t.Fatalf("left %q after the header", rest)
+		}
+	}
+}
+
+func TestV2Checksum(t *testing.T) {
+	h := &proxyproto.Header{
+		Version: 2, Command: proxyproto.Proxy, Protocol: proxyproto.TCP4,
+		Source: tcpAddr("192.168.0.1:1"), Destination: tcpAddr("10.0.0.1:2"),
+		TLVs: []proxyproto.TLV{
+			{Type: proxyproto.TypeCRC32C, Value: make([]byte, 4)},
+			{Type: proxyproto.TypeAuthority, Value: []byte("example.com")},
+		},
+	}
+	b, err := h.Format()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := proxyproto.ReadHeader(bufio.NewReader(bytes.NewReader(b))); err != nil {
+		t.Fatalf("good checksum: %v", err)
+	}
+	b[len(b)-1] ^= 0xff
+	if _, err := proxyproto.ReadHeader(bufio.NewReader(bytes.NewReader(b))); err != proxyproto.ErrBadChecksum {
+		t.Fatalf("corrupted header: got %v, want ErrBadChecksum", err)
+	}
+}
+
+func TestNoHeader(t *testing.T) {
+	for _, in := range []string{"hello", "PROXX", "\r\n\r\nhi"} {
+		r := bufio.NewReader(strings.NewReader(in))
+		if _, err := proxyproto.ReadHeader(r); err != proxyproto.ErrNoHeader {
+			t.Fatalf("%q: got %v, want ErrNoHeader", in, err)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != in {
+			t.Fatalf("%q: consumed input, %q left", in, rest)
+		}
+	}
+}
+
+// listen returns a proxyproto listener on a loopback port
+func listen(cfg proxyproto.Config) (*proxyproto.Listener, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	pl, err := proxyproto.NewListener(ln, cfg)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	pl.ErrorLog = quiet
+	return pl, nil
+}
+
+// serveAddr answers every connection with its remote address and the
+// first line it reads
+func serveAddr(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			fmt.Fprintf(conn, "%s %s", conn.RemoteAddr(), line)
+		}()
+	}
+}
+
+// send dials addr, writes header and msg, and returns the reply
+func send(addr string, header []byte, msg string) (string, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write(append(header, msg...)); err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadAll(conn)
+	return string(b), err
+}
+
+var v1Header = []byte("PROXY TCP4 203.0.113.7 10.0.0.1 40000 443\r\n")
+
+func TestListenerV1(t *testing.T) {
+	ln, err := listen(proxyproto.Config{Policy: proxyproto.Allow, Trusted: loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveAddr(ln)
+	got, err := send(ln.Addr().String(), v1Header, "hi\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "203.0.113.7:40000 hi\n" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestListenerAllow(t *testing.T) {
+	ln, err := listen(proxyproto.Config{Policy: proxyproto.Allow, Trusted: loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveAddr(ln)
+	got, err := send(ln.Addr().String(), nil, "hi\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(got, "127.0.0.1:") || !strings.HasSuffix(got, " hi\n") {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestListenerRequire(t *testing.T) {
+	ln, err := listen(proxyproto.Config{Policy: proxyproto.Require, Trusted: loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveAddr(ln)
+	if got, err := send(ln.Addr().String(), nil, "hi\n"); got != "" {
+		t.Fatalf("connection without a header got %q, %v", got, err)
+	}
+	if got, err := send(ln.Addr().String(), []byte("PROXY TCP4 nope\r\n"), "hi\n"); got != "" {
+		t.Fatalf("connection with a bad header got %q, %v", got, err)
+	}
+	got, err := send(ln.Addr().String(), v1Header, "hi\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "203.0.113.7:40000 hi\n" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestListenerUntrusted(t *testing.T) {
+	ln, err := listen(proxyproto.Config{Policy: proxyproto.Require, Trusted: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveAddr(ln)
+	// loopback isn't trusted, so its header is left as data rather than
+	// letting it pick its own address...
+	got, err := send(ln.Addr().String(), v1Header, "hi\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(got, "127.0.0.1:") || !strings.HasSuffix(got, " "+string(v1Header)) {
+		t.Fatalf("untrusted header got %q", got)
+	}
+	// ...and it can still connect without one
+	got, err = send(ln.Addr().String(), nil, "hi\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(got, "127.0.0.1:") {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestNoTrusted(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	for _, p := range []proxyproto.Policy{proxyproto.Allow, proxyproto.Require} {
+		if _, err := proxyproto.NewListener(ln, proxyproto.Config{Policy: p}); err != proxyproto.ErrNoTrusted {
+			t.Fatalf("%s without trusted: got %v, want ErrNoTrusted", p, err)
+		}
+	}
+	if _, err := proxyproto.NewListener(ln, proxyproto.Config{}); err != nil {
+		t.Fatalf("off without trusted: %v", err)
+	}
+	// a listener made by hand with no Trusted trusts no one
+	pl := &proxyproto.Listener{Listener: ln, Policy: proxyproto.Require, ErrorLog: quiet}
+	defer pl.Close()
+	go serveAddr(pl)
+	got, err := send(ln.Addr().String(), v1Header, "hi\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(got, "127.0.0.1:") {
+		t.Fatalf("header from an untrusted source got %q", got)
+	}
+}
+
+func TestClosePending(t *testing.T) {
+	ln, err := listen(proxyproto.Config{Policy: proxyproto.Require, Trusted: loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveAddr(ln)
+	silent, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		ln.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer silent.Close()
+	// give the listener time to start on the header
+	time.Sleep(50 * time.Millisecond)
+	ln.Close()
+	silent.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := silent.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("pending connection: got %v, want EOF", err)
+	}
+}
+
+func TestHeaderTimeout(t *testing.T) {
+	ln, err := listen(proxyproto.Config{Policy: proxyproto.Require, Trusted: loopback, HeaderTimeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveAddr(ln)
+	// a silent client must not hold up the next one
+	silent, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	start := time.Now()
+	got, err := send(ln.Addr().String(), v1Header, "hi\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "203.0.113.7:40000 hi\n" || time.Since(start) > 150*time.Millisecond {
+		t.Fatalf("got %q after %v", got, time.Since(start))
+	}
+	silent.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := silent.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("silent client: got %v, want EOF", err)
+	}
+}
+
+// serveBanner greets every connection first, then echoes back the first
+// line it reads along with the remote address
+func serveBanner(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.WriteString(conn, "220 ready\n")
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			fmt.Fprintf(conn, "%s %s", conn.RemoteAddr(), line)
+		}()
+	}
+}
+
+// TestServerFirst checks that a client waiting for a banner gets one, both
+// from an untrusted source, which is never read from, and from a trusted
+// one once the header timeout is up
+func TestServerFirst(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		trusted []string
+		wait    time.Duration // longest the banner may take
+	}{
+		{"untrusted", []string{"10.0.0.0/8"}, 100 * time.Millisecond},
+		{"trusted", loopback, time.Second},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ln, err := listen(proxyproto.Config{Policy: proxyproto.Allow, Trusted: tc.trusted, HeaderTimeout: 200 * time.Millisecond})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			go serveBanner(ln)
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(tc.wait))
+			r := bufio.NewReader(conn)
+			banner, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("waiting for the banner: %v", err)
+			}
+			if banner != "220 ready\n" {
+				t.Fatalf("got banner %q", banner)
+			}
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			io.WriteString(conn, "hi\n")
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(line, "127.0.0.1:") || !strings.HasSuffix(line, " hi\n") {
+				t.Fatalf("got %q", line)
+			}
+		})
+	}
+}
+
+// TestAllowPartial checks that under Allow a trusted client that sends a
+// few bytes and stops keeps them when the header timeout passes
+func TestAllowPartial(t *testing.T) {
+	ln, err := listen(proxyproto.Config{Policy: proxyproto.Allow, Trusted: loopback, HeaderTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveAddr(ln)
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	io.WriteString(conn, "PRO")
+	time.Sleep(200 * time.Millisecond)
+	io.WriteString(conn, "BE\n")
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b); !strings.HasSuffix(got, " PROBE\n") {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestTCPServer(t *testing.T) {
+	// the settings come in through pkg/config the way a service would
+	var cfg server.Config
+	l := &config.Loader{Args: []string{"-addr", "127.0.0.1:0", "-proxy.policy", "require", "-proxy.trusted", "127.0.0.1"}}
+	if err := l.Load(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Proxy.Policy != proxyproto.Require || cfg.Proxy.HeaderTimeout != proxyproto.DefaultHeaderTimeout {
+		t.Fatalf("loaded %+v", cfg.Proxy)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	cfg.Addr = addr
+	srv, err := server.NewServer(cfg, func(conn net.Conn) {
+		defer conn.Close()
+		fmt.Fprintf(conn, "%s\n", conn.RemoteAddr())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.ErrorLog = quiet
+	go srv.ListenAndServe()
+	defer srv.Close()
+	h := &proxyproto.Header{
+		Version: 2, Command: proxyproto.Proxy, Protocol: proxyproto.TCP6,
+		Source: tcpAddr("[2001:db8::7]:5000"), Destination: tcpAddr("[2001:db8::1]:443"),
+	}
+	b, err := h.Format()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	for i := 0; i < 50; i++ {
+		if got, err = send(addr, b, ""); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "[2001:db8::7]:5000\n" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestWebServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	srv := web.NewServerWithConfig(web.Config{
+		Addr:  addr,
+		Proxy: proxyproto.Config{Policy: proxyproto.Require, Trusted: loopback},
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.RemoteAddr)
+	}))
+	srv.ErrorLog = quiet
+	go srv.ListenAndServe()
+	defer srv.Close()
+	req := "GET / HTTP/1.0\r\nHost: example.com\r\n\r\n"
+	var got string
+	for i := 0; i < 50; i++ {
+		if got, err = send(addr, v1Header, req); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(got, "\r\n\r\n203.0.113.7:40000") {
+		t.Fatal("response did not carry the client address: " + got)
+	}
+}
@@ -0,0 +1,77 @@
+package resp
+
+import (
+	"net"
+	"sync"
+)
+
+// Client is a RESP client over a single connection. Do is safe to call
+// from many goroutines; Send, Flush and Receive pipeline commands, and
+// should be used by one goroutine at a time.
+type Client struct {
+	conn net.Conn
+	r    *Reader
+	w    *Writer
+	mu   sync.Mutex
+}
+
+// NewClient returns a client using conn, such as one from a
+// client.Dialer or a client.Pool
+func NewClient(conn net.Conn) *Client {
+	return &Client{
+		conn: conn,
+		r:    NewReader(conn),
+		w:    NewWriter(conn),
+	}
+}
+
+// Dial connects to the server at addr over tcp
+func Dial(addr string) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// Do sends a command and waits for its reply. An error reply is
+// returned as an Error.
+func (c *Client) Do(args ...string) (Value, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.Send(args...); err != nil {
+		return Value{}, err
+	}
+	if err := c.Flush(); err != nil {
+		return Value{}, err
+	}
+	return c.Receive()
+}
+
+// Send buffers a command to be sent by Flush
+func (c *Client) Send(args ...string) error {
+	return c.w.WriteCommand(args...)
+}
+
+// Flush sends the buffered commands
+func (c *Client) Flush() error {
+	return c.w.Flush()
+}
+
+// Receive reads the reply to the next command sent. An error reply is
+// returned as an Error, along with the value.
+func (c *Client) Receive() (Value, error) {
+	v, err := c.r.ReadValue()
+	if err != nil {
+		return v, err
+	}
+	if v.Kind == ErrorReply || v.Kind == BulkError {
+		return v, Error(v.Str)
+	}
+	return v, nil
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,620 @@
+package resp
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// command is a command the server knows
+type command struct {
+	// arity counts the command name too; a negative arity is a minimum
+	arity int
+	// noQueue commands run straight away inside a MULTI
+	noQueue bool
+	fn      func(s *Server, c *conn, args [][]byte) error
+}
+
+func (cmd *command) arityOK(n int) bool {
+	if cmd.arity < 0 {
+		return n >= -cmd.arity
+	}
+	return n == cmd.arity
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"ping":     {arity: -1, fn: cmdPing},
+		"echo":     {arity: 2, fn: cmdEcho},
+		"get":      {arity: 2, fn: cmdGet},
+		"set":      {arity: -3, fn: cmdSet},
+		"del":      {arity: -2, fn: cmdDel},
+		"exists":   {arity: -2, fn: cmdExists},
+		"incr":     {arity: 2, fn: cmdIncr},
+		"decr":     {arity: 2, fn: cmdIncr},
+		"incrby":   {arity: 3, fn: cmdIncr},
+		"decrby":   {arity: 3, fn: cmdIncr},
+		"expire":   {arity: 3, fn: cmdExpire},
+		"pexpire":  {arity: 3, fn: cmdExpire},
+		"persist":  {arity: 2, fn: cmdPersist},
+		"ttl":      {arity: 2, fn: cmdTTL},
+		"pttl":     {arity: 2, fn: cmdTTL},
+		"keys":     {arity: 2, fn: cmdKeys},
+		"scan":     {arity: -2, fn: cmdScan},
+		"dbsize":   {arity: 1, fn: cmdDBSize},
+		"flushdb":  {arity: -1, fn: cmdFlush},
+		"flushall": {arity: -1, fn: cmdFlush},
+		"save":     {arity: 1, fn: cmdSave},
+		"info":     {arity: -1, fn: cmdInfo},
+		"select":   {arity: 2, fn: cmdSelect},
+		"multi":    {arity: 1, noQueue: true, fn: cmdMulti},
+		"exec":     {arity: 1, noQueue: true, fn: cmdExec},
+		"discard":  {arity: 1, noQueue: true, fn: cmdDiscard},
+		"hello":    {arity: -1, noQueue: true, fn: cmdHello},
+		"client":   {arity: -2, fn: cmdClient},
+		"command":  {arity: -1, fn: cmdCommand},
+		"quit":     {arity: 1, noQueue: true, fn: cmdQuit},
+	}
+}
+
+var (
+	errSyntax     = Error("ERR syntax error")
+	errNotInt     = Error("ERR value is not an integer or out of range")
+	errOverflow   = Error("ERR increment or decrement would overflow")
+	errBadExpire  = Error("ERR invalid expire time")
+	errNestedMult = Error("ERR MULTI calls can not be nested")
+	errNoMulti    = Error("ERR EXEC without MULTI")
+)
+
+func parseInt(b []byte) (int64, error) {
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return 0, errNotInt
+	}
+	return n, nil
+}
+
+func cmdPing(s *Server, c *conn, args [][]byte) error {
+	switch len(args) {
+	case 1:
+		return c.w.WriteSimple("PONG")
+	case 2:
+		return c.w.WriteBulk(args[1])
+	}
+	return Error("ERR wrong number of arguments for 'ping' command")
+}
+
+func cmdEcho(s *Server, c *conn, args [][]byte) error {
+	return c.w.WriteBulk(args[1])
+}
+
+func cmdGet(s *Server, c *conn, args [][]byte) error {
+	e, ok, err := s.lookup(string(args[1]))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		atomic.AddInt64(&s.misses, 1)
+		return c.w.WriteNull()
+	}
+	atomic.AddInt64(&s.hits, 1)
+	return c.w.WriteBulk(e.Value)
+}
+
+// cmdSet is SET key value [NX|XX] [GET] [EX seconds|PX milliseconds|KEEPTTL]
+func cmdSet(s *Server, c *conn, args [][]byte) error {
+	var nx, xx, get, keepTTL bool
+	var expires time.Time
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		switch {
+		case opt == "NX" && !xx:
+			nx = true
+		case opt == "XX" && !nx:
+			xx = true
+		case opt == "GET":
+			get = true
+		case opt == "KEEPTTL" && expires.IsZero():
+			keepTTL = true
+		case (opt == "EX" || opt == "PX") && expires.IsZero() && !keepTTL && i+1 < len(args):
+			i++
+			n, err := parseInt(args[i])
+			if err != nil {
+				return err
+			}
+			if n <= 0 {
+				return Error("ERR invalid expire time in 'set' command")
+			}
+			unit := time.Second
+			if opt == "PX" {
+				unit = time.Millisecond
+			}
+			if n > math.MaxInt64/int64(unit) {
+				return Error("ERR invalid expire time in 'set' command")
+			}
+			expires = time.Now().Add(time.Duration(n) * unit)
+		default:
+			return errSyntax
+		}
+	}
+	key := string(args[1])
+	old, exists, err := s.lookup(key)
+	if err != nil {
+		return err
+	}
+	if (nx && exists) || (xx && !exists) {
+		if get && exists {
+			return c.w.WriteBulk(old.Value)
+		}
+		return c.w.WriteNull()
+	}
+	e := Entry{Value: append([]byte(nil), args[2]...), Expires: expires}
+	if keepTTL {
+		e.Expires = old.Expires
+	}
+	if err := s.Storage.Set(key, e); err != nil {
+		return err
+	}
+	if get {
+		if !exists {
+			return c.w.WriteNull()
+		}
+		return c.w.WriteBulk(old.Value)
+	}
+	return c.w.WriteOK()
+}
+
+func cmdDel(s *Server, c *conn, args [][]byte) error {
+	var n int64
+	for _, key := range args[1:] {
+		if _, ok, err := s.lookup(string(key)); err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		ok, err := s.Storage.Delete(string(key))
+		if err != nil {
+			return err
+		}
+		if ok {
+			n++
+		}
+	}
+	return c.w.WriteInt(n)
+}
+
+func cmdExists(s *Server, c *conn, args [][]byte) error {
+	var n int64
+	for _, key := range args[1:] {
+		_, ok, err := s.lookup(string(key))
+		if err != nil {
+			return err
+		}
+		if ok {
+			n++
+		}
+	}
+	return c.w.WriteInt(n)
+}
+
+// cmdIncr is INCR, DECR, INCRBY and DECRBY
+func cmdIncr(s *Server, c *conn, args [][]byte) error {
+	name := strings.ToLower(string(args[0]))
+	by := int64(1)
+	if len(args) == 3 {
+		var err error
+		if by, err = parseInt(args[2]); err != nil {
+			return err
+		}
+	}
+	if strings.HasPrefix(name, "decr") {
+		if by == math.MinInt64 {
+			return errOverflow
+		}
+		by = -by
+	}
+	key := string(args[1])
+	e, ok, err := s.lookup(key)
+	if err != nil {
+		return err
+	}
+	var n int64
+	if ok {
+		if n, err = parseInt(e.Value); err != nil {
+			return err
+		}
+	}
+	if (by > 0 && n > math.MaxInt64-by) || (by < 0 && n < math.MinInt64-by) {
+		return errOverflow
+	}
+	n += by
+	e.Value = strconv.AppendInt(nil, n, 10)
+	if err := s.Storage.Set(key, e); err != nil {
+		return err
+	}
+	return c.w.WriteInt(n)
+}
+
+// cmdExpire is EXPIRE and PEXPIRE
+func cmdExpire(s *Server, c *conn, args [][]byte) error {
+	n, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	unit := time.Second
+	if strings.EqualFold(string(args[0]), "pexpire") {
+		unit = time.Millisecond
+	}
+	if n > math.MaxInt64/int64(unit) || n < math.MinInt64/int64(unit) {
+		return errBadExpire
+	}
+	key := string(args[1])
+	e, ok, err := s.lookup(key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return c.w.WriteInt(0)
+	}
+	if n <= 0 {
+		// expiring in the past deletes the key straight away
+		if _, err := s.Storage.Delete(key); err != nil {
+			return err
+		}
+		return c.w.WriteInt(1)
+	}
+	e.Expires = time.Now().Add(time.Duration(n) * unit)
+	if err := s.Storage.Set(key, e); err != nil {
+		return err
+	}
+	return c.w.WriteInt(1)
+}
+
+func cmdPersist(s *Server, c *conn, args [][]byte) error {
+	key := string(args[1])
+	e, ok, err := s.lookup(key)
+	if err != nil {
+		return err
+	}
+	if !ok || e.Expires.IsZero() {
+		return c.w.WriteInt(0)
+	}
+	e.Expires = time.Time{}
+	if err := s.Storage.Set(key, e); err != nil {
+		return err
+	}
+	return c.w.WriteInt(1)
+}
+
+// cmdTTL is TTL and PTTL. Both reply -2 for a missing key and -1 for a
+// key that never expires.
+func cmdTTL(s *Server, c *conn, args [][]byte) error {
+	e, ok, err := s.lookup(string(args[1]))
+	if err != nil {
+		return err
+	}
+	switch {
+	case !ok:
+		return c.w.WriteInt(-2)
+	case e.Expires.IsZero():
+		return c.w.WriteInt(-1)
+	}
+	left := time.Until(e.Expires)
+	if strings.EqualFold(string(args[0]), "pttl") {
+		return c.w.WriteInt(int64(left / time.Millisecond))
+	}
+	// round to the nearest second, as redis does
+	return c.w.WriteInt(int64((left + time.Second/2) / time.Second))
+}
+
+func cmdKeys(s *Server, c *conn, args [][]byte) error {
+	keys, err := s.keys()
+	if err != nil {
+		return err
+	}
+	pattern := string(args[1])
+	matched := keys[:0]
+	for _, key := range keys {
+		if match(pattern, key) {
+			matched = append(matched, key)
+		}
+	}
+	sort.Strings(matched)
+	c.w.WriteArray(len(matched))
+	for _, key := range matched {
+		c.w.WriteBulkString(key)
+	}
+	return nil
+}
+
+// cmdScan is SCAN cursor [MATCH pattern] [COUNT count]. The cursor is an
+// offset into the sorted keys, so keys added or removed during a scan
+// may be missed or returned twice, which redis allows too.
+func cmdScan(s *Server, c *conn, args [][]byte) error {
+	cursor, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return Error("ERR invalid cursor")
+	}
+	pattern, count := "*", int64(10)
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return errSyntax
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = string(args[i+1])
+		case "COUNT":
+			if count, err = parseInt(args[i+1]); err != nil {
+				return err
+			}
+			if count < 1 {
+				return errSyntax
+			}
+		case "TYPE":
+			if !strings.EqualFold(string(args[i+1]), "string") {
+				pattern = ""
+			}
+		default:
+			return errSyntax
+		}
+	}
+	keys, err := s.keys()
+	if err != nil {
+		return err
+	}
+	sort.Strings(keys)
+	var found []string
+	i := cursor
+	for ; i < uint64(len(keys)) && i < cursor+uint64(count); i++ {
+		if pattern != "" && match(pattern, keys[i]) {
+			found = append(found, keys[i])
+		}
+	}
+	if i >= uint64(len(keys)) {
+		i = 0
+	}
+	c.w.WriteArray(2)
+	c.w.WriteBulkString(strconv.FormatUint(i, 10))
+	c.w.WriteArray(len(found))
+	for _, key := range found {
+		c.w.WriteBulkString(key)
+	}
+	return nil
+}
+
+func cmdDBSize(s *Server, c *conn, args [][]byte) error {
+	keys, err := s.keys()
+	if err != nil {
+		return err
+	}
+	return c.w.WriteInt(int64(len(keys)))
+}
+
+// cmdFlush is FLUSHDB and FLUSHALL, there only being the one database.
+// ASYNC and SYNC are accepted, but it is always done straight away.
+func cmdFlush(s *Server, c *conn, args [][]byte) error {
+	if len(args) > 2 {
+		return errSyntax
+	}
+	var keys []string
+	err := s.Storage.Keys(func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if _, err := s.Storage.Delete(key); err != nil {
+			return err
+		}
+	}
+	return c.w.WriteOK()
+}
+
+func cmdSave(s *Server, c *conn, args [][]byte) error {
+	if sy, ok := s.Storage.(Syncer); ok {
+		if err := sy.Sync(); err != nil {
+			return err
+		}
+	}
+	return c.w.WriteOK()
+}
+
+// cmdInfo is INFO [section], with the server, clients, stats and
+// keyspace sections
+func cmdInfo(s *Server, c *conn, args [][]byte) error {
+	section := "all"
+	if len(args) > 1 {
+		section = strings.ToLower(string(args[1]))
+	}
+	var sb strings.Builder
+	add := func(name string, fn func()) {
+		if section == "all" || section == "default" || section == "everything" || section == name {
+			if sb.Len() > 0 {
+				sb.WriteString("\r\n")
+			}
+			fmt.Fprintf(&sb, "# %s\r\n", strings.Title(name))
+			fn()
+		}
+	}
+	add("server", func() {
+		fmt.Fprintf(&sb, "redis_version:%s\r\n", version)
+		fmt.Fprintf(&sb, "redis_mode:standalone\r\n")
+		fmt.Fprintf(&sb, "os:%s %s\r\n", runtime.GOOS, runtime.GOARCH)
+		fmt.Fprintf(&sb, "go_version:%s\r\n", runtime.Version())
+		fmt.Fprintf(&sb, "uptime_in_seconds:%d\r\n", int64(time.Since(s.started)/time.Second))
+	})
+	add("clients", func() {
+		fmt.Fprintf(&sb, "connected_clients:%d\r\n", atomic.LoadInt64(&s.clients))
+	})
+	add("stats", func() {
+		fmt.Fprintf(&sb, "total_connections_received:%d\r\n", atomic.LoadInt64(&s.conns))
+		fmt.Fprintf(&sb, "total_commands_processed:%d\r\n", atomic.LoadInt64(&s.commands))
+		fmt.Fprintf(&sb, "expired_keys:%d\r\n", atomic.LoadInt64(&s.expired))
+		fmt.Fprintf(&sb, "keyspace_hits:%d\r\n", atomic.LoadInt64(&s.hits))
+		fmt.Fprintf(&sb, "keyspace_misses:%d\r\n", atomic.LoadInt64(&s.misses))
+	})
+	var err error
+	add("keyspace", func() {
+		var keys []string
+		if keys, err = s.keys(); err != nil || len(keys) == 0 {
+			return
+		}
+		var expires int
+		for _, key := range keys {
+			if e, _, _ := s.Storage.Get(key); !e.Expires.IsZero() {
+				expires++
+			}
+		}
+		fmt.Fprintf(&sb, "db0:keys=%d,expires=%d,avg_ttl=0\r\n", len(keys), expires)
+	})
+	if err != nil {
+		return err
+	}
+	return c.w.WriteBulkString(sb.String())
+}
+
+func cmdSelect(s *Server, c *conn, args [][]byte) error {
+	n, err := parseInt(args[1])
+	if err != nil {
+		return err
+	}
+	if n != 0 {
+		return Error("ERR DB index is out of range")
+	}
+	return c.w.WriteOK()
+}
+
+func cmdMulti(s *Server, c *conn, args [][]byte) error {
+	if c.multi {
+		return errNestedMult
+	}
+	c.multi = true
+	return c.w.WriteOK()
+}
+
+func cmdExec(s *Server, c *conn, args [][]byte) error {
+	if !c.multi {
+		return errNoMulti
+	}
+	queued, dirty := c.queued, c.dirty
+	c.multi, c.queued, c.dirty = false, nil, false
+	if dirty {
+		return Error("EXECABORT Transaction discarded because of previous errors.")
+	}
+	// the caller holds the lock, so nothing else runs in between
+	c.w.WriteArray(len(queued))
+	for _, q := range queued {
+		s.run(c, commands[strings.ToLower(string(q[0]))], q)
+	}
+	return nil
+}
+
+func cmdDiscard(s *Server, c *conn, args [][]byte) error {
+	if !c.multi {
+		return Error("ERR DISCARD without MULTI")
+	}
+	c.multi, c.queued, c.dirty = false, nil, false
+	return c.w.WriteOK()
+}
+
+// version is the redis version reported to clients, some of which
+// check it before using newer commands
+const version = "7.0.0"
+
+// cmdHello is HELLO [protover [AUTH username password] [SETNAME name]].
+// There are no users, so AUTH is accepted as it is.
+func cmdHello(s *Server, c *conn, args [][]byte) error {
+	proto := c.w.Proto
+	if len(args) > 1 {
+		n, err := parseInt(args[1])
+		if err != nil {
+			return Error("ERR Protocol version is not an integer or out of range")
+		}
+		if n != 2 && n != 3 {
+			return Error("NOPROTO unsupported protocol version")
+		}
+		proto = int(n)
+	}
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "AUTH":
+			if i+2 >= len(args) {
+				return errSyntax
+			}
+			i += 2
+		case "SETNAME":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			i++
+			c.name = string(args[i])
+		default:
+			return errSyntax
+		}
+	}
+	c.w.Proto = proto
+	if c.w.Proto == 0 {
+		c.w.Proto = 2
+	}
+	c.w.WriteMap(7)
+	c.w.WriteBulkString("server")
+	c.w.WriteBulkString("redis")
+	c.w.WriteBulkString("version")
+	c.w.WriteBulkString(version)
+	c.w.WriteBulkString("proto")
+	c.w.WriteInt(int64(c.w.Proto))
+	c.w.WriteBulkString("id")
+	c.w.WriteInt(c.id)
+	c.w.WriteBulkString("mode")
+	c.w.WriteBulkString("standalone")
+	c.w.WriteBulkString("role")
+	c.w.WriteBulkString("master")
+	c.w.WriteBulkString("modules")
+	return c.w.WriteArray(0)
+}
+
+// cmdClient is CLIENT ID, GETNAME, SETNAME and SETINFO, which clients
+// send when they connect
+func cmdClient(s *Server, c *conn, args [][]byte) error {
+	switch strings.ToUpper(string(args[1])) {
+	case "ID":
+		return c.w.WriteInt(c.id)
+	case "GETNAME":
+		if c.name == "" {
+			return c.w.WriteNull()
+		}
+		return c.w.WriteBulkString(c.name)
+	case "SETNAME":
+		if len(args) != 3 {
+			return errSyntax
+		}
+		c.name = string(args[2])
+		return c.w.WriteOK()
+	case "SETINFO":
+		return c.w.WriteOK()
+	}
+	return Error("ERR unknown subcommand '" + string(args[1]) + "'")
+}
+
+// cmdCommand replies with an empty list, which is enough for redis-cli
+// and the clients that ask on startup
+func cmdCommand(s *Server, c *conn, args [][]byte) error {
+	if len(args) > 1 && strings.EqualFold(string(args[1]), "count") {
+		return c.w.WriteInt(int64(len(commands)))
+	}
+	return c.w.WriteArray(0)
+}
+
+func cmdQuit(s *Server, c *conn, args [][]byte) error {
+	c.quit = true
+	return c.w.WriteOK()
+}
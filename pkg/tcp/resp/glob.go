@@ -0,0 +1,88 @@
+package resp
+
+// match reports whether s matches the glob pattern, the way KEYS and
+// SCAN MATCH do: * matches anything, ? any one byte, [abc] and [a-z]
+// any byte in the set ([^abc] any byte not in it), and \ escapes the
+// next byte.
+func match(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if match(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			ok, rest := matchClass(pattern[1:], s[0])
+			if !ok {
+				return false
+			}
+			s = s[1:]
+			pattern = rest
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		}
+	}
+	return len(s) == 0
+}
+
+// matchClass matches c against the class at the start of p, which comes
+// just after the '[', returning the pattern after the closing ']'
+func matchClass(p string, c byte) (bool, string) {
+	negate := false
+	if len(p) > 0 && p[0] == '^' {
+		negate = true
+		p = p[1:]
+	}
+	found := false
+	for len(p) > 0 && p[0] != ']' {
+		lo := p[0]
+		if lo == '\\' && len(p) > 1 {
+			p = p[1:]
+			lo = p[0]
+		}
+		p = p[1:]
+		hi := lo
+		if len(p) > 1 && p[0] == '-' && p[1] != ']' {
+			hi = p[1]
+			p = p[2:]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+		}
+		if lo <= c && c <= hi {
+			found = true
+		}
+	}
+	if len(p) > 0 {
+		// skip the ']'
+		p = p[1:]
+	}
+	return found != negate, p
+}
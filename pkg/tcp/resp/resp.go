@@ -0,0 +1,300 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/tcp/line"
+	"io"
+	"strconv"
+)
+
+// Kind is the type of a RESP value, named by the byte that starts it
+type Kind byte
+
+const (
+	SimpleString Kind = '+'
+	ErrorReply   Kind = '-'
+	Integer      Kind = ':'
+	BulkString   Kind = '$'
+	Array        Kind = '*'
+	Null         Kind = '_' // RESP3, and the RESP2 "$-1" and "*-1"
+	Double       Kind = ','
+	Boolean      Kind = '#'
+	BigNumber    Kind = '('
+	BulkError    Kind = '!'
+	Verbatim     Kind = '='
+	Map          Kind = '%'
+	Set          Kind = '~'
+	Push         Kind = '>'
+)
+
+// Default limits for a Reader
+const (
+	DefaultMaxBulkLen   = 512 << 20
+	DefaultMaxArrayLen  = 1 << 20
+	DefaultMaxInlineLen = 64 << 10
+)
+
+var (
+	ErrProtocol = errors.New("resp: protocol error")
+	ErrTooLarge = errors.New("resp: value too large")
+)
+
+// Value is a single RESP value
+type Value struct {
+	Kind  Kind
+	Str   []byte  // simple and bulk strings, errors, doubles, big numbers and verbatim text
+	Int   int64   // integers, and booleans as 0 or 1
+	Elems []Value // arrays, sets and pushes, and maps as key, value, key, value...
+}
+
+// IsNull reports whether v is a null
+func (v Value) IsNull() bool {
+	return v.Kind == Null
+}
+
+// String returns v as a string, for strings, errors and numbers
+func (v Value) String() string {
+	switch v.Kind {
+	case Integer:
+		return strconv.FormatInt(v.Int, 10)
+	case Boolean:
+		return strconv.FormatBool(v.Int != 0)
+	case Null:
+		return "(nil)"
+	case Array, Set, Push, Map:
+		return fmt.Sprint(v.Elems)
+	}
+	return string(v.Str)
+}
+
+// Error is an error reply from the server
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Reader reads RESP values and commands
+type Reader struct {
+	MaxBulkLen   int // DefaultMaxBulkLen if zero
+	MaxArrayLen  int // DefaultMaxArrayLen if zero
+	MaxInlineLen int // DefaultMaxInlineLen if zero
+
+	br *bufio.Reader
+}
+
+// NewReader returns a new Reader reading from r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{br: bufio.NewReader(r)}
+}
+
+// Buffered returns the number of bytes that have been read but not yet
+// used. When it is zero, there are no more pipelined commands waiting.
+func (r *Reader) Buffered() int {
+	return r.br.Buffered()
+}
+
+// ReadCommand reads a command, either a RESP array of bulk strings or an
+// inline command, which is a line of space separated arguments that may
+// be quoted the way line.ParseArgs does it. An empty inline command
+// returns no args and no error.
+func (r *Reader) ReadCommand() ([][]byte, error) {
+	b, err := r.br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] != byte(Array) {
+		return r.readInline()
+	}
+	r.br.ReadByte()
+	n, err := r.readLength(r.maxArrayLen())
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, nil
+	}
+	args := make([][]byte, n)
+	for i := range args {
+		c, err := r.br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if c != byte(BulkString) {
+			return nil, fmt.Errorf("%w: expected '$', got %q", ErrProtocol, c)
+		}
+		if args[i], err = r.readBulk(); err != nil {
+			return nil, err
+		}
+		if args[i] == nil {
+			return nil, fmt.Errorf("%w: null bulk string in command", ErrProtocol)
+		}
+	}
+	return args, nil
+}
+
+func (r *Reader) readInline() ([][]byte, error) {
+	ln, err := r.readLine(r.maxInlineLen())
+	if err != nil {
+		return nil, err
+	}
+	words, err := line.ParseArgs(string(ln))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrProtocol, err)
+	}
+	args := make([][]byte, len(words))
+	for i, w := range words {
+		args[i] = []byte(w)
+	}
+	return args, nil
+}
+
+// ReadValue reads any RESP2 or RESP3 value
+func (r *Reader) ReadValue() (Value, error) {
+	c, err := r.br.ReadByte()
+	if err != nil {
+		return Value{}, err
+	}
+	v := Value{Kind: Kind(c)}
+	switch v.Kind {
+	case SimpleString, ErrorReply, Double, BigNumber:
+		v.Str, err = r.readLine(r.maxInlineLen())
+	case Integer:
+		v.Int, err = r.readInt()
+	case BulkString, BulkError, Verbatim:
+		v.Str, err = r.readBulk()
+		if err == nil && v.Str == nil {
+			v.Kind = Null
+		}
+	case Boolean:
+		var ln []byte
+		if ln, err = r.readLine(3); err == nil {
+			switch string(ln) {
+			case "t":
+				v.Int = 1
+			case "f":
+			default:
+				err = fmt.Errorf("%w: bad boolean %q", ErrProtocol, ln)
+			}
+		}
+	case Null:
+		_, err = r.readLine(2)
+	case Array, Set, Push, Map:
+		var n int
+		if n, err = r.readLength(r.maxArrayLen()); err != nil {
+			break
+		}
+		if n < 0 {
+			v.Kind = Null
+			break
+		}
+		if v.Kind == Map {
+			n *= 2
+		}
+		v.Elems = make([]Value, n)
+		for i := range v.Elems {
+			if v.Elems[i], err = r.ReadValue(); err != nil {
+				break
+			}
+		}
+	default:
+		err = fmt.Errorf("%w: unknown type %q", ErrProtocol, c)
+	}
+	if err != nil {
+		return Value{}, err
+	}
+	return v, nil
+}
+
+// readLine reads up to a crlf, returning the line without it
+func (r *Reader) readLine(max int) ([]byte, error) {
+	var ln []byte
+	for {
+		b, err := r.br.ReadSlice('\n')
+		ln = append(ln, b...)
+		if err == bufio.ErrBufferFull {
+			if len(ln) > max {
+				return nil, ErrTooLarge
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	if len(ln) > max+2 {
+		return nil, ErrTooLarge
+	}
+	if len(ln) < 2 || ln[len(ln)-2] != '\r' {
+		return nil, fmt.Errorf("%w: line not ended by crlf", ErrProtocol)
+	}
+	return ln[:len(ln)-2], nil
+}
+
+func (r *Reader) readInt() (int64, error) {
+	ln, err := r.readLine(20)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(string(ln), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: bad integer %q", ErrProtocol, ln)
+	}
+	return n, nil
+}
+
+// readLength reads an array or bulk string length, -1 for a null
+func (r *Reader) readLength(max int) (int, error) {
+	n, err := r.readInt()
+	if err != nil {
+		return 0, err
+	}
+	if n < -1 {
+		return 0, fmt.Errorf("%w: bad length %d", ErrProtocol, n)
+	}
+	if n > int64(max) {
+		return 0, ErrTooLarge
+	}
+	return int(n), nil
+}
+
+// readBulk reads the rest of a bulk string, nil for a null
+func (r *Reader) readBulk() ([]byte, error) {
+	n, err := r.readLength(r.maxBulkLen())
+	if err != nil || n < 0 {
+		return nil, err
+	}
+	b := make([]byte, n+2)
+	if _, err := io.ReadFull(r.br, b); err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(b, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: bulk string not ended by crlf", ErrProtocol)
+	}
+	return b[:n], nil
+}
+
+func (r *Reader) maxBulkLen() int {
+	if r.MaxBulkLen > 0 {
+		return r.MaxBulkLen
+	}
+	return DefaultMaxBulkLen
+}
+
+func (r *Reader) maxArrayLen() int {
+	if r.MaxArrayLen > 0 {
+		return r.MaxArrayLen
+	}
+	return DefaultMaxArrayLen
+}
+
+func (r *Reader) maxInlineLen() int {
+	if r.MaxInlineLen > 0 {
+		return r.MaxInlineLen
+	}
+	return DefaultMaxInlineLen
+}
@@ -0,0 +1,702 @@
+package resp_test
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/data"
+	"github.com/scottcagno/net-tools/pkg/tcp/resp"
+	"github.com/scottcagno/net-tools/pkg/tcp/server"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var quiet = log.New(ioutil.Discard, "", 0)
+
+// start serves st on a loopback port, returning its address and a func
+// to stop it
+func start(st resp.Storage) (string, func(), error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	rs := resp.NewServer(st)
+	rs.ErrorLog = quiet
+	srv := &server.Server{Handler: rs.ServeConn, ErrorLog: quiet}
+	go srv.Serve(ln)
+	return ln.Addr().String(), func() { srv.Close() }, nil
+}
+
+// dial starts a server on fresh memory storage and connects to it
+func dial() (*resp.Client, func(), error) {
+	addr, stop, err := start(resp.NewMemStorage())
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := resp.Dial(addr)
+	if err != nil {
+		stop()
+		return nil, nil, err
+	}
+	return c, func() { c.Close(); stop() }, nil
+}
+
+// script runs each command and compares the reply, as a string, with the
+// expected one; "ERR..." expects an error starting with it
+func script(c *resp.Client, steps [][2]string) error {
+	for _, step := range steps {
+		args, want := strings.Fields(step[0]), step[1]
+		v, err := c.Do(args...)
+		got := v.String()
+		if err != nil {
+			got = err.Error()
+		}
+		if got != want && !(strings.HasSuffix(want, "...") && strings.HasPrefix(got, strings.TrimSuffix(want, "..."))) {
+			return fmt.Errorf("%s: got %q, want %q", step[0], got, want)
+		}
+	}
+	return nil
+}
+
+func TestReadValues(t *testing.T) {
+	in := "+OK\r\n-ERR bad\r\n:42\r\n$5\r\nhello\r\n$-1\r\n*2\r\n$1\r\na\r\n:1\r\n*-1\r\n" +
+		"_\r\n,3.5\r\n#t\r\n(123456789012345678901234567890\r\n!3\r\nbad\r\n=8\r\ntxt:text\r\n" +
+		"%1\r\n+k\r\n:2\r\n~1\r\n+m\r\n>1\r\n+p\r\n"
+	r := resp.NewReader(strings.NewReader(in))
+	want := []resp.Value{
+		{Kind: resp.SimpleString, Str: []byte("OK")},
+		{Kind: resp.ErrorReply, Str: []byte("ERR bad")},
+		{Kind: resp.Integer, Int: 42},
+		{Kind: resp.BulkString, Str: []byte("hello")},
+		{Kind: resp.Null},
+		{Kind: resp.Array, Elems: []resp.Value{{Kind: resp.BulkString, Str: []byte("a")}, {Kind: resp.Integer, Int: 1}}},
+		{Kind: resp.Null},
+		{Kind: resp.Null},
+		{Kind: resp.Double, Str: []byte("3.5")},
+		{Kind: resp.Boolean, Int: 1},
+		{Kind: resp.BigNumber, Str: []byte("123456789012345678901234567890")},
+		{Kind: resp.BulkError, Str: []byte("bad")},
+		{Kind: resp.Verbatim, Str: []byte("txt:text")},
+		{Kind: resp.Map, Elems: []resp.Value{{Kind: resp.SimpleString, Str: []byte("k")}, {Kind: resp.Integer, Int: 2}}},
+		{Kind: resp.Set, Elems: []resp.Value{{Kind: resp.SimpleString, Str: []byte("m")}}},
+		{Kind: resp.Push, Elems: []resp.Value{{Kind: resp.SimpleString, Str: []byte("p")}}},
+	}
+	for i, w := range want {
+		v, err := r.ReadValue()
+		if err != nil {
+			t.Fatalf("value %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(v, w) {
+			t.Fatalf("value %d: got %+v, want %+v", i, v, w)
+		}
+	}
+	for _, bad := range []string{"$5\r\nhi\r\n", "*x\r\n", "?\r\n", ":1\n"} {
+		if _, err := resp.NewReader(strings.NewReader(bad)).ReadValue(); err == nil {
+			t.Fatalf("%q: no error", bad)
+		}
+	}
+	r = resp.NewReader(strings.NewReader("$10\r\n0123456789\r\n"))
+	r.MaxBulkLen = 5
+	if _, err := r.ReadValue(); err != resp.ErrTooLarge {
+		t.Fatalf("oversized bulk: got %v", err)
+	}
+}
+
+func TestGlob(t *testing.T) {
+	c, stop, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	for _, k := range []string{"hello", "hallo", "hxllo", "hllo", "heeeello", "h*llo", "user:1", "user:22"} {
+		if _, err := c.Do("SET", k, "x"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := script(c, [][2]string{
+		{`KEYS h?llo`, "[h*llo hallo hello hxllo]"},
+		{`KEYS h*llo`, "[h*llo hallo heeeello hello hllo hxllo]"},
+		{`KEYS h[ae]llo`, "[hallo hello]"},
+		{`KEYS h[^e]llo`, "[h*llo hallo hxllo]"},
+		{`KEYS h[a-b]llo`, "[hallo]"},
+		{`KEYS h\*llo`, "[h*llo]"},
+		{`KEYS user:?`, "[user:1]"},
+		{`KEYS nothing*`, "[]"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetSetDel(t *testing.T) {
+	c, stop, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	if err := script(c, [][2]string{
+		{"GET a", "(nil)"},
+		{"SET a 1", "OK"},
+		{"GET a", "1"},
+		{"SET b 2", "OK"},
+		{"EXISTS a b c a", "3"},
+		{"DEL a c", "1"},
+		{"GET a", "(nil)"},
+		{"DBSIZE", "1"},
+		{"FLUSHDB", "OK"},
+		{"DBSIZE", "0"},
+		{"GET", "ERR wrong number of arguments for 'get' command"},
+		{"NOPE x", "ERR unknown command 'NOPE'"},
+		{"SELECT 0", "OK"},
+		{"SELECT 1", "ERR DB index is out of range"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetOptions(t *testing.T) {
+	c, stop, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	if err := script(c, [][2]string{
+		{"SET a 1 NX", "OK"},
+		{"SET a 2 NX", "(nil)"},
+		{"GET a", "1"},
+		{"SET b 1 XX", "(nil)"},
+		{"GET b", "(nil)"},
+		{"SET a 3 XX GET", "1"},
+		{"SET a 4 GET", "3"},
+		{"SET c 1 GET", "(nil)"},
+		{"SET a 5 EX 100", "OK"},
+		{"TTL a", "100"},
+		{"SET a 6 KEEPTTL", "OK"},
+		{"TTL a", "100"},
+		{"SET a 7", "OK"},
+		{"TTL a", "-1"},
+		{"SET a 8 PX 100000", "OK"},
+		{"TTL a", "100"},
+		{"SET a 1 NX XX", "ERR syntax error"},
+		{"SET a 1 EX", "ERR syntax error"},
+		{"SET a 1 EX 0", "ERR invalid expire time in 'set' command"},
+		{"SET a 1 EX x", "ERR value is not an integer or out of range"},
+		{"SET a 1 EX 10 KEEPTTL", "ERR syntax error"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIncr(t *testing.T) {
+	c, stop, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	if err := script(c, [][2]string{
+		{"INCR n", "1"},
+		{"INCR n", "2"},
+		{"INCRBY n 10", "12"},
+		{"DECR n", "11"},
+		{"DECRBY n 20", "-9"},
+		{"GET n", "-9"},
+		{"SET s abc", "OK"},
+		{"INCR s", "ERR value is not an integer or out of range"},
+		{"SET m 9223372036854775807", "OK"},
+		{"INCR m", "ERR increment or decrement would overflow"},
+		{"SET e 5 EX 100", "OK"},
+		{"INCR e", "6"},
+		{"TTL e", "100"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	c, stop, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	err = script(c, [][2]string{
+		{"TTL a", "-2"},
+		{"SET a 1", "OK"},
+		{"EXPIRE missing 10", "0"},
+		{"EXPIRE a 10", "1"},
+		{"TTL a", "10"},
+		{"PERSIST a", "1"},
+		{"PERSIST a", "0"},
+		{"TTL a", "-1"},
+		{"PEXPIRE a 50", "1"},
+		{"SET b 1 PX 50", "OK"},
+		{"SET c 1", "OK"},
+		{"EXPIRE c 0", "1"},
+		{"EXISTS c", "0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := c.Do("PTTL", "a")
+	if err != nil || v.Int <= 0 || v.Int > 50 {
+		t.Fatalf("PTTL a: %v, %v", v, err)
+	}
+	time.Sleep(80 * time.Millisecond)
+	if err := script(c, [][2]string{
+		{"GET a", "(nil)"},
+		{"TTL a", "-2"},
+		{"DBSIZE", "0"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	v, err = c.Do("INFO", "stats")
+	if err != nil || !strings.Contains(v.String(), "expired_keys:2\r\n") {
+		t.Fatalf("INFO stats: %q, %v", v, err)
+	}
+}
+
+func TestKeysScan(t *testing.T) {
+	c, stop, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	want := map[string]bool{}
+	for i := 0; i < 95; i++ {
+		key := fmt.Sprintf("key:%d", i)
+		want[key] = true
+		if _, err := c.Do("SET", key, "x"); err != nil {
+			t.Fatal(err)
+		}
+		c.Do("SET", fmt.Sprintf("other:%d", i), "x")
+	}
+	// scan with a pattern until the cursor comes back round to 0
+	seen := map[string]bool{}
+	cursor := "0"
+	for calls := 0; ; calls++ {
+		if calls > 100 {
+			t.Fatal("scan never finished")
+		}
+		v, err := c.Do("SCAN", cursor, "MATCH", "key:*", "COUNT", "20")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(v.Elems) != 2 {
+			t.Fatalf("scan reply %v", v)
+		}
+		for _, k := range v.Elems[1].Elems {
+			seen[string(k.Str)] = true
+		}
+		if cursor = v.Elems[0].String(); cursor == "0" {
+			break
+		}
+	}
+	if !reflect.DeepEqual(seen, want) {
+		t.Fatalf("scan found %d keys, want %d", len(seen), len(want))
+	}
+	v, err := c.Do("KEYS", "key:9*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Elems) != 6 {
+		t.Fatalf("KEYS key:9* found %v", v)
+	}
+	if err := script(c, [][2]string{
+		{"SCAN x", "ERR invalid cursor"},
+		{"SCAN 0 COUNT 0", "ERR syntax error"},
+		{"SCAN 0 MATCH", "ERR syntax error"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMultiExec(t *testing.T) {
+	c, stop, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	err = script(c, [][2]string{
+		{"MULTI", "OK"},
+		{"SET a 1", "QUEUED"},
+		{"INCR a", "QUEUED"},
+		{"INCR s", "QUEUED"},
+		{"GET a", "QUEUED"},
+		{"MULTI", "ERR MULTI calls can not be nested"},
+		{"EXEC", "[OK 2 1 2]"},
+		{"EXEC", "ERR EXEC without MULTI"},
+		{"MULTI", "OK"},
+		{"SET a", "ERR wrong number of arguments for 'set' command"},
+		{"SET a 10", "QUEUED"},
+		{"EXEC", "EXECABORT Transaction discarded because of previous errors."},
+		{"GET a", "2"},
+		{"MULTI", "OK"},
+		{"SET a 10", "QUEUED"},
+		{"DISCARD", "OK"},
+		{"GET a", "2"},
+		{"DISCARD", "ERR DISCARD without MULTI"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// runtime errors inside EXEC come back in place, the rest still run
+	if _, err := c.Do("MULTI"); err != nil {
+		t.Fatal(err)
+	}
+	c.Do("SET", "t", "abc")
+	c.Do("INCR", "t")
+	c.Do("SET", "u", "1")
+	v, err := c.Do("EXEC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Elems) != 3 || v.Elems[1].Kind != resp.ErrorReply || v.Elems[2].String() != "OK" {
+		t.Fatalf("EXEC with an error inside: %v", v)
+	}
+}
+
+func TestHello(t *testing.T) {
+	c, stop, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	v, err := c.Do("HELLO", "3", "SETNAME", "checker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Kind != resp.Map || len(v.Elems) != 14 || v.Elems[5].Int != 3 {
+		t.Fatalf("HELLO 3: %+v", v)
+	}
+	v, err = c.Do("GET", "missing")
+	if err != nil || v.Kind != resp.Null {
+		t.Fatalf("RESP3 GET missing: %+v, %v", v, err)
+	}
+	if err := script(c, [][2]string{
+		{"CLIENT GETNAME", "checker"},
+		{"HELLO 4", "NOPROTO unsupported protocol version"},
+		{"HELLO 2", "[server redis version 7.0.0 proto 2 id 1 mode standalone role master modules []]"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// back on RESP2, the map is an array and null is $-1
+	v, err = c.Do("GET", "missing")
+	if err != nil || v.Kind != resp.Null {
+		t.Fatalf("RESP2 GET missing: %+v, %v", v, err)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	c, stop, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	c.Do("SET", "a", "1")
+	c.Do("SET", "b", "1", "EX", "100")
+	v, err := c.Do("INFO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"# Server\r\n", "redis_version:", "connected_clients:1\r\n", "db0:keys=2,expires=1"} {
+		if !strings.Contains(v.String(), want) {
+			t.Fatalf("INFO missing %q:\n%s", want, v)
+		}
+	}
+	v, err = c.Do("INFO", "clients")
+	if err != nil || strings.Contains(v.String(), "# Server") {
+		t.Fatalf("INFO clients: %q, %v", v, err)
+	}
+	if err := script(c, [][2]string{
+		{"PING", "PONG"},
+		{"PING hi", "hi"},
+		{"PING a b", "ERR wrong number of arguments for 'ping' command"},
+		{"ECHO hello", "hello"},
+		{"COMMAND", "[]"},
+		{"QUIT", "OK"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// raw sends s on a plain connection and reads until the server closes it
+func raw(addr, s string) (string, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte(s)); err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadAll(conn)
+	return string(b), err
+}
+
+func TestInline(t *testing.T) {
+	addr, stop, err := start(resp.NewMemStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	got, err := raw(addr, "PING\r\n\r\nSET k \"two words\"\r\nGET k\r\nQUIT\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "+PONG\r\n+OK\r\n$9\r\ntwo words\r\n+OK\r\n"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	addr, stop, err := start(resp.NewMemStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	got, err := raw(addr, "*1\r\n+PING\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(got, "-ERR Protocol error") {
+		t.Fatalf("got %q", got)
+	}
+	got, err = raw(addr, "SET k \"open\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(got, "-ERR Protocol error") {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	addr, stop, err := start(resp.NewMemStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	// send a whole pipeline in one write, the replies must come back in
+	// order
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	const n = 500
+	var req []byte
+	for i := 0; i < n; i++ {
+		req = append(req, "*2\r\n$4\r\nINCR\r\n$1\r\nk\r\n"...)
+	}
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	br := bufio.NewReader(conn)
+	for i := 1; i <= n; i++ {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := ":" + strconv.Itoa(i) + "\r\n"; line != want {
+			t.Fatalf("reply %d: got %q, want %q", i, line, want)
+		}
+	}
+}
+
+func TestDataStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.dat")
+	ds, err := resp.OpenDataStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, stop, err := start(ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := resp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = script(c, [][2]string{
+		{"SET a 1", "OK"},
+		{"SET b 2 EX 100", "OK"},
+		{"SET gone 3 PX 1", "OK"},
+		{"INCR a", "2"},
+		{"SET c 3", "OK"},
+		{"DEL c", "1"},
+		{"SAVE", "OK"},
+	})
+	c.Close()
+	stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// a torn write at the end of the log is dropped on the next open
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.Write([]byte{40, 0, 0, 0, 0, 0, 0, 0, 1, 2})
+	fd.Close()
+	log.SetOutput(ioutil.Discard)
+	ds, err = resp.OpenDataStorage(path)
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	addr, stop, err = start(ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	c, err = resp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = script(c, [][2]string{
+		{"GET a", "2"},
+		{"GET b", "2"},
+		{"TTL b", "100"},
+		{"GET c", "(nil)"},
+		{"GET gone", "(nil)"},
+		{"DBSIZE", "2"},
+		{"SET d 4", "OK"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// and the log still takes appends after the truncation
+	stop()
+	ds.Close()
+	st, err := data.OpenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds2, err := resp.NewDataStorage(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds2.Close()
+	if e, ok, _ := ds2.Get("d"); !ok || string(e.Value) != "4" {
+		t.Fatalf("d after reopen: %q, %v", e.Value, ok)
+	}
+}
+
+func TestDataStorageBadRecord(t *testing.T) {
+	for name, garbage := range map[string][]byte{
+		// a length far past anything we would write
+		"length": {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x3f},
+		// a record whose checksum doesn't match
+		"checksum": {6, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4, 1, 0},
+		// a length header with nothing after it
+		"header": {6, 0, 0, 0, 0, 0, 0, 0},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "kv.dat")
+			ds, err := resp.OpenDataStorage(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = ds.Set("a", resp.Entry{Value: []byte("1")}); err != nil {
+				t.Fatal(err)
+			}
+			if err = ds.Close(); err != nil {
+				t.Fatal(err)
+			}
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fd.Write(garbage)
+			fd.Close()
+			log.SetOutput(ioutil.Discard)
+			ds, err = resp.OpenDataStorage(path)
+			log.SetOutput(os.Stderr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ds.Close()
+			if e, ok, _ := ds.Get("a"); !ok || string(e.Value) != "1" {
+				t.Fatalf("a after reopen: %q, %v", e.Value, ok)
+			}
+			fi2, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi2.Size() != fi.Size() {
+				t.Fatalf("store is %d bytes, want it cut back to %d", fi2.Size(), fi.Size())
+			}
+		})
+	}
+}
+
+func TestBench(t *testing.T) {
+	addr, stop, err := start(resp.NewMemStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	// redis-benchmark style: clients each sending pipelines of SET and GET
+	const clients, requests, pipeline = 20, 5000, 16
+	start := time.Now()
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := resp.Dial(addr)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer c.Close()
+			for n := 0; n < requests; n += pipeline {
+				for j := 0; j < pipeline; j++ {
+					key := "key:" + strconv.Itoa((i*requests+n+j)%1000)
+					if j%2 == 0 {
+						c.Send("SET", key, "xxx")
+					} else {
+						c.Send("GET", key)
+					}
+				}
+				if err := c.Flush(); err != nil {
+					errs <- err
+					return
+				}
+				for j := 0; j < pipeline; j++ {
+					if _, err := c.Receive(); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	total := clients * requests
+	t.Logf("%d requests, %d clients, pipeline %d: %.0f requests per second",
+		total, clients, pipeline, float64(total)/elapsed.Seconds())
+}
@@ -0,0 +1,190 @@
+package resp
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// flushAt is how much reply data is let build up while working through
+// a pipeline before it is written out anyway
+const flushAt = 64 << 10
+
+// Server speaks the Redis protocol, RESP2 or RESP3 (after a HELLO 3),
+// against a Storage. ServeConn is a server.Handler, so it can be used
+// with pkg/tcp/server and its middleware:
+//
+//	srv, err := server.NewServer(cfg, resp.NewServer(resp.NewMemStorage()).ServeConn)
+//
+// Commands run one at a time, the way they do in Redis, so each one is
+// atomic, and so is a MULTI ... EXEC block. Pipelined commands are all
+// handled before their replies are flushed, in one write.
+type Server struct {
+	Storage  Storage
+	ErrorLog *log.Logger // logs connection errors, log.Default() if nil
+
+	mu      sync.Mutex // held while a command runs
+	started time.Time
+	nextID  int64
+
+	// stats for INFO
+	clients  int64
+	conns    int64
+	commands int64
+	expired  int64
+	hits     int64
+	misses   int64
+}
+
+// NewServer returns a new Server using st
+func NewServer(st Storage) *Server {
+	return &Server{Storage: st, started: time.Now()}
+}
+
+// conn is the state of a single client connection
+type conn struct {
+	id     int64
+	name   string
+	w      *Writer
+	multi  bool       // inside a MULTI
+	queued [][][]byte // commands queued by MULTI
+	dirty  bool       // a command failed to queue, so EXEC must abort
+	quit   bool
+}
+
+// ServeConn serves a single client connection until it quits or the
+// connection is closed
+func (s *Server) ServeConn(nc net.Conn) {
+	defer nc.Close()
+	atomic.AddInt64(&s.clients, 1)
+	defer atomic.AddInt64(&s.clients, -1)
+	atomic.AddInt64(&s.conns, 1)
+
+	r := NewReader(nc)
+	c := &conn{
+		id: atomic.AddInt64(&s.nextID, 1),
+		w:  NewWriter(nc),
+	}
+	for !c.quit {
+		args, err := r.ReadCommand()
+		if err != nil {
+			if errors.Is(err, ErrProtocol) || err == ErrTooLarge {
+				c.w.WriteError("ERR Protocol error: " + strings.TrimPrefix(err.Error(), "resp: "))
+				c.w.Flush()
+			} else if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				s.logf("resp: reading from %s: %v", nc.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(args) > 0 {
+			s.handle(c, args)
+		}
+		// write the replies once the pipeline is drained
+		if r.Buffered() == 0 || c.w.Buffered() >= flushAt || c.quit {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handle runs, or queues, a single command
+func (s *Server) handle(c *conn, args [][]byte) {
+	atomic.AddInt64(&s.commands, 1)
+	name := strings.ToLower(string(args[0]))
+	cmd, ok := commands[name]
+	if !ok {
+		c.dirty = c.multi
+		c.w.WriteError("ERR unknown command '" + string(args[0]) + "'")
+		return
+	}
+	if !cmd.arityOK(len(args)) {
+		c.dirty = c.multi
+		c.w.WriteError("ERR wrong number of arguments for '" + name + "' command")
+		return
+	}
+	if c.multi && !cmd.noQueue {
+		c.queued = append(c.queued, args)
+		c.w.WriteSimple("QUEUED")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.run(c, cmd, args)
+}
+
+// run runs cmd and writes its reply. The caller must hold the lock.
+func (s *Server) run(c *conn, cmd *command, args [][]byte) {
+	if err := cmd.fn(s, c, args); err != nil {
+		if e, ok := err.(Error); ok {
+			c.w.WriteError(string(e))
+			return
+		}
+		c.w.WriteError("ERR " + err.Error())
+	}
+}
+
+// lookup returns the live entry for key, deleting it if it has expired.
+// The caller must hold the lock.
+func (s *Server) lookup(key string) (Entry, bool, error) {
+	e, ok, err := s.Storage.Get(key)
+	if err != nil || !ok {
+		return e, false, err
+	}
+	if e.expired(time.Now()) {
+		atomic.AddInt64(&s.expired, 1)
+		_, err = s.Storage.Delete(key)
+		return Entry{}, false, err
+	}
+	return e, true, nil
+}
+
+// keys returns every live key, deleting the expired ones it comes
+// across. The caller must hold the lock.
+func (s *Server) keys() ([]string, error) {
+	var live, dead []string
+	now := time.Now()
+	err := s.Storage.Keys(func(key string) bool {
+		live = append(live, key)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	n := 0
+	for _, key := range live {
+		e, ok, err := s.Storage.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if e.expired(now) {
+			dead = append(dead, key)
+			continue
+		}
+		live[n] = key
+		n++
+	}
+	for _, key := range dead {
+		atomic.AddInt64(&s.expired, 1)
+		if _, err := s.Storage.Delete(key); err != nil {
+			return nil, err
+		}
+	}
+	return live[:n], nil
+}
+
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
@@ -0,0 +1,271 @@
+package resp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/scottcagno/net-tools/pkg/data"
+	"hash/crc32"
+	"io"
+	"log"
+	"time"
+)
+
+// Entry is a stored value and when it expires
+type Entry struct {
+	Value   []byte
+	Expires time.Time // the zero time for never
+}
+
+// expired reports whether e has expired by now
+func (e Entry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+// Storage is where a Server keeps its keys. The server only calls it
+// while holding its own lock, so an implementation need not be safe for
+// concurrent use, and the server takes care of expiring entries.
+type Storage interface {
+	// Get returns the entry for key, and whether there is one
+	Get(key string) (Entry, bool, error)
+	// Set stores the entry for key
+	Set(key string, e Entry) error
+	// Delete removes key, reporting whether it was there
+	Delete(key string) (bool, error)
+	// Keys calls fn with every key, stopping if fn returns false
+	Keys(fn func(key string) bool) error
+}
+
+// Syncer is implemented by storage that buffers its writes. The SAVE
+// command calls Sync.
+type Syncer interface {
+	Sync() error
+}
+
+// MemStorage keeps everything in a map
+type MemStorage map[string]Entry
+
+// NewMemStorage returns a new, empty MemStorage
+func NewMemStorage() MemStorage {
+	return make(MemStorage)
+}
+
+func (m MemStorage) Get(key string) (Entry, bool, error) {
+	e, ok := m[key]
+	return e, ok, nil
+}
+
+func (m MemStorage) Set(key string, e Entry) error {
+	m[key] = e
+	return nil
+}
+
+func (m MemStorage) Delete(key string) (bool, error) {
+	_, ok := m[key]
+	delete(m, key)
+	return ok, nil
+}
+
+func (m MemStorage) Keys(fn func(key string) bool) error {
+	for k := range m {
+		if !fn(k) {
+			break
+		}
+	}
+	return nil
+}
+
+const (
+	opSet    = 1
+	opDelete = 2
+
+	// maxRecordSize is the largest record replay will read, room for the
+	// largest value and its key. A length over it is garbage.
+	maxRecordSize = DefaultMaxBulkLen + 1<<20
+)
+
+// errBadRecord is returned for a record that fails its checksum
+var errBadRecord = errors.New("resp: bad record")
+
+// DataStorage adapts a data.Store to Storage. Every change is appended
+// to the store as a record, and the records are replayed into memory
+// when it is opened, so reads never touch the disk. Writes are buffered
+// by the store until Sync or Close. Each record starts with a crc32 of
+// the rest of it.
+type DataStorage struct {
+	st *data.Store
+	m  MemStorage
+}
+
+// NewDataStorage replays the records in st and returns a DataStorage
+// that appends to it. The store is truncated at the first record that is
+// partially written, too large or fails its checksum, since nothing
+// after it can be trusted.
+func NewDataStorage(st *data.Store) (*DataStorage, error) {
+	ds := &DataStorage{st: st, m: NewMemStorage()}
+	if err := ds.replay(); err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// OpenDataStorage opens (or creates) the data.Store at path and returns a
+// DataStorage using it
+func OpenDataStorage(path string) (*DataStorage, error) {
+	st, err := data.OpenStore(path)
+	if err != nil {
+		return nil, err
+	}
+	ds, err := NewDataStorage(st)
+	if err != nil {
+		st.Close()
+		return nil, err
+	}
+	return ds, nil
+}
+
+func (ds *DataStorage) replay() error {
+	var offset int64
+	now := time.Now()
+	for {
+		b, err := ds.st.ReadDataMax(maxRecordSize)
+		if err == io.EOF {
+			break
+		}
+		var op byte
+		var key string
+		var e Entry
+		if err == nil {
+			op, key, e, err = decodeRecord(b)
+		}
+		if err == io.ErrUnexpectedEOF || err == data.ErrTooLarge || err == errBadRecord {
+			log.Printf("resp: truncating at offset %d: %v\n", offset, err)
+			if err = ds.st.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch op {
+		case opSet:
+			ds.m[key] = e
+		case opDelete:
+			delete(ds.m, key)
+		}
+		offset += int64(8 + len(b))
+	}
+	// no need to carry what expired while we were down
+	for k, e := range ds.m {
+		if e.expired(now) {
+			delete(ds.m, k)
+		}
+	}
+	return nil
+}
+
+func (ds *DataStorage) Get(key string) (Entry, bool, error) {
+	return ds.m.Get(key)
+}
+
+func (ds *DataStorage) Set(key string, e Entry) error {
+	b, err := encodeRecord(opSet, key, e)
+	if err != nil {
+		return err
+	}
+	if err = ds.st.WriteData(b); err != nil {
+		return err
+	}
+	return ds.m.Set(key, e)
+}
+
+func (ds *DataStorage) Delete(key string) (bool, error) {
+	if _, ok := ds.m[key]; !ok {
+		return false, nil
+	}
+	b, err := encodeRecord(opDelete, key, Entry{})
+	if err != nil {
+		return false, err
+	}
+	if err = ds.st.WriteData(b); err != nil {
+		return false, err
+	}
+	return ds.m.Delete(key)
+}
+
+func (ds *DataStorage) Keys(fn func(key string) bool) error {
+	return ds.m.Keys(fn)
+}
+
+// Sync commits the records written so far to stable storage
+func (ds *DataStorage) Sync() error {
+	return ds.st.Sync()
+}
+
+// Close syncs and closes the underlying store
+func (ds *DataStorage) Close() error {
+	return ds.st.Close()
+}
+
+func encodeRecord(op byte, key string, e Entry) ([]byte, error) {
+	var buf bytes.Buffer
+	// room for the checksum
+	buf.Write(make([]byte, 4))
+	dw := data.NewDataWriter(&buf)
+	if err := dw.WriteByte(op); err != nil {
+		return nil, err
+	}
+	if err := dw.WriteString(key); err != nil {
+		return nil, err
+	}
+	if op == opSet {
+		if err := dw.WriteBytes(e.Value); err != nil {
+			return nil, err
+		}
+		var expires int64
+		if !e.Expires.IsZero() {
+			expires = e.Expires.UnixNano()
+		}
+		if err := dw.WriteVarint(expires); err != nil {
+			return nil, err
+		}
+	}
+	if err := dw.Flush(); err != nil {
+		return nil, err
+	}
+	b := buf.Bytes()
+	binary.LittleEndian.PutUint32(b, crc32.ChecksumIEEE(b[4:]))
+	return b, nil
+}
+
+// decodeRecord checks and decodes a record. Anything wrong with it is
+// errBadRecord, since the store can't be trusted past it.
+func decodeRecord(b []byte) (byte, string, Entry, error) {
+	var e Entry
+	if len(b) < 4 || binary.LittleEndian.Uint32(b) != crc32.ChecksumIEEE(b[4:]) {
+		return 0, "", e, errBadRecord
+	}
+	dr := data.NewDataReader(bytes.NewReader(b[4:]))
+	op, err := dr.ReadByte()
+	if err != nil || (op != opSet && op != opDelete) {
+		return 0, "", e, errBadRecord
+	}
+	key, err := dr.ReadString()
+	if err != nil {
+		return 0, "", e, errBadRecord
+	}
+	if op == opSet {
+		if e.Value, err = dr.ReadBytes(); err != nil {
+			return 0, "", e, errBadRecord
+		}
+		expires, err := dr.ReadVarint()
+		if err != nil {
+			return 0, "", e, errBadRecord
+		}
+		if expires != 0 {
+			e.Expires = time.Unix(0, expires)
+		}
+	}
+	return op, key, e, nil
+}
@@ -0,0 +1,182 @@
+package resp
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Writer writes RESP replies. Proto picks how the types RESP2 lacks are
+// written: in RESP2 a null is "$-1", a map is a flat array, a boolean is
+// an integer and a double is a bulk string.
+type Writer struct {
+	Proto int // 2 or 3, 2 if zero
+
+	bw *bufio.Writer
+}
+
+// NewWriter returns a new RESP2 Writer writing to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{Proto: 2, bw: bufio.NewWriter(w)}
+}
+
+// Flush writes any buffered replies to the underlying writer
+func (w *Writer) Flush() error {
+	return w.bw.Flush()
+}
+
+// Buffered returns the number of bytes waiting to be flushed
+func (w *Writer) Buffered() int {
+	return w.bw.Buffered()
+}
+
+func (w *Writer) resp3() bool {
+	return w.Proto == 3
+}
+
+func (w *Writer) writeLine(k Kind, s string) error {
+	w.bw.WriteByte(byte(k))
+	w.bw.WriteString(s)
+	_, err := w.bw.WriteString("\r\n")
+	return err
+}
+
+// WriteSimple writes a simple string, which must not hold a cr or lf
+func (w *Writer) WriteSimple(s string) error {
+	return w.writeLine(SimpleString, s)
+}
+
+// WriteOK writes the +OK simple string
+func (w *Writer) WriteOK() error {
+	return w.WriteSimple("OK")
+}
+
+// WriteError writes an error reply. By convention msg starts with an
+// upper case error code, e.g. "ERR syntax error" or "WRONGTYPE ...".
+// Line breaks in msg are replaced with spaces.
+func (w *Writer) WriteError(msg string) error {
+	msg = strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+	return w.writeLine(ErrorReply, msg)
+}
+
+// WriteInt writes an integer
+func (w *Writer) WriteInt(n int64) error {
+	return w.writeLine(Integer, strconv.FormatInt(n, 10))
+}
+
+// WriteBulk writes a bulk string, or a null if b is nil
+func (w *Writer) WriteBulk(b []byte) error {
+	if b == nil {
+		return w.WriteNull()
+	}
+	w.writeLine(BulkString, strconv.Itoa(len(b)))
+	w.bw.Write(b)
+	_, err := w.bw.WriteString("\r\n")
+	return err
+}
+
+// WriteBulkString writes s as a bulk string
+func (w *Writer) WriteBulkString(s string) error {
+	w.writeLine(BulkString, strconv.Itoa(len(s)))
+	w.bw.WriteString(s)
+	_, err := w.bw.WriteString("\r\n")
+	return err
+}
+
+// WriteNull writes a null
+func (w *Writer) WriteNull() error {
+	if w.resp3() {
+		return w.writeLine(Null, "")
+	}
+	return w.writeLine(BulkString, "-1")
+}
+
+// WriteNullArray writes a null where an array is expected, such as the
+// reply to an EXEC that was aborted
+func (w *Writer) WriteNullArray() error {
+	if w.resp3() {
+		return w.writeLine(Null, "")
+	}
+	return w.writeLine(Array, "-1")
+}
+
+// WriteArray writes the header of an array of n values, which must be
+// written next
+func (w *Writer) WriteArray(n int) error {
+	return w.writeLine(Array, strconv.Itoa(n))
+}
+
+// WriteMap writes the header of a map of n pairs, each a key and then a
+// value, which must be written next
+func (w *Writer) WriteMap(n int) error {
+	if w.resp3() {
+		return w.writeLine(Map, strconv.Itoa(n))
+	}
+	return w.WriteArray(2 * n)
+}
+
+// WriteBool writes a boolean
+func (w *Writer) WriteBool(t bool) error {
+	if w.resp3() {
+		if t {
+			return w.writeLine(Boolean, "t")
+		}
+		return w.writeLine(Boolean, "f")
+	}
+	if t {
+		return w.WriteInt(1)
+	}
+	return w.WriteInt(0)
+}
+
+// WriteDouble writes a floating point number
+func (w *Writer) WriteDouble(f float64) error {
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if w.resp3() {
+		return w.writeLine(Double, s)
+	}
+	return w.WriteBulkString(s)
+}
+
+// WriteValue writes v, as it is
+func (w *Writer) WriteValue(v Value) error {
+	switch v.Kind {
+	case Integer:
+		return w.WriteInt(v.Int)
+	case Null:
+		return w.WriteNull()
+	case Boolean:
+		return w.WriteBool(v.Int != 0)
+	case Array, Set, Push, Map:
+		n := len(v.Elems)
+		if v.Kind == Map {
+			n /= 2
+		}
+		w.writeLine(v.Kind, strconv.Itoa(n))
+		for _, e := range v.Elems {
+			if err := w.WriteValue(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	case BulkString, BulkError, Verbatim:
+		w.writeLine(v.Kind, strconv.Itoa(len(v.Str)))
+		w.bw.Write(v.Str)
+		_, err := w.bw.WriteString("\r\n")
+		return err
+	}
+	return w.writeLine(v.Kind, string(v.Str))
+}
+
+// WriteCommand writes a command as an array of bulk strings, the way a
+// client sends it
+func (w *Writer) WriteCommand(args ...string) error {
+	w.WriteArray(len(args))
+	for _, a := range args {
+		if err := w.WriteBulkString(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
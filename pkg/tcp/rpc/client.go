@@ -0,0 +1,183 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"github.com/scottcagno/net-tools/pkg/tcp/client"
+	"github.com/scottcagno/net-tools/pkg/tcp/frame"
+	"net"
+	"sync"
+)
+
+// ErrShutdown is returned by Call once the client has been closed or the
+// connection has gone away
+var ErrShutdown = errors.New("rpc: client is shut down")
+
+// ServerError is an error returned by the remote method
+type ServerError string
+
+func (e ServerError) Error() string {
+	return string(e)
+}
+
+// call is a call waiting on its response
+type call struct {
+	done chan *message
+}
+
+// Client makes calls over a single connection. It is safe to use from
+// many goroutines at once, and calls do not wait on each other: each one
+// carries an id that its response is matched up with.
+type Client struct {
+	conn  net.Conn
+	f     *frame.Framer
+	codec Codec
+	wmu   sync.Mutex // guards writes to f
+
+	mu      sync.Mutex
+	pending map[uint64]*call
+	nextID  uint64
+	err     error // set once the connection is done
+}
+
+// NewClient returns a client making calls over conn with codec, Gob if
+// it is nil
+func NewClient(conn net.Conn, codec Codec) *Client {
+	if codec == nil {
+		codec = Gob
+	}
+	c := &Client{
+		conn:    conn,
+		f:       frame.NewFramer(conn),
+		codec:   codec,
+		pending: make(map[uint64]*call),
+	}
+	go c.readLoop()
+	return c
+}
+
+// Dial connects with d and returns a client for the connection
+func Dial(ctx context.Context, d *client.Dialer, codec Codec) (*Client, error) {
+	conn, err := d.DialRetry(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// calls set their own deadlines, so use the raw connection
+	return NewClient(conn.Conn, codec), nil
+}
+
+// Call calls the named method ("Service.Method") with req and decodes the
+// response into resp. The context's deadline is sent along with the
+// call, and if the context is done before the response comes back the
+// server is told to cancel the call.
+func (c *Client) Call(ctx context.Context, method string, req, resp interface{}) error {
+	body, err := c.codec.Marshal(req)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	c.nextID++
+	id := c.nextID
+	cl := &call{done: make(chan *message, 1)}
+	c.pending[id] = cl
+	c.mu.Unlock()
+
+	m := &message{id: id, method: method, body: body}
+	if deadline, ok := ctx.Deadline(); ok {
+		m.deadline = deadline.UnixNano()
+	}
+	if err = c.send(typeRequest, m); err != nil {
+		c.forget(id)
+		return err
+	}
+	select {
+	case r := <-cl.done:
+		if r == nil {
+			return c.shutdownErr()
+		}
+		if r.err != "" {
+			return ServerError(r.err)
+		}
+		if len(r.body) == 0 || resp == nil {
+			return nil
+		}
+		return c.codec.Unmarshal(r.body, resp)
+	case <-ctx.Done():
+		c.forget(id)
+		c.send(typeCancel, &message{id: id})
+		return ctx.Err()
+	}
+}
+
+// Close closes the connection, failing any calls still waiting
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = ErrShutdown
+	}
+	c.mu.Unlock()
+	return c.conn.Close()
+}
+
+func (c *Client) send(typ uint8, m *message) error {
+	fr, err := m.encode(typ, c.codec.ID())
+	if err != nil {
+		return err
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.f.Send(fr)
+}
+
+func (c *Client) forget(id uint64) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+func (c *Client) shutdownErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// readLoop hands responses to the calls waiting on them until the
+// connection fails, and then fails every call still waiting
+func (c *Client) readLoop() {
+	var err error
+	for {
+		var fr frame.Frame
+		if fr, err = c.f.ReadFrame(); err != nil {
+			break
+		}
+		if fr.Type != typeResponse {
+			continue
+		}
+		m := new(message)
+		if err = m.decode(fr); err != nil {
+			break
+		}
+		c.mu.Lock()
+		cl, ok := c.pending[m.id]
+		delete(c.pending, m.id)
+		c.mu.Unlock()
+		if ok {
+			// responses to calls that were cancelled are dropped
+			cl.done <- m
+		}
+	}
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = ErrShutdown
+	}
+	for id, cl := range c.pending {
+		close(cl.done)
+		delete(c.pending, id)
+	}
+	c.mu.Unlock()
+	c.conn.Close()
+}
@@ -0,0 +1,123 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/data"
+	"sync"
+)
+
+// Codec encodes request and response values. The codec a client uses is
+// sent in the flags of every frame, and the server replies with the
+// same one, so a server can talk to clients using different codecs.
+type Codec interface {
+	ID() uint16 // sent on the wire, must be unique
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(b []byte, v interface{}) error
+}
+
+// DataMarshaler is implemented by values that can write themselves with
+// the binary writers in pkg/data, for use with the Data codec.
+type DataMarshaler interface {
+	MarshalData(dw *data.DataWriter) error
+}
+
+// DataUnmarshaler is implemented by values that can read themselves with
+// the binary readers in pkg/data, for use with the Data codec.
+type DataUnmarshaler interface {
+	UnmarshalData(dr *data.DataReader) error
+}
+
+var (
+	// Gob encodes values with encoding/gob
+	Gob Codec = gobCodec{}
+	// JSON encodes values with encoding/json
+	JSON Codec = jsonCodec{}
+	// Data encodes values that implement DataMarshaler and
+	// DataUnmarshaler, using pkg/data
+	Data Codec = dataCodec{}
+)
+
+var codecs = struct {
+	sync.RWMutex
+	m map[uint16]Codec
+}{
+	m: map[uint16]Codec{
+		Gob.ID():  Gob,
+		JSON.ID(): JSON,
+		Data.ID(): Data,
+	},
+}
+
+// RegisterCodec makes a codec available to servers. It replaces any
+// codec with the same ID.
+func RegisterCodec(c Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.m[c.ID()] = c
+}
+
+func codecFor(id uint16) (Codec, bool) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	c, ok := codecs.m[id]
+	return c, ok
+}
+
+type gobCodec struct{}
+
+func (gobCodec) ID() uint16 { return 1 }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(b []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ID() uint16 { return 2 }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(b []byte, v interface{}) error {
+	return json.Unmarshal(b, v)
+}
+
+type dataCodec struct{}
+
+func (dataCodec) ID() uint16 { return 3 }
+
+func (dataCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(DataMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("rpc: %T does not implement DataMarshaler", v)
+	}
+	var buf bytes.Buffer
+	dw := data.NewDataWriter(&buf)
+	if err := m.MarshalData(dw); err != nil {
+		return nil, err
+	}
+	if err := dw.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (dataCodec) Unmarshal(b []byte, v interface{}) error {
+	u, ok := v.(DataUnmarshaler)
+	if !ok {
+		return fmt.Errorf("rpc: %T does not implement DataUnmarshaler", v)
+	}
+	return u.UnmarshalData(data.NewDataReader(bytes.NewReader(b)))
+}
@@ -0,0 +1,123 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/scottcagno/net-tools/pkg/data"
+	"github.com/scottcagno/net-tools/pkg/tcp/frame"
+)
+
+// Frame types used by the protocol. The frame flags hold the codec ID.
+const (
+	typeRequest  uint8 = 1 // id, deadline, method, body
+	typeResponse uint8 = 2 // id, error, body
+	typeCancel   uint8 = 3 // id
+)
+
+// message is the payload of any of the frame types, fields that a type
+// does not use are left empty
+type message struct {
+	id       uint64
+	deadline int64  // unix nanos, 0 for none
+	method   string // requests only
+	err      string // responses only
+	body     []byte
+}
+
+// encode writes m as a frame of the given type
+func (m *message) encode(typ uint8, codec uint16) (frame.Frame, error) {
+	var buf bytes.Buffer
+	dw := data.NewDataWriter(&buf)
+	if err := dw.WriteUint64(m.id); err != nil {
+		return frame.Frame{}, err
+	}
+	switch typ {
+	case typeRequest:
+		dw.WriteInt64(m.deadline)
+		dw.WriteString(m.method)
+		dw.WriteBinary(m.body)
+	case typeResponse:
+		dw.WriteString(m.err)
+		dw.WriteBinary(m.body)
+	}
+	if err := dw.Flush(); err != nil {
+		return frame.Frame{}, err
+	}
+	return frame.Frame{Type: typ, Flags: codec, Payload: buf.Bytes()}, nil
+}
+
+// errShortMessage is returned for a payload that ends early or has a length
+// running past its end
+var errShortMessage = errors.New("rpc: short message")
+
+// decode reads the payload of fr into m. The lengths come off the wire, so
+// they are checked against what is left of the payload before anything is
+// allocated.
+func (m *message) decode(fr frame.Frame) error {
+	p := fr.Payload
+	var err error
+	if m.id, p, err = readUint64(p); err != nil {
+		return err
+	}
+	switch fr.Type {
+	case typeRequest:
+		var deadline uint64
+		if deadline, p, err = readUint64(p); err != nil {
+			return err
+		}
+		m.deadline = int64(deadline)
+		var method []byte
+		if method, p, err = readString(p); err != nil {
+			return err
+		}
+		m.method = string(method)
+		m.body, _, err = readBinary(p)
+	case typeResponse:
+		var msg []byte
+		if msg, p, err = readString(p); err != nil {
+			return err
+		}
+		m.err = string(msg)
+		m.body, _, err = readBinary(p)
+	}
+	return err
+}
+
+// readUint64 reads a little endian uint64 off the front of p
+func readUint64(p []byte) (uint64, []byte, error) {
+	if len(p) < 8 {
+		return 0, p, errShortMessage
+	}
+	return binary.LittleEndian.Uint64(p), p[8:], nil
+}
+
+// readString reads a uvarint length and that many bytes, the way
+// data.DataWriter.WriteString writes them
+func readString(p []byte) ([]byte, []byte, error) {
+	n, w := binary.Uvarint(p)
+	if w <= 0 {
+		return nil, p, errShortMessage
+	}
+	return readN(p[w:], n)
+}
+
+// readBinary reads a uint64 length and that many bytes, the way
+// data.DataWriter.WriteBinary writes them
+func readBinary(p []byte) ([]byte, []byte, error) {
+	n, p, err := readUint64(p)
+	if err != nil {
+		return nil, p, err
+	}
+	return readN(p, n)
+}
+
+// readN copies n bytes off the front of p
+func readN(p []byte, n uint64) ([]byte, []byte, error) {
+	if n > uint64(len(p)) {
+		return nil, p, errShortMessage
+	}
+	b := make([]byte, n)
+	copy(b, p)
+	return b, p[n:], nil
+}
@@ -0,0 +1,304 @@
+package rpc_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/data"
+	"github.com/scottcagno/net-tools/pkg/tcp/client"
+	"github.com/scottcagno/net-tools/pkg/tcp/frame"
+	"github.com/scottcagno/net-tools/pkg/tcp/rpc"
+	"github.com/scottcagno/net-tools/pkg/tcp/server"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Args and Reply work with every codec, including rpc.Data
+type Args struct {
+	A, B int64
+}
+
+func (a *Args) MarshalData(dw *data.DataWriter) error {
+	if err := dw.WriteInt64(a.A); err != nil {
+		return err
+	}
+	return dw.WriteInt64(a.B)
+}
+
+func (a *Args) UnmarshalData(dr *data.DataReader) error {
+	var err error
+	if a.A, err = dr.ReadInt64(); err != nil {
+		return err
+	}
+	a.B, err = dr.ReadInt64()
+	return err
+}
+
+type Reply struct {
+	N int64
+}
+
+func (r *Reply) MarshalData(dw *data.DataWriter) error {
+	return dw.WriteInt64(r.N)
+}
+
+func (r *Reply) UnmarshalData(dr *data.DataReader) error {
+	var err error
+	r.N, err = dr.ReadInt64()
+	return err
+}
+
+// Arith is the service the tests call
+type Arith struct {
+	cancelled chan struct{}
+}
+
+func (t *Arith) Add(ctx context.Context, args *Args) (*Reply, error) {
+	return &Reply{N: args.A + args.B}, nil
+}
+
+func (t *Arith) Div(ctx context.Context, args *Args) (*Reply, error) {
+	if args.B == 0 {
+		return nil, errors.New("divide by zero")
+	}
+	return &Reply{N: args.A / args.B}, nil
+}
+
+// Reset replies with no result
+func (t *Arith) Reset(ctx context.Context, args *Args) (*Reply, error) {
+	return nil, nil
+}
+
+// Wait blocks until the call's context is done
+func (t *Arith) Wait(ctx context.Context, args *Args) (*Reply, error) {
+	<-ctx.Done()
+	t.cancelled <- struct{}{}
+	return nil, ctx.Err()
+}
+
+// ArithClient is a typed stub for the Arith service. Like the rpc.Client
+// it wraps, it can be used from many goroutines at once.
+type ArithClient struct {
+	c *rpc.Client
+}
+
+func (a *ArithClient) Add(ctx context.Context, x, y int64) (int64, error) {
+	var reply Reply
+	err := a.c.Call(ctx, "Arith.Add", &Args{A: x, B: y}, &reply)
+	return reply.N, err
+}
+
+func (a *ArithClient) Div(ctx context.Context, x, y int64) (int64, error) {
+	var reply Reply
+	err := a.c.Call(ctx, "Arith.Div", &Args{A: x, B: y}, &reply)
+	return reply.N, err
+}
+
+// TestCodecs runs the checks below against an rpc server on a loopback
+// listener, once for each codec
+func TestCodecs(t *testing.T) {
+	arith := &Arith{cancelled: make(chan struct{}, 16)}
+	rs := rpc.NewServer()
+	if err := rs.Register(arith); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &server.Server{Handler: rs.ServeConn}
+	go srv.Serve(ln)
+	defer srv.Close()
+	d := &client.Dialer{Addr: ln.Addr().String(), Timeout: time.Second}
+
+	for _, codec := range []struct {
+		name  string
+		codec rpc.Codec
+	}{{"gob", rpc.Gob}, {"json", rpc.JSON}, {"data", rpc.Data}} {
+		c, err := rpc.Dial(context.Background(), d, codec.codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, check := range checks {
+			t.Run(codec.name+"/"+check.name, func(t *testing.T) {
+				check.fn(t, c, arith)
+			})
+		}
+		t.Run(codec.name+"/shutdown", func(t *testing.T) {
+			checkShutdown(t, c)
+		})
+	}
+}
+
+var checks = []struct {
+	name string
+	fn   func(t *testing.T, c *rpc.Client, arith *Arith)
+}{
+	{"call", checkCall},
+	{"no-result", checkNoResult},
+	{"server-error", checkServerError},
+	{"method-not-found", checkNotFound},
+	{"concurrent", checkConcurrent},
+	{"deadline", checkDeadline},
+	{"cancel", checkCancel},
+}
+
+func checkCall(t *testing.T, c *rpc.Client, arith *Arith) {
+	stub := &ArithClient{c}
+	n, err := stub.Add(context.Background(), 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Fatalf("2 + 3 = %d", n)
+	}
+}
+
+func checkNoResult(t *testing.T, c *rpc.Client, arith *Arith) {
+	reply := Reply{N: 7}
+	if err := c.Call(context.Background(), "Arith.Reset", &Args{}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.N != 7 {
+		t.Fatalf("reply changed to %+v", reply)
+	}
+}
+
+func checkServerError(t *testing.T, c *rpc.Client, arith *Arith) {
+	stub := &ArithClient{c}
+	_, err := stub.Div(context.Background(), 1, 0)
+	if _, ok := err.(rpc.ServerError); !ok || err.Error() != "divide by zero" {
+		t.Fatalf("expected a ServerError, got %v", err)
+	}
+}
+
+func checkNotFound(t *testing.T, c *rpc.Client, arith *Arith) {
+	err := c.Call(context.Background(), "Arith.Nope", &Args{}, &Reply{})
+	if _, ok := err.(rpc.ServerError); !ok {
+		t.Fatalf("expected a ServerError, got %v", err)
+	}
+}
+
+func checkConcurrent(t *testing.T, c *rpc.Client, arith *Arith) {
+	stub := &ArithClient{c}
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := int64(0); i < 100; i++ {
+		wg.Add(1)
+		go func(i int64) {
+			defer wg.Done()
+			n, err := stub.Div(context.Background(), i*7, 7)
+			if err == nil && n != i {
+				err = fmt.Errorf("%d / 7 = %d", i*7, n)
+			}
+			if err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkDeadline(t *testing.T, c *rpc.Client, arith *Arith) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.Call(ctx, "Arith.Wait", &Args{}, &Reply{}); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	waitCancelled(t, arith)
+}
+
+func checkCancel(t *testing.T, c *rpc.Client, arith *Arith) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if err := c.Call(ctx, "Arith.Wait", &Args{}, &Reply{}); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	waitCancelled(t, arith)
+}
+
+// waitCancelled checks that the server side of the call was stopped
+func waitCancelled(t *testing.T, arith *Arith) {
+	select {
+	case <-arith.cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("the server never cancelled the call")
+	}
+}
+
+func checkShutdown(t *testing.T, c *rpc.Client) {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.Call(context.Background(), "Arith.Wait", &Args{}, &Reply{})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c.Close()
+	if err := <-errc; err != rpc.ErrShutdown {
+		t.Fatalf("expected ErrShutdown for the waiting call, got %v", err)
+	}
+	if err := c.Call(context.Background(), "Arith.Add", &Args{}, &Reply{}); err != rpc.ErrShutdown {
+		t.Fatalf("expected ErrShutdown after Close, got %v", err)
+	}
+}
+
+// TestOversizedLength sends requests whose lengths run far past the end of
+// the frame. The server must drop the connection without allocating them
+// and keep serving everyone else.
+func TestOversizedLength(t *testing.T) {
+	rs := rpc.NewServer()
+	if err := rs.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &server.Server{Handler: rs.ServeConn}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	// id, deadline, then a huge method length
+	method := make([]byte, 16+binary.MaxVarintLen64)
+	method = method[:16+binary.PutUvarint(method[16:], 1<<62)]
+	// id, deadline, an empty method, then a huge body length
+	body := make([]byte, 25)
+	binary.LittleEndian.PutUint64(body[17:], 1<<62)
+
+	for name, payload := range map[string][]byte{"method": method, "body": body} {
+		t.Run(name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			f := frame.NewFramer(conn)
+			if err = f.Send(frame.Frame{Type: 1, Payload: payload}); err != nil {
+				t.Fatal(err)
+			}
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err = f.ReadFrame(); err == nil {
+				t.Fatal("expected the server to close the connection")
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatal("the server kept the connection open")
+			}
+		})
+	}
+
+	d := &client.Dialer{Addr: ln.Addr().String(), Timeout: time.Second}
+	c, err := rpc.Dial(context.Background(), d, rpc.Gob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if n, err := (&ArithClient{c}).Add(context.Background(), 2, 3); err != nil || n != 5 {
+		t.Fatalf("server stopped answering: %d, %v", n, err)
+	}
+}
@@ -0,0 +1,242 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/tcp/frame"
+	"io"
+	"log"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var (
+	ErrMethodNotFound = errors.New("rpc: method not found")
+	ErrUnknownCodec   = errors.New("rpc: unknown codec")
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// method is a registered service method
+type method struct {
+	rcvr reflect.Value
+	fn   reflect.Value
+	req  reflect.Type // the type *Req points to
+}
+
+// Server dispatches calls to registered services. Methods are called as
+// "Service.Method" and must look like
+//
+//	func (t *T) Method(ctx context.Context, req *Req) (*Resp, error)
+//
+// Every call runs on its own goroutine, so a slow call does not hold up
+// the others on the same connection. The context is done when the
+// client's deadline passes, the client cancels the call, or the
+// connection goes away.
+type Server struct {
+	MaxFrameSize int // largest frame accepted, frame.DefaultMaxSize if zero
+
+	mu      sync.RWMutex
+	methods map[string]*method
+}
+
+// NewServer returns a new Server with no services
+func NewServer() *Server {
+	return &Server{
+		methods: make(map[string]*method),
+	}
+}
+
+// Register registers the methods of rcvr under the name of its type
+func (s *Server) Register(rcvr interface{}) error {
+	typ := reflect.TypeOf(rcvr)
+	name := typ.Name()
+	if typ.Kind() == reflect.Ptr {
+		name = typ.Elem().Name()
+	}
+	return s.RegisterName(name, rcvr)
+}
+
+// RegisterName registers the methods of rcvr under the given name. It is
+// an error if rcvr has no methods with the right signature.
+func (s *Server) RegisterName(name string, rcvr interface{}) error {
+	if name == "" {
+		return errors.New("rpc: no service name")
+	}
+	v := reflect.ValueOf(rcvr)
+	typ := v.Type()
+	found := make(map[string]*method)
+	for i := 0; i < typ.NumMethod(); i++ {
+		m := typ.Method(i)
+		if m.PkgPath != "" {
+			continue
+		}
+		mt := m.Type
+		if mt.NumIn() != 3 || mt.In(1) != contextType || mt.In(2).Kind() != reflect.Ptr ||
+			mt.NumOut() != 2 || mt.Out(0).Kind() != reflect.Ptr || mt.Out(1) != errorType {
+			continue
+		}
+		found[name+"."+m.Name] = &method{
+			rcvr: v,
+			fn:   m.Func,
+			req:  mt.In(2).Elem(),
+		}
+	}
+	if len(found) == 0 {
+		return fmt.Errorf("rpc: %s has no methods of the form func(context.Context, *Req) (*Resp, error)", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.methods == nil {
+		s.methods = make(map[string]*method)
+	}
+	for k, m := range found {
+		s.methods[k] = m
+	}
+	return nil
+}
+
+// Methods returns the names of the registered methods
+func (s *Server) Methods() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.methods))
+	for name := range s.methods {
+		names = append(names, name)
+	}
+	return names
+}
+
+// serverConn is the state of one connection
+type serverConn struct {
+	srv *Server
+	f   *frame.Framer
+	wmu sync.Mutex // guards writes to f
+
+	mu    sync.Mutex
+	calls map[uint64]context.CancelFunc
+	wg    sync.WaitGroup
+}
+
+// ServeConn serves calls on conn until it is closed. It has the signature
+// of a server.Handler, so it can be passed straight to a server in
+// pkg/tcp/server.
+func (s *Server) ServeConn(conn net.Conn) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sc := &serverConn{
+		srv:   s,
+		f:     frame.NewFramer(conn),
+		calls: make(map[uint64]context.CancelFunc),
+	}
+	sc.f.SetMaxSize(s.MaxFrameSize)
+	defer func() {
+		// stop the calls still running and wait for them before closing
+		cancel()
+		sc.wg.Wait()
+		conn.Close()
+	}()
+	for {
+		fr, err := sc.f.ReadFrame()
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("rpc: reading from %s: %v\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		var m message
+		if err = m.decode(fr); err != nil {
+			log.Printf("rpc: bad message from %s: %v\n", conn.RemoteAddr(), err)
+			return
+		}
+		switch fr.Type {
+		case typeRequest:
+			sc.start(ctx, fr.Flags, &m)
+		case typeCancel:
+			sc.mu.Lock()
+			if cancel, ok := sc.calls[m.id]; ok {
+				cancel()
+			}
+			sc.mu.Unlock()
+		}
+	}
+}
+
+// start runs a call on its own goroutine
+func (sc *serverConn) start(parent context.Context, codecID uint16, m *message) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if m.deadline != 0 {
+		ctx, cancel = context.WithDeadline(parent, time.Unix(0, m.deadline))
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+	sc.mu.Lock()
+	sc.calls[m.id] = cancel
+	sc.mu.Unlock()
+	sc.wg.Add(1)
+	go func() {
+		defer sc.wg.Done()
+		body, err := sc.call(ctx, codecID, m)
+		sc.mu.Lock()
+		delete(sc.calls, m.id)
+		sc.mu.Unlock()
+		cancel()
+		resp := &message{id: m.id, body: body}
+		if err != nil {
+			resp.err = err.Error()
+			resp.body = nil
+		}
+		sc.reply(codecID, resp)
+	}()
+}
+
+// call decodes the request, calls the method and encodes its response
+func (sc *serverConn) call(ctx context.Context, codecID uint16, m *message) (body []byte, err error) {
+	codec, ok := codecFor(codecID)
+	if !ok {
+		return nil, ErrUnknownCodec
+	}
+	sc.srv.mu.RLock()
+	meth, ok := sc.srv.methods[m.method]
+	sc.srv.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrMethodNotFound, m.method)
+	}
+	req := reflect.New(meth.req)
+	if err = codec.Unmarshal(m.body, req.Interface()); err != nil {
+		return nil, fmt.Errorf("rpc: decoding request: %v", err)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("rpc: panic in %s: %v\n", m.method, r)
+			err = fmt.Errorf("rpc: %s panicked", m.method)
+		}
+	}()
+	out := meth.fn.Call([]reflect.Value{meth.rcvr, reflect.ValueOf(ctx), req})
+	if e := out[1].Interface(); e != nil {
+		return nil, e.(error)
+	}
+	if out[0].IsNil() {
+		return nil, nil
+	}
+	return codec.Marshal(out[0].Interface())
+}
+
+func (sc *serverConn) reply(codecID uint16, m *message) {
+	fr, err := m.encode(typeResponse, codecID)
+	if err != nil {
+		log.Printf("rpc: encoding response: %v\n", err)
+		return
+	}
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	if err = sc.f.Send(fr); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("rpc: writing response: %v\n", err)
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+// ConnMiddleware is a piece of connection middleware.
+type ConnMiddleware func(Handler) Handler
+
+// Chain acts as a list of Handler middlewares. It's effectively immutable.
+type Chain struct {
+	mw []ConnMiddleware
+}
+
+// NewChain creates a new chain, memorizing the given list of middleware handlers.
+// New serves no other function, middlewares are only called upon a call to Then().
+func NewChain(mw ...ConnMiddleware) *Chain {
+	return &Chain{
+		mw: append(([]ConnMiddleware)(nil), mw...),
+	}
+}
+
+// Then chains the middleware and returns the final Handler.
+// Then() treats nil as HandleEcho().
+func (c *Chain) Then(handler Handler) Handler {
+	if handler == nil {
+		handler = HandleEcho()
+	}
+	for i := range c.mw {
+		handler = c.mw[len(c.mw)-1-i](handler)
+	}
+	return handler
+}
+
+// Append extends a chain, adding the specified constructors
+// as the last ones in the connection flow.
+func (c *Chain) Append(mw ...ConnMiddleware) *Chain {
+	nc := make([]ConnMiddleware, 0, len(c.mw)+len(mw))
+	nc = append(nc, c.mw...)
+	nc = append(nc, mw...)
+
+	return &Chain{
+		mw: nc,
+	}
+}
+
+// Extend extends a chain by adding the specified chain
+// as the last one in the connection flow.
+func (c *Chain) Extend(chain *Chain) *Chain {
+	return c.Append(chain.mw...)
+}
+
+// PacketMiddleware is a piece of packet middleware.
+type PacketMiddleware func(PacketHandler) PacketHandler
+
+// PacketChain is the same as Chain, for a PacketServer's handler.
+type PacketChain struct {
+	mw []PacketMiddleware
+}
+
+// NewPacketChain creates a new packet chain, memorizing the given list of
+// middleware handlers.
+func NewPacketChain(mw ...PacketMiddleware) *PacketChain {
+	return &PacketChain{
+		mw: append(([]PacketMiddleware)(nil), mw...),
+	}
+}
+
+// Then chains the middleware and returns the final PacketHandler.
+// Then() treats nil as EchoPacket.
+func (c *PacketChain) Then(handler PacketHandler) PacketHandler {
+	if handler == nil {
+		handler = EchoPacket
+	}
+	for i := range c.mw {
+		handler = c.mw[len(c.mw)-1-i](handler)
+	}
+	return handler
+}
+
+// Append extends a packet chain, adding the specified constructors
+// as the last ones in the packet flow.
+func (c *PacketChain) Append(mw ...PacketMiddleware) *PacketChain {
+	nc := make([]PacketMiddleware, 0, len(c.mw)+len(mw))
+	nc = append(nc, c.mw...)
+	nc = append(nc, mw...)
+
+	return &PacketChain{
+		mw: nc,
+	}
+}
+
+// Extend extends a packet chain by adding the specified chain
+// as the last one in the packet flow.
+func (c *PacketChain) Extend(chain *PacketChain) *PacketChain {
+	return c.Append(chain.mw...)
+}
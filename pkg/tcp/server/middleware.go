@@ -0,0 +1,274 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultLogger is the logger used by LogConn and Recover when they are
+// given a nil logger.
+var DefaultLogger = log.New(os.Stdout, "", log.LstdFlags)
+
+func loggerOr(logger *log.Logger) *log.Logger {
+	if logger == nil {
+		return DefaultLogger
+	}
+	return logger
+}
+
+// countingConn counts the bytes read from and written to a connection
+type countingConn struct {
+	net.Conn
+	read    int64
+	written int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// Unwrap returns the underlying connection
+func (c *countingConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// LogConn logs every connection as it is accepted, and again once the
+// handler returns with how long it was open and the bytes read and written.
+func LogConn(logger *log.Logger) ConnMiddleware {
+	logger = loggerOr(logger)
+	return func(next Handler) Handler {
+		return func(conn net.Conn) {
+			start := time.Now()
+			cc := &countingConn{Conn: conn}
+			logger.Printf("ACCEPTED CONNECTION: %q\n", conn.RemoteAddr())
+			defer func() {
+				logger.Printf("CLOSED CONNECTION: %q after %v, read %d bytes, wrote %d bytes\n",
+					conn.RemoteAddr(), time.Since(start).Round(time.Millisecond),
+					atomic.LoadInt64(&cc.read), atomic.LoadInt64(&cc.written))
+			}()
+			next(cc)
+		}
+	}
+}
+
+// Recover catches a panic in the handler, logs it with a stack trace and
+// closes the connection, so one bad connection can't take the server down.
+func Recover(logger *log.Logger) ConnMiddleware {
+	logger = loggerOr(logger)
+	return func(next Handler) Handler {
+		return func(conn net.Conn) {
+			defer func() {
+				if err := recover(); err != nil {
+					logger.Printf("err: %v, from: %q, trace: %s\n", err, conn.RemoteAddr(), debug.Stack())
+					conn.Close()
+				}
+			}()
+			next(conn)
+		}
+	}
+}
+
+// IdleTimeout closes the connection once it has gone d without a read or
+// a write. It is the same as setting Server.IdleTimeout, for handlers
+// that need their own timeout.
+func IdleTimeout(d time.Duration) ConnMiddleware {
+	return func(next Handler) Handler {
+		if d <= 0 {
+			return next
+		}
+		return func(conn net.Conn) {
+			dc := newDeadlineConn(conn, 0, 0, d)
+			defer dc.Close()
+			next(dc)
+		}
+	}
+}
+
+// IPFilter only lets through connections from addresses that match one
+// of the allow entries (or any address, if allow is empty), and that do
+// not match any of the deny entries. Entries are ip addresses or CIDR
+// ranges, e.g. "10.0.0.0/8" or "::1". Other connections are closed.
+func IPFilter(allow, deny []string) (ConnMiddleware, error) {
+	allowNets, err := parseNets(allow)
+	if err != nil {
+		return nil, err
+	}
+	denyNets, err := parseNets(deny)
+	if err != nil {
+		return nil, err
+	}
+	return func(next Handler) Handler {
+		return func(conn net.Conn) {
+			ip := net.ParseIP(remoteIP(conn))
+			if ip == nil ||
+				(len(allowNets) > 0 && !containsIP(allowNets, ip)) ||
+				containsIP(denyNets, ip) {
+				conn.Close()
+				return
+			}
+			next(conn)
+		}
+	}, nil
+}
+
+// LogPacket logs every packet with its size and how long the handler took.
+func LogPacket(logger *log.Logger) PacketMiddleware {
+	logger = loggerOr(logger)
+	return func(next PacketHandler) PacketHandler {
+		return func(w PacketWriter, p *Packet) {
+			start := time.Now()
+			n := len(p.Data)
+			defer func() {
+				logger.Printf("PACKET: %q, %d bytes, handled in %v\n",
+					addrString(p.Addr), n, time.Since(start).Round(time.Microsecond))
+			}()
+			next(w, p)
+		}
+	}
+}
+
+// RecoverPacket catches a panic in the packet handler and logs it with a
+// stack trace, so one bad packet can't take the server down.
+func RecoverPacket(logger *log.Logger) PacketMiddleware {
+	logger = loggerOr(logger)
+	return func(next PacketHandler) PacketHandler {
+		return func(w PacketWriter, p *Packet) {
+			defer func() {
+				if err := recover(); err != nil {
+					logger.Printf("err: %v, from: %q, trace: %s\n", err, addrString(p.Addr), debug.Stack())
+				}
+			}()
+			next(w, p)
+		}
+	}
+}
+
+// PacketIPFilter is IPFilter for packets. Packets that are not let
+// through are dropped.
+func PacketIPFilter(allow, deny []string) (PacketMiddleware, error) {
+	allowNets, err := parseNets(allow)
+	if err != nil {
+		return nil, err
+	}
+	denyNets, err := parseNets(deny)
+	if err != nil {
+		return nil, err
+	}
+	return func(next PacketHandler) PacketHandler {
+		return func(w PacketWriter, p *Packet) {
+			ip := net.ParseIP(hostOf(p.Addr))
+			if ip == nil ||
+				(len(allowNets) > 0 && !containsIP(allowNets, ip)) ||
+				containsIP(denyNets, ip) {
+				return
+			}
+			next(w, p)
+		}
+	}, nil
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// parseNets parses a list of ip addresses and CIDR ranges
+func parseNets(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("tcp: bad ip address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("tcp: %v", err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// RateLimit limits new connections to rate per second, allowing bursts of
+// up to burst at once, using a token bucket. Connections over the limit
+// are closed straight away.
+func RateLimit(rate float64, burst int) ConnMiddleware {
+	tb := &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+	return func(next Handler) Handler {
+		return func(conn net.Conn) {
+			if !tb.take() {
+				conn.Close()
+				return
+			}
+			next(conn)
+		}
+	}
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64 // max tokens
+	tokens float64
+	last   time.Time
+}
+
+// take takes a token from the bucket, reporting whether there was one
+func (tb *tokenBucket) take() bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
@@ -0,0 +1,160 @@
+package server_test
+
+import (
+	"bytes"
+	"github.com/scottcagno/net-tools/pkg/tcp/server"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serveChain starts a tcp server running handler behind mw on loopback
+func serveChain(t *testing.T, handler server.Handler, mw ...server.ConnMiddleware) string {
+	t.Helper()
+	srv := &server.Server{Handler: server.NewChain(mw...).Then(handler), ErrorLog: quiet}
+	addr, _, err := startTCP(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return addr
+}
+
+func dial(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestRecover(t *testing.T) {
+	var buf bytes.Buffer
+	var mu sync.Mutex
+	panicky := func(conn net.Conn) {
+		defer conn.Close()
+		line := make([]byte, 5)
+		if _, err := io.ReadFull(conn, line); err != nil {
+			return
+		}
+		if string(line) == "panic" {
+			panic("boom")
+		}
+		conn.Write(line)
+	}
+	addr := serveChain(t, panicky, server.Recover(newLogger(&buf, &mu)))
+	conn := dial(t, addr)
+	conn.Write([]byte("panic"))
+	expectClosed(t, conn)
+	// the server is still up
+	if got, err := exchange(dial(t, addr), "hello"); err != nil || got != "hello" {
+		t.Fatalf("after a panic got %q, %v", got, err)
+	}
+	mu.Lock()
+	logged := buf.String()
+	mu.Unlock()
+	if !strings.Contains(logged, "err: boom") || !strings.Contains(logged, "trace:") {
+		t.Fatalf("panic not logged with a trace: %q", logged)
+	}
+}
+
+func TestLogConn(t *testing.T) {
+	var buf bytes.Buffer
+	var mu sync.Mutex
+	addr := serveChain(t, server.HandleEcho(), server.LogConn(newLogger(&buf, &mu)))
+	conn := dial(t, addr)
+	if got, err := exchange(conn, "hello"); err != nil || got != "hello" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	conn.Close()
+	// the closing line is logged once the handler returns
+	var logged string
+	for i := 0; i < 100; i++ {
+		mu.Lock()
+		logged = buf.String()
+		mu.Unlock()
+		if strings.Contains(logged, "CLOSED CONNECTION") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(logged, "ACCEPTED CONNECTION") || !strings.Contains(logged, "read 5 bytes, wrote 5 bytes") {
+		t.Fatalf("got log %q", logged)
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	if _, err := server.IPFilter([]string{"not-an-ip"}, nil); err == nil {
+		t.Fatal("expected an error for a bad allow entry")
+	}
+	for _, tc := range []struct {
+		name        string
+		allow, deny []string
+		ok          bool
+	}{
+		{"allowed", []string{"127.0.0.0/8"}, nil, true},
+		{"not allowed", []string{"10.0.0.0/8"}, nil, false},
+		{"denied", nil, []string{"127.0.0.1"}, false},
+		{"deny wins", []string{"127.0.0.0/8"}, []string{"127.0.0.1"}, false},
+		{"no rules", nil, nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			filter, err := server.IPFilter(tc.allow, tc.deny)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn := dial(t, serveChain(t, server.HandleEcho(), filter))
+			if !tc.ok {
+				expectClosed(t, conn)
+				return
+			}
+			if got, err := exchange(conn, "hello"); err != nil || got != "hello" {
+				t.Fatalf("got %q, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	// a burst of 2, and too slow a refill to matter during the test
+	addr := serveChain(t, server.HandleEcho(), server.RateLimit(0.1, 2))
+	for i := 0; i < 2; i++ {
+		if got, err := exchange(dial(t, addr), "hello"); err != nil || got != "hello" {
+			t.Fatalf("connection %d: got %q, %v", i+1, got, err)
+		}
+	}
+	expectClosed(t, dial(t, addr))
+
+	// a fast refill lets new connections in again
+	addr = serveChain(t, server.HandleEcho(), server.RateLimit(100, 1))
+	if got, err := exchange(dial(t, addr), "hello"); err != nil || got != "hello" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got, err := exchange(dial(t, addr), "hello"); err != nil || got != "hello" {
+		t.Fatalf("after the refill got %q, %v", got, err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	addr := serveChain(t, server.HandleEcho(), server.IdleTimeout(100*time.Millisecond))
+	conn := dial(t, addr)
+	// traffic keeps it open past the timeout...
+	for i := 0; i < 3; i++ {
+		if got, err := exchange(conn, "hello"); err != nil || got != "hello" {
+			t.Fatalf("got %q, %v", got, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	// ...and it is closed once that stops
+	start := time.Now()
+	expectClosed(t, conn)
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("closed after %v idle, want about 100ms", d)
+	}
+}
@@ -0,0 +1,398 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PacketConfig holds the settings for a packet server. The tags let it be
+// filled in by pkg/config.
+type PacketConfig struct {
+	Network        string        `config:"network" default:"udp" usage:"udp, udp4, udp6 or unixgram"`
+	Addr           string        `config:"addr" default:":8080" usage:"address to listen on, or the socket file for unixgram"`
+	SocketPerm     os.FileMode   `config:"socket-perm" default:"0660" usage:"mode of the unix socket file"`
+	Workers        int           `config:"workers" default:"0" usage:"number of packet handlers running at once, 0 for one per cpu"`
+	QueueSize      int           `config:"queue-size" default:"1024" usage:"packets waiting for a worker before new ones are dropped"`
+	MaxPacketSize  int           `config:"max-packet-size" default:"65535" usage:"largest packet read, longer ones are cut short"`
+	SessionTimeout time.Duration `config:"session-timeout" default:"2m" usage:"forget peers that have sent nothing for this long"`
+}
+
+// Packet is a single datagram and who it came from
+type Packet struct {
+	Addr    net.Addr
+	Data    []byte         // only valid until the handler returns
+	Session *PacketSession // nil for peers without an address, such as unnamed unix sockets
+}
+
+// PacketWriter sends replies, a net.PacketConn is one
+type PacketWriter interface {
+	WriteTo(b []byte, addr net.Addr) (int, error)
+	LocalAddr() net.Addr
+}
+
+// PacketHandler handles a single packet
+type PacketHandler func(w PacketWriter, p *Packet)
+
+// PacketSession tracks a peer across packets. Datagram protocols have no
+// connections, so a peer's session starts with its first packet and ends
+// once it has been quiet for the server's SessionTimeout.
+type PacketSession struct {
+	Addr    net.Addr
+	Created time.Time
+
+	lastSeen int64 // unix nanos
+	packets  int64
+	bytes    int64
+
+	mu     sync.Mutex
+	values map[string]interface{}
+}
+
+// LastSeen returns when the last packet from the peer arrived
+func (ps *PacketSession) LastSeen() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&ps.lastSeen))
+}
+
+// Packets returns the number of packets received from the peer
+func (ps *PacketSession) Packets() int64 {
+	return atomic.LoadInt64(&ps.packets)
+}
+
+// Bytes returns the number of bytes received from the peer
+func (ps *PacketSession) Bytes() int64 {
+	return atomic.LoadInt64(&ps.bytes)
+}
+
+// Get returns the session value stored under key, or nil
+func (ps *PacketSession) Get(key string) interface{} {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.values[key]
+}
+
+// Set stores a session value under key, it lives as long as the session
+func (ps *PacketSession) Set(key string, v interface{}) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.values == nil {
+		ps.values = make(map[string]interface{})
+	}
+	ps.values[key] = v
+}
+
+// PacketServer reads datagrams, from UDP or a unix datagram socket, and
+// hands each one to Handler on a fixed pool of workers. It has the same
+// lifecycle as Server: Serve, ListenAndServe, Shutdown and Close.
+type PacketServer struct {
+	Network        string        // "udp" if empty, or "udp4", "udp6" or "unixgram"
+	Addr           string        // address to listen on, ":8080" if empty, or the socket file for unixgram
+	SocketPerm     os.FileMode   // mode of the unix socket file, DefaultSocketPerm if zero
+	Handler        PacketHandler // called for every packet
+	Workers        int           // number of handlers running at once, runtime.NumCPU() if zero
+	QueueSize      int           // packets waiting for a worker before new ones are dropped, 1024 if zero
+	MaxPacketSize  int           // largest packet read, 65535 if zero
+	SessionTimeout time.Duration // forget peers that have sent nothing for this long, 2 minutes if zero
+	ErrorLog       *log.Logger   // logs read errors, log.Default() if nil
+
+	// OnSessionEnd, if set, is called when a peer's session times out
+	OnSessionEnd func(ps *PacketSession)
+
+	mu       sync.Mutex
+	conns    map[net.PacketConn]struct{}
+	sessions map[string]*PacketSession
+	active   sync.WaitGroup // serve loops and their workers
+	closing  int32
+	dropped  int64
+	done     chan struct{}
+}
+
+// NewPacketServer returns a new PacketServer using the settings in cfg
+func NewPacketServer(cfg PacketConfig, handler PacketHandler) *PacketServer {
+	return &PacketServer{
+		Network:        cfg.Network,
+		Addr:           cfg.Addr,
+		SocketPerm:     cfg.SocketPerm,
+		Handler:        handler,
+		Workers:        cfg.Workers,
+		QueueSize:      cfg.QueueSize,
+		MaxPacketSize:  cfg.MaxPacketSize,
+		SessionTimeout: cfg.SessionTimeout,
+	}
+}
+
+// ListenAndServe listens on s.Addr and then calls Serve. For unixgram, a
+// stale socket file is removed first, and the file is removed again when
+// the server is closed.
+func (s *PacketServer) ListenAndServe() error {
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+	network, addr := s.Network, s.Addr
+	if network == "" {
+		network = "udp"
+	}
+	var pc net.PacketConn
+	var err error
+	if network == "unixgram" {
+		pc, err = listenUnixgram(addr, s.SocketPerm)
+	} else {
+		if addr == "" {
+			addr = ":8080"
+		}
+		pc, err = net.ListenPacket(network, addr)
+	}
+	if err != nil {
+		return err
+	}
+	return s.Serve(pc)
+}
+
+// Serve reads packets from pc until it is closed, handing each one to
+// s.Handler on one of the workers. When every worker is busy and the
+// queue is full, packets are dropped, the same as the network would.
+// Serve always closes pc, and returns ErrServerClosed after Shutdown or
+// Close.
+func (s *PacketServer) Serve(pc net.PacketConn) error {
+	if !s.track(pc, true) {
+		pc.Close()
+		return ErrServerClosed
+	}
+	defer s.track(pc, false)
+	defer pc.Close()
+	s.active.Add(1)
+	defer s.active.Done()
+
+	handler := s.Handler
+	if handler == nil {
+		handler = EchoPacket
+	}
+	size := s.MaxPacketSize
+	if size <= 0 {
+		size = 65535
+	}
+	bufs := sync.Pool{New: func() interface{} { return make([]byte, size) }}
+
+	// the workers
+	queue := make(chan *Packet, s.queueSize())
+	var workers sync.WaitGroup
+	for i := 0; i < s.workers(); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for p := range queue {
+				handler(pc, p)
+				bufs.Put(p.Data[:cap(p.Data)])
+			}
+		}()
+	}
+	// let the workers finish what is queued before Serve returns
+	defer workers.Wait()
+	defer close(queue)
+
+	var delay time.Duration
+	for {
+		buf := bufs.Get().([]byte)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			bufs.Put(buf)
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else {
+					delay *= 2
+				}
+				if max := time.Second; delay > max {
+					delay = max
+				}
+				s.logf("error reading packet: %v; retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		p := &Packet{Addr: addr, Data: buf[:n], Session: s.session(addr, n)}
+		select {
+		case queue <- p:
+		default:
+			atomic.AddInt64(&s.dropped, 1)
+			bufs.Put(buf)
+		}
+	}
+}
+
+func (s *PacketServer) workers() int {
+	if s.Workers > 0 {
+		return s.Workers
+	}
+	return runtime.NumCPU()
+}
+
+func (s *PacketServer) queueSize() int {
+	if s.QueueSize > 0 {
+		return s.QueueSize
+	}
+	return 1024
+}
+
+func (s *PacketServer) sessionTimeout() time.Duration {
+	if s.SessionTimeout > 0 {
+		return s.SessionTimeout
+	}
+	return 2 * time.Minute
+}
+
+// session returns the session for addr, starting one if need be
+func (s *PacketServer) session(addr net.Addr, n int) *PacketSession {
+	if addr == nil || addr.String() == "" {
+		// an unnamed unix socket can't be told apart from any other
+		return nil
+	}
+	now := time.Now()
+	key := addr.Network() + " " + addr.String()
+	s.mu.Lock()
+	ps, ok := s.sessions[key]
+	if !ok {
+		ps = &PacketSession{Addr: addr, Created: now}
+		s.sessions[key] = ps
+	}
+	s.mu.Unlock()
+	atomic.StoreInt64(&ps.lastSeen, now.UnixNano())
+	atomic.AddInt64(&ps.packets, 1)
+	atomic.AddInt64(&ps.bytes, int64(n))
+	return ps
+}
+
+// sweep ends the sessions that have timed out, until the server closes
+func (s *PacketServer) sweep(done chan struct{}) {
+	timeout := s.sessionTimeout()
+	t := time.NewTicker(timeout / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-done:
+			return
+		}
+		var ended []*PacketSession
+		s.mu.Lock()
+		for key, ps := range s.sessions {
+			if time.Since(ps.LastSeen()) > timeout {
+				delete(s.sessions, key)
+				ended = append(ended, ps)
+			}
+		}
+		s.mu.Unlock()
+		if s.OnSessionEnd != nil {
+			for _, ps := range ended {
+				s.OnSessionEnd(ps)
+			}
+		}
+	}
+}
+
+// Sessions returns the number of peers currently being tracked
+func (s *PacketServer) Sessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+// Dropped returns the number of packets dropped because the queue was full
+func (s *PacketServer) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// Shutdown stops the server gracefully. It closes the sockets and then
+// waits for the packets already queued to be handled, or for ctx to be
+// done, in which case the context's error is returned.
+func (s *PacketServer) Shutdown(ctx context.Context) error {
+	err := s.closeConns()
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close closes the sockets. Handlers that are running carry on, but
+// nothing new is read.
+func (s *PacketServer) Close() error {
+	return s.closeConns()
+}
+
+func (s *PacketServer) closeConns() error {
+	atomic.StoreInt32(&s.closing, 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for pc := range s.conns {
+		if cerr := pc.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(s.conns, pc)
+	}
+	if s.done != nil {
+		close(s.done)
+		s.done = nil
+	}
+	return err
+}
+
+func (s *PacketServer) shuttingDown() bool {
+	return atomic.LoadInt32(&s.closing) != 0
+}
+
+func (s *PacketServer) track(pc net.PacketConn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[net.PacketConn]struct{})
+		s.sessions = make(map[string]*PacketSession)
+	}
+	if !add {
+		delete(s.conns, pc)
+		return true
+	}
+	if s.shuttingDown() {
+		return false
+	}
+	s.conns[pc] = struct{}{}
+	if s.done == nil {
+		s.done = make(chan struct{})
+		go s.sweep(s.done)
+	}
+	return true
+}
+
+func (s *PacketServer) logf(format string, v ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// EchoPacket is a packet handler that sends every packet straight back
+func EchoPacket(w PacketWriter, p *Packet) {
+	if p.Addr == nil || p.Addr.String() == "" {
+		// nowhere to send it
+		return
+	}
+	w.WriteTo(p.Data, p.Addr)
+}
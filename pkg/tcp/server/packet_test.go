@@ -0,0 +1,450 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/tcp/server"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startUDP starts srv on a loopback udp port, returning its address
+func startUDP(srv *server.PacketServer) (net.Addr, chan error, error) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(pc) }()
+	return pc.LocalAddr(), errc, nil
+}
+
+// exchange sends msg on conn and waits for the reply
+func exchange(conn net.Conn, msg string) (string, error) {
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return "", err
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:n]), nil
+}
+
+func TestUDPEcho(t *testing.T) {
+	srv := &server.PacketServer{}
+	addr, _, err := startUDP(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, msg := range []string{"hello", "world"} {
+		got, err := exchange(conn, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != msg {
+			t.Fatalf("got %q, want %q", got, msg)
+		}
+	}
+}
+
+func TestSessions(t *testing.T) {
+	srv := &server.PacketServer{
+		Handler: func(w server.PacketWriter, p *server.Packet) {
+			n, _ := p.Session.Get("n").(int)
+			n++
+			p.Session.Set("n", n)
+			w.WriteTo([]byte(fmt.Sprintf("%d %d", n, p.Session.Packets())), p.Addr)
+		},
+		Workers: 1,
+	}
+	addr, _, err := startUDP(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	for peer := 0; peer < 2; peer++ {
+		conn, err := net.Dial("udp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		for i := 1; i <= 3; i++ {
+			got, err := exchange(conn, "x")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := fmt.Sprintf("%d %d", i, i); got != want {
+				t.Fatalf("peer %d: got %q, want %q", peer, got, want)
+			}
+		}
+	}
+	if n := srv.Sessions(); n != 2 {
+		t.Fatalf("%d sessions, want 2", n)
+	}
+}
+
+func TestSessionTimeout(t *testing.T) {
+	ended := make(chan *server.PacketSession, 1)
+	srv := &server.PacketServer{
+		SessionTimeout: 50 * time.Millisecond,
+		OnSessionEnd:   func(ps *server.PacketSession) { ended <- ps },
+	}
+	addr, _, err := startUDP(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := exchange(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Sessions(); n != 1 {
+		t.Fatalf("%d sessions, want 1", n)
+	}
+	select {
+	case ps := <-ended:
+		if ps.Addr.String() != conn.LocalAddr().String() {
+			t.Fatalf("ended session for %v, want %v", ps.Addr, conn.LocalAddr())
+		}
+		if ps.Bytes() != 4 {
+			t.Fatalf("session counted %d bytes, want 4", ps.Bytes())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("session did not time out")
+	}
+	if n := srv.Sessions(); n != 0 {
+		t.Fatalf("%d sessions after timeout, want 0", n)
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	// four workers each hold a packet until released, so at most four
+	// handlers run at once and the rest wait in the queue
+	var running, most int32
+	release := make(chan struct{})
+	srv := &server.PacketServer{
+		Workers: 4,
+		Handler: func(w server.PacketWriter, p *server.Packet) {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&most)
+				if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+					break
+				}
+			}
+			<-release
+			atomic.AddInt32(&running, -1)
+			w.WriteTo(p.Data, p.Addr)
+		},
+	}
+	addr, _, err := startUDP(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 10; i++ {
+		if _, err := conn.Write([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 16)
+	for i := 0; i < 10; i++ {
+		if _, err := conn.Read(buf); err != nil {
+			t.Fatalf("reply %d: %v", i, err)
+		}
+	}
+	if m := atomic.LoadInt32(&most); m != 4 {
+		t.Fatalf("%d handlers ran at once, want 4", m)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	var mu sync.Mutex
+	logger := newLogger(&buf, &mu)
+	filter, err := server.PacketIPFilter(nil, []string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	panicky := func(w server.PacketWriter, p *server.Packet) {
+		if string(p.Data) == "panic" {
+			panic("boom")
+		}
+		w.WriteTo(p.Data, p.Addr)
+	}
+	chain := server.NewPacketChain(server.LogPacket(logger), server.RecoverPacket(logger))
+	srv := &server.PacketServer{Handler: chain.Then(panicky), Workers: 1}
+	addr, _, err := startUDP(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("panic")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := exchange(conn, "after"); err != nil || got != "after" {
+		t.Fatalf("after a panic got %q, %v", got, err)
+	}
+	mu.Lock()
+	logged := buf.String()
+	mu.Unlock()
+	if !bytes.Contains([]byte(logged), []byte("boom")) || !bytes.Contains([]byte(logged), []byte("PACKET")) {
+		t.Fatalf("log missing panic or packet lines: %q", logged)
+	}
+
+	// loopback is denied, so nothing comes back
+	srv2 := &server.PacketServer{Handler: server.NewPacketChain(filter).Then(nil)}
+	addr2, _, err := startUDP(srv2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv2.Close()
+	conn2, err := net.Dial("udp", addr2.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	conn2.Write([]byte("x"))
+	conn2.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := conn2.Read(make([]byte, 8)); err == nil {
+		t.Fatal("denied peer got a reply")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{})
+	var handled int32
+	srv := &server.PacketServer{
+		Workers: 1,
+		Handler: func(w server.PacketWriter, p *server.Packet) {
+			close(started)
+			time.Sleep(50 * time.Millisecond)
+			atomic.AddInt32(&handled, 1)
+		},
+	}
+	addr, errc, err := startUDP(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("x"))
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&handled) != 1 {
+		t.Fatal("shutdown returned before the handler finished")
+	}
+	if err := <-errc; err != server.ErrServerClosed {
+		t.Fatalf("serve returned %v, want ErrServerClosed", err)
+	}
+	if err := srv.ListenAndServe(); err != server.ErrServerClosed {
+		t.Fatalf("listen after shutdown returned %v", err)
+	}
+}
+
+func TestUnixEcho(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "echo.sock")
+	srv := &server.Server{Network: "unix", Addr: path, SocketPerm: 0600, Handler: server.HandleEcho()}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	conn, err := dialRetry("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := exchange(conn, "hello")
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "hello" {
+		t.Fatalf("got %q", got)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Fatalf("socket mode %v, want 0600", perm)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != server.ErrServerClosed {
+		t.Fatalf("serve returned %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket file left behind: %v", err)
+	}
+}
+
+func TestStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "stale.sock")
+	// leave a socket file behind with nothing listening on it
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+	srv := &server.Server{Network: "unix", Addr: path, Handler: server.HandleEcho()}
+	go srv.ListenAndServe()
+	defer srv.Close()
+	conn, err := dialRetry("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got, err := exchange(conn, "hi"); err != nil || got != "hi" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	// a file that is not a socket is left alone
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv2 := &server.Server{Network: "unix", Addr: file}
+	if err := srv2.ListenAndServe(); err == nil {
+		t.Fatal("listened over a regular file")
+	}
+}
+
+func TestInUse(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "busy.sock")
+	srv := &server.Server{Network: "unix", Addr: path}
+	go srv.ListenAndServe()
+	defer srv.Close()
+	conn, err := dialRetry("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	srv2 := &server.Server{Network: "unix", Addr: path}
+	if err := srv2.ListenAndServe(); err == nil {
+		t.Fatal("a second server took over a socket in use")
+	}
+}
+
+func TestUnixgramEcho(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "echo.dgram")
+	srv := &server.PacketServer{Network: "unixgram", Addr: path}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	// the client binds its own socket file so the server has somewhere
+	// to send the reply
+	local := filepath.Join(dir, "client.dgram")
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		conn, err = net.DialUnix("unixgram",
+			&net.UnixAddr{Name: local, Net: "unixgram"},
+			&net.UnixAddr{Name: path, Net: "unixgram"})
+		if err == nil {
+			break
+		}
+		os.Remove(local)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	got, err := exchange(conn, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "hello" {
+		t.Fatalf("got %q", got)
+	}
+	if n := srv.Sessions(); n != 1 {
+		t.Fatalf("%d sessions, want 1", n)
+	}
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != server.ErrServerClosed {
+		t.Fatalf("serve returned %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket file left behind: %v", err)
+	}
+}
+
+// dialRetry dials until the server is listening
+func dialRetry(network, addr string) (net.Conn, error) {
+	var err error
+	for i := 0; i < 50; i++ {
+		var conn net.Conn
+		if conn, err = net.Dial(network, addr); err == nil {
+			return conn, nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil, err
+}
+
+// syncWriter guards a writer shared by loggers on many goroutines
+type syncWriter struct {
+	w  io.Writer
+	mu *sync.Mutex
+}
+
+func (sw syncWriter) Write(p []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.w.Write(p)
+}
+
+func newLogger(w io.Writer, mu *sync.Mutex) *log.Logger {
+	return log.New(syncWriter{w, mu}, "", 0)
+}
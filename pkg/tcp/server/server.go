@@ -9,29 +9,12 @@ import (
 )
 
 // ListenAndServe creates a generic listening socket on the TCP protocol
-// for the provided address and/port and handles TCP connections. You can
-// in theory change the network type of this listener to a different
-// protocol if you know how to properly handle that protocol.
+// for the provided address and/port and handles TCP connections. To use a
+// different network, such as a unix socket, set Network on a Server; for
+// UDP and unix datagrams see PacketServer.
 func ListenAndServe(host string) error {
-	// initialize a listening socket
-	ln, err := net.Listen("tcp", host)
-	if err != nil {
-		return err
-	}
-	defer ln.Close()
-	for {
-		// wait (block) for a connection, accepting it when it arrives.
-		conn, err := ln.Accept()
-		if err != nil {
-			// if we can't accept a connection, then finish loop and wait for next connection.
-			log.Printf("error accepting connection: %s\n", err)
-			continue
-		}
-		// got a connection--lets hand it off on it's own goroutine and get back to waiting for
-		// the next potential connection and do it all again.
-		log.Printf("ACCEPTED CONNECTION: %q\n", conn.RemoteAddr())
-		go HandleConn(conn)
-	}
+	srv := &Server{Addr: host, Handler: defaultChain.Then(HandleConn)}
+	return srv.ListenAndServe()
 }
 
 // HandleConn is a server handler that takes a generic net.Conn. A new one is
@@ -57,7 +40,10 @@ func HandleConn(conn net.Conn) {
 		}
 		fmt.Printf("RECEIVED: %q FROM [%s], REPLYING...", data, conn.RemoteAddr())
 		reply := fmt.Sprintf("ECHO: %q\n", data)
-		if _, err = w.WriteString(reply); err != nil {
+		if _, err = w.WriteString(reply); err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
 			log.Printf("Error writing: %s\n", err)
 			fmt.Printf(" ERR!\n")
 		} else {
@@ -76,62 +62,20 @@ func HandleConn(conn net.Conn) {
 // ListenAndServeTCP creates a listening socket on the TCP protocol
 // for the provided address and/port and handles TCP connections.
 func ListenAndServeTCP(host string) error {
-	// resolve tcp address
-	addr, err := net.ResolveTCPAddr("tcp", host)
-	if err != nil {
-		return err
-	}
-	// initialize a listening socket
-	ln, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		return err
-	}
-	defer ln.Close()
-	for {
-		// wait (block) for a connection, accepting it when it arrives.
-		conn, err := ln.AcceptTCP()
-		if err != nil {
-			// if we can't accept a connection, then finish loop and wait for next connection.
-			log.Printf("error accepting connection: %s\n", err)
-			continue
+	return ListenAndServeTCPWithHandler(host, func(conn net.Conn) {
+		if tc, ok := conn.(*net.TCPConn); ok {
+			HandleTCPConn(tc)
+			return
 		}
-		// got a connection--lets hand it off on it's own goroutine and get back to waiting for
-		// the next potential connection and do it all again.
-		log.Printf("ACCEPTED CONNECTION: %q\n", conn.RemoteAddr())
-		go HandleTCPConn(conn)
-	}
+		HandleConn(conn)
+	})
 }
 
 // HandleTCPConn is a server handler that takes a *net.TCPConn. A new one is
 // created in a separate goroutine for every incoming connection that is accepted.
+// It behaves the same as HandleConn.
 func HandleTCPConn(conn *net.TCPConn) {
-	// make a buffered reader to read incoming data
-	r := bufio.NewReader(conn)
-	// make a buffered writer to write back to client
-	w := bufio.NewWriter(conn)
-	defer conn.Close()
-	for {
-		// read data until we get to the end of a line
-		data, err := r.ReadBytes('\n')
-		if err == io.EOF {
-			// if we find the end of the data before
-			// we find a newline char, then just stop
-			break
-		} else if err != nil {
-			// if some other error happens, log and return
-			log.Printf("Error reading: %s\n", err)
-			HandleConnClose(conn)
-			return
-		}
-		fmt.Printf("RECEIVED: %q FROM [%s], REPLYING...", data, conn.RemoteAddr())
-		reply := fmt.Sprintf("ECHO: %q\n", data)
-		if _, err = w.WriteString(reply); err != nil {
-			log.Printf("Error writing: %s\n", err)
-			fmt.Printf(" ERR!\n")
-		} else {
-			fmt.Printf(" OK!\n")
-		}
-	}
+	HandleConn(conn)
 }
 
 // Handler is a generic type definition
@@ -163,22 +107,14 @@ func ListenAndServeTCPWithHandler(host string, handle Handler) error {
 	if err != nil {
 		return err
 	}
-	defer ln.Close()
-	for {
-		// wait (block) for a connection, accepting it when it arrives.
-		conn, err := ln.AcceptTCP()
-		if err != nil {
-			// if we can't accept a connection, then finish loop and wait for next connection.
-			log.Printf("error accepting connection: %s\n", err)
-			continue
-		}
-		// got a connection--lets hand it off on it's own goroutine and get back to waiting for
-		// the next potential connection and do it all again.
-		log.Printf("ACCEPTED CONNECTION: %q\n", conn.RemoteAddr())
-		go handle(conn)
-	}
+	srv := &Server{Handler: defaultChain.Then(handle)}
+	return srv.Serve(ln)
 }
 
+// defaultChain is the middleware the ListenAndServe functions wrap their
+// handlers in
+var defaultChain = NewChain(LogConn(nil), Recover(nil))
+
 // HandleConnClose is a semi generic handler that closes down a remote connection
 // if something happens to the connected client and it is unrecoverable.
 func HandleConnClose(conn net.Conn) {
@@ -0,0 +1,450 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/scottcagno/net-tools/pkg/tcp/proxyproto"
+	"github.com/scottcagno/net-tools/pkg/tcp/tlsutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after a call to
+// Shutdown or Close.
+var ErrServerClosed = errors.New("tcp: server closed")
+
+// Config holds the settings for a TCP server. The tags let it be filled
+// in by pkg/config.
+type Config struct {
+	Network       string        `config:"network" default:"tcp" usage:"tcp, tcp4, tcp6 or unix"`
+	Addr          string        `config:"addr" default:":8080" usage:"address to listen on, or the socket file for unix"`
+	SocketPerm    os.FileMode   `config:"socket-perm" default:"0660" usage:"mode of the unix socket file"`
+	MaxConns      int           `config:"max-conns" default:"0" usage:"max number of open connections, 0 for no limit"`
+	MaxConnsPerIP int           `config:"max-conns-per-ip" default:"0" usage:"max number of open connections from one ip, 0 for no limit"`
+	ReadTimeout   time.Duration `config:"read-timeout" default:"0s" usage:"max duration of a single read, 0 for no limit"`
+	WriteTimeout  time.Duration `config:"write-timeout" default:"0s" usage:"max duration of a single write, 0 for no limit"`
+	IdleTimeout   time.Duration `config:"idle-timeout" default:"0s" usage:"close connections with no reads or writes for this long, 0 for no limit"`
+	TLSCert       string        `config:"tls-cert" usage:"certificate file, turns on tls"`
+	TLSKey        string        `config:"tls-key" usage:"private key file for the certificate"`
+	TLSClientCA   string        `config:"tls-client-ca" usage:"ca bundle to verify client certificates against, turns on mutual tls"`
+
+	Proxy proxyproto.Config `config:"proxy"`
+}
+
+// TLSConfig returns the tls settings described by the config, or nil if
+// TLSCert is not set. The certificate is reloaded when its files change.
+func (c Config) TLSConfig() (*tls.Config, error) {
+	if c.TLSCert == "" {
+		return nil, nil
+	}
+	return tlsutil.ServerConfig(c.TLSCert, c.TLSKey, c.TLSClientCA)
+}
+
+// Server accepts connections and hands each one to Handler on its own
+// goroutine. It tracks the open connections so it can enforce limits
+// and shut down gracefully.
+type Server struct {
+	Network       string        // "tcp" if empty, or "tcp4", "tcp6" or "unix"
+	Addr          string        // address to listen on, ":8080" if empty, or the socket file for unix
+	SocketPerm    os.FileMode   // mode of the unix socket file, DefaultSocketPerm if zero
+	Handler       Handler       // called for every accepted connection
+	MaxConns      int           // max number of open connections, 0 for no limit
+	MaxConnsPerIP int           // max number of open connections from one ip, 0 for no limit
+	ReadTimeout   time.Duration // max duration of a single read, 0 for no limit
+	WriteTimeout  time.Duration // max duration of a single write, 0 for no limit
+	IdleTimeout   time.Duration // close connections with no reads or writes for this long
+	ErrorLog      *log.Logger   // logs accept and limit errors, log.Default() if nil
+	TLSConfig     *tls.Config   // used by ListenAndServe and ServeTLS, plain tcp if nil
+
+	// Proxy has ListenAndServe read the PROXY protocol header sent by a
+	// load balancer, so handlers see the client's address. It is off
+	// unless Proxy.Policy is set. To use it with Serve, wrap the listener
+	// with proxyproto.NewListener.
+	Proxy proxyproto.Config
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	perIP     map[string]int
+	active    sync.WaitGroup
+	closing   int32
+}
+
+// NewServer returns a new Server using the settings in cfg. If cfg has a
+// tls certificate, it is loaded into TLSConfig, and an error is returned
+// if that fails.
+func NewServer(cfg Config, handler Handler) (*Server, error) {
+	tlsConfig, err := cfg.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		Network:       cfg.Network,
+		Addr:          cfg.Addr,
+		SocketPerm:    cfg.SocketPerm,
+		Handler:       handler,
+		MaxConns:      cfg.MaxConns,
+		MaxConnsPerIP: cfg.MaxConnsPerIP,
+		ReadTimeout:   cfg.ReadTimeout,
+		WriteTimeout:  cfg.WriteTimeout,
+		IdleTimeout:   cfg.IdleTimeout,
+		TLSConfig:     tlsConfig,
+		Proxy:         cfg.Proxy,
+	}, nil
+}
+
+// ListenAndServe listens on s.Addr and then calls Serve, or ServeTLS if
+// s.TLSConfig is set. For a unix socket, a stale socket file left behind
+// by an earlier process is removed first, and the file is removed again
+// when the server is closed.
+func (s *Server) ListenAndServe() error {
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+	network, addr := s.Network, s.Addr
+	if network == "" {
+		network = "tcp"
+	}
+	var ln net.Listener
+	var err error
+	if isUnix(network) {
+		ln, err = listenUnix(network, addr, s.SocketPerm)
+	} else {
+		if addr == "" {
+			addr = ":8080"
+		}
+		ln, err = net.Listen(network, addr)
+	}
+	if err != nil {
+		return err
+	}
+	if s.Proxy.Policy != proxyproto.Off {
+		// the header comes before the tls handshake
+		pl, err := proxyproto.NewListener(ln, s.Proxy)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		pl.ErrorLog = s.ErrorLog
+		ln = pl
+	}
+	if s.TLSConfig != nil {
+		return s.ServeTLS(ln)
+	}
+	return s.Serve(ln)
+}
+
+// ListenAndServeTLS listens on s.Addr and serves TLS connections using
+// the certificate and key in the given files. They are reloaded when
+// they change, so certificates can be rotated without a restart. Any
+// other settings in s.TLSConfig, such as ClientCAs, are kept.
+func (s *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	r, err := tlsutil.NewReloader(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if s.TLSConfig != nil {
+		cfg = s.TLSConfig.Clone()
+	}
+	cfg.GetCertificate = r.GetCertificate
+	s.TLSConfig = cfg
+	return s.ListenAndServe()
+}
+
+// ServeTLS is like Serve, but does a TLS handshake on each connection
+// using s.TLSConfig. The handshake happens on the handler's first read or
+// write, or when it asks for the peer's identity with
+// tlsutil.PeerIdentity.
+func (s *Server) ServeTLS(ln net.Listener) error {
+	if s.TLSConfig == nil {
+		ln.Close()
+		return errors.New("tcp: ServeTLS needs a TLSConfig")
+	}
+	return s.Serve(tls.NewListener(ln, s.TLSConfig))
+}
+
+// Serve accepts connections on ln until it is closed, handing each one
+// to s.Handler on a new goroutine. Temporary accept errors are retried
+// with an exponential backoff. Serve always closes ln, and returns
+// ErrServerClosed after Shutdown or Close.
+func (s *Server) Serve(ln net.Listener) error {
+	if !s.trackListener(ln, true) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(ln, false)
+	defer ln.Close()
+
+	var delay time.Duration
+	for {
+		// wait (block) for a connection, accepting it when it arrives.
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// back off the same way net/http does, 5ms doubling up to 1s
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else {
+					delay *= 2
+				}
+				if max := time.Second; delay > max {
+					delay = max
+				}
+				s.logf("error accepting connection: %v; retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		// check the limits before handing it off
+		if !s.trackConn(conn) {
+			conn.Close()
+			continue
+		}
+		// got a connection--lets hand it off on it's own goroutine and get back to waiting for
+		// the next potential connection and do it all again.
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.active.Done()
+	defer s.untrackConn(conn)
+	defer conn.Close()
+	if s.ReadTimeout > 0 || s.WriteTimeout > 0 || s.IdleTimeout > 0 {
+		conn = newDeadlineConn(conn, s.ReadTimeout, s.WriteTimeout, s.IdleTimeout)
+	}
+	handler := s.Handler
+	if handler == nil {
+		handler = HandleEcho()
+	}
+	handler(conn)
+}
+
+// Shutdown stops the server gracefully. It closes all of the listeners and
+// then waits for every active handler to return, or for ctx to be done, in
+// which case the context's error is returned. Handlers are not interrupted;
+// ones that may never return on their own (an echo loop, for example) can
+// be cut off with Close once ctx expires.
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.closing, 1)
+	s.mu.Lock()
+	err := s.closeListeners()
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close immediately closes all of the listeners and active connections.
+func (s *Server) Close() error {
+	atomic.StoreInt32(&s.closing, 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.closeListeners()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
+
+// ActiveConns returns the number of connections currently being handled
+func (s *Server) ActiveConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+func (s *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&s.closing) != 0
+}
+
+// closeListeners closes every listener. The caller must hold the lock.
+func (s *Server) closeListeners() error {
+	var err error
+	for ln := range s.listeners {
+		if cerr := ln.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(s.listeners, ln)
+	}
+	return err
+}
+
+func (s *Server) trackListener(ln net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		s.listeners[ln] = struct{}{}
+	} else {
+		delete(s.listeners, ln)
+	}
+	return true
+}
+
+// trackConn records a new connection, unless it would go over one of the
+// connection limits or the server is shutting down.
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown() {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+		s.perIP = make(map[string]int)
+	}
+	if s.MaxConns > 0 && len(s.conns) >= s.MaxConns {
+		s.logf("rejecting connection from %s: at max connections (%d)", conn.RemoteAddr(), s.MaxConns)
+		return false
+	}
+	ip := remoteIP(conn)
+	if s.MaxConnsPerIP > 0 && s.perIP[ip] >= s.MaxConnsPerIP {
+		s.logf("rejecting connection from %s: at max connections per ip (%d)", conn.RemoteAddr(), s.MaxConnsPerIP)
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.perIP[ip]++
+	s.active.Add(1)
+	return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+	ip := remoteIP(conn)
+	if s.perIP[ip]--; s.perIP[ip] <= 0 {
+		delete(s.perIP, ip)
+	}
+}
+
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// remoteIP returns the ip part of the connection's remote address
+func remoteIP(conn net.Conn) string {
+	return hostOf(conn.RemoteAddr())
+}
+
+// hostOf returns the host part of addr, or all of it if it has no port
+func hostOf(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// deadlineConn sets a deadline before every read and write, and closes
+// the connection once it has gone idle for too long.
+type deadlineConn struct {
+	net.Conn
+	read  time.Duration
+	write time.Duration
+	idle  time.Duration
+	last  int64 // unix nanos of the last read or write, for the idle timer
+	timer *time.Timer
+}
+
+func newDeadlineConn(conn net.Conn, read, write, idle time.Duration) *deadlineConn {
+	c := &deadlineConn{
+		Conn:  conn,
+		read:  read,
+		write: write,
+		idle:  idle,
+		last:  time.Now().UnixNano(),
+	}
+	if idle > 0 {
+		c.timer = time.AfterFunc(idle, c.checkIdle)
+	}
+	return c
+}
+
+// checkIdle runs when the idle timer fires. If there has been traffic
+// since it was set, it sets itself again for the time remaining.
+func (c *deadlineConn) checkIdle() {
+	idleFor := time.Since(time.Unix(0, atomic.LoadInt64(&c.last)))
+	if idleFor < c.idle {
+		c.timer.Reset(c.idle - idleFor)
+		return
+	}
+	c.Conn.Close()
+}
+
+func (c *deadlineConn) touch() {
+	if c.timer != nil {
+		atomic.StoreInt64(&c.last, time.Now().UnixNano())
+	}
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	if c.read > 0 {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.read)); err != nil {
+			return 0, err
+		}
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	if c.write > 0 {
+		if err := c.Conn.SetWriteDeadline(time.Now().Add(c.write)); err != nil {
+			return 0, err
+		}
+	}
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *deadlineConn) Close() error {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	return c.Conn.Close()
+}
+
+// Unwrap returns the underlying connection
+func (c *deadlineConn) Unwrap() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,320 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/scottcagno/net-tools/pkg/tcp/server"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var quiet = log.New(ioutil.Discard, "", 0)
+
+// startTCP starts srv on a loopback tcp port, returning its address and
+// what Serve returns
+func startTCP(srv *server.Server) (string, chan error, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(ln) }()
+	return ln.Addr().String(), errc, nil
+}
+
+// holdHandler returns a handler that writes "ok" and then blocks until
+// release is closed, and a channel that gets a value as each one starts
+func holdHandler(release chan struct{}) (server.Handler, chan struct{}) {
+	started := make(chan struct{}, 16)
+	return func(conn net.Conn) {
+		conn.Write([]byte("ok"))
+		started <- struct{}{}
+		<-release
+	}, started
+}
+
+// expectClosed checks that the server closes conn without sending it
+// anything
+func expectClosed(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := conn.Read(make([]byte, 8)); err != io.EOF {
+		t.Fatalf("expected the server to close the connection, got %d bytes, %v", n, err)
+	}
+}
+
+// expectOK checks that conn was handed to a holdHandler
+func expectOK(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ok" {
+		t.Fatalf("expected the connection to be handled, got %q, %v", buf, err)
+	}
+}
+
+// waitActive waits for the server to have n active connections
+func waitActive(t *testing.T, srv *server.Server, n int) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if srv.ActiveConns() == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%d active connections, want %d", srv.ActiveConns(), n)
+}
+
+func TestTCPEcho(t *testing.T) {
+	srv := &server.Server{}
+	addr, errc, err := startTCP(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got, err := exchange(conn, "hello"); err != nil || got != "hello" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	srv.Close()
+	if err := <-errc; err != server.ErrServerClosed {
+		t.Fatalf("serve returned %v, want ErrServerClosed", err)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	var buf bytes.Buffer
+	var mu sync.Mutex
+	release := make(chan struct{})
+	handler, _ := holdHandler(release)
+	srv := &server.Server{Handler: handler, MaxConns: 2, ErrorLog: newLogger(&buf, &mu)}
+	addr, _, err := startTCP(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		expectOK(t, conn)
+	}
+	over, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer over.Close()
+	expectClosed(t, over)
+	mu.Lock()
+	logged := buf.String()
+	mu.Unlock()
+	if !strings.Contains(logged, "at max connections (2)") {
+		t.Fatalf("rejection not logged: %q", logged)
+	}
+	// once the handlers return there is room again
+	close(release)
+	waitActive(t, srv, 0)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expectOK(t, conn)
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	handler, _ := holdHandler(release)
+	srv := &server.Server{Handler: handler, MaxConnsPerIP: 1, ErrorLog: quiet}
+	addr, _, err := startTCP(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	expectOK(t, first)
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	expectClosed(t, second)
+	// another ip still gets in, where the system routes all of 127/8
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}}
+	other, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Logf("skipping the second ip: %v", err)
+		return
+	}
+	defer other.Close()
+	expectOK(t, other)
+}
+
+func TestServerShutdown(t *testing.T) {
+	release := make(chan struct{})
+	handler, started := holdHandler(release)
+	srv := &server.Server{Handler: handler}
+	addr, errc, err := startTCP(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-started
+
+	// the handler is still running, so a short shutdown gives up
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("shutdown returned %v, want DeadlineExceeded", err)
+	}
+	if err := <-errc; err != server.ErrServerClosed {
+		t.Fatalf("serve returned %v, want ErrServerClosed", err)
+	}
+	if _, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		t.Fatal("the listener is still open after shutdown")
+	}
+
+	// and a longer one waits for it to return
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		done <- srv.Shutdown(ctx)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("shutdown returned %v with a handler still running", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ListenAndServe(); err != server.ErrServerClosed {
+		t.Fatalf("listen after shutdown returned %v", err)
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	// HandleEcho never returns while the client stays connected
+	srv := &server.Server{Handler: server.HandleEcho()}
+	addr, errc, err := startTCP(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got, err := exchange(conn, "hello"); err != nil || got != "hello" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(t, conn)
+	if err := <-errc; err != server.ErrServerClosed {
+		t.Fatalf("serve returned %v, want ErrServerClosed", err)
+	}
+	waitActive(t, srv, 0)
+}
+
+// tempErr is a temporary accept error
+type tempErr struct{}
+
+func (tempErr) Error() string   { return "try again" }
+func (tempErr) Timeout() bool   { return false }
+func (tempErr) Temporary() bool { return true }
+
+// flakyListener fails Accept with a temporary error a few times before
+// handing over to the real listener
+type flakyListener struct {
+	net.Listener
+	fails int
+	times []time.Time
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.times = append(l.times, time.Now())
+	if len(l.times) <= l.fails {
+		return nil, tempErr{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	var buf bytes.Buffer
+	var mu sync.Mutex
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fl := &flakyListener{Listener: ln, fails: 3}
+	srv := &server.Server{ErrorLog: newLogger(&buf, &mu)}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(fl) }()
+	defer srv.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// served once the errors run out
+	if got, err := exchange(conn, "hello"); err != nil || got != "hello" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	srv.Close()
+	if err := <-errc; err != server.ErrServerClosed {
+		t.Fatalf("serve returned %v, want ErrServerClosed", err)
+	}
+	// 5ms, then 10ms, then 20ms
+	for i, want := range []time.Duration{5, 10, 20} {
+		if got := fl.times[i+1].Sub(fl.times[i]); got < want*time.Millisecond {
+			t.Fatalf("retry %d after %v, want at least %vms", i+1, got, want)
+		}
+	}
+	mu.Lock()
+	logged := buf.String()
+	mu.Unlock()
+	if strings.Count(logged, "try again") != 3 {
+		t.Fatalf("expected 3 logged accept errors: %q", logged)
+	}
+}
+
+func TestServeAfterClose(t *testing.T) {
+	srv := &server.Server{}
+	srv.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Serve(ln); err != server.ErrServerClosed {
+		t.Fatalf("serve after close returned %v", err)
+	}
+	// Serve closes the listener it was given
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("listener still open: %v", err)
+	}
+}
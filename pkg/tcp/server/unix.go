@@ -0,0 +1,93 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// DefaultSocketPerm is the mode given to unix socket files when none is set
+const DefaultSocketPerm os.FileMode = 0660
+
+// isUnix reports whether network is one of the unix socket networks
+func isUnix(network string) bool {
+	return network == "unix" || network == "unixgram" || network == "unixpacket"
+}
+
+// prepareSocket gets the socket file path ready to listen on. A leftover
+// socket file from a process that is gone is removed; one that something
+// is still listening on, or a file that is not a socket, is an error.
+func prepareSocket(network, path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("unix: %s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial(network, path); err == nil {
+		conn.Close()
+		return fmt.Errorf("unix: %s is in use", path)
+	}
+	return os.Remove(path)
+}
+
+// listenUnix listens on the unix socket at path, cleaning up a stale
+// socket file first, and sets the socket file's mode. The socket file is
+// removed when the listener is closed.
+func listenUnix(network, path string, perm os.FileMode) (net.Listener, error) {
+	if err := prepareSocket(network, path); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen(network, path)
+	if err != nil {
+		return nil, err
+	}
+	if perm == 0 {
+		perm = DefaultSocketPerm
+	}
+	if err = os.Chmod(path, perm); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	// a listener from net.Listen already unlinks the file on Close
+	return ln, nil
+}
+
+// listenUnixgram is listenUnix for datagram sockets, which net does not
+// clean up after
+func listenUnixgram(path string, perm os.FileMode) (net.PacketConn, error) {
+	if err := prepareSocket("unixgram", path); err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		return nil, err
+	}
+	if perm == 0 {
+		perm = DefaultSocketPerm
+	}
+	if err = os.Chmod(path, perm); err != nil {
+		pc.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return &unlinkPacketConn{PacketConn: pc, path: path}, nil
+}
+
+// unlinkPacketConn removes its socket file when it is closed
+type unlinkPacketConn struct {
+	net.PacketConn
+	path string
+}
+
+func (c *unlinkPacketConn) Close() error {
+	err := c.PacketConn.Close()
+	if rerr := os.Remove(c.path); rerr != nil && !os.IsNotExist(rerr) && err == nil {
+		err = rerr
+	}
+	return err
+}
@@ -0,0 +1,279 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// Dialer connects to destinations through a SOCKS5 proxy. It has the
+// same Dial and DialContext methods as net.Dialer, so it can stand in for
+// one, e.g. as the DialContext of an http.Transport.
+type Dialer struct {
+	ProxyAddr string        // address of the proxy
+	Username  string        // user name for RFC 1929 auth, no auth if empty
+	Password  string        // password for RFC 1929 auth
+	Timeout   time.Duration // max duration to connect and get a reply, 0 for no limit
+}
+
+// Dial connects to addr through the proxy
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr through the proxy. Only tcp networks are
+// supported, see ListenPacket for udp.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	dest, err := ParseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, _, err := d.request(ctx, Connect, dest)
+	return conn, err
+}
+
+// Bind asks the proxy to listen for a connection from addr, the peer
+// expected to connect in, or from anyone if addr has a zero ip. The
+// address to give the peer is in the returned Binding.
+func (d *Dialer) Bind(ctx context.Context, addr string) (*Binding, error) {
+	peer, err := ParseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, bound, err := d.request(ctx, Bind, peer)
+	if err != nil {
+		return nil, err
+	}
+	return &Binding{Addr: bound, conn: conn}, nil
+}
+
+// ListenPacket asks the proxy for a UDP association, and returns a
+// PacketConn that sends and receives datagrams through it
+func (d *Dialer) ListenPacket(ctx context.Context) (*PacketConn, error) {
+	conn, relay, err := d.request(ctx, Associate, &Addr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, err
+	}
+	// a proxy listening on every address sends a zero ip
+	if relay.IP == nil || relay.IP.IsUnspecified() {
+		relay.IP = addrFrom(conn.RemoteAddr()).IP
+	}
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p := &PacketConn{
+		pc:    pc,
+		ctrl:  conn,
+		relay: &net.UDPAddr{IP: relay.IP, Port: relay.Port},
+	}
+	// the proxy ends the association by closing the control connection
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		p.Close()
+	}()
+	return p, nil
+}
+
+// request connects to the proxy, authenticates and sends a request,
+// returning the connection and the address in the reply
+func (d *Dialer) request(ctx context.Context, cmd Command, dest *Addr) (net.Conn, *Addr, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	var nd net.Dialer
+	conn, err := nd.DialContext(ctx, "tcp", d.ProxyAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	// a context that ends mid handshake unblocks it through the deadline
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	bound, err := d.handshake(conn, cmd, dest)
+	close(stop)
+	<-stopped
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, bound, nil
+}
+
+func (d *Dialer) handshake(conn net.Conn, cmd Command, dest *Addr) (*Addr, error) {
+	method := byte(methodNoAuth)
+	if d.Username != "" {
+		method = methodUserPass
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return nil, err
+	}
+	var buf [2]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		return nil, err
+	}
+	if buf[0] != socks5Version {
+		return nil, ErrVersion
+	}
+	if buf[1] != method {
+		return nil, ErrAuth
+	}
+	if method == methodUserPass {
+		if len(d.Username) > 255 || len(d.Password) > 255 {
+			return nil, errors.New("socks5: user name or password too long")
+		}
+		b := append([]byte{authVersion, byte(len(d.Username))}, d.Username...)
+		b = append(append(b, byte(len(d.Password))), d.Password...)
+		if _, err := conn.Write(b); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, buf[:]); err != nil {
+			return nil, err
+		}
+		if buf[1] != 0 {
+			return nil, ErrAuth
+		}
+	}
+	if err := writeRequest(conn, byte(cmd), dest); err != nil {
+		return nil, err
+	}
+	return readReply(conn)
+}
+
+// readReply reads a reply, turning a failure into its Reply error
+func readReply(r io.Reader) (*Addr, error) {
+	rep, addr, err := readRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	if Reply(rep) != Succeeded {
+		return nil, Reply(rep)
+	}
+	return addr, nil
+}
+
+// Binding is a connection the proxy is waiting for, started by Bind
+type Binding struct {
+	Addr *Addr // the address the proxy is listening on, for the peer
+	conn net.Conn
+}
+
+// Accept waits for the peer to connect to the proxy, and returns the
+// connection to it along with the peer's address. It can only be called
+// once.
+func (b *Binding) Accept() (net.Conn, *Addr, error) {
+	peer, err := readReply(b.conn)
+	if err != nil {
+		b.conn.Close()
+		return nil, nil, err
+	}
+	return b.conn, peer, nil
+}
+
+// Close gives up on the binding
+func (b *Binding) Close() error {
+	return b.conn.Close()
+}
+
+// PacketConn sends and receives datagrams through a UDP association. It
+// is a net.PacketConn. The addresses from ReadFrom are *net.UDPAddr for
+// ip addresses and *Addr for names, and WriteTo takes either.
+type PacketConn struct {
+	pc    *net.UDPConn
+	ctrl  net.Conn // the control connection the association lasts for
+	relay *net.UDPAddr
+	once  sync.Once
+}
+
+// ReadFrom reads a datagram, returning the address it came from
+func (p *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(b)+262)
+	for {
+		n, from, err := p.pc.ReadFromUDP(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !from.IP.Equal(p.relay.IP) || from.Port != p.relay.Port {
+			continue
+		}
+		addr, data, err := parseUDP(buf[:n])
+		if err != nil {
+			continue
+		}
+		n = copy(b, data)
+		if addr.Name != "" {
+			return n, addr, nil
+		}
+		return n, &net.UDPAddr{IP: addr.IP, Port: addr.Port}, nil
+	}
+}
+
+// WriteTo sends b to addr through the proxy
+func (p *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	pkt := appendUDPHeader(make([]byte, 0, len(b)+262), addrFrom(addr))
+	if _, err := p.pc.WriteToUDP(append(pkt, b...), p.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read reads a datagram, dropping the address it came from
+func (p *PacketConn) Read(b []byte) (int, error) {
+	n, _, err := p.ReadFrom(b)
+	return n, err
+}
+
+// Close ends the association
+func (p *PacketConn) Close() error {
+	var err error
+	p.once.Do(func() {
+		p.ctrl.Close()
+		err = p.pc.Close()
+	})
+	return err
+}
+
+// LocalAddr returns the local address datagrams are sent from
+func (p *PacketConn) LocalAddr() net.Addr {
+	return p.pc.LocalAddr()
+}
+
+// SetDeadline sets the read and write deadlines
+func (p *PacketConn) SetDeadline(t time.Time) error {
+	return p.pc.SetDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for ReadFrom
+func (p *PacketConn) SetReadDeadline(t time.Time) error {
+	return p.pc.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for WriteTo
+func (p *PacketConn) SetWriteDeadline(t time.Time) error {
+	return p.pc.SetWriteDeadline(t)
+}
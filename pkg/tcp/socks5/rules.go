@@ -0,0 +1,97 @@
+package socks5
+
+import (
+	"crypto/subtle"
+	"github.com/scottcagno/net-tools/pkg/tcp/netutil"
+	"net"
+)
+
+// Request is a SOCKS request, as passed to a Rule. Domain names in Dest
+// are resolved before the rules see them, so both Dest.Name and Dest.IP
+// are set, and Dest.IP is the address that will be used.
+//
+// For a connect Dest is the destination, and for a bind it is the peer
+// expected to connect in. The rules are checked for every datagram of a
+// UDP associate, with Dest the datagram's destination.
+type Request struct {
+	Command Command
+	Dest    *Addr
+	Client  net.Addr // the client's address
+	User    string   // the authenticated user name, empty without auth
+}
+
+// Rule decides whether a request may go ahead
+type Rule interface {
+	Allow(req *Request) bool
+}
+
+// RuleFunc adapts a function to a Rule
+type RuleFunc func(req *Request) bool
+
+// Allow calls f(req)
+func (f RuleFunc) Allow(req *Request) bool {
+	return f(req)
+}
+
+// PermitAll allows every request
+var PermitAll Rule = RuleFunc(func(*Request) bool { return true })
+
+// PermitCommands only allows the given commands
+func PermitCommands(cmds ...Command) Rule {
+	return RuleFunc(func(req *Request) bool {
+		for _, cmd := range cmds {
+			if req.Command == cmd {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// All allows a request only if every one of rules does
+func All(rules ...Rule) Rule {
+	return RuleFunc(func(req *Request) bool {
+		for _, rule := range rules {
+			if !rule.Allow(req) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// DestRule is a Rule that allows or denies requests by their
+// destination, using the entries described at netutil.NewDestRule
+type DestRule struct {
+	rule *netutil.DestRule
+}
+
+// NewDestRule returns a DestRule for the allow and deny entries
+func NewDestRule(allow, deny []string) (*DestRule, error) {
+	rule, err := netutil.NewDestRule(allow, deny)
+	if err != nil {
+		return nil, err
+	}
+	return &DestRule{rule: rule}, nil
+}
+
+// Allow reports whether the rule allows req
+func (r *DestRule) Allow(req *Request) bool {
+	return r.rule.Allow(req.Dest.Name, req.Dest.IP, req.Dest.Port)
+}
+
+// Credentials checks the user name and password sent by a client
+type Credentials interface {
+	Valid(user, password string) bool
+}
+
+// StaticCredentials maps user names to their passwords
+type StaticCredentials map[string]string
+
+// Valid reports whether password is the password for user
+func (c StaticCredentials) Valid(user, password string) bool {
+	want, ok := c[user]
+	// compare anyway, so a bad user name takes as long as a bad password
+	eq := subtle.ConstantTimeCompare([]byte(want), []byte(password)) == 1
+	return ok && eq
+}
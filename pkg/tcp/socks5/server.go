@@ -0,0 +1,456 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/tcp/netutil"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultDialTimeout is the longest a server waits to connect to a
+	// destination
+	DefaultDialTimeout = 10 * time.Second
+	// DefaultBindTimeout is the longest a bind waits for its incoming
+	// connection
+	DefaultBindTimeout = 2 * time.Minute
+	// DefaultHandshakeTimeout is the longest a client has to send its
+	// auth and request
+	DefaultHandshakeTimeout = 10 * time.Second
+)
+
+// Config holds the settings for a Server. The tags let it be filled in
+// by pkg/config.
+type Config struct {
+	Users       []string      `config:"users" usage:"user:password pairs allowed to use the proxy, no auth if empty"`
+	Allow       []string      `config:"allow" usage:"destinations to allow: ips, cidrs, host names, *.domains or *, each with an optional :port or :lo-hi, any if empty"`
+	Deny        []string      `config:"deny" usage:"destinations to deny, in the same form as allow"`
+	DialTimeout time.Duration `config:"dial-timeout" default:"10s" usage:"max duration to connect to a destination"`
+	BindTimeout time.Duration `config:"bind-timeout" default:"2m" usage:"max duration a bind waits for its incoming connection"`
+}
+
+// Server is an RFC 1928 SOCKS5 proxy, supporting the connect, bind and
+// UDP associate commands. ServeConn is a server.Handler, so it can be
+// used with pkg/tcp/server and its middleware:
+//
+//	ps, err := socks5.NewServer(cfg.Socks)
+//	srv, err := server.NewServer(cfg.Server, ps.ServeConn)
+//
+// Clients must authenticate with a user name and password (RFC 1929) when
+// Credentials is set. Every tunnel is logged to TunnelLog once it closes,
+// with the bytes sent and received.
+type Server struct {
+	Credentials      Credentials   // user names and passwords, no auth if nil
+	Rules            Rule          // decides which requests go ahead, all of them if nil
+	Resolver         *net.Resolver // resolves destination names, net.DefaultResolver if nil
+	DialTimeout      time.Duration // DefaultDialTimeout if zero
+	BindTimeout      time.Duration // DefaultBindTimeout if zero
+	HandshakeTimeout time.Duration // DefaultHandshakeTimeout if zero
+	TunnelLog        *log.Logger   // logs every tunnel, log.Default() if nil
+	ErrorLog         *log.Logger   // logs failed and denied requests, log.Default() if nil
+
+	// Dial connects to destinations, a net.Dialer if nil
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// NewServer returns a new Server using the settings in cfg
+func NewServer(cfg Config) (*Server, error) {
+	s := &Server{
+		DialTimeout: cfg.DialTimeout,
+		BindTimeout: cfg.BindTimeout,
+	}
+	if len(cfg.Users) > 0 {
+		creds := make(StaticCredentials)
+		for _, u := range cfg.Users {
+			i := strings.Index(u, ":")
+			if i < 1 {
+				return nil, fmt.Errorf("socks5: bad user %q, want user:password", u)
+			}
+			creds[u[:i]] = u[i+1:]
+		}
+		s.Credentials = creds
+	}
+	if len(cfg.Allow) > 0 || len(cfg.Deny) > 0 {
+		rule, err := NewDestRule(cfg.Allow, cfg.Deny)
+		if err != nil {
+			return nil, err
+		}
+		s.Rules = rule
+	}
+	return s, nil
+}
+
+// ServeConn serves a single client connection, for as long as its tunnel
+// or association lasts
+func (s *Server) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	timeout := s.HandshakeTimeout
+	if timeout == 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	r := bufio.NewReader(conn)
+	user, err := s.authenticate(r, conn)
+	if err != nil {
+		if err != io.EOF {
+			s.logf("socks5: %s: %v", conn.RemoteAddr(), err)
+		}
+		return
+	}
+	cmd, dest, err := readRequest(r)
+	if err == ErrAddrType {
+		writeRequest(conn, byte(AddressNotSupported), nil)
+		return
+	}
+	if err != nil {
+		if err != io.EOF {
+			s.logf("socks5: %s: reading request: %v", conn.RemoteAddr(), err)
+		}
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	req := &Request{Command: Command(cmd), Dest: dest, Client: conn.RemoteAddr(), User: user}
+	switch req.Command {
+	case Connect:
+		s.connect(req, conn, r)
+	case Bind:
+		s.bind(req, conn, r)
+	case Associate:
+		s.associate(req, conn, r)
+	default:
+		writeRequest(conn, byte(CommandNotSupported), nil)
+	}
+}
+
+// authenticate runs the method negotiation, and the user name and
+// password sub negotiation when there are Credentials. It returns the
+// user name.
+func (s *Server) authenticate(r *bufio.Reader, w io.Writer) (string, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return "", err
+	}
+	if head[0] != socks5Version {
+		return "", ErrVersion
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", err
+	}
+	want := byte(methodNoAuth)
+	if s.Credentials != nil {
+		want = methodUserPass
+	}
+	if !hasMethod(methods, want) {
+		w.Write([]byte{socks5Version, methodNoAcceptable})
+		return "", errors.New("no acceptable auth method")
+	}
+	if _, err := w.Write([]byte{socks5Version, want}); err != nil {
+		return "", err
+	}
+	if want == methodNoAuth {
+		return "", nil
+	}
+	// VER ULEN UNAME PLEN PASSWD
+	var buf [256]byte
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != authVersion {
+		return "", fmt.Errorf("bad auth version %d", buf[0])
+	}
+	n := buf[1]
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return "", err
+	}
+	user := string(buf[:n])
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return "", err
+	}
+	n = buf[0]
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return "", err
+	}
+	password := string(buf[:n])
+	if !s.Credentials.Valid(user, password) {
+		w.Write([]byte{authVersion, 1})
+		return "", fmt.Errorf("bad password for user %q", user)
+	}
+	_, err := w.Write([]byte{authVersion, 0})
+	return user, err
+}
+
+func hasMethod(methods []byte, m byte) bool {
+	for _, b := range methods {
+		if b == m {
+			return true
+		}
+	}
+	return false
+}
+
+// check resolves the destination of req and runs the rules on it,
+// returning the reply to send if the request can't go ahead
+func (s *Server) check(ctx context.Context, req *Request) Reply {
+	if req.Dest.Name != "" && req.Dest.IP == nil {
+		resolver := s.Resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		ips, err := resolver.LookupIPAddr(ctx, req.Dest.Name)
+		if err != nil || len(ips) == 0 {
+			s.logf("socks5: %s: resolving %s: %v", req.Client, req.Dest.Name, err)
+			return HostUnreachable
+		}
+		req.Dest.IP = ips[0].IP
+	}
+	if s.Rules != nil && !s.Rules.Allow(req) {
+		s.logf("socks5: %s: %s to %s denied", req.Client, req.Command, req.Dest)
+		return NotAllowed
+	}
+	return Succeeded
+}
+
+func (s *Server) connect(req *Request, conn net.Conn, r io.Reader) {
+	timeout := s.DialTimeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if rep := s.check(ctx, req); rep != Succeeded {
+		writeRequest(conn, byte(rep), nil)
+		return
+	}
+	dial := s.Dial
+	if dial == nil {
+		dial = new(net.Dialer).DialContext
+	}
+	out, err := dial(ctx, "tcp", req.Dest.dialString())
+	if err != nil {
+		s.logf("socks5: %s: connect to %s: %v", req.Client, req.Dest, err)
+		writeRequest(conn, byte(replyFor(err)), nil)
+		return
+	}
+	defer out.Close()
+	if err := writeRequest(conn, byte(Succeeded), addrFrom(out.LocalAddr())); err != nil {
+		return
+	}
+	s.tunnel(req, conn, r, out)
+}
+
+func (s *Server) bind(req *Request, conn net.Conn, r io.Reader) {
+	if rep := s.check(context.Background(), req); rep != Succeeded {
+		writeRequest(conn, byte(rep), nil)
+		return
+	}
+	// listen on the address the client reached us on
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: addrFrom(conn.LocalAddr()).IP})
+	if err != nil {
+		s.logf("socks5: %s: bind: %v", req.Client, err)
+		writeRequest(conn, byte(GeneralFailure), nil)
+		return
+	}
+	defer ln.Close()
+	if err := writeRequest(conn, byte(Succeeded), addrFrom(ln.Addr())); err != nil {
+		return
+	}
+	timeout := s.BindTimeout
+	if timeout == 0 {
+		timeout = DefaultBindTimeout
+	}
+	ln.SetDeadline(time.Now().Add(timeout))
+	var in net.Conn
+	for {
+		in, err = ln.Accept()
+		if err != nil {
+			s.logf("socks5: %s: bind: %v", req.Client, err)
+			writeRequest(conn, byte(replyFor(err)), nil)
+			return
+		}
+		// only the expected peer may connect, if the client named one
+		ip := addrFrom(in.RemoteAddr()).IP
+		if req.Dest.IP.IsUnspecified() || req.Dest.IP.Equal(ip) {
+			break
+		}
+		s.logf("socks5: %s: bind: unexpected peer %s", req.Client, in.RemoteAddr())
+		in.Close()
+	}
+	ln.Close()
+	defer in.Close()
+	if err := writeRequest(conn, byte(Succeeded), addrFrom(in.RemoteAddr())); err != nil {
+		return
+	}
+	s.tunnel(req, conn, r, in)
+}
+
+// tunnel copies between the client and out until both sides are done,
+// passing on a close of either side's write half to the other, then logs
+// the tunnel
+func (s *Server) tunnel(req *Request, conn net.Conn, r io.Reader, out net.Conn) {
+	start := time.Now()
+	var received int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var err error
+		received, err = io.Copy(conn, out)
+		if err != nil {
+			out.Close()
+			conn.Close()
+			return
+		}
+		if !netutil.CloseWrite(conn) {
+			conn.Close()
+		}
+	}()
+	sent, err := io.Copy(out, r)
+	if err != nil {
+		out.Close()
+		conn.Close()
+	} else if !netutil.CloseWrite(out) {
+		out.Close()
+	}
+	<-done
+	s.tunnelf(req, out.RemoteAddr(), sent, received, start)
+}
+
+func (s *Server) associate(req *Request, conn net.Conn, r io.Reader) {
+	local := addrFrom(conn.LocalAddr()).IP
+	client := addrFrom(conn.RemoteAddr())
+	// relay faces the client, and out faces the destinations
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local})
+	if err != nil {
+		s.logf("socks5: %s: associate: %v", req.Client, err)
+		writeRequest(conn, byte(GeneralFailure), nil)
+		return
+	}
+	defer relay.Close()
+	out, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		s.logf("socks5: %s: associate: %v", req.Client, err)
+		writeRequest(conn, byte(GeneralFailure), nil)
+		return
+	}
+	defer out.Close()
+	if err := writeRequest(conn, byte(Succeeded), addrFrom(relay.LocalAddr())); err != nil {
+		return
+	}
+	// the association lasts as long as the control connection
+	go func() {
+		io.Copy(ioutil.Discard, r)
+		relay.Close()
+		out.Close()
+	}()
+
+	start := time.Now()
+	var (
+		mu       sync.Mutex
+		clientTo *net.UDPAddr        // where the client sends from
+		peers    = map[string]bool{} // destinations the client has sent to
+		sent     int64
+		received int64
+		wg       sync.WaitGroup
+	)
+	wg.Add(1)
+	go func() {
+		// replies from destinations, wrapped and passed to the client
+		defer wg.Done()
+		buf := make([]byte, 64<<10)
+		for {
+			n, from, err := out.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			to, ok := clientTo, peers[from.String()]
+			mu.Unlock()
+			if !ok || to == nil {
+				continue
+			}
+			pkt := appendUDPHeader(make([]byte, 0, n+22), addrFrom(from))
+			if _, err := relay.WriteToUDP(append(pkt, buf[:n]...), to); err == nil {
+				atomic.AddInt64(&received, int64(n))
+			}
+		}
+	}()
+	buf := make([]byte, 64<<10)
+	for {
+		n, from, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+		// datagrams are only taken from the client, and from the port it
+		// said it would use, if it said
+		if !from.IP.Equal(client.IP) || (req.Dest.Port != 0 && from.Port != req.Dest.Port) {
+			continue
+		}
+		dest, data, err := parseUDP(buf[:n])
+		if err != nil {
+			continue
+		}
+		dreq := &Request{Command: Associate, Dest: dest, Client: req.Client, User: req.User}
+		if s.check(context.Background(), dreq) != Succeeded {
+			continue
+		}
+		to := &net.UDPAddr{IP: dest.IP, Port: dest.Port}
+		mu.Lock()
+		clientTo = from
+		peers[to.String()] = true
+		mu.Unlock()
+		if _, err := out.WriteToUDP(data, to); err == nil {
+			atomic.AddInt64(&sent, int64(len(data)))
+		}
+	}
+	out.Close()
+	wg.Wait()
+	s.tunnelf(req, relay.LocalAddr(), sent, received, start)
+}
+
+// replyFor returns the reply for a failed dial or accept
+func replyFor(err error) Reply {
+	var ne net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return NetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return HostUnreachable
+	case errors.As(err, &ne) && ne.Timeout():
+		return TTLExpired
+	}
+	return GeneralFailure
+}
+
+func (s *Server) tunnelf(req *Request, via net.Addr, sent, received int64, start time.Time) {
+	logger := s.TunnelLog
+	if logger == nil {
+		logger = log.Default()
+	}
+	user := req.User
+	if user == "" {
+		user = "-"
+	}
+	logger.Printf("TUNNEL: %s %s %q -> %s via %s, sent %d bytes, received %d bytes in %v\n",
+		req.Command, user, req.Client, req.Dest, via, sent, received,
+		time.Since(start).Round(time.Millisecond))
+}
+
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
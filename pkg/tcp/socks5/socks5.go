@@ -0,0 +1,271 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	socks5Version = 5
+	// authVersion is the version of the RFC 1929 user name and password
+	// sub negotiation
+	authVersion = 1
+)
+
+// authentication methods
+const (
+	methodNoAuth       = 0x00
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xff
+)
+
+// address types
+const (
+	atypIPv4   = 1
+	atypDomain = 3
+	atypIPv6   = 4
+)
+
+var (
+	// ErrVersion is returned when the other side doesn't speak SOCKS5
+	ErrVersion = errors.New("socks5: unsupported version")
+	// ErrAddrType is returned for an address of an unknown type
+	ErrAddrType = errors.New("socks5: unsupported address type")
+	// ErrAuth is returned by a Dialer when the proxy won't accept any of
+	// the auth methods it offered, or rejects the user name and password
+	ErrAuth = errors.New("socks5: authentication failed")
+)
+
+// Command is the command of a SOCKS request
+type Command byte
+
+const (
+	Connect   Command = 1
+	Bind      Command = 2
+	Associate Command = 3
+)
+
+func (c Command) String() string {
+	switch c {
+	case Connect:
+		return "connect"
+	case Bind:
+		return "bind"
+	case Associate:
+		return "associate"
+	}
+	return "command(" + strconv.Itoa(int(c)) + ")"
+}
+
+// Reply is the status code of a reply to a SOCKS request. A Reply other
+// than Succeeded is also the error a Dialer returns for it.
+type Reply byte
+
+const (
+	Succeeded Reply = iota
+	GeneralFailure
+	NotAllowed
+	NetworkUnreachable
+	HostUnreachable
+	ConnectionRefused
+	TTLExpired
+	CommandNotSupported
+	AddressNotSupported
+)
+
+var replyText = []string{
+	"succeeded",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+func (r Reply) String() string {
+	if int(r) < len(replyText) {
+		return replyText[r]
+	}
+	return "reply(" + strconv.Itoa(int(r)) + ")"
+}
+
+func (r Reply) Error() string {
+	return "socks5: " + r.String()
+}
+
+// Addr is a SOCKS address, an ip address or a domain name and a port. It
+// is a net.Addr, so it can be returned from a PacketConn.
+type Addr struct {
+	Name string // domain name, empty for an ip address
+	IP   net.IP // the ip address, or what Name resolved to
+	Port int
+}
+
+// ParseAddr parses a host:port address. Hosts that are not ip addresses
+// are taken as domain names.
+func ParseAddr(s string) (*Addr, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 0xffff {
+		return nil, fmt.Errorf("socks5: bad port in %q", s)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &Addr{IP: ip, Port: p}, nil
+	}
+	if len(host) == 0 || len(host) > 255 {
+		return nil, fmt.Errorf("socks5: bad host in %q", s)
+	}
+	return &Addr{Name: host, Port: p}, nil
+}
+
+// addrFrom converts a tcp or udp address to an Addr
+func addrFrom(addr net.Addr) *Addr {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return &Addr{IP: a.IP, Port: a.Port}
+	case *net.UDPAddr:
+		return &Addr{IP: a.IP, Port: a.Port}
+	case *Addr:
+		return a
+	}
+	if addr != nil {
+		if a, err := ParseAddr(addr.String()); err == nil {
+			return a
+		}
+	}
+	return &Addr{IP: net.IPv4zero}
+}
+
+// Network returns "socks5"
+func (a *Addr) Network() string {
+	return "socks5"
+}
+
+// String returns the address as host:port, using Name if it is set
+func (a *Addr) String() string {
+	host := a.Name
+	if host == "" {
+		host = a.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(a.Port))
+}
+
+// dialString returns the address to dial, the ip if there is one
+func (a *Addr) dialString() string {
+	if a.IP == nil {
+		return a.String()
+	}
+	return net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port))
+}
+
+// appendAddr appends the wire form of a to b, ATYP first. An address
+// without a Name or an IP is sent as 0.0.0.0.
+func appendAddr(b []byte, a *Addr) []byte {
+	switch {
+	case a.Name != "":
+		b = append(b, atypDomain, byte(len(a.Name)))
+		b = append(b, a.Name...)
+	case a.IP.To4() != nil:
+		b = append(b, atypIPv4)
+		b = append(b, a.IP.To4()...)
+	case a.IP != nil:
+		b = append(b, atypIPv6)
+		b = append(b, a.IP.To16()...)
+	default:
+		b = append(b, atypIPv4, 0, 0, 0, 0)
+	}
+	return append(b, byte(a.Port>>8), byte(a.Port))
+}
+
+// readAddr reads an address in wire form, ATYP first
+func readAddr(r io.Reader) (*Addr, error) {
+	var buf [256]byte
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return nil, err
+	}
+	a := new(Addr)
+	switch buf[0] {
+	case atypIPv4, atypIPv6:
+		n := net.IPv4len
+		if buf[0] == atypIPv6 {
+			n = net.IPv6len
+		}
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return nil, err
+		}
+		a.IP = append(net.IP(nil), buf[:n]...)
+	case atypDomain:
+		if _, err := io.ReadFull(r, buf[:1]); err != nil {
+			return nil, err
+		}
+		n := int(buf[0])
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return nil, err
+		}
+		a.Name = string(buf[:n])
+	default:
+		return nil, ErrAddrType
+	}
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return nil, err
+	}
+	a.Port = int(buf[0])<<8 | int(buf[1])
+	return a, nil
+}
+
+// readRequest reads a request, or a reply, as they share a layout:
+// VER CMD|REP RSV ADDR
+func readRequest(r io.Reader) (byte, *Addr, error) {
+	var head [3]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	if head[0] != socks5Version {
+		return 0, nil, ErrVersion
+	}
+	addr, err := readAddr(r)
+	return head[1], addr, err
+}
+
+// writeRequest writes a request, or a reply with a nil addr meaning
+// 0.0.0.0:0
+func writeRequest(w io.Writer, code byte, addr *Addr) error {
+	if addr == nil {
+		addr = &Addr{}
+	}
+	_, err := w.Write(appendAddr([]byte{socks5Version, code, 0}, addr))
+	return err
+}
+
+// appendUDPHeader appends the header of a relayed datagram to b:
+// RSV RSV FRAG ADDR
+func appendUDPHeader(b []byte, addr *Addr) []byte {
+	return appendAddr(append(b, 0, 0, 0), addr)
+}
+
+// parseUDP splits a relayed datagram into its destination and data.
+// Fragments are not supported, so a datagram with a FRAG set is an error.
+func parseUDP(b []byte) (*Addr, []byte, error) {
+	if len(b) < 3 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	if b[2] != 0 {
+		return nil, nil, errors.New("socks5: fragmented datagram")
+	}
+	r := bytes.NewReader(b[3:])
+	addr, err := readAddr(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return addr, b[len(b)-r.Len():], nil
+}
@@ -0,0 +1,525 @@
+package socks5_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/tcp/server"
+	"github.com/scottcagno/net-tools/pkg/tcp/socks5"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var quiet = log.New(ioutil.Discard, "", 0)
+
+// syncBuffer collects log output from many goroutines
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.b.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.b.String()
+}
+
+// proxy is a socks5 server on a loopback port
+type proxy struct {
+	addr    string
+	tunnels *syncBuffer
+	srv     *server.Server
+}
+
+func startProxy(ps *socks5.Server) (*proxy, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &proxy{addr: ln.Addr().String(), tunnels: new(syncBuffer)}
+	ps.TunnelLog = log.New(p.tunnels, "", 0)
+	ps.ErrorLog = quiet
+	p.srv = &server.Server{Handler: ps.ServeConn, ErrorLog: quiet}
+	go p.srv.Serve(ln)
+	return p, nil
+}
+
+// waitLog waits for the tunnel log to contain s, as it is written once
+// the tunnel has closed on the proxy's side
+func (p *proxy) waitLog(s string) error {
+	for i := 0; i < 100; i++ {
+		if strings.Contains(p.tunnels.String(), s) {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("tunnel log %q doesn't have %q", p.tunnels.String(), s)
+}
+
+// echoServer echoes on tcp until the client closes its write side, then
+// closes
+func echoServer() (net.Listener, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln, nil
+}
+
+// roundTrip sends msg on conn, closes the write side and reads to EOF
+func roundTrip(conn net.Conn, msg string) (string, error) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return "", err
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	b, err := ioutil.ReadAll(conn)
+	return string(b), err
+}
+
+func TestDestRules(t *testing.T) {
+	rule, err := socks5.NewDestRule(
+		[]string{"10.0.0.0/8", "*.internal", "example.com:80", "[::1]:8000-8999"},
+		[]string{"10.1.0.0/16", "secret.internal", "*:25"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		dest  string
+		name  string // set to resolve dest by this name
+		allow bool
+	}{
+		{"10.2.3.4:22", "", true},
+		{"10.1.3.4:22", "", false},
+		{"10.2.3.4:25", "", false},
+		{"192.168.1.1:80", "", false},
+		{"10.2.3.4:80", "db.internal", true},
+		{"10.2.3.4:80", "secret.internal", false},
+		{"192.168.1.1:80", "a.b.internal", true},
+		{"192.168.1.1:80", "internal", true},
+		{"192.168.1.1:80", "notinternal", false},
+		{"192.168.1.1:80", "EXAMPLE.com.", true},
+		{"192.168.1.1:443", "example.com", false},
+		// a name resolving into a denied range is denied
+		{"10.1.0.1:80", "db.internal", false},
+		{"[::1]:8080", "", true},
+		{"[::1]:9000", "", false},
+	}
+	for _, tt := range tests {
+		dest, err := socks5.ParseAddr(tt.dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dest.Name = tt.name
+		if got := rule.Allow(&socks5.Request{Command: socks5.Connect, Dest: dest}); got != tt.allow {
+			t.Fatalf("%s (%s): allowed %v, want %v", tt.dest, tt.name, got, tt.allow)
+		}
+	}
+	for _, bad := range []string{"10.0.0.0/33", "host:0", "host:9-2", "[::1", "a*b", "host:x"} {
+		if _, err := socks5.NewDestRule([]string{bad}, nil); err == nil {
+			t.Fatalf("rule %q parsed", bad)
+		}
+	}
+	cmds := socks5.All(rule, socks5.PermitCommands(socks5.Connect))
+	dest, _ := socks5.ParseAddr("10.2.3.4:22")
+	if cmds.Allow(&socks5.Request{Command: socks5.Bind, Dest: dest}) {
+		t.Fatalf("bind allowed by PermitCommands(Connect)")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	if _, err := socks5.NewServer(socks5.Config{Users: []string{"nopassword"}}); err == nil {
+		t.Fatalf("user without a password accepted")
+	}
+	if _, err := socks5.NewServer(socks5.Config{Deny: []string{"10.0.0.0/99"}}); err == nil {
+		t.Fatalf("bad deny rule accepted")
+	}
+	s, err := socks5.NewServer(socks5.Config{Users: []string{"bob:pa:ss"}, Allow: []string{"*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Credentials.Valid("bob", "pa:ss") || s.Credentials.Valid("bob", "pa") || s.Rules == nil {
+		t.Fatalf("config not applied")
+	}
+}
+
+func TestConnect(t *testing.T) {
+	echo, err := echoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	p, err := startProxy(&socks5.Server{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.srv.Close()
+	d := &socks5.Dialer{ProxyAddr: p.addr, Timeout: 5 * time.Second}
+	conn, err := d.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the half close has to make it through the proxy for this to end
+	got, err := roundTrip(conn, "hello, world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "hello, world" {
+		t.Fatalf("echo %q", got)
+	}
+	if err := p.waitLog("connect - "); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnectByName(t *testing.T) {
+	echo, err := echoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	p, err := startProxy(&socks5.Server{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.srv.Close()
+	port := strconv.Itoa(echo.Addr().(*net.TCPAddr).Port)
+	d := &socks5.Dialer{ProxyAddr: p.addr, Timeout: 5 * time.Second}
+	conn, err := d.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msg := strings.Repeat("x", 100000)
+	got, err := roundTrip(conn, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != msg {
+		t.Fatalf("echoed %d bytes, want %d", len(got), len(msg))
+	}
+	if err := p.waitLog("-> localhost:" + port + " via 127.0.0.1:" + port + ", sent 100000 bytes, received 100000 bytes"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRefused(t *testing.T) {
+	// find a port with nothing on it
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	p, err := startProxy(&socks5.Server{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.srv.Close()
+	d := &socks5.Dialer{ProxyAddr: p.addr, Timeout: 5 * time.Second}
+	if _, err := d.Dial("tcp", addr); err != socks5.ConnectionRefused {
+		t.Fatalf("got %v, want %v", err, socks5.ConnectionRefused)
+	}
+	if _, err := d.Dial("tcp", "no-such-host.invalid:80"); err != socks5.HostUnreachable {
+		t.Fatalf("got %v, want %v", err, socks5.HostUnreachable)
+	}
+}
+
+func TestUserPass(t *testing.T) {
+	echo, err := echoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	p, err := startProxy(&socks5.Server{Credentials: socks5.StaticCredentials{"alice": "s3cret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.srv.Close()
+	for _, d := range []*socks5.Dialer{
+		{ProxyAddr: p.addr},
+		{ProxyAddr: p.addr, Username: "alice", Password: "wrong"},
+		{ProxyAddr: p.addr, Username: "mallory", Password: "s3cret"},
+	} {
+		if _, err := d.Dial("tcp", echo.Addr().String()); err != socks5.ErrAuth {
+			t.Fatalf("user %q: got %v, want %v", d.Username, err, socks5.ErrAuth)
+		}
+	}
+	d := &socks5.Dialer{ProxyAddr: p.addr, Username: "alice", Password: "s3cret"}
+	conn, err := d.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got, err := roundTrip(conn, "hi"); err != nil || got != "hi" {
+		t.Fatalf("echo %q, %v", got, err)
+	}
+	if err := p.waitLog("connect alice "); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDenied(t *testing.T) {
+	echo, err := echoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	port := strconv.Itoa(echo.Addr().(*net.TCPAddr).Port)
+	rule, err := socks5.NewDestRule(nil, []string{"127.0.0.1:" + port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := startProxy(&socks5.Server{Rules: rule})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.srv.Close()
+	d := &socks5.Dialer{ProxyAddr: p.addr, Timeout: 5 * time.Second}
+	// by ip, and by a name resolving to it
+	for _, addr := range []string{"127.0.0.1:" + port, "localhost:" + port} {
+		if _, err := d.Dial("tcp", addr); err != socks5.NotAllowed {
+			t.Fatalf("%s: got %v, want %v", addr, err, socks5.NotAllowed)
+		}
+	}
+}
+
+func TestBind(t *testing.T) {
+	p, err := startProxy(&socks5.Server{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.srv.Close()
+	d := &socks5.Dialer{ProxyAddr: p.addr, Timeout: 5 * time.Second}
+	b, err := d.Bind(context.Background(), "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	// the peer connects to the address the proxy listens on, and echoes
+	errc := make(chan error, 1)
+	go func() {
+		peer, err := net.Dial("tcp", b.Addr.String())
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer peer.Close()
+		_, err = io.Copy(peer, peer)
+		errc <- err
+	}()
+	conn, from, err := b.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !from.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("peer address %s", from)
+	}
+	got, err := roundTrip(conn, "through the back door")
+	if err != nil || got != "through the back door" {
+		t.Fatalf("echo %q, %v", got, err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if err := p.waitLog("bind - "); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBindWrongPeer(t *testing.T) {
+	p, err := startProxy(&socks5.Server{BindTimeout: 300 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.srv.Close()
+	d := &socks5.Dialer{ProxyAddr: p.addr, Timeout: 5 * time.Second}
+	b, err := d.Bind(context.Background(), "192.0.2.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	// this connection is not from the expected peer, so it is turned away
+	peer, err := net.Dial("tcp", b.Addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("wrong peer read %d, %v, want EOF", n, err)
+	}
+	if _, _, err := b.Accept(); err != socks5.TTLExpired {
+		t.Fatalf("accept: got %v, want %v", err, socks5.TTLExpired)
+	}
+}
+
+func TestAssociate(t *testing.T) {
+	// a udp echo server, and one that is denied
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 64<<10)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(append([]byte("echo: "), buf[:n]...), from)
+		}
+	}()
+	denied, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer denied.Close()
+	rule, err := socks5.NewDestRule(nil, []string{denied.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := startProxy(&socks5.Server{Rules: rule})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.srv.Close()
+	d := &socks5.Dialer{ProxyAddr: p.addr, Timeout: 5 * time.Second}
+	pc, err := d.ListenPacket(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	for i := 0; i < 3; i++ {
+		msg := "packet " + strconv.Itoa(i)
+		if _, err := pc.WriteTo([]byte(msg), echo.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "echo: "+msg || from.String() != echo.LocalAddr().String() {
+			t.Fatalf("got %q from %s", buf[:n], from)
+		}
+	}
+	// a datagram to the denied address is dropped
+	pc.WriteTo([]byte("psst"), denied.LocalAddr())
+	denied.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, _, err := denied.ReadFrom(buf); err == nil {
+		t.Fatalf("denied destination got %q", buf[:n])
+	}
+	// closing the control connection ends the association
+	pc.Close()
+	if err := p.waitLog("associate - "); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBadRequests(t *testing.T) {
+	p, err := startProxy(&socks5.Server{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.srv.Close()
+	tests := []struct {
+		name string
+		req  []byte
+		want []byte
+	}{
+		{"socks4", []byte{4, 1, 0, 80, 127, 0, 0, 1, 0}, nil},
+		{"unknown command", []byte{5, 1, 0, 5, 9, 0, 1, 127, 0, 0, 1, 0, 80}, []byte{5, 0, 5, byte(socks5.CommandNotSupported)}},
+		{"unknown address type", []byte{5, 1, 0, 5, 1, 0, 7}, []byte{5, 0, 5, byte(socks5.AddressNotSupported)}},
+		{"no auth method", []byte{5, 1, 2}, []byte{5, 0xff}},
+	}
+	for _, tt := range tests {
+		conn, err := net.Dial("tcp", p.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conn.Write(tt.req)
+		got, err := ioutil.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(got) > len(tt.want) {
+			got = got[:len(tt.want)]
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Fatalf("%s: got % x, want % x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	echo, err := echoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	p, err := startProxy(&socks5.Server{Credentials: socks5.StaticCredentials{"u": "p"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.srv.Close()
+	d := &socks5.Dialer{ProxyAddr: p.addr, Username: "u", Password: "p", Timeout: 5 * time.Second}
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := d.Dial("tcp", echo.Addr().String())
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			msg := strings.Repeat(strconv.Itoa(i), 5000)
+			if got, err := roundTrip(conn, msg); err != nil || got != msg {
+				errs <- errors.New("bad echo from " + strconv.Itoa(i))
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
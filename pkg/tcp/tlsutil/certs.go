@@ -0,0 +1,184 @@
+package tlsutil
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Pair is a certificate and its private key, PEM encoded
+type Pair struct {
+	Cert    *x509.Certificate
+	Key     crypto.Signer
+	CertPEM []byte
+	KeyPEM  []byte
+}
+
+// TLSCertificate returns the pair as a tls.Certificate
+func (p *Pair) TLSCertificate() (tls.Certificate, error) {
+	return tls.X509KeyPair(p.CertPEM, p.KeyPEM)
+}
+
+// WriteFiles writes the certificate and key out as PEM files. The key is
+// only readable by the owner.
+func (p *Pair) WriteFiles(certFile, keyFile string) error {
+	if err := writeFile(certFile, p.CertPEM, 0644); err != nil {
+		return err
+	}
+	return writeFile(keyFile, p.KeyPEM, 0600)
+}
+
+func writeFile(path string, b []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, perm)
+}
+
+// CA is a certificate authority for issuing certificates in tests and dev
+// environments. It is not meant for anything facing the internet.
+type CA struct {
+	Pair
+}
+
+// Pool returns a cert pool holding just the CA
+func (ca *CA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+	return pool
+}
+
+// GenerateCA creates a new self signed CA
+func GenerateCA(cn string, validFor time.Duration) (*CA, error) {
+	tmpl, err := template(cn, validFor)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.IsCA = true
+	tmpl.BasicConstraintsValid = true
+	tmpl.MaxPathLenZero = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	pair, err := issue(tmpl, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{Pair: *pair}, nil
+}
+
+// LoadCA loads a CA from PEM files, so it can issue more certificates
+func LoadCA(certFile, keyFile string) (*CA, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tc, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(tc.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !cert.IsCA {
+		return nil, errors.New("tlsutil: certificate is not a CA")
+	}
+	key, ok := tc.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("tlsutil: unsupported CA key type")
+	}
+	return &CA{Pair{Cert: cert, Key: key, CertPEM: certPEM, KeyPEM: keyPEM}}, nil
+}
+
+// IssueServer issues a server certificate for the given host names and
+// ip addresses
+func (ca *CA) IssueServer(cn string, hosts []string, validFor time.Duration) (*Pair, error) {
+	tmpl, err := template(cn, validFor)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	addHosts(tmpl, hosts)
+	return issue(tmpl, ca.Cert, ca.Key)
+}
+
+// IssueClient issues a client certificate, for mutual TLS. The cn is the
+// identity the server sees, hosts are added as SANs.
+func (ca *CA) IssueClient(cn string, hosts []string, validFor time.Duration) (*Pair, error) {
+	tmpl, err := template(cn, validFor)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	addHosts(tmpl, hosts)
+	return issue(tmpl, ca.Cert, ca.Key)
+}
+
+func template(cn string, validFor time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(validFor),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, nil
+}
+
+func addHosts(tmpl *x509.Certificate, hosts []string) {
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+}
+
+// issue creates a key and signs tmpl with the parent, or self signs it
+// if parent is nil
+func issue(tmpl, parent *x509.Certificate, parentKey crypto.Signer) (*Pair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Pair{
+		Cert:    cert,
+		Key:     key,
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyPEM:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+	}, nil
+}
@@ -0,0 +1,238 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrNotTLS is returned by PeerIdentity for a connection that is not TLS
+var ErrNotTLS = errors.New("tlsutil: not a tls connection")
+
+// Reloader serves a certificate and key from files, and picks up new
+// ones when the files change, so certificates can be rotated without a
+// restart. The files are checked at most once per CheckInterval.
+type Reloader struct {
+	CertFile      string
+	KeyFile       string
+	CheckInterval time.Duration // one second if zero
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// NewReloader loads the certificate and key, returning an error if they
+// can't be used
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{CertFile: certFile, KeyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the files again, right away. The old certificate is kept
+// if the new files can't be used.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reload()
+}
+
+func (r *Reloader) reload() error {
+	mod, err := r.newestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return fmt.Errorf("tlsutil: %v", err)
+	}
+	r.cert, r.modTime = &cert, mod
+	return nil
+}
+
+func (r *Reloader) newestModTime() (time.Time, error) {
+	var newest time.Time
+	for _, name := range []string{r.CertFile, r.KeyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(newest) {
+			newest = fi.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+// certificate returns the current certificate, reloading it first if
+// the files have changed
+func (r *Reloader) certificate() (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	every := r.CheckInterval
+	if every <= 0 {
+		every = time.Second
+	}
+	if r.cert != nil && time.Since(r.lastCheck) < every {
+		return r.cert, nil
+	}
+	r.lastCheck = time.Now()
+	mod, err := r.newestModTime()
+	if r.cert != nil && (err != nil || mod.Equal(r.modTime)) {
+		return r.cert, nil
+	}
+	// a half written pair fails to load, keep the old one until the
+	// next check
+	if err = r.reload(); err != nil && r.cert == nil {
+		return nil, err
+	}
+	return r.cert, nil
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.certificate()
+}
+
+// GetClientCertificate can be used as tls.Config.GetClientCertificate
+func (r *Reloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.certificate()
+}
+
+// LoadCertPool loads a bundle of PEM certificates, such as a CA file
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("tlsutil: no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// ServerConfig returns a tls.Config serving the certificate and key in
+// the given files, reloading them when they change. If clientCAFile is
+// set, clients must present a certificate signed by one of the CAs in it.
+func ServerConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+	if clientCAFile != "" {
+		pool, err := LoadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// ClientConfig returns a tls.Config that trusts the CAs in caFile (or the
+// system roots if it is empty), and presents the certificate and key in
+// the given files for mutual TLS, if they are set.
+func ClientConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+	if caFile != "" {
+		pool, err := LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		r, err := NewReloader(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = r.GetClientCertificate
+	}
+	return cfg, nil
+}
+
+// Identity is who is on the other end of a TLS connection, taken from
+// the certificate they presented
+type Identity struct {
+	CommonName  string
+	DNSNames    []string
+	IPAddresses []net.IP
+	Emails      []string
+	URIs        []string
+	Verified    bool              // the certificate chained to a trusted CA
+	Certificate *x509.Certificate // the leaf certificate
+}
+
+func (id *Identity) String() string {
+	if id.CommonName != "" {
+		return id.CommonName
+	}
+	if len(id.DNSNames) > 0 {
+		return id.DNSNames[0]
+	}
+	return "<unnamed>"
+}
+
+// PeerIdentity returns the identity of the other end of conn, doing the
+// handshake first if it hasn't happened yet. Wrappers that have an
+// Unwrap() net.Conn method, like the ones in pkg/tcp/server, are looked
+// through. It returns nil, nil for a TLS peer that sent no certificate.
+func PeerIdentity(conn net.Conn) (*Identity, error) {
+	tc, ok := TLSConn(conn)
+	if !ok {
+		return nil, ErrNotTLS
+	}
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	state := tc.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return nil, nil
+	}
+	cert := state.PeerCertificates[0]
+	id := &Identity{
+		CommonName:  cert.Subject.CommonName,
+		DNSNames:    cert.DNSNames,
+		IPAddresses: cert.IPAddresses,
+		Emails:      cert.EmailAddresses,
+		Verified:    len(state.VerifiedChains) > 0,
+		Certificate: cert,
+	}
+	for _, u := range cert.URIs {
+		id.URIs = append(id.URIs, u.String())
+	}
+	return id, nil
+}
+
+// TLSConn finds the *tls.Conn under any wrappers around conn
+func TLSConn(conn net.Conn) (*tls.Conn, bool) {
+	for conn != nil {
+		if tc, ok := conn.(*tls.Conn); ok {
+			return tc, true
+		}
+		u, ok := conn.(interface{ Unwrap() net.Conn })
+		if !ok {
+			return nil, false
+		}
+		conn = u.Unwrap()
+	}
+	return nil, false
+}
@@ -0,0 +1,230 @@
+package web
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// CaptureConfig holds the settings for capturing requests. The tags let
+// it be filled in by pkg/config.
+type CaptureConfig struct {
+	Path        string   `config:"path" usage:"json lines file to capture requests to, off if empty"`
+	MaxBody     int64    `config:"max-body" default:"65536" usage:"max bytes of each body to capture, negative for none"`
+	Redact      []string `config:"redact" default:"Authorization,Proxy-Authorization,Cookie,Set-Cookie,X-Api-Key,X-Auth-Token" usage:"headers whose values are masked"`
+	RedactQuery []string `config:"redact-query" usage:"query parameters whose values are masked"`
+}
+
+// OpenCapture opens a Recorder using the settings in cfg, or returns nil
+// if cfg.Path is empty
+func OpenCapture(cfg CaptureConfig) (*Recorder, error) {
+	if cfg.Path == "" {
+		return nil, nil
+	}
+	rec, err := OpenRecorder(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	rec.MaxBody = cfg.MaxBody
+	rec.Redact = Redaction{Headers: cfg.Redact, Query: cfg.RedactQuery}
+	return rec, nil
+}
+
+// Redacted replaces the values a Redaction masks
+const Redacted = "REDACTED"
+
+// Redaction names the headers and query parameters whose values a
+// Recorder masks before writing them
+type Redaction struct {
+	Headers []string // header names, in any case
+	Query   []string // query parameter names
+}
+
+// DefaultRedaction masks the headers that usually carry credentials. It
+// is what OpenRecorder starts with.
+var DefaultRedaction = Redaction{
+	Headers: []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key", "X-Auth-Token"},
+}
+
+// apply masks the values in ex
+func (rd *Redaction) apply(ex *Exchange) {
+	redactHeader(ex.Request.Header, rd.Headers)
+	if ex.Response != nil {
+		redactHeader(ex.Response.Header, rd.Headers)
+	}
+	if len(rd.Query) > 0 {
+		ex.Request.URL = redactQuery(ex.Request.URL, rd.Query)
+	}
+}
+
+// redactHeader masks the values of the named headers. The scheme of an
+// authorization header is kept, e.g. "Bearer REDACTED", so it still
+// shows how the client authenticated.
+func redactHeader(h http.Header, names []string) {
+	for _, name := range names {
+		key := http.CanonicalHeaderKey(name)
+		vv, ok := h[key]
+		if !ok {
+			continue
+		}
+		masked := make([]string, len(vv))
+		for i, v := range vv {
+			masked[i] = Redacted
+			if strings.HasSuffix(key, "Authorization") {
+				if j := strings.IndexByte(v, ' '); j > 0 {
+					masked[i] = v[:j] + " " + Redacted
+				}
+			}
+		}
+		h[key] = masked
+	}
+}
+
+func redactQuery(raw string, names []string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.RawQuery == "" {
+		return raw
+	}
+	q := u.Query()
+	masked := false
+	for _, name := range names {
+		if vv, ok := q[name]; ok {
+			for i := range vv {
+				vv[i] = Redacted
+			}
+			masked = true
+		}
+	}
+	if masked {
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// Capture records every request, and the response the rest of the chain
+// gives it, to rec. Bodies are captured as they are read and written, so
+// the request body is what the handler read of it. The recording can be
+// played back against a server with cmd/replay.
+func Capture(rec *Recorder) Middleware {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			ex := &Exchange{Time: start, Request: RecordedRequest{
+				Method:     r.Method,
+				URL:        r.URL.String(),
+				Proto:      r.Proto,
+				Host:       r.Host,
+				RemoteAddr: r.RemoteAddr,
+				Header:     r.Header.Clone(),
+			}}
+			reqBody := rec.bodyBuffer()
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = readCloser{io.TeeReader(r.Body, reqBody), r.Body}
+			}
+			cw := &captureWriter{ResponseWriter: w, status: http.StatusOK, body: rec.bodyBuffer()}
+			defer func() {
+				ex.Duration = msSince(start)
+				reqBody.body(&ex.Request.RecordedBody)
+				if cw.hijacked {
+					ex.Error = "connection hijacked"
+				} else {
+					ex.Response = &RecordedResponse{Status: cw.status, Proto: r.Proto, Header: w.Header().Clone()}
+					cw.body.body(&ex.Response.RecordedBody)
+				}
+				if err := recover(); err != nil {
+					ex.Response, ex.Error = nil, "panic"
+					rec.record(ex)
+					panic(err)
+				}
+				rec.record(ex)
+			}()
+			next.ServeHTTP(cw, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// captureWriter keeps the status and body written to a ResponseWriter
+type captureWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	hijacked    bool
+	body        *capBuffer
+}
+
+func (w *captureWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.body.Write(b[:n])
+	return n, err
+}
+
+// Flush passes on a flush to the underlying ResponseWriter, if it can
+func (w *captureWriter) Flush() {
+	if fl, ok := w.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// Hijack hands over the connection of the underlying ResponseWriter. No
+// response is recorded for a hijacked request.
+func (w *captureWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("web: the response writer can't be hijacked")
+	}
+	w.hijacked = true
+	return hj.Hijack()
+}
+
+// ReadExchanges reads a JSON Lines recording, calling fn for every
+// exchange in it, in order, until fn returns an error. A last line that
+// was cut short, by a crash while it was being written, is skipped.
+func ReadExchanges(r io.Reader, fn func(ex *Exchange) error) error {
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		last := err == io.EOF
+		if len(strings.TrimSpace(string(line))) > 0 {
+			ex := new(Exchange)
+			if jerr := json.Unmarshal(line, ex); jerr != nil {
+				if last {
+					return nil
+				}
+				return fmt.Errorf("web: recording line %d: %v", n, jerr)
+			}
+			if err := fn(ex); err != nil {
+				return err
+			}
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// record writes ex, logging rather than failing the request if it can't
+func (rec *Recorder) record(ex *Exchange) {
+	if err := rec.Record(ex); err != nil {
+		log.Printf("web: recording %s %s: %v", ex.Request.Method, ex.Request.URL, err)
+	}
+}
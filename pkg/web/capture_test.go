@@ -0,0 +1,246 @@
+package web_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/web"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// capture serves handler behind Capture, runs fn against it and returns
+// what was recorded
+func capture(t *testing.T, cfg web.CaptureConfig, handler http.HandlerFunc, fn func(url string) error) ([]*web.Exchange, error) {
+	cfg.Path = filepath.Join(t.TempDir(), "requests.jsonl")
+	rec, err := web.OpenCapture(cfg)
+	if err != nil {
+		return nil, err
+	}
+	srv := httptest.NewServer(web.Capture(rec)(handler))
+	err = fn(srv.URL)
+	srv.Close()
+	rec.Close()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var exs []*web.Exchange
+	err = web.ReadExchanges(f, func(ex *web.Exchange) error {
+		exs = append(exs, ex)
+		return nil
+	})
+	return exs, err
+}
+
+func echo(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Path, body)
+}
+
+func TestCapture(t *testing.T) {
+	exs, err := capture(t, web.CaptureConfig{}, echo, func(url string) error {
+		req, _ := http.NewRequest("PUT", url+"/items/7?full=1", strings.NewReader(`{"name":"x"}`))
+		req.Header.Set("X-Trace", "abc")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp, err = http.Get(url + "/"); err == nil {
+			resp.Body.Close()
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exs) != 2 {
+		t.Fatalf("%d exchanges, want 2", len(exs))
+	}
+	ex := exs[0]
+	if ex.Request.Method != "PUT" || ex.Request.URL != "/items/7?full=1" || ex.Request.Header.Get("X-Trace") != "abc" ||
+		ex.Request.Body != `{"name":"x"}` || ex.Request.Host == "" || ex.Request.RemoteAddr == "" {
+		t.Fatalf("request %+v", ex.Request)
+	}
+	if ex.Response == nil || ex.Response.Status != 200 || ex.Response.Body != `PUT /items/7 {"name":"x"}` ||
+		ex.Response.Header.Get("Content-Type") != "text/plain" {
+		t.Fatalf("response %+v", ex.Response)
+	}
+	if ex.Time.IsZero() || ex.Duration <= 0 || exs[1].Time.Before(ex.Time) {
+		t.Fatalf("timing %v %v", ex.Time, ex.Duration)
+	}
+}
+
+func TestCaptureRedaction(t *testing.T) {
+	cfg := web.CaptureConfig{
+		Redact:      []string{"authorization", "Cookie", "Set-Cookie", "X-Api-Key"},
+		RedactQuery: []string{"token"},
+	}
+	exs, err := capture(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "s3cret"})
+		w.WriteHeader(204)
+	}, func(url string) error {
+		req, _ := http.NewRequest("GET", url+"/me?token=t0k3n&page=2", nil)
+		req.Header.Set("Authorization", "Bearer abc.def.ghi")
+		req.Header.Set("Cookie", "session=s3cret")
+		req.Header.Set("X-Api-Key", "k3y")
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := exs[0]
+	for name, want := range map[string]string{
+		"Authorization": "Bearer " + web.Redacted,
+		"Cookie":        web.Redacted,
+		"X-Api-Key":     web.Redacted,
+	} {
+		if got := ex.Request.Header.Get(name); got != want {
+			t.Fatalf("%s recorded as %q, want %q", name, got, want)
+		}
+	}
+	if got := ex.Response.Header.Get("Set-Cookie"); got != web.Redacted {
+		t.Fatalf("Set-Cookie recorded as %q", got)
+	}
+	if ex.Request.URL != "/me?page=2&token="+web.Redacted {
+		t.Fatalf("url recorded as %q", ex.Request.URL)
+	}
+	if ex.Response.Status != 204 {
+		t.Fatalf("status %d", ex.Response.Status)
+	}
+}
+
+func TestCaptureStatus(t *testing.T) {
+	exs, err := capture(t, web.CaptureConfig{MaxBody: 8}, func(w http.ResponseWriter, r *http.Request) {
+		// read only some of the body
+		buf := make([]byte, 4)
+		io.ReadFull(r.Body, buf)
+		http.Error(w, "no such thing here", http.StatusNotFound)
+	}, func(url string) error {
+		resp, err := http.Post(url+"/missing", "text/plain", strings.NewReader("0123456789"))
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := exs[0]
+	if ex.Response.Status != 404 || ex.Response.Body != "no such " || !ex.Response.Truncated {
+		t.Fatalf("response %+v", ex.Response)
+	}
+	if ex.Request.Body != "0123" {
+		t.Fatalf("request body %q, want what the handler read", ex.Request.Body)
+	}
+}
+
+func TestCaptureHijack(t *testing.T) {
+	exs, err := capture(t, web.CaptureConfig{}, func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nhi")
+		brw.Flush()
+	}, func(url string) error {
+		resp, err := http.Get(url)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if string(body) != "hi" {
+			return fmt.Errorf("hijacked body %q", body)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exs) != 1 || exs[0].Response != nil || exs[0].Error == "" {
+		t.Fatalf("hijacked exchange %+v", exs[0])
+	}
+}
+
+func TestReadExchangesTail(t *testing.T) {
+	good := `{"time":"2024-01-01T00:00:00Z","duration_ms":1,"request":{"method":"GET","url":"/a"}}` + "\n"
+	count := func(data string) (int, error) {
+		n := 0
+		err := web.ReadExchanges(strings.NewReader(data), func(*web.Exchange) error {
+			n++
+			return nil
+		})
+		return n, err
+	}
+	// a crash mid write leaves a partial last line, which is skipped
+	if n, err := count(good + good + good[:30]); err != nil || n != 2 {
+		t.Fatalf("partial tail: %d, %v", n, err)
+	}
+	if n, err := count(good + "\n" + good); err != nil || n != 2 {
+		t.Fatalf("blank line: %d, %v", n, err)
+	}
+	// but a bad line in the middle is an error
+	if _, err := count(good + "{oops\n" + good); err == nil {
+		t.Fatalf("bad middle line read")
+	}
+}
+
+func TestCaptureConcurrent(t *testing.T) {
+	var mu sync.Mutex
+	seen := map[string]bool{}
+	exs, err := capture(t, web.CaptureConfig{}, echo, func(url string) error {
+		var wg sync.WaitGroup
+		errs := make(chan error, 20)
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					body := fmt.Sprintf("%d-%d", i, j)
+					resp, err := http.Post(url+"/c", "text/plain", bytes.NewBufferString(body))
+					if err != nil {
+						errs <- err
+						return
+					}
+					resp.Body.Close()
+					mu.Lock()
+					seen[body] = true
+					mu.Unlock()
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		return <-errs
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exs) != 200 {
+		t.Fatalf("%d exchanges, want 200", len(exs))
+	}
+	for _, ex := range exs {
+		if !seen[ex.Request.Body] || ex.Response.Body != "POST /c "+ex.Request.Body {
+			t.Fatalf("mixed up exchange %+v", ex)
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package web
 
 import (
+	"bufio"
+	"errors"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"runtime/debug"
@@ -43,6 +46,23 @@ func (w *loggingResponseWriter) WriteHeader(statusCode int) {
 	w.data.status = statusCode
 }
 
+// Flush passes on a flush to the underlying ResponseWriter, if it can
+func (w *loggingResponseWriter) Flush() {
+	if fl, ok := w.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// Hijack hands over the connection of the underlying ResponseWriter, so
+// handlers like Proxy that take over the connection work behind the logger
+func (w *loggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("web: the response writer can't be hijacked")
+	}
+	return hj.Hijack()
+}
+
 func RequestLogger(logger *log.Logger) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
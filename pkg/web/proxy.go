@@ -0,0 +1,359 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/tcp/netutil"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyConfig holds the settings for a Proxy. The tags let it be filled
+// in by pkg/config.
+type ProxyConfig struct {
+	Allow       []string      `config:"allow" usage:"hosts the proxy may connect to: host names, *.domains, ips, cidrs or *, each with an optional :port or :lo-hi, any if empty"`
+	Deny        []string      `config:"deny" usage:"hosts the proxy may not connect to, in the same form as allow"`
+	Record      string        `config:"record" usage:"json lines file to record plain http requests and responses to, off if empty"`
+	RecordBody  int64         `config:"record-body" default:"65536" usage:"max bytes of each body to record, negative for none"`
+	DialTimeout time.Duration `config:"dial-timeout" default:"10s" usage:"max duration to connect to a host"`
+}
+
+// errNotAllowed is returned when dialing a host the rules don't allow
+var errNotAllowed = errors.New("web: host not allowed by proxy rules")
+
+// Proxy is an explicit HTTP forward proxy. It forwards absolute-form
+// requests (GET http://host/path) and tunnels CONNECT requests, which is
+// how clients reach https hosts through it:
+//
+//	p, err := web.NewProxy(cfg)
+//	web.NewServerWithConfig(serverCfg, p).ListenAndServe()
+//
+// Hop-by-hop headers are not passed on. Rules restrict the hosts it will
+// connect to, checked against the resolved address of every connection it
+// makes, and plain http exchanges are written to Recorder when it is set.
+type Proxy struct {
+	Rules       *netutil.DestRule // hosts the proxy may connect to, any if nil
+	Recorder    *Recorder         // records plain http exchanges if set
+	Transport   http.RoundTripper // forwards requests, one using Rules if nil
+	DialTimeout time.Duration     // max duration to connect to a host, 10s if zero
+	ErrorLog    *log.Logger       // logs failed requests, log.Default() if nil
+
+	once      sync.Once
+	transport http.RoundTripper
+}
+
+// NewProxy returns a new Proxy using the settings in cfg, opening the
+// recording file if there is one
+func NewProxy(cfg ProxyConfig) (*Proxy, error) {
+	p := &Proxy{DialTimeout: cfg.DialTimeout}
+	if len(cfg.Allow) > 0 || len(cfg.Deny) > 0 {
+		rule, err := netutil.NewDestRule(cfg.Allow, cfg.Deny)
+		if err != nil {
+			return nil, err
+		}
+		p.Rules = rule
+	}
+	if cfg.Record != "" {
+		rec, err := OpenRecorder(cfg.Record)
+		if err != nil {
+			return nil, err
+		}
+		rec.MaxBody = cfg.RecordBody
+		p.Recorder = rec
+	}
+	return p, nil
+}
+
+// Close closes the recording file, if there is one
+func (p *Proxy) Close() error {
+	if p.Recorder != nil {
+		return p.Recorder.Close()
+	}
+	return nil
+}
+
+func (p *Proxy) roundTripper() http.RoundTripper {
+	p.once.Do(func() {
+		p.transport = p.Transport
+		if p.transport == nil {
+			p.transport = &http.Transport{
+				DialContext:           p.dial,
+				MaxIdleConns:          100,
+				IdleConnTimeout:       90 * time.Second,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ExpectContinueTimeout: 1 * time.Second,
+				// pass bodies through as they are
+				DisableCompression: true,
+			}
+		}
+	})
+	return p.transport
+}
+
+// dial connects to addr if the rules allow it, resolving names first so
+// the rules see the address that is used
+func (p *Proxy) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	timeout := p.DialTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xffff {
+		return nil, fmt.Errorf("web: bad port in %q", addr)
+	}
+	name, ip := "", net.ParseIP(host)
+	if ip == nil {
+		name = host
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("web: no addresses for %s", name)
+		}
+		ip = ips[0].IP
+	}
+	if p.Rules != nil && !p.Rules.Allow(name, ip, port) {
+		return nil, errNotAllowed
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+}
+
+// ServeHTTP forwards r, or tunnels it if it is a CONNECT
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.connect(w, r)
+		return
+	}
+	if !r.URL.IsAbs() || r.URL.Host == "" {
+		http.Error(w, "not a proxy request, the url must be absolute", http.StatusBadRequest)
+		return
+	}
+	start := time.Now()
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	out.Close = false
+	removeHopHeaders(out.Header)
+	if r.ContentLength == 0 {
+		out.Body = nil
+	}
+
+	var ex *Exchange
+	var reqBody, respBody *capBuffer
+	if p.Recorder != nil {
+		ex = &Exchange{Time: start, Request: RecordedRequest{
+			Method:     r.Method,
+			URL:        r.URL.String(),
+			Proto:      r.Proto,
+			Host:       r.Host,
+			RemoteAddr: r.RemoteAddr,
+			Header:     out.Header.Clone(),
+		}}
+		reqBody, respBody = p.Recorder.bodyBuffer(), p.Recorder.bodyBuffer()
+		if out.Body != nil {
+			out.Body = readCloser{io.TeeReader(r.Body, reqBody), r.Body}
+		}
+	}
+
+	resp, err := p.roundTripper().RoundTrip(out)
+	if err != nil {
+		p.logf("web: proxy %s %s: %v", r.Method, r.URL, err)
+		http.Error(w, http.StatusText(statusFor(err)), statusFor(err))
+		if ex != nil {
+			ex.Duration = msSince(start)
+			ex.Error = err.Error()
+			reqBody.body(&ex.Request.RecordedBody)
+			p.record(ex)
+		}
+		return
+	}
+	defer resp.Body.Close()
+	removeHopHeaders(resp.Header)
+	copyHeader(w.Header(), resp.Header)
+	// announce the trailers, which are sent after the body
+	for k := range resp.Trailer {
+		w.Header().Add("Trailer", k)
+	}
+	w.WriteHeader(resp.StatusCode)
+	var dst io.Writer = w
+	if respBody != nil {
+		dst = io.MultiWriter(w, respBody)
+	}
+	_, err = copyFlushing(dst, w, resp.Body, resp.ContentLength < 0)
+	if err != nil {
+		p.logf("web: proxy %s %s: copying response: %v", r.Method, r.URL, err)
+	}
+	copyHeader(w.Header(), resp.Trailer)
+	if ex != nil {
+		ex.Duration = msSince(start)
+		ex.Response = &RecordedResponse{
+			Status: resp.StatusCode,
+			Proto:  resp.Proto,
+			Header: resp.Header.Clone(),
+		}
+		if err != nil {
+			ex.Error = err.Error()
+		}
+		reqBody.body(&ex.Request.RecordedBody)
+		respBody.body(&ex.Response.RecordedBody)
+		p.record(ex)
+	}
+}
+
+// connect tunnels a CONNECT request, copying bytes both ways until both
+// sides are done
+func (p *Proxy) connect(w http.ResponseWriter, r *http.Request) {
+	if _, _, err := net.SplitHostPort(r.Host); err != nil {
+		http.Error(w, "CONNECT needs a host:port", http.StatusBadRequest)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "CONNECT is not supported on this connection", http.StatusInternalServerError)
+		return
+	}
+	out, err := p.dial(r.Context(), "tcp", r.Host)
+	if err != nil {
+		p.logf("web: proxy CONNECT %s: %v", r.Host, err)
+		http.Error(w, http.StatusText(statusFor(err)), statusFor(err))
+		return
+	}
+	defer out.Close()
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		p.logf("web: proxy CONNECT %s: %v", r.Host, err)
+		return
+	}
+	defer conn.Close()
+	// the server's deadlines are still set on a hijacked connection
+	conn.SetDeadline(time.Time{})
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := io.Copy(conn, out); err != nil || !netutil.CloseWrite(conn) {
+			conn.Close()
+		}
+	}()
+	// anything the client sent after the request is in brw
+	if _, err := io.Copy(out, brw.Reader); err != nil || !netutil.CloseWrite(out) {
+		out.Close()
+	}
+	<-done
+}
+
+func (p *Proxy) record(ex *Exchange) {
+	if err := p.Recorder.Record(ex); err != nil {
+		p.logf("web: proxy recording: %v", err)
+	}
+}
+
+func (p *Proxy) logf(format string, v ...interface{}) {
+	if p.ErrorLog != nil {
+		p.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// statusFor returns the status to reply with when reaching a host fails
+func statusFor(err error) int {
+	var ne net.Error
+	switch {
+	case errors.Is(err, errNotAllowed):
+		return http.StatusForbidden
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// hopHeaders are the headers that only apply to a single connection, so
+// a proxy must not pass them on
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers from h, along with any
+// headers named in its Connection header
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
+
+// copyFlushing copies src to dst, flushing w after every write when
+// flush is set, so streamed responses reach the client as they arrive
+func copyFlushing(dst io.Writer, w http.ResponseWriter, src io.Reader, flush bool) (int64, error) {
+	fl, ok := w.(http.Flusher)
+	if !flush || !ok {
+		return io.Copy(dst, src)
+	}
+	buf := make([]byte, 32*KB)
+	var written int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			m, werr := dst.Write(buf[:n])
+			written += int64(m)
+			if werr != nil {
+				return written, werr
+			}
+			fl.Flush()
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func msSince(t time.Time) float64 {
+	return float64(time.Since(t)) / float64(time.Millisecond)
+}
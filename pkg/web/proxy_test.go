@@ -0,0 +1,406 @@
+package web_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/scottcagno/net-tools/pkg/web"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var quiet = log.New(ioutil.Discard, "", 0)
+
+// origin is a server that describes the request it got in its response
+func origin() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Method", r.Method)
+		w.Header().Set("X-Path", r.URL.RequestURI())
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"header": r.Header,
+			"body":   string(body),
+		})
+	}))
+}
+
+// startProxy serves p behind the request logger, like a real setup would
+func startProxy(p *web.Proxy) *httptest.Server {
+	p.ErrorLog = quiet
+	logger := web.RequestLogger(quiet)
+	return httptest.NewServer(logger(p))
+}
+
+// client returns an http client that goes through the proxy at addr
+func client(proxy *httptest.Server) *http.Client {
+	u, _ := url.Parse(proxy.URL)
+	return &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(u)},
+		Timeout:   5 * time.Second,
+	}
+}
+
+func TestProxyForward(t *testing.T) {
+	o := origin()
+	defer o.Close()
+	px := startProxy(&web.Proxy{})
+	defer px.Close()
+	resp, err := client(px).Post(o.URL+"/echo?q=1", "text/plain", strings.NewReader("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got struct {
+		Header http.Header
+		Body   string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 || resp.Header.Get("X-Method") != "POST" || resp.Header.Get("X-Path") != "/echo?q=1" || got.Body != "ping" {
+		t.Fatalf("status %d, headers %v, body %q", resp.StatusCode, resp.Header, got.Body)
+	}
+}
+
+func TestProxyHopHeaders(t *testing.T) {
+	o := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var leaked []string
+		for _, h := range []string{"Proxy-Authorization", "Proxy-Connection", "X-Hop", "Keep-Alive"} {
+			if r.Header.Get(h) != "" {
+				leaked = append(leaked, h)
+			}
+		}
+		w.Header().Set("Connection", "X-Resp-Hop")
+		w.Header().Set("X-Resp-Hop", "1")
+		w.Header().Set("X-End", "1")
+		fmt.Fprint(w, strings.Join(leaked, ","))
+	}))
+	defer o.Close()
+	px := startProxy(&web.Proxy{})
+	defer px.Close()
+	// write the request by hand, so the hop headers are really sent
+	conn, err := net.Dial("tcp", px.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic eDp5\r\n"+
+		"Proxy-Connection: keep-alive\r\nConnection: X-Hop\r\nX-Hop: 1\r\nX-End: 1\r\n\r\n",
+		o.URL, o.Listener.Addr())
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if len(body) != 0 {
+		t.Fatalf("origin got hop headers %s", body)
+	}
+	if resp.Header.Get("X-Resp-Hop") != "" || resp.Header.Get("X-End") != "1" {
+		t.Fatalf("response headers %v", resp.Header)
+	}
+}
+
+func TestProxyOriginForm(t *testing.T) {
+	px := startProxy(&web.Proxy{})
+	defer px.Close()
+	resp, err := http.Get(px.URL + "/index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestProxyConnectHTTPS(t *testing.T) {
+	o := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "secret stuff")
+	}))
+	defer o.Close()
+	px := startProxy(&web.Proxy{})
+	defer px.Close()
+	c := client(px)
+	// trust the test server's certificate
+	c.Transport.(*http.Transport).TLSClientConfig = o.Client().Transport.(*http.Transport).TLSClientConfig
+	for i := 0; i < 2; i++ {
+		resp, err := c.Get(o.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "secret stuff" {
+			t.Fatalf("body %q", body)
+		}
+	}
+}
+
+func TestProxyConnectRaw(t *testing.T) {
+	// a tcp echo server, to see that half closes make it through
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	px := startProxy(&web.Proxy{})
+	defer px.Close()
+	conn, err := net.Dial("tcp", px.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// data sent straight after the request must not be lost
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n\r\nearly bird", ln.Addr())
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	io.WriteString(conn, ", late bird")
+	conn.(*net.TCPConn).CloseWrite()
+	got, err := ioutil.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "early bird, late bird" {
+		t.Fatalf("echo %q", got)
+	}
+}
+
+func TestProxyAllowList(t *testing.T) {
+	allowed, denied := origin(), origin()
+	defer allowed.Close()
+	defer denied.Close()
+	p, err := web.NewProxy(web.ProxyConfig{Allow: []string{allowed.Listener.Addr().String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	px := startProxy(p)
+	defer px.Close()
+	c := client(px)
+	for _, tt := range []struct {
+		url    string
+		status int
+	}{
+		{allowed.URL, 200},
+		{denied.URL, 403},
+		// by name, resolving to the allowed address
+		{strings.Replace(allowed.URL, "127.0.0.1", "localhost", 1), 200},
+	} {
+		resp, err := c.Get(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Fatalf("%s: status %d, want %d", tt.url, resp.StatusCode, tt.status)
+		}
+	}
+	// tunnels are held to the same rules
+	conn, err := net.Dial("tcp", px.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", denied.Listener.Addr())
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 403 {
+		t.Fatalf("denied CONNECT: status %d", resp.StatusCode)
+	}
+	if _, err := web.NewProxy(web.ProxyConfig{Allow: []string{"10.0.0.0/99"}}); err == nil {
+		t.Fatalf("bad allow entry accepted")
+	}
+}
+
+func TestProxyBadGateway(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	px := startProxy(&web.Proxy{})
+	defer px.Close()
+	resp, err := client(px).Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status %d, want 502", resp.StatusCode)
+	}
+}
+
+func TestProxyStreaming(t *testing.T) {
+	release := make(chan struct{})
+	o := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "first\n")
+		w.(http.Flusher).Flush()
+		<-release
+		fmt.Fprint(w, "second\n")
+	}))
+	defer o.Close()
+	defer close(release)
+	px := startProxy(&web.Proxy{})
+	defer px.Close()
+	resp, err := client(px).Get(o.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	// the first line has to arrive while the origin is still holding back
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != "first\n" {
+		t.Fatalf("read %q, %v", line, err)
+	}
+}
+
+func TestProxyTrailers(t *testing.T) {
+	o := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		fmt.Fprint(w, "data")
+		w.Header().Set("X-Checksum", "abc")
+	}))
+	defer o.Close()
+	px := startProxy(&web.Proxy{})
+	defer px.Close()
+	resp, err := client(px).Get(o.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if got := resp.Trailer.Get("X-Checksum"); got != "abc" {
+		t.Fatalf("trailer %q, want abc", got)
+	}
+}
+
+func TestProxyRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.jsonl")
+	o := origin()
+	defer o.Close()
+	p, err := web.NewProxy(web.ProxyConfig{Record: path, RecordBody: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	px := startProxy(p)
+	c := client(px)
+	bodies := []string{"short", "a body well over the sixteen byte limit", "\xff\xfe binary"}
+	for _, body := range bodies {
+		resp, err := c.Post(o.URL+"/rec", "application/octet-stream", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	px.Close()
+	p.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	if len(lines) != len(bodies) {
+		t.Fatalf("%d lines recorded, want %d", len(lines), len(bodies))
+	}
+	for i, line := range lines {
+		var ex web.Exchange
+		if err := json.Unmarshal(line, &ex); err != nil {
+			t.Fatal(err)
+		}
+		if ex.Request.Method != "POST" || ex.Request.URL != o.URL+"/rec" || ex.Response == nil || ex.Response.Status != 200 {
+			t.Fatalf("line %d: %s", i, line)
+		}
+		body, err := ex.Request.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := bodies[i]
+		if len(want) > 16 {
+			want = want[:16]
+		}
+		if string(body) != want || ex.Request.Truncated != (len(bodies[i]) > 16) {
+			t.Fatalf("line %d: body %q truncated %v", i, body, ex.Request.Truncated)
+		}
+		if !ex.Response.Truncated || ex.Response.Header.Get("X-Method") != "POST" {
+			t.Fatalf("line %d: response %+v", i, ex.Response)
+		}
+	}
+	var ex web.Exchange
+	json.Unmarshal(lines[2], &ex)
+	if ex.Request.Encoding != "base64" {
+		t.Fatalf("binary body encoded as %q", ex.Request.Encoding)
+	}
+}
+
+func TestProxyConcurrent(t *testing.T) {
+	o := origin()
+	defer o.Close()
+	p, err := web.NewProxy(web.ProxyConfig{Record: filepath.Join(t.TempDir(), "rec.jsonl")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	px := startProxy(p)
+	defer px.Close()
+	c := client(px)
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				body := strings.Repeat("x", i*j)
+				resp, err := c.Post(o.URL, "text/plain", strings.NewReader(body))
+				if err != nil {
+					errs <- err
+					return
+				}
+				ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != 200 {
+					errs <- fmt.Errorf("status %d", resp.StatusCode)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
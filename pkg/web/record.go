@@ -0,0 +1,153 @@
+package web
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Exchange is a recorded request and its response, written as one line
+// of a JSON Lines file by a Recorder
+type Exchange struct {
+	Time     time.Time         `json:"time"`
+	Duration float64           `json:"duration_ms"`
+	Request  RecordedRequest   `json:"request"`
+	Response *RecordedResponse `json:"response,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// RecordedRequest is the request half of an Exchange
+type RecordedRequest struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Proto      string      `json:"proto,omitempty"`
+	Host       string      `json:"host,omitempty"`
+	RemoteAddr string      `json:"remote_addr,omitempty"`
+	Header     http.Header `json:"header,omitempty"`
+	RecordedBody
+}
+
+// RecordedResponse is the response half of an Exchange
+type RecordedResponse struct {
+	Status int         `json:"status"`
+	Proto  string      `json:"proto,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	RecordedBody
+}
+
+// RecordedBody is a request or response body. Bodies that are not valid
+// utf-8 are base64 encoded, and bodies over the recorder's limit are cut
+// short, with Truncated set.
+type RecordedBody struct {
+	Body      string `json:"body,omitempty"`
+	Encoding  string `json:"body_encoding,omitempty"`
+	Truncated bool   `json:"body_truncated,omitempty"`
+}
+
+// SetBody sets the body to b
+func (rb *RecordedBody) SetBody(b []byte, truncated bool) {
+	rb.Truncated = truncated
+	if utf8.Valid(b) {
+		rb.Body, rb.Encoding = string(b), ""
+		return
+	}
+	rb.Body, rb.Encoding = base64.StdEncoding.EncodeToString(b), "base64"
+}
+
+// Bytes returns the body
+func (rb *RecordedBody) Bytes() ([]byte, error) {
+	if rb.Encoding == "base64" {
+		return base64.StdEncoding.DecodeString(rb.Body)
+	}
+	return []byte(rb.Body), nil
+}
+
+// DefaultMaxRecordBody is the most of each body a Recorder keeps
+const DefaultMaxRecordBody = 64 * KB
+
+// Recorder appends Exchanges to a JSON Lines file. It is safe to use
+// from many goroutines.
+type Recorder struct {
+	// MaxBody is the most of each body to keep, DefaultMaxRecordBody if
+	// zero, and none if negative
+	MaxBody int64
+	// Redact masks credentials in every exchange before it is written,
+	// OpenRecorder sets it to DefaultRedaction
+	Redact Redaction
+
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// OpenRecorder opens a Recorder appending to the file at path, creating
+// it if it doesn't exist
+func OpenRecorder(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{Redact: DefaultRedaction, f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Record writes ex as a line of the file, masking the values Redact
+// names in it first
+func (rec *Recorder) Record(ex *Exchange) error {
+	rec.Redact.apply(ex)
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.enc.Encode(ex)
+}
+
+// Close closes the file
+func (rec *Recorder) Close() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.f.Close()
+}
+
+// bodyBuffer returns a buffer for capturing a body under the limit
+func (rec *Recorder) bodyBuffer() *capBuffer {
+	max := rec.MaxBody
+	if max == 0 {
+		max = DefaultMaxRecordBody
+	}
+	return &capBuffer{max: max}
+}
+
+// capBuffer keeps the first max bytes written to it, and notes whether
+// there were more. Writes never fail, so it can sit in an io.TeeReader or
+// an io.MultiWriter. The body of a request can still be read by the
+// transport after its response is back, so it has a lock.
+type capBuffer struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	max       int64
+	truncated bool
+}
+
+func (cb *capBuffer) Write(p []byte) (int, error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	n := len(p)
+	if room := cb.max - int64(cb.buf.Len()); int64(len(p)) > room {
+		if room < 0 {
+			room = 0
+		}
+		p, cb.truncated = p[:room], true
+	}
+	cb.buf.Write(p)
+	return n, nil
+}
+
+// body copies what has been written into rb
+func (cb *capBuffer) body(rb *RecordedBody) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	rb.SetBody(cb.buf.Bytes(), cb.truncated)
+}
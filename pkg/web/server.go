@@ -1,6 +1,8 @@
 package web
 
 import (
+	"github.com/scottcagno/net-tools/pkg/tcp/proxyproto"
+	"net"
 	"net/http"
 	"os"
 	"time"
@@ -20,15 +22,45 @@ func init() {
 
 var defaultServer *http.Server
 
+// Config holds the settings for a Server. The tags let it be filled in
+// by pkg/config, and the defaults match the default server.
+type Config struct {
+	Addr           string        `config:"addr" default:":8080" usage:"address to listen on"`
+	ReadTimeout    time.Duration `config:"read-timeout" default:"60s" usage:"max duration for reading a request"`
+	WriteTimeout   time.Duration `config:"write-timeout" default:"60s" usage:"max duration for writing a response"`
+	IdleTimeout    time.Duration `config:"idle-timeout" default:"60s" usage:"max time to wait for the next request on a keep-alive connection"`
+	MaxHeaderBytes int           `config:"max-header-bytes" default:"1048576" usage:"max size of the request headers in bytes"`
+
+	Proxy proxyproto.Config `config:"proxy"`
+}
+
 type Server struct {
 	*http.Server
+
+	// Proxy has ListenAndServe read the PROXY protocol header sent by a
+	// load balancer, so r.RemoteAddr is the client's address. It is off
+	// unless Proxy.Policy is set.
+	Proxy proxyproto.Config
+}
+
+// NewServerWithConfig returns a new Server using the settings in cfg
+func NewServerWithConfig(cfg Config, handler http.Handler) *Server {
+	return &Server{&http.Server{
+		Addr:           cfg.Addr,
+		Handler:        handler,
+		ReadTimeout:    cfg.ReadTimeout,
+		WriteTimeout:   cfg.WriteTimeout,
+		IdleTimeout:    cfg.IdleTimeout,
+		MaxHeaderBytes: cfg.MaxHeaderBytes,
+		ErrorLog:       NewLoggerWithPrefix(os.Stderr, "[HTTP Server] "),
+	}, cfg.Proxy}
 }
 
 func NewServer(s *http.Server) *Server {
 	if s == nil {
-		return &Server{defaultServer}
+		return &Server{Server: defaultServer}
 	}
-	return &Server{s}
+	return &Server{Server: s}
 }
 
 func (s *Server) WithAddr(addr string) *Server {
@@ -42,11 +74,28 @@ func (s *Server) WithHandler(handler http.Handler) *Server {
 }
 
 func (s *Server) ListenAndServe() error {
-	return s.ListenAndServe()
+	if s.Proxy.Policy == proxyproto.Off {
+		return s.Server.ListenAndServe()
+	}
+	addr := s.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	pl, err := proxyproto.NewListener(ln, s.Proxy)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	pl.ErrorLog = s.ErrorLog
+	return s.Server.Serve(pl)
 }
 
 func ListenAndServe(addr string, handler http.Handler) error {
-	server := &Server{defaultServer}
+	server := &Server{Server: defaultServer}
 	server.Addr = addr
 	server.Handler = handler
 	return server.ListenAndServe()
@@ -1,11 +1,7 @@
 package web
 
 import (
-	"bytes"
-	"encoding/json"
-	"io"
-	"os"
-	"sync"
+	"github.com/scottcagno/net-tools/pkg/store"
 )
 
 type Store interface {
@@ -15,56 +11,25 @@ type Store interface {
 	Del(string)
 }
 
-var lock sync.Mutex
-
-// func Save(path string, v interface{}) error
-// func Load(path string, v interface{}) error
-
-// Save saves a representation of v to the file at path.
+// Save saves a representation of v to the file at path. The encoding is
+// picked from the extension of path by pkg/store (.json, .xml, .gob or
+// .csv), falling back to JSON for anything else. The file is replaced
+// atomically, and only saves and loads of the same path block each other.
 func Save(path string, v interface{}) error {
-	lock.Lock()
-	defer lock.Unlock()
-	f, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	r, err := Marshal(v)
-	if err != nil {
-		return err
-	}
-	_, err = io.Copy(f, r)
-	return err
+	return storeFor(path).Save(path, v)
 }
 
 // Load loads the file at path into v.
 // Use os.IsNotExist() to see if the returned error is due
 // to the file being missing.
 func Load(path string, v interface{}) error {
-	lock.Lock()
-	defer lock.Unlock()
-	f, err := os.Open(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	return Unmarshal(f, v)
+	return storeFor(path).Load(path, v)
 }
 
-// Marshal is a function that marshals the object into an
-// io.Reader.
-// By default, it uses the JSON marshaller.
-var Marshal = func(v interface{}) (io.Reader, error) {
-	b, err := json.MarshalIndent(v, "", "\t")
+func storeFor(path string) store.Store {
+	st, err := store.New(path)
 	if err != nil {
-		return nil, err
+		return store.NewJSONStore()
 	}
-	return bytes.NewReader(b), nil
-}
-
-// Unmarshal is a function that unmarshals the data from the
-// reader into the specified value.
-// By default, it uses the JSON unmarshaller.
-var Unmarshal = func(r io.Reader, v interface{}) error {
-	return json.NewDecoder(r).Decode(v)
+	return st
 }